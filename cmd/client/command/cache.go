@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package command
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+type cachePurgeRecord struct {
+	Pipeline string `yaml:"pipeline,omitempty"`
+	Filter   string `yaml:"filter,omitempty"`
+	Key      string `yaml:"key"`
+	Prefix   bool   `yaml:"prefix,omitempty"`
+}
+
+// CacheCmd defines cache command.
+func CacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage caches of all members",
+	}
+
+	cmd.AddCommand(cachePurgeCmd())
+	return cmd
+}
+
+func cachePurgeCmd() *cobra.Command {
+	record := &cachePurgeRecord{}
+
+	cmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Purge cached responses in all members",
+		Example: "egctl cache purge example.com/index.html\n" +
+			"egctl cache purge example.com/static/ --prefix --pipeline <pipeline> --filter <filter>",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("requires the cache key, which begins with the host and the path")
+			}
+			if record.Filter != "" && record.Pipeline == "" {
+				return errors.New("requires pipeline when filter is specified")
+			}
+			return nil
+		},
+
+		Run: func(cmd *cobra.Command, args []string) {
+			record.Key = args[0]
+			body, err := yaml.Marshal(record)
+			if err != nil {
+				ExitWithError(err)
+			}
+			handleRequest(http.MethodPost, makeURL(cachePurgeURL), body, cmd)
+		},
+	}
+
+	cmd.Flags().StringVar(&record.Pipeline, "pipeline", "", "The pipeline of caches to purge, all pipelines if empty.")
+	cmd.Flags().StringVar(&record.Filter, "filter", "", "The filter of caches to purge, all cache filters of the pipeline if empty.")
+	cmd.Flags().BoolVar(&record.Prefix, "prefix", false, "Purge all cached responses whose keys begin with the key.")
+
+	return cmd
+}
@@ -66,6 +66,10 @@ const (
 	customDataKindURL = apiURL + "/customdata/%s"
 	customDataURL     = apiURL + "/customdata/%s/%s"
 
+	cachePurgeURL = apiURL + "/cache/purge"
+
+	openAPIImportURL = apiURL + "/openapi/import"
+
 	// MeshTenantsURL is the mesh tenant prefix.
 	MeshTenantsURL = apiURL + "/mesh/tenants"
 
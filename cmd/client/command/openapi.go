@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package command
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+type openAPIImportRequest struct {
+	Name      string   `yaml:"name"`
+	Port      uint16   `yaml:"port"`
+	BasePath  string   `yaml:"basePath,omitempty"`
+	Servers   []string `yaml:"servers,omitempty"`
+	Validator bool     `yaml:"validator"`
+	Mock      bool     `yaml:"mock"`
+	Document  string   `yaml:"document"`
+}
+
+// OpenAPICmd defines openapi command.
+func OpenAPICmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "openapi",
+		Short: "Generate objects from OpenAPI 3 documents",
+	}
+
+	cmd.AddCommand(openAPIImportCmd())
+	return cmd
+}
+
+func openAPIImportCmd() *cobra.Command {
+	var specFile string
+	var dryRun bool
+	req := &openAPIImportRequest{}
+
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Generate an HTTPServer and HTTPPipelines from an OpenAPI 3 document, and create or update them",
+		Example: "egctl openapi import -f petstore.yaml --name petstore --port 10080 --backend http://127.0.0.1:9095\n" +
+			"egctl openapi import -f petstore.yaml --name petstore --port 10080 --validator --mock --dry-run",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if req.Name == "" {
+				return errors.New("requires the name of the HTTPServer")
+			}
+			return nil
+		},
+
+		Run: func(cmd *cobra.Command, args []string) {
+			var doc []byte
+			var err error
+			if specFile == "" {
+				doc, err = io.ReadAll(os.Stdin)
+			} else {
+				doc, err = os.ReadFile(specFile)
+			}
+			if err != nil {
+				ExitWithErrorf("%s failed: %v", cmd.Short, err)
+			}
+
+			req.Document = string(doc)
+			body, err := yaml.Marshal(req)
+			if err != nil {
+				ExitWithError(err)
+			}
+
+			url := makeURL(openAPIImportURL)
+			if dryRun {
+				url += "?dryRun=true"
+			}
+			handleRequest(http.MethodPost, url, body, cmd)
+		},
+	}
+
+	cmd.Flags().StringVarP(&specFile, "file", "f", "", "A yaml or json file of the OpenAPI 3 document, stdin if empty.")
+	cmd.Flags().StringVar(&req.Name, "name", "", "The name of the HTTPServer, and the prefix of the names of the HTTPPipelines.")
+	cmd.Flags().Uint16Var(&req.Port, "port", 10080, "The port of the HTTPServer.")
+	cmd.Flags().StringVar(&req.BasePath, "base-path", "", "The prefix of all paths, the path of the first server of the document if empty.")
+	cmd.Flags().StringSliceVar(&req.Servers, "backend", nil, "The backend servers, the servers of the document if empty.")
+	cmd.Flags().BoolVar(&req.Validator, "validator", false, "Validate requests against the document.")
+	cmd.Flags().BoolVar(&req.Mock, "mock", false, "Mock responses by the examples of the document.")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the generated objects without applying them.")
+
+	return cmd
+}
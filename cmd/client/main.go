@@ -111,6 +111,8 @@ func main() {
 		command.MemberCmd(),
 		command.WasmCmd(),
 		command.CustomDataCmd(),
+		command.CacheCmd(),
+		command.OpenAPICmd(),
 		completionCmd,
 	)
 
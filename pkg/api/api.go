@@ -102,6 +102,8 @@ func (s *Server) registerAPIs() {
 	group.Entries = append(group.Entries, s.healthAPIEntries()...)
 	group.Entries = append(group.Entries, s.aboutAPIEntries()...)
 	group.Entries = append(group.Entries, s.customDataAPIEntries()...)
+	group.Entries = append(group.Entries, s.cacheAPIEntries()...)
+	group.Entries = append(group.Entries, s.openAPIAPIEntries()...)
 
 	for _, fn := range appendAddonAPIs {
 		fn(s, group)
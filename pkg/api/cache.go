@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/util/cachepurge"
+)
+
+const (
+	// CachePurgePath is the path to purge the caches of all members.
+	CachePurgePath = "/cache/purge"
+)
+
+func (s *Server) cacheAPIEntries() []*Entry {
+	return []*Entry{
+		{
+			Path:    CachePurgePath,
+			Method:  http.MethodPost,
+			Handler: s.purgeCache,
+		},
+	}
+}
+
+// purgeCache posts a purge record to the cluster, every member applies it
+// to its caches, expired records are removed at the same time.
+func (s *Server) purgeCache(w http.ResponseWriter, r *http.Request) {
+	record := &cachepurge.Record{}
+	if err := yaml.NewDecoder(r.Body).Decode(record); err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("unmarshal purge record failed: %v", err))
+		return
+	}
+	if err := record.Validate(); err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	record.CreatedAt = now
+	buff, err := yaml.Marshal(record)
+	if err != nil {
+		panic(fmt.Errorf("marshal %#v to yaml failed: %v", record, err))
+	}
+
+	layout := s.cluster.Layout()
+	kvs, err := s.cluster.GetPrefix(layout.CachePurgePrefix())
+	if err != nil {
+		ClusterPanic(err)
+	}
+
+	value := string(buff)
+	kvsToPut := map[string]*string{
+		layout.CachePurgeKey(strconv.FormatInt(now.UnixNano(), 10)): &value,
+	}
+	for k, v := range kvs {
+		old := &cachepurge.Record{}
+		if err := yaml.Unmarshal([]byte(v), old); err != nil || now.Sub(old.CreatedAt) > cachepurge.RecordTTL {
+			kvsToPut[k] = nil
+		}
+	}
+
+	if err := s.cluster.PutAndDelete(kvsToPut); err != nil {
+		ClusterPanic(err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "cache purge record posted at: %s\n", now.Format(time.RFC3339Nano))
+}
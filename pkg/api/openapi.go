@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/openapi"
+)
+
+const (
+	// OpenAPIImportPath is the path to import an OpenAPI 3 document.
+	OpenAPIImportPath = "/openapi/import"
+
+	openAPIActionCreated   = "created"
+	openAPIActionUpdated   = "updated"
+	openAPIActionUnchanged = "unchanged"
+	openAPIActionDeleted   = "deleted"
+)
+
+type (
+	// OpenAPIImportRequest is the request to import an OpenAPI 3 document.
+	OpenAPIImportRequest struct {
+		openapi.Options `yaml:",inline"`
+		Document        string `yaml:"document"`
+	}
+
+	// OpenAPIImportAction is the action applied to an object by the import.
+	OpenAPIImportAction struct {
+		Kind   string `yaml:"kind"`
+		Name   string `yaml:"name"`
+		Action string `yaml:"action"`
+	}
+)
+
+func (s *Server) openAPIAPIEntries() []*Entry {
+	return []*Entry{
+		{
+			Path:    OpenAPIImportPath,
+			Method:  http.MethodPost,
+			Handler: s.importOpenAPI,
+		},
+	}
+}
+
+// importOpenAPI generates an HTTPServer and HTTPPipelines from the document
+// and applies them, objects not changed are left untouched, and pipelines
+// generated by the previous import but not any more are deleted.
+func (s *Server) importOpenAPI(w http.ResponseWriter, r *http.Request) {
+	req := &OpenAPIImportRequest{}
+	if err := yaml.NewDecoder(r.Body).Decode(req); err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("unmarshal import request failed: %v", err))
+		return
+	}
+
+	result, err := openapi.Generate([]byte(req.Document), &req.Options)
+	if err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	specs := make([]*supervisor.Spec, 0, len(result.Objects))
+	for _, obj := range result.Objects {
+		spec, err := s.super.NewSpec(obj.YAML)
+		if err != nil {
+			HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("%s %s: %v", obj.Kind, obj.Name, err))
+			return
+		}
+		specs = append(specs, spec)
+	}
+
+	if r.URL.Query().Get("dryRun") == "true" {
+		w.Header().Set("Content-Type", "text/vnd.yaml")
+		w.Write([]byte(result.YAML()))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, spec := range specs {
+		existed := s._getObject(spec.Name())
+		if existed != nil && existed.Kind() != spec.Kind() {
+			HandleAPIError(w, r, http.StatusConflict,
+				fmt.Errorf("conflict name: %s, existed kind is %s", spec.Name(), existed.Kind()))
+			return
+		}
+	}
+
+	generated := s._getOpenAPIImport(req.Name)
+	stale := s._staleOpenAPIPipelines(generated, specs)
+
+	actions := []*OpenAPIImportAction{}
+	changed := false
+	for _, spec := range specs {
+		action := &OpenAPIImportAction{Kind: spec.Kind(), Name: spec.Name(), Action: openAPIActionCreated}
+		if existed := s._getObject(spec.Name()); existed != nil {
+			action.Action = openAPIActionUpdated
+			if existed.Equals(spec) {
+				action.Action = openAPIActionUnchanged
+			}
+		}
+		if action.Action != openAPIActionUnchanged {
+			s._putObject(spec)
+			changed = true
+		}
+		actions = append(actions, action)
+	}
+
+	for _, name := range stale {
+		s._deleteObject(name)
+		changed = true
+		actions = append(actions, &OpenAPIImportAction{
+			Kind:   httppipeline.Kind,
+			Name:   name,
+			Action: openAPIActionDeleted,
+		})
+	}
+
+	s._putOpenAPIImport(req.Name, generated, specs)
+
+	if changed {
+		s.upgradeConfigVersion(w, r)
+	}
+
+	buff, err := yaml.Marshal(actions)
+	if err != nil {
+		panic(fmt.Errorf("marshal %#v to yaml failed: %v", actions, err))
+	}
+	w.Header().Set("Content-Type", "text/vnd.yaml")
+	w.Write(buff)
+}
+
+// _getOpenAPIImport returns the pipelines generated by the previous
+// import of the server.
+func (s *Server) _getOpenAPIImport(name string) []string {
+	value, err := s.cluster.Get(s.cluster.Layout().OpenAPIImportKey(name))
+	if err != nil {
+		ClusterPanic(err)
+	}
+	if value == nil {
+		return nil
+	}
+
+	pipelines := []string{}
+	if err := yaml.Unmarshal([]byte(*value), &pipelines); err != nil {
+		panic(fmt.Errorf("unmarshal %s to yaml failed: %v", *value, err))
+	}
+	return pipelines
+}
+
+// _putOpenAPIImport records the pipelines generated by the current import
+// of the server, so that only they are deleted by later imports.
+func (s *Server) _putOpenAPIImport(name string, previous []string, specs []*supervisor.Spec) {
+	pipelines := []string{}
+	for _, spec := range specs {
+		if spec.Kind() == httppipeline.Kind {
+			pipelines = append(pipelines, spec.Name())
+		}
+	}
+	if reflect.DeepEqual(pipelines, previous) {
+		return
+	}
+
+	buff, err := yaml.Marshal(pipelines)
+	if err != nil {
+		panic(fmt.Errorf("marshal %#v to yaml failed: %v", pipelines, err))
+	}
+	if err := s.cluster.Put(s.cluster.Layout().OpenAPIImportKey(name), string(buff)); err != nil {
+		ClusterPanic(err)
+	}
+}
+
+// _staleOpenAPIPipelines returns the pipelines generated by the previous
+// import of the server, which are not generated by the current import.
+// NOTE: Pipelines not recorded as generated are never deleted, even if
+// they are routed by the server, since they may be created by users.
+func (s *Server) _staleOpenAPIPipelines(generated []string, specs []*supervisor.Spec) []string {
+	current := map[string]bool{}
+	for _, spec := range specs {
+		current[spec.Name()] = true
+	}
+
+	stale := []string{}
+	for _, name := range generated {
+		if current[name] {
+			continue
+		}
+		spec := s._getObject(name)
+		if spec == nil || spec.Kind() != httppipeline.Kind {
+			continue
+		}
+		current[name] = true
+		stale = append(stale, name)
+	}
+	return stale
+}
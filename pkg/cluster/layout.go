@@ -36,6 +36,9 @@ const (
 	wasmDataPrefixFormat     = "/wasm/data/%s/%s/"  // + pipelineName + filterName
 	customDataPrefixFormat   = "/custom-data/%s/"   // + kind
 	customDataItemFormat     = "/custom-data/%s/%s" // + kind + item key
+	cachePurgePrefix         = "/cache/purges/"
+	cachePurgeFormat         = "/cache/purges/%s"    // + purge id
+	openAPIImportFormat      = "/openapi/imports/%s" // + server name
 
 	// the cluster name of this eg group will be registered under this path in etcd
 	// any new member(primary or secondary ) will be rejected if it is configured a different cluster name
@@ -140,3 +143,19 @@ func (l *Layout) CustomDataPrefix(kind string) string {
 func (l *Layout) CustomDataItem(kind, key string) string {
 	return fmt.Sprintf(customDataItemFormat, kind, key)
 }
+
+// CachePurgePrefix returns the prefix of cache purge records
+func (l *Layout) CachePurgePrefix() string {
+	return cachePurgePrefix
+}
+
+// CachePurgeKey returns the key of a cache purge record
+func (l *Layout) CachePurgeKey(id string) string {
+	return fmt.Sprintf(cachePurgeFormat, id)
+}
+
+// OpenAPIImportKey returns the key of the pipelines generated by the
+// OpenAPI import of the server
+func (l *Layout) OpenAPIImportKey(serverName string) string {
+	return fmt.Sprintf(openAPIImportFormat, serverName)
+}
@@ -67,4 +67,12 @@ func TestLayout(t *testing.T) {
 	if len(l.WasmDataPrefix("pipeline", "wasm")) == 0 {
 		t.Error("WasmDataPrefix empty")
 	}
+
+	if len(l.CachePurgePrefix()) == 0 {
+		t.Error("CachePurgePrefix empty")
+	}
+
+	if len(l.CachePurgeKey("1")) == 0 {
+		t.Error("CachePurgeKey empty")
+	}
 }
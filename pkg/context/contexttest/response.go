@@ -35,6 +35,8 @@ type MockedHTTPResponse struct {
 	MockedSetBody       func(body io.Reader)
 	MockedBody          func() io.Reader
 	MockedOnFlushBody   func(fn context.BodyFlushFunc)
+	MockedSetStreaming  func(opts *context.StreamingOptions)
+	MockedStreaming     func() bool
 	MockedStd           func() http.ResponseWriter
 	MockedSize          func() uint64
 }
@@ -91,6 +93,21 @@ func (r *MockedHTTPResponse) OnFlushBody(fn context.BodyFlushFunc) {
 	}
 }
 
+// SetStreaming sets the streaming options
+func (r *MockedHTTPResponse) SetStreaming(opts *context.StreamingOptions) {
+	if r.MockedSetStreaming != nil {
+		r.MockedSetStreaming(opts)
+	}
+}
+
+// Streaming returns whether the body is streamed
+func (r *MockedHTTPResponse) Streaming() bool {
+	if r.MockedStreaming != nil {
+		return r.MockedStreaming()
+	}
+	return false
+}
+
 // Std returns the standard response
 func (r *MockedHTTPResponse) Std() http.ResponseWriter {
 	if r.MockedStd != nil {
@@ -119,6 +119,13 @@ type (
 		Body() io.Reader
 		OnFlushBody(BodyFlushFunc)
 
+		// SetStreaming makes the body be written to the client chunk by
+		// chunk instead of being buffered, nil turns it off.
+		SetStreaming(opts *StreamingOptions)
+		// Streaming returns whether the body is streamed, responses of
+		// Server-Sent Events are always streamed.
+		Streaming() bool
+
 		Std() http.ResponseWriter
 
 		Size() uint64 // bytes
@@ -137,6 +144,21 @@ type (
 	// when body is flushing.
 	BodyFlushFunc = func(body []byte, complete bool) (newBody []byte)
 
+	// StreamingOptions is the options of streaming response bodies.
+	StreamingOptions struct {
+		// IdleTimeout ends the stream if the body produces nothing
+		// for the duration, heartbeats are not counted. Zero means no
+		// timeout.
+		IdleTimeout time.Duration
+		// HeartbeatInterval is the interval of the comments injected
+		// into idle Server-Sent Events streams. Zero means no heartbeat.
+		HeartbeatInterval time.Duration
+		// WriteTimeout is the timeout of writing every chunk, it replaces
+		// the write deadline of the whole response set by the server.
+		// Zero means no timeout.
+		WriteTimeout time.Duration
+	}
+
 	// LazyTagFunc is the type of function to be called back
 	// when converting lazy tags to strings.
 	LazyTagFunc = func() string
@@ -41,6 +41,8 @@ type (
 		body           io.Reader
 		bodyWritten    uint64
 		bodyFlushFuncs []BodyFlushFunc
+
+		streaming *StreamingOptions
 	}
 )
 
@@ -98,6 +100,11 @@ func (w *httpResponse) flushBody() {
 		}
 	}()
 
+	if w.Streaming() {
+		w.streamBody()
+		return
+	}
+
 	copyToClient := func(src io.Reader) (succeed bool) {
 		written, err := io.Copy(w.std, src)
 		if err != nil {
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package context
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+)
+
+const eventStreamMediaType = "text/event-stream"
+
+// sseHeartbeat is a comment line followed by an empty line, which is
+// ignored by clients of Server-Sent Events.
+var sseHeartbeat = []byte(": heartbeat\n\n")
+
+// writeDeadlineSetter is implemented by the response writers of the
+// standard library since Go 1.20.
+type writeDeadlineSetter interface {
+	SetWriteDeadline(deadline time.Time) error
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+func (w *httpResponse) SetStreaming(opts *StreamingOptions) {
+	w.streaming = opts
+}
+
+func (w *httpResponse) Streaming() bool {
+	return w.streaming != nil || w.isEventStream()
+}
+
+func (w *httpResponse) isEventStream() bool {
+	ct := w.header.Get(httpheader.KeyContentType)
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.EqualFold(strings.TrimSpace(ct), eventStreamMediaType)
+}
+
+// streamBody writes the body to the client chunk by chunk, every chunk is
+// flushed as soon as it is read. It returns when the body is complete, the
+// stream is idle for too long or the client is gone.
+func (w *httpResponse) streamBody() {
+	opts := w.streaming
+	if opts == nil {
+		opts = &StreamingOptions{}
+	}
+	sse := w.isEventStream()
+
+	flusher, _ := w.std.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// NOTE: The write deadline set by the server covers the whole
+	// response, which would cut off long streams, so it is extended
+	// before every write, or cleared if there's no write timeout.
+	deadliner, _ := w.std.(writeDeadlineSetter)
+	extendDeadline := func() {
+		if deadliner == nil {
+			return
+		}
+		var deadline time.Time
+		if opts.WriteTimeout > 0 {
+			deadline = time.Now().Add(opts.WriteTimeout)
+		}
+		deadliner.SetWriteDeadline(deadline)
+	}
+
+	write := func(data []byte) bool {
+		extendDeadline()
+		n, err := w.std.Write(data)
+		w.bodyWritten += uint64(n)
+		if err != nil {
+			logger.Warnf("write body failed: %v", err)
+			return false
+		}
+		flush()
+		return true
+	}
+
+	// Send the header right away, clients may wait for it before the
+	// first chunk is produced.
+	extendDeadline()
+	flush()
+
+	chunks, ack, done := make(chan streamChunk), make(chan struct{}), make(chan struct{})
+	defer close(done)
+
+	// NOTE: Read blocks until the body produces something, so it runs in
+	// another goroutine. The buffer is reused after the chunk is written.
+	go func() {
+		buff := make([]byte, bodyFlushBuffSize)
+		for {
+			n, err := w.body.Read(buff)
+			select {
+			case chunks <- streamChunk{data: buff[:n], err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+			select {
+			case <-ack:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var idleTimer, heartbeatTimer *time.Timer
+	var idleC, heartbeatC <-chan time.Time
+	if opts.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if sse && opts.HeartbeatInterval > 0 {
+		heartbeatTimer = time.NewTimer(opts.HeartbeatInterval)
+		defer heartbeatTimer.Stop()
+		heartbeatC = heartbeatTimer.C
+	}
+
+	// tail is the end of the written data, heartbeats are only injected
+	// between events to keep the events intact.
+	tail := make([]byte, 0, 8)
+	for {
+		select {
+		case chunk := <-chunks:
+			data := chunk.data
+			complete := chunk.err != nil
+			for _, fn := range w.bodyFlushFuncs {
+				data = fn(data, complete)
+			}
+			if len(data) > 0 {
+				if !write(data) {
+					return
+				}
+				tail = appendTail(tail, data)
+			}
+
+			if complete {
+				if chunk.err != io.EOF {
+					logger.Warnf("read body failed: %v", chunk.err)
+					w.SetStatusCode(http.StatusInternalServerError)
+				}
+				return
+			}
+			ack <- struct{}{}
+
+			if idleTimer != nil && len(chunk.data) > 0 {
+				resetTimer(idleTimer, opts.IdleTimeout)
+			}
+			if heartbeatTimer != nil && len(data) > 0 {
+				resetTimer(heartbeatTimer, opts.HeartbeatInterval)
+			}
+		case <-heartbeatC:
+			if atEventBoundary(tail) {
+				if !write(sseHeartbeat) {
+					return
+				}
+			}
+			heartbeatTimer.Reset(opts.HeartbeatInterval)
+		case <-idleC:
+			logger.Debugf("stream of %s idle for %v, closed", w.stdr.URL.Path, opts.IdleTimeout)
+			return
+		case <-w.stdr.Context().Done():
+			return
+		}
+	}
+}
+
+// resetTimer resets a timer which may have fired.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// appendTail keeps the last few bytes of the written data.
+func appendTail(tail, data []byte) []byte {
+	const tailSize = 4
+
+	if len(data) >= tailSize {
+		return append(tail[:0], data[len(data)-tailSize:]...)
+	}
+	tail = append(tail, data...)
+	if len(tail) > tailSize {
+		tail = append(tail[:0], tail[len(tail)-tailSize:]...)
+	}
+	return tail
+}
+
+// atEventBoundary returns whether the data written so far ends with an
+// empty line, which dispatches an event of Server-Sent Events.
+func atEventBoundary(tail []byte) bool {
+	if len(tail) == 0 {
+		return true
+	}
+
+	for _, eol := range [][]byte{[]byte("\r\n"), []byte("\n"), []byte("\r")} {
+		if bytes.HasSuffix(tail, eol) {
+			rest := tail[:len(tail)-len(eol)]
+			return bytes.HasSuffix(rest, []byte("\n")) || bytes.HasSuffix(rest, []byte("\r"))
+		}
+	}
+	return false
+}
@@ -23,6 +23,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -42,6 +43,7 @@ type (
 		SubscribePacket() *packets.SubscribePacket     // read only
 		UnsubscribePacket() *packets.UnsubscribePacket // read only
 		PublishPacket() *packets.PublishPacket         // read only
+		Properties() *packets5.Properties              // read only, properties of MQTT 5.0 packet, nil for MQTT 3.1.1
 
 		SetDrop()         // set drop value to true
 		Drop() bool       // if true, this mqtt packet will be dropped
@@ -50,6 +52,13 @@ type (
 		SetEarlyStop()    // set early stop value to true
 		EarlyStop() bool  // if early stop is true, pipeline will skip following filters and return
 
+		SetReasonCode(byte) // set MQTT 5.0 reason code sent to client when packet is dropped or client is disconnected
+		ReasonCode() byte
+		SetAuthData([]byte) // set MQTT 5.0 enhanced authentication data sent to client
+		AuthData() []byte
+		SetAuthContinue() // set to continue MQTT 5.0 enhanced authentication with another AUTH packet from client
+		AuthContinue() bool
+
 		SetKV(string, interface{})
 		GetKV(string) interface{}
 	}
@@ -75,13 +84,17 @@ type (
 		endTime    time.Time
 		client     MQTTClient
 		packet     packets.ControlPacket
+		properties *packets5.Properties
 		packetType MQTTPacketType
 		kvMap      map[string]interface{}
 
-		err        error
-		drop       int32
-		disconnect int32
-		earlyStop  int32
+		err          error
+		drop         int32
+		disconnect   int32
+		earlyStop    int32
+		reasonCode   byte
+		authData     []byte
+		authContinue bool
 	}
 
 	// MQTTResult is result for handling mqtt request
@@ -114,6 +127,11 @@ var _ MQTTContext = (*mqttContext)(nil)
 
 // NewMQTTContext create new MQTTContext
 func NewMQTTContext(ctx stdcontext.Context, client MQTTClient, packet packets.ControlPacket) MQTTContext {
+	return NewMQTT5Context(ctx, client, packet, nil)
+}
+
+// NewMQTT5Context create new MQTTContext for MQTT 5.0 packet with its properties
+func NewMQTT5Context(ctx stdcontext.Context, client MQTTClient, packet packets.ControlPacket, properties *packets5.Properties) MQTTContext {
 	stdctx, cancelFunc := stdcontext.WithCancel(ctx)
 	startTime := time.Now()
 	mqttCtx := &mqttContext{
@@ -139,6 +157,7 @@ func NewMQTTContext(ctx stdcontext.Context, client MQTTClient, packet packets.Co
 		mqttCtx.packetType = MQTTOther
 	}
 	mqttCtx.packet = packet
+	mqttCtx.properties = properties
 
 	return mqttCtx
 }
@@ -240,6 +259,10 @@ func (ctx *mqttContext) UnsubscribePacket() *packets.UnsubscribePacket {
 	return ctx.packet.(*packets.UnsubscribePacket)
 }
 
+func (ctx *mqttContext) Properties() *packets5.Properties {
+	return ctx.properties
+}
+
 func (ctx *mqttContext) SetDrop() {
 	atomic.StoreInt32(&ctx.drop, 1)
 }
@@ -264,6 +287,42 @@ func (ctx *mqttContext) EarlyStop() bool {
 	return atomic.LoadInt32(&ctx.earlyStop) == 1
 }
 
+func (ctx *mqttContext) SetReasonCode(code byte) {
+	ctx.mu.Lock()
+	ctx.reasonCode = code
+	ctx.mu.Unlock()
+}
+
+func (ctx *mqttContext) ReasonCode() byte {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.reasonCode
+}
+
+func (ctx *mqttContext) SetAuthData(data []byte) {
+	ctx.mu.Lock()
+	ctx.authData = data
+	ctx.mu.Unlock()
+}
+
+func (ctx *mqttContext) AuthData() []byte {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.authData
+}
+
+func (ctx *mqttContext) SetAuthContinue() {
+	ctx.mu.Lock()
+	ctx.authContinue = true
+	ctx.mu.Unlock()
+}
+
+func (ctx *mqttContext) AuthContinue() bool {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.authContinue
+}
+
 func (ctx *mqttContext) SetKV(key string, value interface{}) {
 	ctx.kvMap[key] = value
 }
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package amqp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+	"github.com/megaease/easegress/pkg/util/mqttbackend"
+)
+
+const (
+	// Kind is the kind of AMQP
+	Kind = "AMQP"
+
+	resultGetDataFailed = "GetDataFailed"
+	resultSendFailed    = "SendFailed"
+)
+
+func init() {
+	pipeline.Register(&AMQP{})
+}
+
+type (
+	// AMQP is AMQP 0.9.1 backend, like RabbitMQ, for MQTT proxy
+	AMQP struct {
+		filterSpec *pipeline.FilterSpec
+		spec       *Spec
+		publisher  *publisher
+		sender     *mqttbackend.Sender
+
+		defaultTopic string
+	}
+
+	// channel is the part of *amqp091.Channel used by AMQP
+	channel interface {
+		Publish(exchange, key string, mandatory, immediate bool, msg amqp091.Publishing) error
+		Confirm(noWait bool) error
+		NotifyPublish(confirm chan amqp091.Confirmation) chan amqp091.Confirmation
+		Close() error
+	}
+
+	// dialFunc opens a channel, and returns the function to close its connection.
+	dialFunc func() (channel, func() error, error)
+
+	// publisher publishes messages by a channel, the channel is opened when
+	// the first message is published, and reopened after it fails.
+	publisher struct {
+		dial     dialFunc
+		exchange string
+		confirm  bool
+		timeout  time.Duration
+
+		mu        sync.Mutex
+		ch        channel
+		closeConn func() error
+		confirms  chan amqp091.Confirmation
+	}
+)
+
+var _ pipeline.Filter = (*AMQP)(nil)
+var _ pipeline.MQTTFilter = (*AMQP)(nil)
+
+// Kind return kind of AMQP
+func (a *AMQP) Kind() string {
+	return Kind
+}
+
+// DefaultSpec return default spec of AMQP
+func (a *AMQP) DefaultSpec() interface{} {
+	return &Spec{}
+}
+
+// Description return description of AMQP
+func (a *AMQP) Description() string {
+	return "AMQP is a backend of MQTTProxy, which publishes messages to AMQP 0.9.1 brokers like RabbitMQ"
+}
+
+// Results return possible results of AMQP
+func (a *AMQP) Results() []string {
+	return []string{resultGetDataFailed, resultSendFailed}
+}
+
+// Init init AMQP
+func (a *AMQP) Init(filterSpec *pipeline.FilterSpec) {
+	if filterSpec.Protocol() != context.MQTT {
+		panic("filter AMQP only support MQTT protocol for now")
+	}
+	a.filterSpec, a.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	if _, err := amqp091.ParseURI(a.spec.URL); err != nil {
+		panic(fmt.Errorf("invalid amqp url %v: %v", a.spec.URL, err))
+	}
+	a.setDial(dial(filterSpec.Name(), a.spec.URL, a.spec.Delivery.AttemptTimeout()))
+}
+
+func (a *AMQP) setDial(fn dialFunc) {
+	if a.spec.Topic != nil {
+		a.defaultTopic = a.spec.Topic.Default
+	}
+	a.publisher = &publisher{
+		dial:     fn,
+		exchange: a.spec.Exchange,
+		confirm:  a.spec.Delivery.AtLeastOnce(),
+		timeout:  a.spec.Delivery.AttemptTimeout(),
+	}
+	a.sender = mqttbackend.NewSender(a.spec.Delivery, a.publisher)
+}
+
+func dial(name, url string, timeout time.Duration) dialFunc {
+	return func() (channel, func() error, error) {
+		config := amqp091.Config{
+			Dial:       amqp091.DefaultDial(timeout),
+			Properties: amqp091.Table{"connection_name": name},
+		}
+		conn, err := amqp091.DialConfig(url, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		ch, err := conn.Channel()
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		return ch, conn.Close, nil
+	}
+}
+
+// Inherit init AMQP based on previous generation
+func (a *AMQP) Inherit(filterSpec *pipeline.FilterSpec, previousGeneration pipeline.Filter) {
+	previousGeneration.Close()
+	a.Init(filterSpec)
+}
+
+// Close close AMQP
+func (a *AMQP) Close() {
+	a.sender.Close()
+	a.publisher.close()
+}
+
+// Status return status of AMQP
+func (a *AMQP) Status() interface{} {
+	return a.sender.Status()
+}
+
+// HandleMQTT handle MQTT context
+func (a *AMQP) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult {
+	msg, ok := mqttbackend.GetMessage(ctx, a.spec.KVMap, a.defaultTopic, routingKey)
+	if !ok {
+		return &context.MQTTResult{ErrString: resultGetDataFailed}
+	}
+	if err := a.sender.Send(msg); err != nil {
+		logger.SpanErrorf(nil, "send message of client %v to amqp routing key %v failed: %v", msg.ClientID, msg.Topic, err)
+		ctx.SetDrop()
+		ctx.SetReasonCode(packets5.PubackUnspecifiedError)
+		return &context.MQTTResult{ErrString: resultSendFailed}
+	}
+	return &context.MQTTResult{}
+}
+
+// routingKey converts MQTT topic to AMQP routing key, levels of MQTT topic are separated
+// by '/', while words of routing key are separated by '.' for topic exchanges.
+func routingKey(topic string) string {
+	return strings.ReplaceAll(topic, "/", ".")
+}
+
+// Publish publishes the message, and waits for the confirmation of the broker if confirm is true.
+func (p *publisher) Publish(msg *mqttbackend.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil {
+		if err := p.open(); err != nil {
+			return err
+		}
+	}
+
+	publishing := amqp091.Publishing{
+		Headers:     amqp091.Table{},
+		ContentType: msg.Headers[mqttbackend.HeaderContentType],
+		Timestamp:   time.Now(),
+		Body:        msg.Payload,
+	}
+	for k, v := range msg.Headers {
+		publishing.Headers[k] = v
+	}
+	if p.confirm {
+		publishing.DeliveryMode = amqp091.Persistent
+	}
+	if err := p.ch.Publish(p.exchange, msg.Topic, false, false, publishing); err != nil {
+		p.reset()
+		return err
+	}
+	if !p.confirm {
+		return nil
+	}
+
+	select {
+	case c, ok := <-p.confirms:
+		if !ok {
+			p.reset()
+			return fmt.Errorf("channel closed before confirmation")
+		}
+		if !c.Ack {
+			return fmt.Errorf("message nacked by broker")
+		}
+		return nil
+	case <-time.After(p.timeout):
+		// confirmation arrives later would be taken as the one of next message, so reopen the channel
+		p.reset()
+		return fmt.Errorf("wait for confirmation timeout")
+	}
+}
+
+func (p *publisher) open() error {
+	ch, closeConn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	if p.confirm {
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			closeConn()
+			return err
+		}
+		p.confirms = ch.NotifyPublish(make(chan amqp091.Confirmation, 1))
+	}
+	p.ch, p.closeConn = ch, closeConn
+	return nil
+}
+
+func (p *publisher) reset() {
+	if p.ch == nil {
+		return
+	}
+	p.ch.Close()
+	p.closeConn()
+	p.ch, p.closeConn, p.confirms = nil, nil, nil
+}
+
+func (p *publisher) close() {
+	p.mu.Lock()
+	p.reset()
+	p.mu.Unlock()
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package amqp
+
+import (
+	"github.com/megaease/easegress/pkg/util/mqttbackend"
+)
+
+type (
+	// Spec is spec of AMQP
+	Spec struct {
+		URL string `yaml:"url" jsonschema:"required,format=uri"`
+		// Exchange is the exchange messages are published to, empty is the default exchange.
+		Exchange string                `yaml:"exchange" jsonschema:"omitempty"`
+		Topic    *Topic                `yaml:"topic" jsonschema:"omitempty"`
+		KVMap    *mqttbackend.KVMap    `yaml:"mqtt" jsonschema:"omitempty"`
+		Delivery *mqttbackend.Delivery `yaml:"delivery" jsonschema:"omitempty"`
+	}
+
+	// Topic defined ways to get AMQP routing key
+	Topic struct {
+		Default string `yaml:"default" jsonschema:"omitempty"`
+	}
+)
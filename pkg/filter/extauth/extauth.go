@@ -0,0 +1,538 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extauth
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/iotool"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+const (
+	// Kind is the kind of ExtAuth.
+	Kind = "ExtAuth"
+
+	resultDenied = "denied"
+	resultFailed = "failed"
+
+	defaultTimeout       = 200 * time.Millisecond
+	defaultCacheSize     = 10240
+	defaultStatusOnError = http.StatusForbidden
+
+	// 64KB
+	maxDeniedBodyBytes = 64 * 1024
+)
+
+var results = []string{resultDenied, resultFailed}
+
+func init() {
+	httppipeline.Register(&ExtAuth{})
+}
+
+type (
+	// ExtAuth is the filter delegating the authorization of requests
+	// to an external service.
+	ExtAuth struct {
+		filterSpec *httppipeline.FilterSpec
+		spec       *Spec
+
+		timeout      time.Duration
+		cacheTTL     time.Duration
+		cacheDenyTTL time.Duration
+		cache        *lru.Cache
+
+		allowedRequestHeaders  map[string]struct{}
+		allowedUpstreamHeaders []string
+		allowedClientHeaders   map[string]struct{}
+
+		authorizer authorizer
+
+		allowed   uint64
+		denied    uint64
+		failed    uint64
+		cacheHits uint64
+	}
+
+	// Spec describes the ExtAuth.
+	Spec struct {
+		HTTP *HTTPSpec `yaml:"http,omitempty" jsonschema:"omitempty"`
+		GRPC *GRPCSpec `yaml:"grpc,omitempty" jsonschema:"omitempty"`
+
+		Timeout          string `yaml:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+		FailureModeAllow bool   `yaml:"failureModeAllow" jsonschema:"omitempty"`
+		StatusOnError    int    `yaml:"statusOnError,omitempty" jsonschema:"omitempty,format=httpcode"`
+
+		AllowedRequestHeaders  []string  `yaml:"allowedRequestHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		AllowedUpstreamHeaders []string  `yaml:"allowedUpstreamHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		AllowedClientHeaders   []string  `yaml:"allowedClientHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		WithRequestBody        *BodySpec `yaml:"withRequestBody,omitempty" jsonschema:"omitempty"`
+
+		Cache *CacheSpec `yaml:"cache,omitempty" jsonschema:"omitempty"`
+	}
+
+	// HTTPSpec describes the HTTP authorization service.
+	HTTPSpec struct {
+		URL        string `yaml:"url" jsonschema:"required,format=uri"`
+		AppendPath bool   `yaml:"appendPath" jsonschema:"omitempty"`
+	}
+
+	// GRPCSpec describes the gRPC authorization service, which implements
+	// envoy.service.auth.v3.Authorization.
+	GRPCSpec struct {
+		Address            string            `yaml:"address" jsonschema:"required"`
+		TLS                bool              `yaml:"tls" jsonschema:"omitempty"`
+		InsecureSkipVerify bool              `yaml:"insecureSkipVerify" jsonschema:"omitempty"`
+		ContextExtensions  map[string]string `yaml:"contextExtensions,omitempty" jsonschema:"omitempty"`
+	}
+
+	// BodySpec describes how to send the request body to the authorization service.
+	BodySpec struct {
+		MaxRequestBytes     int64 `yaml:"maxRequestBytes" jsonschema:"required,minimum=1"`
+		AllowPartialMessage bool  `yaml:"allowPartialMessage" jsonschema:"omitempty"`
+	}
+
+	// CacheSpec describes the cache of authorization decisions.
+	CacheSpec struct {
+		TTL        string   `yaml:"ttl" jsonschema:"required,format=duration"`
+		DenyTTL    string   `yaml:"denyTTL,omitempty" jsonschema:"omitempty,format=duration"`
+		MaxEntries int      `yaml:"maxEntries,omitempty" jsonschema:"omitempty,minimum=1"`
+		KeyHeaders []string `yaml:"keyHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	}
+
+	// Status is the status of ExtAuth.
+	Status struct {
+		Allowed   uint64 `yaml:"allowed"`
+		Denied    uint64 `yaml:"denied"`
+		Failed    uint64 `yaml:"failed"`
+		CacheHits uint64 `yaml:"cacheHits"`
+	}
+
+	// authorizer is the client of an authorization service.
+	authorizer interface {
+		check(ctx stdcontext.Context, req *checkRequest) (*decision, error)
+		close()
+	}
+
+	// checkRequest is the request metadata sent to the authorization service.
+	checkRequest struct {
+		realIP   string
+		method   string
+		scheme   string
+		host     string
+		path     string
+		query    string
+		fragment string
+		proto    string
+		size     int64
+		header   http.Header
+		body     []byte
+	}
+
+	// decision is the result of the authorization.
+	decision struct {
+		allowed bool
+
+		// upstreamHeaders are set to the request when allowed.
+		upstreamHeaders http.Header
+		// appendedUpstreamHeaders are added to the request when allowed.
+		appendedUpstreamHeaders http.Header
+		// removedUpstreamHeaders are removed from the request when allowed.
+		removedUpstreamHeaders []string
+
+		// statusCode, clientHeaders and body are sent to the client when denied.
+		statusCode    int
+		clientHeaders http.Header
+		body          []byte
+	}
+
+	cacheEntry struct {
+		decision *decision
+		expireAt time.Time
+	}
+)
+
+// Validate validates the spec of ExtAuth.
+func (spec Spec) Validate() error {
+	if spec.HTTP == nil && spec.GRPC == nil {
+		return fmt.Errorf("one of http and grpc is required")
+	}
+	if spec.HTTP != nil && spec.GRPC != nil {
+		return fmt.Errorf("http and grpc are mutually exclusive")
+	}
+	if spec.GRPC != nil && len(spec.AllowedUpstreamHeaders) != 0 {
+		return fmt.Errorf("allowedUpstreamHeaders is not supported by grpc, " +
+			"the authorization service decides the upstream headers")
+	}
+
+	if spec.Cache != nil && spec.WithRequestBody != nil {
+		return fmt.Errorf("cache is not supported when the request body is sent")
+	}
+
+	return nil
+}
+
+// Kind returns the kind of ExtAuth.
+func (ea *ExtAuth) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of ExtAuth.
+func (ea *ExtAuth) DefaultSpec() interface{} {
+	return &Spec{
+		StatusOnError: defaultStatusOnError,
+	}
+}
+
+// Description returns the description of ExtAuth.
+func (ea *ExtAuth) Description() string {
+	return "ExtAuth authorizes requests by calling an external authorization service."
+}
+
+// Results returns the results of ExtAuth.
+func (ea *ExtAuth) Results() []string {
+	return results
+}
+
+// Init initializes ExtAuth.
+func (ea *ExtAuth) Init(filterSpec *httppipeline.FilterSpec) {
+	ea.filterSpec, ea.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	ea.reload()
+}
+
+// Inherit inherits previous generation of ExtAuth.
+func (ea *ExtAuth) Inherit(filterSpec *httppipeline.FilterSpec, previousGeneration httppipeline.Filter) {
+	previousGeneration.Close()
+	ea.Init(filterSpec)
+}
+
+func parseDuration(d string, defaultValue time.Duration) time.Duration {
+	if d == "" {
+		return defaultValue
+	}
+
+	v, err := time.ParseDuration(d)
+	if err != nil {
+		logger.Errorf("BUG: parse duration %s failed: %v", d, err)
+		return defaultValue
+	}
+
+	return v
+}
+
+func headerSet(headers []string) map[string]struct{} {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	m := make(map[string]struct{}, len(headers))
+	for _, h := range headers {
+		m[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	return m
+}
+
+func (ea *ExtAuth) reload() {
+	ea.timeout = parseDuration(ea.spec.Timeout, defaultTimeout)
+
+	ea.allowedRequestHeaders = headerSet(ea.spec.AllowedRequestHeaders)
+	ea.allowedClientHeaders = headerSet(ea.spec.AllowedClientHeaders)
+	ea.allowedUpstreamHeaders = nil
+	for _, h := range ea.spec.AllowedUpstreamHeaders {
+		ea.allowedUpstreamHeaders = append(ea.allowedUpstreamHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	if c := ea.spec.Cache; c != nil {
+		ea.cacheTTL = parseDuration(c.TTL, 0)
+		ea.cacheDenyTTL = parseDuration(c.DenyTTL, 0)
+		size := c.MaxEntries
+		if size <= 0 {
+			size = defaultCacheSize
+		}
+		ea.cache, _ = lru.New(size)
+	}
+
+	if ea.spec.HTTP != nil {
+		ea.authorizer = newHTTPAuthorizer(ea.spec.HTTP, ea.allowedUpstreamHeaders)
+	} else {
+		ea.authorizer = newGRPCAuthorizer(ea.spec.GRPC)
+	}
+}
+
+// Handle authorizes the request of HTTPContext.
+func (ea *ExtAuth) Handle(ctx context.HTTPContext) string {
+	result := ea.handle(ctx)
+	return ctx.CallNextHandler(result)
+}
+
+func (ea *ExtAuth) handle(ctx context.HTTPContext) string {
+	req, err := ea.buildCheckRequest(ctx)
+	if err != nil {
+		return ea.fail(ctx, err)
+	}
+
+	key := ea.cacheKey(req)
+	d := ea.getCache(key)
+	if d != nil {
+		atomic.AddUint64(&ea.cacheHits, 1)
+	} else {
+		timeoutCtx, cancel := stdcontext.WithTimeout(stdcontext.Background(), ea.timeout)
+		defer cancel()
+
+		d, err = ea.authorizer.check(timeoutCtx, req)
+		if err != nil {
+			return ea.fail(ctx, err)
+		}
+		ea.putCache(key, d)
+	}
+
+	if d.allowed {
+		atomic.AddUint64(&ea.allowed, 1)
+		ea.allow(ctx, d)
+		return ""
+	}
+
+	atomic.AddUint64(&ea.denied, 1)
+	ea.deny(ctx, d)
+	return resultDenied
+}
+
+func (ea *ExtAuth) fail(ctx context.HTTPContext, err error) string {
+	atomic.AddUint64(&ea.failed, 1)
+
+	if ea.spec.FailureModeAllow {
+		ctx.AddTag(stringtool.Cat("extAuthErr: ", err.Error(), ", allowed by failure mode"))
+		return ""
+	}
+
+	ctx.AddTag(stringtool.Cat("extAuthErr: ", err.Error()))
+	code := ea.spec.StatusOnError
+	if code == 0 {
+		code = defaultStatusOnError
+	}
+	ctx.Response().SetStatusCode(code)
+	return resultFailed
+}
+
+func (ea *ExtAuth) allow(ctx context.HTTPContext, d *decision) {
+	h := ctx.Request().Header()
+	for _, key := range d.removedUpstreamHeaders {
+		h.Del(key)
+	}
+	for key, values := range d.upstreamHeaders {
+		h.Del(key)
+		for _, v := range values {
+			h.Add(key, v)
+		}
+	}
+	for key, values := range d.appendedUpstreamHeaders {
+		for _, v := range values {
+			h.Add(key, v)
+		}
+	}
+}
+
+func (ea *ExtAuth) deny(ctx context.HTTPContext, d *decision) {
+	w := ctx.Response()
+
+	code := d.statusCode
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+	w.SetStatusCode(code)
+
+	for key, values := range d.clientHeaders {
+		if ea.allowedClientHeaders != nil {
+			if _, ok := ea.allowedClientHeaders[http.CanonicalHeaderKey(key)]; !ok {
+				continue
+			}
+		}
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+
+	if len(d.body) != 0 {
+		w.SetBody(bytes.NewReader(d.body))
+	}
+
+	ctx.AddTag(stringtool.Cat("extAuth: denied with status code ", fmt.Sprint(code)))
+}
+
+func (ea *ExtAuth) buildCheckRequest(ctx context.HTTPContext) (*checkRequest, error) {
+	r := ctx.Request()
+
+	req := &checkRequest{
+		realIP:   r.RealIP(),
+		method:   r.Method(),
+		scheme:   r.Scheme(),
+		host:     r.Host(),
+		path:     r.Path(),
+		query:    r.Query(),
+		fragment: r.Fragment(),
+		proto:    r.Proto(),
+		size:     r.Std().ContentLength,
+		header:   http.Header{},
+	}
+
+	r.Header().VisitAll(func(key, value string) {
+		if ea.allowedRequestHeaders != nil {
+			if _, ok := ea.allowedRequestHeaders[http.CanonicalHeaderKey(key)]; !ok {
+				return
+			}
+		}
+		req.header.Add(key, value)
+	})
+
+	if ea.spec.WithRequestBody != nil && r.Body() != nil {
+		body, err := ea.readBody(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.body = body
+	}
+
+	return req, nil
+}
+
+// readBody reads at most MaxRequestBytes of the request body, and puts
+// them back so that the following filters can still read the whole body.
+func (ea *ExtAuth) readBody(ctx context.HTTPContext) ([]byte, error) {
+	r := ctx.Request()
+	n := ea.spec.WithRequestBody.MaxRequestBytes
+
+	data, truncated, body, err := iotool.PeekBody(r.Body(), n)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %v", err)
+	}
+	r.SetBody(body)
+
+	if truncated && !ea.spec.WithRequestBody.AllowPartialMessage {
+		return nil, fmt.Errorf("request body is larger than %dB", n)
+	}
+	return data, nil
+}
+
+// cacheKey returns the key of the decision, every attribute sent to the
+// authorization service is a part of it except the headers not listed in
+// KeyHeaders, because the decision may depend on any of them.
+func (ea *ExtAuth) cacheKey(req *checkRequest) string {
+	if ea.cache == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(req.realIP)
+	sb.WriteByte(' ')
+	sb.WriteString(req.method)
+	sb.WriteByte(' ')
+	sb.WriteString(req.scheme)
+	sb.WriteString("://")
+	sb.WriteString(req.host)
+	sb.WriteString(req.path)
+	sb.WriteByte('?')
+	sb.WriteString(req.query)
+	sb.WriteByte('#')
+	sb.WriteString(req.fragment)
+	sb.WriteByte(' ')
+	sb.WriteString(req.proto)
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.FormatInt(req.size, 10))
+
+	keyHeaders := ea.spec.Cache.KeyHeaders
+	if len(keyHeaders) == 0 {
+		for key := range req.header {
+			keyHeaders = append(keyHeaders, key)
+		}
+		sort.Strings(keyHeaders)
+	}
+
+	for _, key := range keyHeaders {
+		sb.WriteByte('\n')
+		sb.WriteString(http.CanonicalHeaderKey(key))
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(req.header.Values(key), ","))
+	}
+
+	return sb.String()
+}
+
+func (ea *ExtAuth) getCache(key string) *decision {
+	if ea.cache == nil {
+		return nil
+	}
+
+	v, ok := ea.cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	entry := v.(*cacheEntry)
+	if time.Now().After(entry.expireAt) {
+		ea.cache.Remove(key)
+		return nil
+	}
+
+	return entry.decision
+}
+
+func (ea *ExtAuth) putCache(key string, d *decision) {
+	if ea.cache == nil {
+		return
+	}
+
+	ttl := ea.cacheTTL
+	if !d.allowed {
+		ttl = ea.cacheDenyTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	ea.cache.Add(key, &cacheEntry{decision: d, expireAt: time.Now().Add(ttl)})
+}
+
+// Status returns the status of ExtAuth.
+func (ea *ExtAuth) Status() interface{} {
+	return &Status{
+		Allowed:   atomic.LoadUint64(&ea.allowed),
+		Denied:    atomic.LoadUint64(&ea.denied),
+		Failed:    atomic.LoadUint64(&ea.failed),
+		CacheHits: atomic.LoadUint64(&ea.cacheHits),
+	}
+}
+
+// Close closes ExtAuth.
+func (ea *ExtAuth) Close() {
+	if ea.authorizer != nil {
+		ea.authorizer.close()
+	}
+}
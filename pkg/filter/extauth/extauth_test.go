@@ -0,0 +1,390 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extauth
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/yamltool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newExtAuth(t *testing.T, yamlSpec string) *ExtAuth {
+	rawSpec := make(map[string]interface{})
+	yamltool.Unmarshal([]byte(yamlSpec), &rawSpec)
+
+	spec, err := httppipeline.NewFilterSpec(rawSpec, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ea := &ExtAuth{}
+	ea.Init(spec)
+	return ea
+}
+
+func newContext(method, url string, header map[string]string) context.HTTPContext {
+	req := httptest.NewRequest(method, url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	ctx := context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+	ctx.SetHandlerCaller(func(lastResult string) string {
+		return lastResult
+	})
+	return ctx
+}
+
+func TestHTTPAuthorizer(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("X-Secret") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			if r.URL.Path != "/auth/api/orders" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("X-User-Id", "u1")
+			w.Header().Set("X-Internal", "secret")
+			w.WriteHeader(http.StatusOK)
+		case "":
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.Header().Set("X-Debug", "no token")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("login required"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	ea := newExtAuth(t, fmt.Sprintf(`
+kind: ExtAuth
+name: ext-auth
+http:
+  url: %s/auth
+  appendPath: true
+allowedRequestHeaders: [Authorization, X-Secret]
+allowedUpstreamHeaders: [X-User-Id]
+allowedClientHeaders: [WWW-Authenticate]
+cache:
+  ttl: 1m
+  keyHeaders: [Authorization]
+`, server.URL))
+	defer ea.Close()
+
+	ctx := newContext(http.MethodGet, "/api/orders", map[string]string{"Authorization": "Bearer good"})
+	if result := ea.Handle(ctx); result != "" {
+		t.Fatalf("request should be allowed, got %s", result)
+	}
+	h := ctx.Request().Header()
+	if h.Get("X-User-Id") != "u1" || h.Get("X-Internal") != "" {
+		t.Errorf("unexpected upstream headers: %v", h.Std())
+	}
+
+	ctx = newContext(http.MethodGet, "/api/orders", map[string]string{"Authorization": "Bearer good"})
+	if result := ea.Handle(ctx); result != "" {
+		t.Fatalf("request should be allowed, got %s", result)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("the decision should be cached")
+	}
+
+	ctx = newContext(http.MethodGet, "/api/orders", nil)
+	if result := ea.Handle(ctx); result != resultDenied {
+		t.Fatalf("request should be denied, got %s", result)
+	}
+	w := ctx.Response()
+	if w.StatusCode() != http.StatusUnauthorized {
+		t.Errorf("want status code 401, got %d", w.StatusCode())
+	}
+	if w.Header().Get("WWW-Authenticate") != "Bearer" || w.Header().Get("X-Debug") != "" {
+		t.Errorf("unexpected client headers: %v", w.Header().Std())
+	}
+	if body, _ := io.ReadAll(w.Body()); string(body) != "login required" {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	ctx = newContext(http.MethodGet, "/api/orders", map[string]string{"X-Secret": "1"})
+	if result := ea.Handle(ctx); result != resultFailed {
+		t.Fatalf("5xx response should fail the request, got %s", result)
+	}
+	if code := ctx.Response().StatusCode(); code != http.StatusForbidden {
+		t.Errorf("want status code 403, got %d", code)
+	}
+
+	status := ea.Status().(*Status)
+	if status.Allowed != 2 || status.Denied != 1 || status.Failed != 1 || status.CacheHits != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	ea := newExtAuth(t, `
+kind: ExtAuth
+name: ext-auth
+http:
+  url: http://127.0.0.1:1/auth
+cache:
+  ttl: 1m
+  keyHeaders: [Authorization]
+`)
+	defer ea.Close()
+
+	header := http.Header{"Authorization": []string{"Bearer good"}}
+	base := checkRequest{realIP: "10.0.0.1", method: http.MethodGet, scheme: "http",
+		host: "example.com", path: "/api", proto: "HTTP/1.1", header: header}
+	key := ea.cacheKey(&base)
+
+	// Decisions may depend on any attribute sent to the authorization service.
+	for name, modify := range map[string]func(r *checkRequest){
+		"realIP":   func(r *checkRequest) { r.realIP = "10.0.0.2" },
+		"scheme":   func(r *checkRequest) { r.scheme = "https" },
+		"fragment": func(r *checkRequest) { r.fragment = "top" },
+		"proto":    func(r *checkRequest) { r.proto = "HTTP/2.0" },
+		"size":     func(r *checkRequest) { r.size = 10 },
+		"header":   func(r *checkRequest) { r.header = http.Header{"Authorization": []string{"Bearer other"}} },
+	} {
+		req := base
+		modify(&req)
+		if ea.cacheKey(&req) == key {
+			t.Errorf("requests with different %s should have different keys", name)
+		}
+	}
+
+	req := base
+	req.header = http.Header{"Authorization": []string{"Bearer good"}, "X-Other": []string{"1"}}
+	if ea.cacheKey(&req) != key {
+		t.Errorf("headers not in keyHeaders should not change the key")
+	}
+}
+
+func TestFailureMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	yamlSpec := `
+kind: ExtAuth
+name: ext-auth
+http:
+  url: %s
+timeout: 20ms
+failureModeAllow: %v
+statusOnError: 503
+`
+	ea := newExtAuth(t, fmt.Sprintf(yamlSpec, server.URL, false))
+	ctx := newContext(http.MethodGet, "/", nil)
+	if result := ea.Handle(ctx); result != resultFailed {
+		t.Errorf("timeout should fail the request, got %s", result)
+	}
+	if code := ctx.Response().StatusCode(); code != http.StatusServiceUnavailable {
+		t.Errorf("want status code 503, got %d", code)
+	}
+
+	ea = newExtAuth(t, fmt.Sprintf(yamlSpec, server.URL, true))
+	ctx = newContext(http.MethodGet, "/", nil)
+	if result := ea.Handle(ctx); result != "" {
+		t.Errorf("failure mode allow should allow the request, got %s", result)
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "hello" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	ea := newExtAuth(t, fmt.Sprintf(`
+kind: ExtAuth
+name: ext-auth
+http:
+  url: %s
+withRequestBody:
+  maxRequestBytes: 5
+  allowPartialMessage: true
+`, server.URL))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello world"))
+	ctx := context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+	ctx.SetHandlerCaller(func(lastResult string) string { return lastResult })
+	if result := ea.Handle(ctx); result != "" {
+		t.Errorf("request should be allowed, got %s", result)
+	}
+	if body, _ := io.ReadAll(ctx.Request().Body()); string(body) != "hello world" {
+		t.Errorf("body is not restored, got %s", body)
+	}
+}
+
+func appendHeaderOption(b []byte, num protowire.Number, key, value string, appendValue bool) []byte {
+	var hv []byte
+	hv = appendString(hv, 1, key)
+	hv = appendString(hv, 2, value)
+
+	var opt []byte
+	opt = appendBytes(opt, 1, hv)
+	if appendValue {
+		opt = appendBytes(opt, 2, appendVarint(nil, 1, 1))
+	}
+	return appendBytes(b, num, opt)
+}
+
+// checkHandler is a fake envoy.service.auth.v3.Authorization server,
+// it allows requests whose path is /allowed.
+func checkHandler(srv interface{}, stream grpc.ServerStream) error {
+	var in []byte
+	if err := stream.RecvMsg(&in); err != nil {
+		return err
+	}
+
+	var path, tenant string
+	visitFields(in, func(num protowire.Number, v uint64, attrs []byte) {
+		visitFields(attrs, func(num protowire.Number, v uint64, b []byte) {
+			switch num {
+			case 4:
+				visitFields(b, func(num protowire.Number, v uint64, httpReq []byte) {
+					if num != 2 {
+						return
+					}
+					visitFields(httpReq, func(num protowire.Number, v uint64, b []byte) {
+						if num == 4 {
+							path = string(b)
+						}
+					})
+				})
+			case 10:
+				visitFields(b, func(num protowire.Number, v uint64, b []byte) {
+					if num == 2 {
+						tenant = string(b)
+					}
+				})
+			}
+		})
+	})
+
+	var out []byte
+	if path == "/allowed" {
+		var okResp []byte
+		okResp = appendHeaderOption(okResp, 2, "X-Tenant", tenant, false)
+		okResp = appendHeaderOption(okResp, 2, "X-Tag", "b", true)
+		okResp = appendString(okResp, 5, "X-Remove")
+		out = appendBytes(out, 3, okResp)
+	} else {
+		out = appendBytes(out, 1, appendVarint(nil, 1, 7))
+		var deniedResp []byte
+		deniedResp = appendBytes(deniedResp, 1, appendVarint(nil, 1, 401))
+		deniedResp = appendHeaderOption(deniedResp, 2, "X-Reason", "path", false)
+		deniedResp = appendString(deniedResp, 3, "denied by grpc")
+		out = appendBytes(out, 2, deniedResp)
+	}
+
+	return stream.SendMsg(&out)
+}
+
+func TestGRPCAuthorizer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(checkHandler))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	ea := newExtAuth(t, fmt.Sprintf(`
+kind: ExtAuth
+name: ext-auth
+timeout: 5s
+grpc:
+  address: %s
+  contextExtensions:
+    tenant: megaease
+`, listener.Addr().String()))
+	defer ea.Close()
+
+	ctx := newContext(http.MethodGet, "/allowed", map[string]string{"X-Remove": "1", "X-Tag": "a"})
+	if result := ea.Handle(ctx); result != "" {
+		t.Fatalf("request should be allowed, got %s", result)
+	}
+	h := ctx.Request().Header()
+	if h.Get("X-Tenant") != "megaease" || h.Get("X-Remove") != "" || len(h.GetAll("X-Tag")) != 2 {
+		t.Errorf("unexpected upstream headers: %v", h.Std())
+	}
+
+	ctx = newContext(http.MethodGet, "/denied", nil)
+	if result := ea.Handle(ctx); result != resultDenied {
+		t.Fatalf("request should be denied, got %s", result)
+	}
+	w := ctx.Response()
+	if w.StatusCode() != http.StatusUnauthorized || w.Header().Get("X-Reason") != "path" {
+		t.Errorf("unexpected response: %d %v", w.StatusCode(), w.Header().Std())
+	}
+	if body, _ := io.ReadAll(w.Body()); string(body) != "denied by grpc" {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	spec := Spec{}
+	if spec.Validate() == nil {
+		t.Errorf("spec without service should be invalid")
+	}
+
+	spec = Spec{HTTP: &HTTPSpec{URL: "http://127.0.0.1"}, GRPC: &GRPCSpec{Address: "127.0.0.1:9000"}}
+	if spec.Validate() == nil {
+		t.Errorf("spec with both http and grpc should be invalid")
+	}
+
+	spec = Spec{
+		HTTP:            &HTTPSpec{URL: "http://127.0.0.1"},
+		WithRequestBody: &BodySpec{MaxRequestBytes: 10},
+		Cache:           &CacheSpec{TTL: "1m"},
+	}
+	if spec.Validate() == nil {
+		t.Errorf("cache with request body should be invalid")
+	}
+}
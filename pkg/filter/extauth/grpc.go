@@ -0,0 +1,360 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extauth
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+// checkMethod is the full method name of envoy.service.auth.v3.Authorization.Check.
+const checkMethod = "/envoy.service.auth.v3.Authorization/Check"
+
+// grpcAuthorizer calls the authorization service with the protocol of
+// envoy.service.auth.v3.Authorization. The messages are encoded and
+// decoded by hand, only the fields used by ExtAuth are handled.
+type grpcAuthorizer struct {
+	spec *GRPCSpec
+	conn *grpc.ClientConn
+}
+
+// rawCodec passes through the already encoded protobuf messages.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *(v.(*[]byte)), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = append([]byte(nil), data...)
+	return nil
+}
+
+// Name returns proto to make the content type application/grpc+proto.
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+func newGRPCAuthorizer(spec *GRPCSpec) *grpcAuthorizer {
+	opts := []grpc.DialOption{}
+	if spec.TLS {
+		tlsConfig := &tls.Config{InsecureSkipVerify: spec.InsecureSkipVerify}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	// NOTE: Dial doesn't block, the connection is established in background.
+	conn, err := grpc.Dial(spec.Address, opts...)
+	if err != nil {
+		logger.Errorf("dial grpc authorization service %s failed: %v", spec.Address, err)
+	}
+
+	return &grpcAuthorizer{spec: spec, conn: conn}
+}
+
+func (a *grpcAuthorizer) check(ctx stdcontext.Context, req *checkRequest) (*decision, error) {
+	if a.conn == nil {
+		return nil, fmt.Errorf("no connection to %s", a.spec.Address)
+	}
+
+	in := encodeCheckRequest(req, a.spec.ContextExtensions, time.Now())
+	var out []byte
+	err := a.conn.Invoke(ctx, checkMethod, &in, &out, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return nil, fmt.Errorf("call %s failed: %v", checkMethod, err)
+	}
+
+	d, err := decodeCheckResponse(out)
+	if err != nil {
+		return nil, fmt.Errorf("decode check response failed: %v", err)
+	}
+
+	return d, nil
+}
+
+func (a *grpcAuthorizer) close() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for k, v := range m {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, v)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// encodeCheckRequest encodes envoy.service.auth.v3.CheckRequest.
+func encodeCheckRequest(req *checkRequest, contextExtensions map[string]string, now time.Time) []byte {
+	// envoy.config.core.v3.SocketAddress
+	var socketAddr []byte
+	host, port, err := net.SplitHostPort(req.realIP)
+	if err != nil {
+		host = req.realIP
+	}
+	socketAddr = appendString(socketAddr, 2, host)
+	if p, err := strconv.ParseUint(port, 10, 32); err == nil {
+		socketAddr = appendVarint(socketAddr, 3, p)
+	}
+
+	// envoy.config.core.v3.Address
+	address := appendBytes(nil, 1, socketAddr)
+	// envoy.service.auth.v3.AttributeContext.Peer
+	source := appendBytes(nil, 1, address)
+
+	// envoy.service.auth.v3.AttributeContext.HttpRequest
+	headers := map[string]string{}
+	for key, values := range req.header {
+		headers[strings.ToLower(key)] = strings.Join(values, ",")
+	}
+	path := req.path
+	if req.query != "" {
+		path += "?" + req.query
+	}
+	var httpReq []byte
+	httpReq = appendString(httpReq, 2, req.method)
+	httpReq = appendMap(httpReq, 3, headers)
+	httpReq = appendString(httpReq, 4, path)
+	httpReq = appendString(httpReq, 5, req.host)
+	httpReq = appendString(httpReq, 6, req.scheme)
+	httpReq = appendString(httpReq, 7, req.query)
+	httpReq = appendString(httpReq, 8, req.fragment)
+	if req.size >= 0 {
+		httpReq = protowire.AppendTag(httpReq, 9, protowire.VarintType)
+		httpReq = protowire.AppendVarint(httpReq, uint64(req.size))
+	}
+	httpReq = appendString(httpReq, 10, req.proto)
+	httpReq = appendBytes(httpReq, 12, req.body)
+
+	// google.protobuf.Timestamp
+	var timestamp []byte
+	timestamp = appendVarint(timestamp, 1, uint64(now.Unix()))
+	timestamp = appendVarint(timestamp, 2, uint64(now.Nanosecond()))
+
+	// envoy.service.auth.v3.AttributeContext.Request
+	var request []byte
+	request = appendBytes(request, 1, timestamp)
+	request = appendBytes(request, 2, httpReq)
+
+	// envoy.service.auth.v3.AttributeContext
+	var attrs []byte
+	attrs = appendBytes(attrs, 1, source)
+	attrs = appendBytes(attrs, 4, request)
+	attrs = appendMap(attrs, 10, contextExtensions)
+
+	// envoy.service.auth.v3.CheckRequest
+	return appendBytes(nil, 1, attrs)
+}
+
+// visitFields calls fn for each field of the encoded message, v is the
+// value of varint fields, and b is the value of bytes fields.
+func visitFields(msg []byte, fn func(num protowire.Number, v uint64, b []byte)) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, v, nil)
+			msg = msg[n:]
+		case protowire.BytesType:
+			b, n := protowire.ConsumeBytes(msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, 0, b)
+			msg = msg[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			msg = msg[n:]
+		}
+	}
+
+	return nil
+}
+
+// decodeHeaderValueOption decodes envoy.config.core.v3.HeaderValueOption.
+func decodeHeaderValueOption(msg []byte) (key, value string, appendValue bool, err error) {
+	err = visitFields(msg, func(num protowire.Number, v uint64, b []byte) {
+		switch num {
+		case 1:
+			// envoy.config.core.v3.HeaderValue
+			visitFields(b, func(num protowire.Number, v uint64, b []byte) {
+				switch num {
+				case 1:
+					key = string(b)
+				case 2:
+					value = string(b)
+				}
+			})
+		case 2:
+			// google.protobuf.BoolValue
+			visitFields(b, func(num protowire.Number, v uint64, b []byte) {
+				if num == 1 {
+					appendValue = v != 0
+				}
+			})
+		}
+	})
+	return
+}
+
+// decodeCheckResponse decodes envoy.service.auth.v3.CheckResponse.
+func decodeCheckResponse(msg []byte) (*decision, error) {
+	var (
+		code         uint64
+		deniedResp   []byte
+		okResp       []byte
+		decodeErrors []error
+	)
+
+	err := visitFields(msg, func(num protowire.Number, v uint64, b []byte) {
+		switch num {
+		case 1:
+			// google.rpc.Status
+			err := visitFields(b, func(num protowire.Number, v uint64, b []byte) {
+				if num == 1 {
+					code = v
+				}
+			})
+			if err != nil {
+				decodeErrors = append(decodeErrors, err)
+			}
+		case 2:
+			deniedResp = b
+		case 3:
+			okResp = b
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(decodeErrors) != 0 {
+		return nil, decodeErrors[0]
+	}
+
+	d := &decision{allowed: code == 0}
+	addHeader := func(h *http.Header, b []byte) {
+		key, value, _, err := decodeHeaderValueOption(b)
+		if err != nil {
+			decodeErrors = append(decodeErrors, err)
+			return
+		}
+		if *h == nil {
+			*h = http.Header{}
+		}
+		h.Add(key, value)
+	}
+
+	if d.allowed {
+		// envoy.service.auth.v3.OkHttpResponse
+		err = visitFields(okResp, func(num protowire.Number, v uint64, b []byte) {
+			switch num {
+			case 2:
+				_, _, appendValue, err := decodeHeaderValueOption(b)
+				if err != nil {
+					decodeErrors = append(decodeErrors, err)
+				} else if appendValue {
+					addHeader(&d.appendedUpstreamHeaders, b)
+				} else {
+					addHeader(&d.upstreamHeaders, b)
+				}
+			case 5:
+				d.removedUpstreamHeaders = append(d.removedUpstreamHeaders, string(b))
+			}
+		})
+	} else {
+		// envoy.service.auth.v3.DeniedHttpResponse
+		err = visitFields(deniedResp, func(num protowire.Number, v uint64, b []byte) {
+			switch num {
+			case 1:
+				// envoy.type.v3.HttpStatus
+				visitFields(b, func(num protowire.Number, v uint64, b []byte) {
+					if num == 1 {
+						d.statusCode = int(v)
+					}
+				})
+			case 2:
+				addHeader(&d.clientHeaders, b)
+			case 3:
+				d.body = append([]byte(nil), b...)
+			}
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if len(decodeErrors) != 0 {
+		return nil, decodeErrors[0]
+	}
+
+	return d, nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extauth
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// All HTTP authorizers use one globalClient in order to reuse
+// some resounces such as keepalive connections.
+var globalClient = &http.Client{
+	// NOTE: The timeout is controlled by the context of each request.
+	Timeout: 0,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		MaxIdleConns:          10240,
+		MaxIdleConnsPerHost:   512,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// httpAuthorizer calls the authorization service with a request which has
+// the same method and headers of the original request. A 2xx response
+// allows the request, a 5xx response is regarded as a failure, any other
+// response denies the request and is sent back to the client.
+type httpAuthorizer struct {
+	spec           *HTTPSpec
+	allowedHeaders []string
+}
+
+func newHTTPAuthorizer(spec *HTTPSpec, allowedUpstreamHeaders []string) *httpAuthorizer {
+	return &httpAuthorizer{
+		spec:           spec,
+		allowedHeaders: allowedUpstreamHeaders,
+	}
+}
+
+func (a *httpAuthorizer) url(req *checkRequest) string {
+	if !a.spec.AppendPath {
+		return a.spec.URL
+	}
+
+	url := strings.TrimSuffix(a.spec.URL, "/") + req.path
+	if req.query != "" {
+		url += "?" + req.query
+	}
+	return url
+}
+
+func (a *httpAuthorizer) check(ctx stdcontext.Context, req *checkRequest) (*decision, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+
+	authReq, err := http.NewRequestWithContext(ctx, req.method, a.url(req), body)
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %v", err)
+	}
+
+	for key, values := range req.header {
+		authReq.Header[key] = values
+	}
+	authReq.Header.Set("X-Forwarded-Host", req.host)
+	authReq.Header.Set("X-Forwarded-Proto", req.scheme)
+	authReq.Header.Set("X-Forwarded-For", req.realIP)
+
+	resp, err := globalClient.Do(authReq)
+	if err != nil {
+		return nil, fmt.Errorf("do request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("authorization service responded %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		d := &decision{allowed: true, upstreamHeaders: http.Header{}}
+		for _, key := range a.allowedHeaders {
+			if values := resp.Header.Values(key); len(values) != 0 {
+				d.upstreamHeaders[key] = values
+			}
+		}
+		return d, nil
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxDeniedBodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("read response body failed: %v", err)
+	}
+
+	header := resp.Header.Clone()
+	// NOTE: The body may be truncated, and the transfer related
+	// headers are decided by the server of Easegress.
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	header.Del("Connection")
+
+	return &decision{
+		allowed:       false,
+		statusCode:    resp.StatusCode,
+		clientHeaders: header,
+		body:          respBody,
+	}, nil
+}
+
+func (a *httpAuthorizer) close() {}
@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	keyAge             = "Age"
+	keyDate            = "Date"
+	keyETag            = "Etag"
+	keyExpires         = "Expires"
+	keyIfModifiedSince = "If-Modified-Since"
+	keyIfNoneMatch     = "If-None-Match"
+	keyLastModified    = "Last-Modified"
+	keyPragma          = "Pragma"
+	keySetCookie       = "Set-Cookie"
+	keyAuthorization   = "Authorization"
+
+	// heuristicFraction is the fraction of the time since the last
+	// modification used as the heuristic freshness lifetime.
+	// Reference: https://tools.ietf.org/html/rfc7234#section-4.2.2
+	heuristicFraction = 10
+)
+
+type (
+	// cacheControl is the parsed directives of Cache-Control headers.
+	cacheControl map[string]string
+
+	// entry is a stored response, exported fields are persisted to disk.
+	entry struct {
+		StatusCode int
+		Header     http.Header
+		Body       []byte
+
+		// VaryHeaders are the canonical names of headers in Vary of the
+		// response, VaryValues are the values of them in the request.
+		VaryHeaders []string
+		VaryValues  []string
+
+		ResponseTime time.Time
+		InitialAge   time.Duration
+		Lifetime     time.Duration
+
+		StaleWhileRevalidate time.Duration
+		StaleIfError         time.Duration
+		MustRevalidate       bool
+
+		revalidating int32
+	}
+
+	// item is the unit of the storage, it contains all variants of a key.
+	item struct {
+		Key     string
+		Entries []*entry
+	}
+)
+
+// parseCacheControl parses Cache-Control header values, directive names
+// are converted to lower case.
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta seconds argument of the directive.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		// Reference: https://tools.ietf.org/html/rfc7234#section-1.2.1
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// age returns the current age of the entry.
+// Reference: https://tools.ietf.org/html/rfc7234#section-4.2.3
+func (e *entry) age(now time.Time) time.Duration {
+	age := e.InitialAge + now.Sub(e.ResponseTime)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// staleness returns how long the entry has been stale, it is negative if
+// the entry is still fresh.
+func (e *entry) staleness(now time.Time) time.Duration {
+	return e.age(now) - e.Lifetime
+}
+
+func (e *entry) etag() string {
+	return e.Header.Get(keyETag)
+}
+
+func (e *entry) lastModified() string {
+	return e.Header.Get(keyLastModified)
+}
+
+func (e *entry) hasValidator() bool {
+	return e.etag() != "" || e.lastModified() != ""
+}
+
+func (e *entry) size() int {
+	size := len(e.Body)
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			size += len(k) + len(v) + 4
+		}
+	}
+	return size
+}
+
+// matchVary reports whether the entry could be used for the request header.
+// Reference: https://tools.ietf.org/html/rfc7234#section-4.1
+func (e *entry) matchVary(header http.Header) bool {
+	for i, name := range e.VaryHeaders {
+		if varyValue(header, name) != e.VaryValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *entry) sameVary(other *entry) bool {
+	if len(e.VaryHeaders) != len(other.VaryHeaders) {
+		return false
+	}
+	for i := range e.VaryHeaders {
+		if e.VaryHeaders[i] != other.VaryHeaders[i] || e.VaryValues[i] != other.VaryValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// varyValue normalizes the values of a header for comparing.
+func varyValue(header http.Header, name string) string {
+	values := header.Values(name)
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseVary returns the canonical header names in Vary, and whether the
+// response varies on everything.
+func parseVary(header http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, true
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names, false
+}
+
+// matchETag reports whether the ETag matches the If-None-Match header with
+// the weak comparison.
+// Reference: https://tools.ietf.org/html/rfc7232#section-3.2
+func matchETag(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates the conditional headers of the request against the
+// entry.
+// Reference: https://tools.ietf.org/html/rfc7232#section-6
+func (e *entry) notModified(header http.Header) bool {
+	if inm := header.Get(keyIfNoneMatch); inm != "" {
+		return matchETag(inm, e.etag())
+	}
+
+	ims, ok := parseHTTPDate(header.Get(keyIfModifiedSince))
+	if !ok {
+		return false
+	}
+	lm, ok := parseHTTPDate(e.lastModified())
+	if !ok {
+		return false
+	}
+	return !lm.After(ims)
+}
+
+// clone returns a shallow copy of the entry with a deep copied header.
+func (e *entry) clone() *entry {
+	c := *e
+	c.Header = e.Header.Clone()
+	c.revalidating = 0
+	return &c
+}
+
+// updateHeader updates the stored header with the ones of a 304 response.
+// Reference: https://tools.ietf.org/html/rfc7234#section-4.3.4
+func (e *entry) updateHeader(header http.Header) {
+	for k, vs := range header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection":
+			continue
+		}
+		e.Header[k] = append([]string(nil), vs...)
+	}
+}
+
+func (i *item) size() int {
+	size := len(i.Key)
+	for _, e := range i.Entries {
+		size += e.size()
+	}
+	return size
+}
+
+// match returns the latest variant matching the request header.
+func (i *item) match(header http.Header) *entry {
+	var result *entry
+	for _, e := range i.Entries {
+		if !e.matchVary(header) {
+			continue
+		}
+		if result == nil || e.ResponseTime.After(result.ResponseTime) {
+			result = e
+		}
+	}
+	return result
+}
+
+// withEntry returns a new item with the entry replacing the variant with
+// the same vary values, variants with other vary headers are dropped.
+func (i *item) withEntry(e *entry) *item {
+	n := &item{Key: i.Key}
+	for _, old := range i.Entries {
+		if old.sameVary(e) || !sameNames(old.VaryHeaders, e.VaryHeaders) {
+			continue
+		}
+		n.Entries = append(n.Entries, old)
+	}
+	n.Entries = append(n.Entries, e)
+	return n
+}
+
+func sameNames(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
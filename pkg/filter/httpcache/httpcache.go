@@ -0,0 +1,678 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/cachepurge"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+const (
+	// Kind is the kind of HTTPCache.
+	Kind = "HTTPCache"
+
+	resultCached = "cached"
+
+	httpCacheAPIPrefix = "/httpcache/%s/%s/entries"
+
+	// 1MB
+	defaultMaxEntryBytes = 1 << 20
+)
+
+var (
+	results = []string{resultCached}
+
+	// defaultCodes are the status codes which are cacheable by default.
+	// Reference: https://tools.ietf.org/html/rfc7231#section-6.1
+	defaultCodes = []int{200, 203, 204, 300, 301, 404, 405, 410, 414, 501}
+
+	// hopByHopHeaders are not stored.
+	hopByHopHeaders = []string{
+		"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+		"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	}
+)
+
+func init() {
+	httppipeline.Register(&HTTPCache{})
+}
+
+type (
+	// HTTPCache is the filter caching responses according to RFC 7234.
+	HTTPCache struct {
+		filterSpec *httppipeline.FilterSpec
+		spec       *Spec
+
+		codes                map[int]struct{}
+		defaultTTL           time.Duration
+		maxTTL               time.Duration
+		staleWhileRevalidate time.Duration
+		staleIfError         time.Duration
+		maxEntryBytes        int
+
+		storage *storage
+		watcher *cachepurge.Watcher
+
+		hits        uint64
+		misses      uint64
+		stale       uint64
+		revalidated uint64
+		stored      uint64
+	}
+
+	// Status is the status of HTTPCache.
+	Status struct {
+		Hits        uint64 `yaml:"hits"`
+		Misses      uint64 `yaml:"misses"`
+		Stale       uint64 `yaml:"stale"`
+		Revalidated uint64 `yaml:"revalidated"`
+		Stored      uint64 `yaml:"stored"`
+
+		MemoryEntries int   `yaml:"memoryEntries"`
+		MemoryBytes   int64 `yaml:"memoryBytes"`
+		DiskEntries   int   `yaml:"diskEntries"`
+		DiskBytes     int64 `yaml:"diskBytes"`
+	}
+
+	// PurgeResult is the result of the purge API.
+	PurgeResult struct {
+		Purged int `yaml:"purged"`
+	}
+)
+
+// Kind returns the kind of HTTPCache.
+func (c *HTTPCache) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of HTTPCache.
+func (c *HTTPCache) DefaultSpec() interface{} {
+	return &Spec{}
+}
+
+// Description returns the description of HTTPCache.
+func (c *HTTPCache) Description() string {
+	return "HTTPCache caches responses according to RFC 7234."
+}
+
+// Results returns the results of HTTPCache.
+func (c *HTTPCache) Results() []string {
+	return results
+}
+
+// Init initializes HTTPCache.
+func (c *HTTPCache) Init(filterSpec *httppipeline.FilterSpec) {
+	c.filterSpec, c.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	c.reload()
+}
+
+// Inherit inherits previous generation of HTTPCache.
+func (c *HTTPCache) Inherit(filterSpec *httppipeline.FilterSpec, previousGeneration httppipeline.Filter) {
+	previousGeneration.Close()
+	c.Init(filterSpec)
+}
+
+func parseDuration(name, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Errorf("BUG: parse %s %s failed: %v", name, value, err)
+		return 0
+	}
+	return d
+}
+
+func (c *HTTPCache) reload() {
+	codes := c.spec.Codes
+	if len(codes) == 0 {
+		codes = defaultCodes
+	}
+	c.codes = map[int]struct{}{}
+	for _, code := range codes {
+		c.codes[code] = struct{}{}
+	}
+
+	c.defaultTTL = parseDuration("defaultTTL", c.spec.DefaultTTL)
+	c.maxTTL = parseDuration("maxTTL", c.spec.MaxTTL)
+	c.staleWhileRevalidate = parseDuration("staleWhileRevalidate", c.spec.StaleWhileRevalidate)
+	c.staleIfError = parseDuration("staleIfError", c.spec.StaleIfError)
+
+	c.maxEntryBytes = defaultMaxEntryBytes
+	if c.spec.MaxEntryBytes > 0 {
+		c.maxEntryBytes = int(c.spec.MaxEntryBytes)
+	}
+
+	c.storage = newStorage(c.spec.Memory, c.spec.Disk)
+
+	// NOTE: The filter spec has no supervisor when the filter is not
+	// created by a pipeline, there is no admin API for it.
+	if c.filterSpec.Super() != nil {
+		c.registerAPIs()
+		c.watcher = cachepurge.Watch(c.filterSpec.Super().Cluster(),
+			c.filterSpec.Pipeline(), c.filterSpec.Name(), c.purgeURI)
+	}
+}
+
+func (c *HTTPCache) apiPath() string {
+	return fmt.Sprintf(httpCacheAPIPrefix, c.filterSpec.Pipeline(), c.filterSpec.Name())
+}
+
+func (c *HTTPCache) apiGroup() string {
+	return fmt.Sprintf("httpcache-%s-%s", c.filterSpec.Pipeline(), c.filterSpec.Name())
+}
+
+func (c *HTTPCache) registerAPIs() {
+	group := &api.Group{
+		Group: c.apiGroup(),
+		Entries: []*api.Entry{
+			{Path: c.apiPath(), Method: http.MethodDelete, Handler: c.httpPurgeHandler},
+		},
+	}
+
+	api.RegisterAPIs(group)
+}
+
+// httpPurgeHandler purges the entry of the key, or the entries of the
+// prefix, e.g. DELETE /apis/v1/httpcache/pipeline/filter/entries?prefix=example.com/static/
+func (c *HTTPCache) httpPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key, prefix := query.Get("key"), query.Get("prefix")
+	if (key == "") == (prefix == "") {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("one and only one of key and prefix is required"))
+		return
+	}
+
+	result := &PurgeResult{}
+	if key != "" {
+		result.Purged = c.Purge(key, false)
+	} else {
+		result.Purged = c.Purge(prefix, true)
+	}
+
+	buff, err := yaml.Marshal(result)
+	if err != nil {
+		panic(fmt.Errorf("marshal %#v to yaml failed: %v", result, err))
+	}
+	w.Write(buff)
+}
+
+// Purge removes the cached responses of the key, or of all keys beginning
+// with the key if prefix is true. It returns the number of removed keys.
+func (c *HTTPCache) Purge(key string, prefix bool) int {
+	return c.storage.purge(key, prefix)
+}
+
+// Handle caches the responses of the requests or responds them from cache.
+func (c *HTTPCache) Handle(ctx context.HTTPContext) string {
+	return c.handle(ctx)
+}
+
+// baseKey returns the part of the cache key from the URI of the request.
+func (c *HTTPCache) baseKey(ctx context.HTTPContext) string {
+	r := ctx.Request()
+	ks := c.spec.Key
+	if ks == nil {
+		ks = &KeySpec{}
+	}
+
+	var buff strings.Builder
+	if !ks.IgnoreHost {
+		buff.WriteString(strings.ToLower(r.Host()))
+	}
+	buff.WriteString(r.Path())
+
+	if !ks.IgnoreQuery && r.Query() != "" {
+		query, err := url.ParseQuery(r.Query())
+		if err == nil && len(ks.QueryParams) > 0 {
+			picked := url.Values{}
+			for _, name := range ks.QueryParams {
+				if values, ok := query[name]; ok {
+					picked[name] = values
+				}
+			}
+			query = picked
+		}
+		// NOTE: Encode sorts the parameters by name.
+		if q := query.Encode(); q != "" {
+			buff.WriteString("?")
+			buff.WriteString(q)
+		}
+	}
+
+	return buff.String()
+}
+
+// key returns the cache key of the request, it begins with the base key
+// and is followed by the configured headers and cookies.
+func (c *HTTPCache) key(ctx context.HTTPContext) string {
+	key := c.baseKey(ctx)
+	ks := c.spec.Key
+	if ks == nil || (len(ks.Headers) == 0 && len(ks.Cookies) == 0) {
+		return key
+	}
+
+	r := ctx.Request()
+	parts := []string{key}
+	for _, name := range ks.Headers {
+		parts = append(parts, stringtool.Cat(http.CanonicalHeaderKey(name), "=", r.Header().Get(name)))
+	}
+	for _, name := range ks.Cookies {
+		value := ""
+		if cookie, err := r.Cookie(name); err == nil {
+			value = cookie.Value
+		}
+		parts = append(parts, stringtool.Cat("cookie:", name, "=", value))
+	}
+	return strings.Join(parts, "|")
+}
+
+// invalidate removes all cached responses of the URI of the request.
+// Reference: https://tools.ietf.org/html/rfc7234#section-4.4
+func (c *HTTPCache) invalidate(ctx context.HTTPContext) {
+	c.purgeURI(c.baseKey(ctx), false)
+}
+
+// purgeURI removes the cached responses of the base key, including the
+// ones with headers and cookies in their keys, or all cached responses
+// whose keys begin with the base key if prefix is true.
+func (c *HTTPCache) purgeURI(key string, prefix bool) int {
+	if prefix {
+		return c.storage.purge(key, true)
+	}
+	return c.storage.purge(key, false) + c.storage.purge(key+"|", true)
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+func (c *HTTPCache) handle(ctx context.HTTPContext) string {
+	r := ctx.Request()
+
+	if !isSafeMethod(r.Method()) {
+		result := ctx.CallNextHandler("")
+		if code := ctx.Response().StatusCode(); result == "" && code < 400 {
+			c.invalidate(ctx)
+		}
+		return result
+	}
+
+	header := r.Header().Std()
+	reqCC := parseCacheControl(header.Values(httpheader.KeyCacheControl))
+	if reqCC.has("no-store") {
+		return ctx.CallNextHandler("")
+	}
+
+	// The conditional headers of the client are evaluated against the
+	// cached response, as they may be replaced during revalidation.
+	conds := http.Header{}
+	for _, k := range []string{keyIfNoneMatch, keyIfModifiedSince} {
+		if v := header.Get(k); v != "" {
+			conds.Set(k, v)
+		}
+	}
+
+	now := time.Now()
+	key := c.key(ctx)
+
+	var e *entry
+	if it := c.storage.get(key); it != nil {
+		e = it.match(header)
+	}
+
+	noCache := reqCC.has("no-cache") || (len(reqCC) == 0 && header.Get(keyPragma) == "no-cache")
+	if e != nil && !noCache && c.usable(e, reqCC, now) {
+		atomic.AddUint64(&c.hits, 1)
+		ctx.AddTag("httpCache: hit")
+		c.serve(ctx, e, conds, now)
+		return ctx.CallNextHandler(resultCached)
+	}
+
+	revalidating := false
+	if e != nil && !noCache && !e.MustRevalidate {
+		staleness := e.staleness(now)
+		if staleness <= e.StaleWhileRevalidate {
+			if !atomic.CompareAndSwapInt32(&e.revalidating, 0, 1) {
+				// Another request is revalidating the entry.
+				atomic.AddUint64(&c.stale, 1)
+				ctx.AddTag("httpCache: stale while revalidate")
+				c.serve(ctx, e, conds, now)
+				return ctx.CallNextHandler(resultCached)
+			}
+			revalidating = true
+		}
+	}
+
+	conditional := false
+	if e != nil && e.hasValidator() {
+		conditional = true
+		header.Del(keyIfNoneMatch)
+		header.Del(keyIfModifiedSince)
+		if etag := e.etag(); etag != "" {
+			header.Set(keyIfNoneMatch, etag)
+		}
+		if lm := e.lastModified(); lm != "" {
+			header.Set(keyIfModifiedSince, lm)
+		}
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	requestTime := time.Now()
+	result := ctx.CallNextHandler("")
+	responseTime := time.Now()
+
+	if revalidating {
+		atomic.StoreInt32(&e.revalidating, 0)
+	}
+
+	w := ctx.Response()
+	if conditional && result == "" && w.StatusCode() == http.StatusNotModified {
+		discardBody(w)
+
+		ne := e.clone()
+		ne.updateHeader(w.Header().Std())
+		c.refresh(ne, requestTime, responseTime)
+		c.storage.put(c.itemOf(key).withEntry(ne))
+
+		atomic.AddUint64(&c.revalidated, 1)
+		ctx.AddTag("httpCache: revalidated")
+		c.serve(ctx, ne, conds, responseTime)
+		return result
+	}
+
+	if e != nil && (result != "" || w.StatusCode() >= 500) {
+		if e.staleness(responseTime) <= e.StaleIfError && !e.MustRevalidate {
+			discardBody(w)
+			atomic.AddUint64(&c.stale, 1)
+			ctx.AddTag("httpCache: stale if error")
+			c.serve(ctx, e, conds, responseTime)
+			return result
+		}
+	}
+
+	if r.Method() == http.MethodGet && result == "" {
+		c.store(ctx, key, reqCC, requestTime, responseTime)
+	}
+
+	return result
+}
+
+// usable reports whether the entry could be served without revalidation.
+// Reference: https://tools.ietf.org/html/rfc7234#section-4.2.4
+func (c *HTTPCache) usable(e *entry, reqCC cacheControl, now time.Time) bool {
+	age := e.age(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	fresh := e.Lifetime - age
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && fresh < minFresh {
+		return false
+	}
+	if fresh > 0 {
+		return true
+	}
+
+	if e.MustRevalidate || !reqCC.has("max-stale") {
+		return false
+	}
+	maxStale, ok := reqCC.seconds("max-stale")
+	return !ok || -fresh <= maxStale
+}
+
+func (c *HTTPCache) itemOf(key string) *item {
+	if it := c.storage.get(key); it != nil {
+		return it
+	}
+	return &item{Key: key}
+}
+
+func discardBody(w context.HTTPResponse) {
+	body := w.Body()
+	if body == nil {
+		return
+	}
+	io.Copy(io.Discard, body)
+	if closer, ok := body.(io.Closer); ok {
+		closer.Close()
+	}
+	w.SetBody(nil)
+}
+
+// serve writes the entry to the response.
+func (c *HTTPCache) serve(ctx context.HTTPContext, e *entry, conds http.Header, now time.Time) {
+	w := ctx.Response()
+	header := w.Header().Std()
+	for k, vs := range e.Header {
+		header[k] = append([]string(nil), vs...)
+	}
+	header.Set(keyAge, strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+
+	if e.notModified(conds) {
+		header.Del(httpheader.KeyContentLength)
+		w.SetStatusCode(http.StatusNotModified)
+		w.SetBody(nil)
+		return
+	}
+
+	w.SetStatusCode(e.StatusCode)
+	w.SetBody(bytes.NewReader(e.Body))
+}
+
+// refresh calculates the freshness of the entry from its header.
+// Reference: https://tools.ietf.org/html/rfc7234#section-4.2
+func (c *HTTPCache) refresh(e *entry, requestTime, responseTime time.Time) {
+	header := e.Header
+	cc := parseCacheControl(header.Values(httpheader.KeyCacheControl))
+
+	date, ok := parseHTTPDate(header.Get(keyDate))
+	if !ok {
+		date = responseTime
+	}
+
+	apparentAge := responseTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue, _ := parseCacheControl([]string{"age=" + header.Get(keyAge)}).seconds("age")
+	// The age is calculated when the entry is served.
+	header.Del(keyAge)
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+
+	e.ResponseTime = responseTime
+	e.InitialAge = correctedAge
+	e.Lifetime = c.lifetime(header, cc, date)
+
+	e.MustRevalidate = cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("no-cache")
+	if e.MustRevalidate {
+		e.Lifetime, e.StaleWhileRevalidate, e.StaleIfError = 0, 0, 0
+		return
+	}
+
+	e.StaleWhileRevalidate = c.staleWhileRevalidate
+	if d, ok := cc.seconds("stale-while-revalidate"); ok {
+		e.StaleWhileRevalidate = d
+	}
+	e.StaleIfError = c.staleIfError
+	if d, ok := cc.seconds("stale-if-error"); ok {
+		e.StaleIfError = d
+	}
+}
+
+// lifetime returns the freshness lifetime of a response.
+func (c *HTTPCache) lifetime(header http.Header, cc cacheControl, date time.Time) time.Duration {
+	lifetime := time.Duration(0)
+
+	if d, ok := cc.seconds("s-maxage"); ok {
+		lifetime = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		lifetime = d
+	} else if v := header.Get(keyExpires); v != "" {
+		// An invalid Expires means already expired.
+		if expires, ok := parseHTTPDate(v); ok && expires.After(date) {
+			lifetime = expires.Sub(date)
+		}
+	} else if c.defaultTTL > 0 {
+		lifetime = c.defaultTTL
+	} else if lm, ok := parseHTTPDate(header.Get(keyLastModified)); ok && date.After(lm) {
+		lifetime = date.Sub(lm) / heuristicFraction
+	}
+
+	if c.maxTTL > 0 && lifetime > c.maxTTL {
+		lifetime = c.maxTTL
+	}
+	return lifetime
+}
+
+// storable reports whether the response could be stored.
+// Reference: https://tools.ietf.org/html/rfc7234#section-3
+func (c *HTTPCache) storable(ctx context.HTTPContext, reqCC, respCC cacheControl) bool {
+	w := ctx.Response()
+	if _, ok := c.codes[w.StatusCode()]; !ok {
+		return false
+	}
+
+	// Streaming responses may never end.
+	if w.Streaming() {
+		return false
+	}
+
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+
+	// NOTE: Responses setting cookies are for a specific client.
+	if w.Header().Get(keySetCookie) != "" {
+		return false
+	}
+
+	// Reference: https://tools.ietf.org/html/rfc7234#section-3.2
+	if ctx.Request().Header().Get(keyAuthorization) != "" {
+		if !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *HTTPCache) store(ctx context.HTTPContext, key string, reqCC cacheControl, requestTime, responseTime time.Time) {
+	w := ctx.Response()
+	respHeader := w.Header().Std()
+	respCC := parseCacheControl(respHeader.Values(httpheader.KeyCacheControl))
+	if !c.storable(ctx, reqCC, respCC) {
+		return
+	}
+
+	varyHeaders, varyAll := parseVary(respHeader)
+	if varyAll {
+		return
+	}
+	sort.Strings(varyHeaders)
+
+	reqHeader := ctx.Request().Header().Std()
+	e := &entry{
+		StatusCode:  w.StatusCode(),
+		Header:      respHeader.Clone(),
+		VaryHeaders: varyHeaders,
+		VaryValues:  make([]string, len(varyHeaders)),
+	}
+	for i, name := range varyHeaders {
+		e.VaryValues[i] = varyValue(reqHeader, name)
+	}
+	for _, k := range hopByHopHeaders {
+		e.Header.Del(k)
+	}
+
+	c.refresh(e, requestTime, responseTime)
+	if e.Lifetime <= 0 && !e.hasValidator() {
+		return
+	}
+
+	save := func() {
+		c.storage.put(c.itemOf(key).withEntry(e))
+		atomic.AddUint64(&c.stored, 1)
+		ctx.AddTag("httpCache: stored")
+	}
+
+	if w.Body() == nil {
+		save()
+		return
+	}
+
+	exceeded := false
+	w.OnFlushBody(func(body []byte, complete bool) []byte {
+		if exceeded {
+			return body
+		}
+		if len(e.Body)+len(body) > c.maxEntryBytes {
+			exceeded, e.Body = true, nil
+			return body
+		}
+
+		e.Body = append(e.Body, body...)
+		if complete {
+			save()
+		}
+		return body
+	})
+}
+
+// Status returns status.
+func (c *HTTPCache) Status() interface{} {
+	s := &Status{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Stale:       atomic.LoadUint64(&c.stale),
+		Revalidated: atomic.LoadUint64(&c.revalidated),
+		Stored:      atomic.LoadUint64(&c.stored),
+	}
+	c.storage.status(s)
+	return s
+}
+
+// Close closes HTTPCache.
+func (c *HTTPCache) Close() {
+	if c.filterSpec.Super() != nil {
+		api.UnregisterAPIs(c.apiGroup())
+		c.watcher.Close()
+	}
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/yamltool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newHTTPCache(t *testing.T, yamlSpec string) *HTTPCache {
+	rawSpec := make(map[string]interface{})
+	yamltool.Unmarshal([]byte(yamlSpec), &rawSpec)
+
+	spec, err := httppipeline.NewFilterSpec(rawSpec, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := &HTTPCache{}
+	c.Init(spec)
+	return c
+}
+
+// upstream simulates the filters after HTTPCache.
+type upstream struct {
+	calls  int
+	header http.Header
+	handle func(ctx context.HTTPContext)
+}
+
+func (u *upstream) do(c *HTTPCache, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx := context.New(w, req, tracing.NoopTracing, "")
+	ctx.SetHandlerCaller(func(lastResult string) string {
+		if lastResult != "" {
+			return lastResult
+		}
+		u.calls++
+		u.header = ctx.Request().Header().Std().Clone()
+		u.handle(ctx)
+		return ""
+	})
+
+	c.Handle(ctx)
+	ctx.Finish()
+	return w
+}
+
+func respond(code int, body string, header ...string) func(ctx context.HTTPContext) {
+	return func(ctx context.HTTPContext) {
+		w := ctx.Response()
+		w.SetStatusCode(code)
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Add(header[i], header[i+1])
+		}
+		if body != "" {
+			w.SetBody(strings.NewReader(body))
+		}
+	}
+}
+
+func newRequest(method, url string, header ...string) *http.Request {
+	req := httptest.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return req
+}
+
+// makeStale moves the response time of all entries of the key backward.
+func makeStale(c *HTTPCache, key string, d time.Duration) {
+	for _, e := range c.storage.get(key).Entries {
+		e.ResponseTime = e.ResponseTime.Add(-d)
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl([]string{`max-age=60, Private, no-cache="Set-Cookie"`, "s-maxage=abc"})
+	if d, ok := cc.seconds("max-age"); !ok || d != time.Minute {
+		t.Errorf("unexpected max-age %v", d)
+	}
+	if !cc.has("private") || cc["no-cache"] != "Set-Cookie" {
+		t.Errorf("unexpected directives %v", cc)
+	}
+	if _, ok := cc.seconds("s-maxage"); ok {
+		t.Errorf("invalid s-maxage should be ignored")
+	}
+}
+
+func TestHitAndVary(t *testing.T) {
+	c := newHTTPCache(t, `
+name: cache
+kind: HTTPCache
+`)
+	u := &upstream{handle: respond(200, "hello", "Cache-Control", "max-age=60", "Vary", "Accept-Encoding")}
+
+	w := u.do(c, newRequest("GET", "http://example.com/a?y=2&x=1", "Accept-Encoding", "gzip"))
+	if w.Code != 200 || w.Body.String() != "hello" || u.calls != 1 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	w = u.do(c, newRequest("GET", "http://example.com/a?x=1&y=2", "Accept-Encoding", "gzip"))
+	if w.Body.String() != "hello" || u.calls != 1 {
+		t.Errorf("response should be served from cache")
+	}
+	if w.Header().Get("Age") == "" {
+		t.Errorf("age header should be set")
+	}
+
+	w = u.do(c, newRequest("HEAD", "http://example.com/a?x=1&y=2", "Accept-Encoding", "gzip"))
+	if w.Code != 200 || u.calls != 1 {
+		t.Errorf("head request should be served from cache")
+	}
+
+	u.do(c, newRequest("GET", "http://example.com/a?x=1&y=2", "Accept-Encoding", "br"))
+	if u.calls != 2 {
+		t.Errorf("request with other vary values should not be served from cache")
+	}
+
+	u.do(c, newRequest("GET", "http://example.com/a?x=1&y=2", "Accept-Encoding", "gzip", "Cache-Control", "no-cache"))
+	if u.calls != 3 {
+		t.Errorf("request with no-cache should not be served from cache")
+	}
+
+	status := c.Status().(*Status)
+	if status.Hits != 2 || status.MemoryEntries != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestNotStored(t *testing.T) {
+	c := newHTTPCache(t, `
+name: cache
+kind: HTTPCache
+`)
+
+	cases := []struct {
+		req    *http.Request
+		handle func(ctx context.HTTPContext)
+	}{
+		{newRequest("GET", "http://example.com/1"), respond(200, "x", "Cache-Control", "no-store, max-age=60")},
+		{newRequest("GET", "http://example.com/2"), respond(200, "x", "Cache-Control", "private, max-age=60")},
+		{newRequest("GET", "http://example.com/3"), respond(200, "x", "Cache-Control", "max-age=60", "Set-Cookie", "a=b")},
+		{newRequest("GET", "http://example.com/4"), respond(200, "x")},
+		{newRequest("GET", "http://example.com/5"), respond(500, "x", "Cache-Control", "max-age=60")},
+		{newRequest("GET", "http://example.com/6", "Authorization", "token"), respond(200, "x", "Cache-Control", "max-age=60")},
+		{newRequest("GET", "http://example.com/7", "Cache-Control", "no-store"), respond(200, "x", "Cache-Control", "max-age=60")},
+		{newRequest("GET", "http://example.com/8"), respond(200, "x", "Cache-Control", "max-age=60", "Vary", "*")},
+	}
+
+	for i, cs := range cases {
+		u := &upstream{handle: cs.handle}
+		u.do(c, cs.req)
+		u.do(c, cs.req.Clone(cs.req.Context()))
+		if u.calls != 2 {
+			t.Errorf("case %d: response should not be stored", i)
+		}
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	c := newHTTPCache(t, `
+name: cache
+kind: HTTPCache
+`)
+
+	u := &upstream{}
+	u.handle = func(ctx context.HTTPContext) {
+		if ctx.Request().Header().Get("If-None-Match") == `"v1"` {
+			respond(304, "", "Cache-Control", "max-age=60", "X-Updated", "true")(ctx)
+			return
+		}
+		respond(200, "hello", "Etag", `"v1"`, "Cache-Control", "no-cache")(ctx)
+	}
+
+	u.do(c, newRequest("GET", "http://example.com/"))
+	w := u.do(c, newRequest("GET", "http://example.com/"))
+	if u.calls != 2 || u.header.Get("If-None-Match") != `"v1"` {
+		t.Fatalf("request should be revalidated")
+	}
+	if w.Code != 200 || w.Body.String() != "hello" || w.Header().Get("X-Updated") != "true" {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	// The 304 response makes the entry fresh.
+	w = u.do(c, newRequest("GET", "http://example.com/", "If-None-Match", `W/"v1"`))
+	if u.calls != 2 || w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("client should get 304 from cache, got %d", w.Code)
+	}
+
+	if c.Status().(*Status).Revalidated != 1 {
+		t.Errorf("unexpected status %+v", c.Status())
+	}
+}
+
+func TestStale(t *testing.T) {
+	c := newHTTPCache(t, `
+name: cache
+kind: HTTPCache
+staleIfError: 1m
+`)
+
+	u := &upstream{handle: respond(200, "hello", "Cache-Control", "max-age=1, stale-while-revalidate=30")}
+	u.do(c, newRequest("GET", "http://example.com/"))
+	makeStale(c, "example.com/", 10*time.Second)
+
+	// Simulate another request revalidating the entry.
+	e := c.storage.get("example.com/").Entries[0]
+	e.revalidating = 1
+	w := u.do(c, newRequest("GET", "http://example.com/"))
+	if u.calls != 1 || w.Body.String() != "hello" {
+		t.Errorf("stale response should be served while revalidating")
+	}
+	e.revalidating = 0
+
+	u.handle = respond(503, "unavailable")
+	w = u.do(c, newRequest("GET", "http://example.com/"))
+	if u.calls != 2 || w.Code != 200 || w.Body.String() != "hello" {
+		t.Errorf("stale response should be served if error, got %d %s", w.Code, w.Body.String())
+	}
+
+	makeStale(c, "example.com/", 2*time.Minute)
+	w = u.do(c, newRequest("GET", "http://example.com/"))
+	if w.Code != 503 {
+		t.Errorf("too stale response should not be served, got %d", w.Code)
+	}
+}
+
+func TestKeyAndInvalidate(t *testing.T) {
+	c := newHTTPCache(t, `
+name: cache
+kind: HTTPCache
+key:
+  queryParams: [id]
+  headers: [X-Tenant]
+  cookies: [lang]
+`)
+
+	req := newRequest("GET", "http://Example.com/item?id=1&t=123", "X-Tenant", "megaease")
+	req.AddCookie(&http.Cookie{Name: "lang", Value: "en"})
+	ctx := context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+	if key := c.key(ctx); key != "example.com/item?id=1|X-Tenant=megaease|cookie:lang=en" {
+		t.Errorf("unexpected key %s", key)
+	}
+
+	u := &upstream{handle: respond(200, "hello", "Cache-Control", "max-age=60")}
+	u.do(c, newRequest("GET", "http://example.com/item?id=1", "X-Tenant", "a"))
+	u.do(c, newRequest("GET", "http://example.com/item?id=1", "X-Tenant", "b"))
+	if c.Status().(*Status).MemoryEntries != 2 {
+		t.Fatalf("unexpected status %+v", c.Status())
+	}
+
+	u.handle = respond(204, "")
+	u.do(c, newRequest("PUT", "http://example.com/item?id=1"))
+	if c.Status().(*Status).MemoryEntries != 0 {
+		t.Errorf("entries should be invalidated by unsafe methods")
+	}
+}
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+	s := newStorage(&MemorySpec{MaxEntries: 1}, &DiskSpec{Dir: dir, MaxBytes: 1 << 20})
+
+	newItem := func(key string) *item {
+		return &item{Key: key, Entries: []*entry{{StatusCode: 200, Header: http.Header{}, Body: []byte(key)}}}
+	}
+
+	s.put(newItem("example.com/static/a"))
+	s.put(newItem("example.com/static/b"))
+	s.put(newItem("example.com/c"))
+
+	status := &Status{}
+	s.status(status)
+	if status.MemoryEntries != 1 || status.DiskEntries != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	it := s.get("example.com/static/a")
+	if it == nil || string(it.Entries[0].Body) != "example.com/static/a" {
+		t.Fatalf("item should be loaded from disk")
+	}
+
+	// A new storage loads the items on disk.
+	s = newStorage(&MemorySpec{MaxEntries: 1}, &DiskSpec{Dir: dir, MaxBytes: 1 << 20})
+	s.status(status)
+	if status.DiskEntries != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if n := s.purge("example.com/static/", true); n != 1 {
+		t.Errorf("want 1 item purged, got %d", n)
+	}
+	if n := s.purge("example.com/c", false); n != 1 {
+		t.Errorf("want 1 item purged, got %d", n)
+	}
+	if s.get("example.com/c") != nil {
+		t.Errorf("item should be purged")
+	}
+}
+
+func TestStorageConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	s := newStorage(&MemorySpec{MaxEntries: 2}, &DiskSpec{Dir: dir, MaxBytes: 1 << 20})
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("example.com/%d", j%5)
+				s.put(&item{Key: key, Entries: []*entry{{StatusCode: 200, Header: http.Header{}, Body: []byte(key)}}})
+				if it := s.get(key); it != nil && string(it.Entries[0].Body) != key {
+					t.Errorf("unexpected item of key %s", key)
+				}
+				if j%10 == i {
+					s.purge(key, false)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	status := &Status{}
+	s.status(status)
+	files, _ := os.ReadDir(dir)
+	if len(files) != status.DiskEntries {
+		t.Errorf("want %d files, got %d", status.DiskEntries, len(files))
+	}
+}
+
+func TestStoragePurgeConcurrency(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		dir := t.TempDir()
+		s := newStorage(&MemorySpec{MaxEntries: 1}, &DiskSpec{Dir: dir, MaxBytes: 1 << 20})
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("example.com/%d", i)
+			s.put(&item{Key: key, Entries: []*entry{{StatusCode: 200, Header: http.Header{}, Body: []byte(key)}}})
+		}
+
+		// Gets promote items from disk and spill others, the purge runs
+		// in the middle of them and must leave nothing behind.
+		var stop int32
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := i; atomic.LoadInt32(&stop) == 0; j++ {
+					s.get(fmt.Sprintf("example.com/%d", j%5))
+				}
+			}(i)
+		}
+		time.Sleep(time.Millisecond)
+		s.purge("example.com/", true)
+		atomic.StoreInt32(&stop, 1)
+		wg.Wait()
+
+		status := &Status{}
+		s.status(status)
+		if status.MemoryEntries != 0 || status.DiskEntries != 0 {
+			t.Fatalf("round %d: purged items are left, memory: %d, disk: %d",
+				round, status.MemoryEntries, status.DiskEntries)
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("round %d: want no files, got %d", round, len(files))
+		}
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	spec := Spec{DefaultTTL: "1h", MaxTTL: "1m"}
+	if spec.Validate() == nil {
+		t.Errorf("defaultTTL greater than maxTTL should be invalid")
+	}
+
+	spec = Spec{Key: &KeySpec{IgnoreQuery: true, QueryParams: []string{"id"}}}
+	if spec.Validate() == nil {
+		t.Errorf("queryParams with ignoreQuery should be invalid")
+	}
+}
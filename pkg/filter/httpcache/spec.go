@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// Spec describes the HTTPCache.
+	Spec struct {
+		// Codes are the status codes of responses which could be stored.
+		Codes []int `yaml:"codes,omitempty" jsonschema:"omitempty,uniqueItems=true,format=httpcode-array"`
+		// DefaultTTL is the freshness lifetime of responses without explicit
+		// expiration, such responses are only stored with validators if
+		// it is empty.
+		DefaultTTL string `yaml:"defaultTTL,omitempty" jsonschema:"omitempty,format=duration"`
+		// MaxTTL caps the freshness lifetime of all responses.
+		MaxTTL string `yaml:"maxTTL,omitempty" jsonschema:"omitempty,format=duration"`
+		// StaleWhileRevalidate and StaleIfError are used when responses
+		// don't carry the corresponding Cache-Control extensions.
+		StaleWhileRevalidate string `yaml:"staleWhileRevalidate,omitempty" jsonschema:"omitempty,format=duration"`
+		StaleIfError         string `yaml:"staleIfError,omitempty" jsonschema:"omitempty,format=duration"`
+		MaxEntryBytes        uint32 `yaml:"maxEntryBytes,omitempty" jsonschema:"omitempty,minimum=1"`
+
+		Key    *KeySpec    `yaml:"key,omitempty" jsonschema:"omitempty"`
+		Memory *MemorySpec `yaml:"memory,omitempty" jsonschema:"omitempty"`
+		Disk   *DiskSpec   `yaml:"disk,omitempty" jsonschema:"omitempty"`
+	}
+
+	// KeySpec describes how to build the cache key of a request, the key
+	// is the host, the path and the query by default.
+	KeySpec struct {
+		IgnoreHost  bool `yaml:"ignoreHost,omitempty" jsonschema:"omitempty"`
+		IgnoreQuery bool `yaml:"ignoreQuery,omitempty" jsonschema:"omitempty"`
+		// QueryParams are the only query parameters in the key if not empty.
+		QueryParams []string `yaml:"queryParams,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		Headers     []string `yaml:"headers,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		Cookies     []string `yaml:"cookies,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	}
+
+	// MemorySpec describes the in-memory tier of the cache.
+	MemorySpec struct {
+		MaxEntries uint32 `yaml:"maxEntries,omitempty" jsonschema:"omitempty,minimum=1"`
+		MaxBytes   int64  `yaml:"maxBytes,omitempty" jsonschema:"omitempty,minimum=1"`
+	}
+
+	// DiskSpec describes the on-disk tier of the cache, entries evicted
+	// from memory are moved to it.
+	DiskSpec struct {
+		Dir      string `yaml:"dir" jsonschema:"required"`
+		MaxBytes int64  `yaml:"maxBytes" jsonschema:"required,minimum=1"`
+	}
+)
+
+// Validate validates Spec.
+func (spec Spec) Validate() error {
+	if spec.DefaultTTL != "" && spec.MaxTTL != "" {
+		defaultTTL, _ := time.ParseDuration(spec.DefaultTTL)
+		maxTTL, _ := time.ParseDuration(spec.MaxTTL)
+		if defaultTTL > maxTTL {
+			return fmt.Errorf("defaultTTL %s is greater than maxTTL %s", spec.DefaultTTL, spec.MaxTTL)
+		}
+	}
+
+	if spec.Key != nil && spec.Key.IgnoreQuery && len(spec.Key.QueryParams) > 0 {
+		return fmt.Errorf("key.queryParams is configured when key.ignoreQuery is true")
+	}
+
+	return nil
+}
@@ -0,0 +1,456 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpcache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const (
+	defaultMaxEntries = 10000
+	defaultMaxBytes   = 64 << 20
+
+	diskFileSuffix = ".cache"
+)
+
+type (
+	// storage is a size bounded LRU cache in memory, with an optional
+	// tier on disk for the items evicted from memory. An item lives in
+	// at most one of the tiers.
+	storage struct {
+		mutex sync.Mutex
+
+		maxEntries int
+		maxBytes   int64
+		bytes      int64
+		lru        *list.List
+		items      map[string]*list.Element
+
+		// purgeGen is increased by every purge, the items taken out of
+		// the tiers for the I/O without holding the lock are dropped if
+		// it changed meanwhile, so that a purge never misses them.
+		purgeGen uint64
+
+		disk *diskTier
+	}
+
+	memoryRecord struct {
+		item *item
+		size int64
+	}
+
+	diskTier struct {
+		seq      uint64
+		dir      string
+		maxBytes int64
+		bytes    int64
+		lru      *list.List
+		records  map[string]*list.Element
+	}
+
+	diskRecord struct {
+		key  string
+		file string
+		size int64
+	}
+)
+
+func newStorage(memory *MemorySpec, disk *DiskSpec) *storage {
+	s := &storage{
+		maxEntries: defaultMaxEntries,
+		maxBytes:   defaultMaxBytes,
+		lru:        list.New(),
+		items:      map[string]*list.Element{},
+	}
+
+	if memory != nil {
+		if memory.MaxEntries > 0 {
+			s.maxEntries = int(memory.MaxEntries)
+		}
+		if memory.MaxBytes > 0 {
+			s.maxBytes = memory.MaxBytes
+		}
+	}
+
+	if disk != nil {
+		dt, err := newDiskTier(disk)
+		if err != nil {
+			logger.Errorf("create disk tier of http cache failed, only memory is used: %v", err)
+		} else {
+			s.disk = dt
+		}
+	}
+
+	return s
+}
+
+func (s *storage) get(key string) *item {
+	s.mutex.Lock()
+	if elem, ok := s.items[key]; ok {
+		s.lru.MoveToFront(elem)
+		s.mutex.Unlock()
+		return elem.Value.(*memoryRecord).item
+	}
+
+	var record *diskRecord
+	if s.disk != nil {
+		record = s.disk.detach(key)
+	}
+	gen := s.purgeGen
+	s.mutex.Unlock()
+
+	if record == nil {
+		return nil
+	}
+
+	// NOTE: The record has been detached from the disk tier, so nobody
+	// else touches the file, and it is read without holding the lock.
+	it, _, err := readItem(record.file)
+	removeFile(record.file)
+	if err != nil {
+		logger.Warnf("read http cache file %s failed: %v", record.file, err)
+		return nil
+	}
+
+	// Promote the item to memory, unless a newer one was put or the
+	// cache was purged meanwhile.
+	s.mutex.Lock()
+	if elem, ok := s.items[key]; ok {
+		s.mutex.Unlock()
+		return elem.Value.(*memoryRecord).item
+	}
+	if s.purgeGen != gen {
+		s.mutex.Unlock()
+		return nil
+	}
+	spilled := s.putLocked(it)
+	gen = s.purgeGen
+	s.mutex.Unlock()
+
+	s.spill(spilled, gen)
+	return it
+}
+
+func (s *storage) put(it *item) {
+	s.mutex.Lock()
+	var stale *diskRecord
+	if s.disk != nil {
+		stale = s.disk.detach(it.Key)
+	}
+	spilled := s.putLocked(it)
+	gen := s.purgeGen
+	s.mutex.Unlock()
+
+	if stale != nil {
+		removeFile(stale.file)
+	}
+	s.spill(spilled, gen)
+}
+
+// putLocked puts the item to memory, it returns the items evicted from
+// memory which should be spilled to disk.
+func (s *storage) putLocked(it *item) []*item {
+	if elem, ok := s.items[it.Key]; ok {
+		s.removeElement(elem)
+	}
+
+	record := &memoryRecord{item: it, size: int64(it.size())}
+	s.items[it.Key] = s.lru.PushFront(record)
+	s.bytes += record.size
+
+	var spilled []*item
+	for s.lru.Len() > s.maxEntries || (s.bytes > s.maxBytes && s.lru.Len() > 1) {
+		elem := s.lru.Back()
+		s.removeElement(elem)
+		if s.disk != nil {
+			spilled = append(spilled, elem.Value.(*memoryRecord).item)
+		}
+	}
+	return spilled
+}
+
+// spill writes the items evicted from memory to the disk tier, gen is
+// the purgeGen when they were evicted. It must be called without holding
+// the lock, since it does the disk I/O.
+func (s *storage) spill(items []*item, gen uint64) {
+	for _, it := range items {
+		record := s.disk.write(it)
+		if record == nil {
+			continue
+		}
+
+		s.mutex.Lock()
+		var removed []*diskRecord
+		if _, ok := s.items[it.Key]; ok {
+			// The key was put to memory again while writing the file.
+			removed = append(removed, record)
+		} else if s.purgeGen != gen {
+			// The cache was purged while writing the file.
+			removed = append(removed, record)
+		} else {
+			removed = s.disk.add(record)
+		}
+		s.mutex.Unlock()
+
+		for _, r := range removed {
+			removeFile(r.file)
+		}
+	}
+}
+
+func (s *storage) removeElement(elem *list.Element) {
+	record := elem.Value.(*memoryRecord)
+	s.lru.Remove(elem)
+	delete(s.items, record.item.Key)
+	s.bytes -= record.size
+}
+
+// purge removes the item of the key, or all items whose keys begin with
+// the key if prefix is true. It returns the number of removed items.
+func (s *storage) purge(key string, prefix bool) int {
+	count := 0
+	var removed []*diskRecord
+
+	s.mutex.Lock()
+	s.purgeGen++
+	if !prefix {
+		if elem, ok := s.items[key]; ok {
+			s.removeElement(elem)
+			count++
+		}
+		if s.disk != nil {
+			if record := s.disk.detach(key); record != nil {
+				removed = append(removed, record)
+			}
+		}
+	} else {
+		for k, elem := range s.items {
+			if strings.HasPrefix(k, key) {
+				s.removeElement(elem)
+				count++
+			}
+		}
+		if s.disk != nil {
+			for k := range s.disk.records {
+				if strings.HasPrefix(k, key) {
+					removed = append(removed, s.disk.detach(k))
+				}
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, r := range removed {
+		removeFile(r.file)
+	}
+	return count + len(removed)
+}
+
+// status fills the status with the sizes of the tiers.
+func (s *storage) status(status *Status) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status.MemoryEntries = s.lru.Len()
+	status.MemoryBytes = s.bytes
+	if s.disk != nil {
+		status.DiskEntries = s.disk.lru.Len()
+		status.DiskBytes = s.disk.bytes
+	}
+}
+
+// newDiskTier creates the disk tier, and loads the items stored by the
+// previous instance.
+func newDiskTier(spec *DiskSpec) (*diskTier, error) {
+	if err := os.MkdirAll(spec.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	dt := &diskTier{
+		dir:      spec.Dir,
+		maxBytes: spec.MaxBytes,
+		lru:      list.New(),
+		records:  map[string]*list.Element{},
+		seq:      uint64(time.Now().UnixNano()),
+	}
+
+	files, err := os.ReadDir(spec.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type loaded struct {
+		record  *diskRecord
+		modTime int64
+	}
+	var records []*loaded
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), diskFileSuffix) {
+			continue
+		}
+
+		file := filepath.Join(spec.Dir, f.Name())
+		it, size, err := readItem(file)
+		if err != nil {
+			logger.Warnf("load http cache file %s failed, removed: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		records = append(records, &loaded{
+			record:  &diskRecord{key: it.Key, file: file, size: size},
+			modTime: info.ModTime().UnixNano(),
+		})
+	}
+
+	// The most recently written file is the most recently used one.
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].modTime > records[j].modTime
+	})
+	for _, l := range records {
+		if _, exists := dt.records[l.record.key]; exists {
+			// An older file of the same key left by a crash.
+			removeFile(l.record.file)
+			continue
+		}
+		dt.records[l.record.key] = dt.lru.PushBack(l.record)
+		dt.bytes += l.record.size
+	}
+	for _, r := range dt.evict() {
+		removeFile(r.file)
+	}
+
+	return dt, nil
+}
+
+// fileName returns a new file name for the key, every write of the key
+// gets a distinct file, so that writing a file never races with removing
+// the stale file of the same key.
+func (dt *diskTier) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	seq := atomic.AddUint64(&dt.seq, 1)
+	return filepath.Join(dt.dir, fmt.Sprintf("%s-%d%s", hex.EncodeToString(sum[:]), seq, diskFileSuffix))
+}
+
+func readItem(file string) (*item, int64, error) {
+	buff, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	it := &item{}
+	if err := gob.NewDecoder(bytes.NewReader(buff)).Decode(it); err != nil {
+		return nil, 0, err
+	}
+	return it, int64(len(buff)), nil
+}
+
+// write writes the item to a new file, it returns nil if the item is not
+// written. It only does the I/O, the record is added by add.
+func (dt *diskTier) write(it *item) *diskRecord {
+	buff := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buff).Encode(it); err != nil {
+		logger.Errorf("BUG: encode http cache item %s failed: %v", it.Key, err)
+		return nil
+	}
+	if int64(buff.Len()) > dt.maxBytes {
+		return nil
+	}
+
+	file := dt.fileName(it.Key)
+	if err := writeFile(file, buff.Bytes()); err != nil {
+		logger.Warnf("write http cache file %s failed: %v", file, err)
+		return nil
+	}
+
+	return &diskRecord{key: it.Key, file: file, size: int64(buff.Len())}
+}
+
+// add adds the record to the tier, it returns the detached records whose
+// files should be removed.
+func (dt *diskTier) add(record *diskRecord) []*diskRecord {
+	var removed []*diskRecord
+	if stale := dt.detach(record.key); stale != nil {
+		removed = append(removed, stale)
+	}
+
+	dt.records[record.key] = dt.lru.PushFront(record)
+	dt.bytes += record.size
+	return append(removed, dt.evict()...)
+}
+
+// writeFile writes the file via a temporary file, so that a partially
+// written file is never loaded.
+func writeFile(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("rename %s failed: %v", tmp, err)
+	}
+	return nil
+}
+
+// detach removes the record of the key from the tier without removing
+// its file, it returns nil if the key doesn't exist.
+func (dt *diskTier) detach(key string) *diskRecord {
+	elem, ok := dt.records[key]
+	if !ok {
+		return nil
+	}
+
+	record := elem.Value.(*diskRecord)
+	dt.lru.Remove(elem)
+	delete(dt.records, key)
+	dt.bytes -= record.size
+	return record
+}
+
+func (dt *diskTier) evict() []*diskRecord {
+	var removed []*diskRecord
+	for dt.bytes > dt.maxBytes && dt.lru.Len() > 0 {
+		removed = append(removed, dt.detach(dt.lru.Back().Value.(*diskRecord).key))
+	}
+	return removed
+}
+
+func removeFile(file string) {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("remove http cache file %s failed: %v", file, err)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsontransformer
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+	"github.com/megaease/easegress/pkg/util/iotool"
+)
+
+const (
+	// Kind is the kind of JSONTransformer.
+	Kind = "JSONTransformer"
+
+	resultBodyTooLarge  = "bodyTooLarge"
+	resultInvalidJSON   = "invalidJSON"
+	resultTransformFail = "transformFail"
+
+	defaultMaxBodyBytes = 4 << 20
+)
+
+var results = []string{resultBodyTooLarge, resultInvalidJSON, resultTransformFail}
+
+func init() {
+	httppipeline.Register(&JSONTransformer{})
+}
+
+type (
+	// JSONTransformer transforms the JSON bodies, the headers and the
+	// queries of requests and responses.
+	JSONTransformer struct {
+		filterSpec *httppipeline.FilterSpec
+		spec       *Spec
+
+		maxBodyBytes int64
+		request      *transformer
+		response     *transformer
+	}
+
+	transformer struct {
+		operations []*operation
+		usesBody   bool
+	}
+)
+
+var _ httppipeline.Filter = (*JSONTransformer)(nil)
+
+// Kind returns the kind of JSONTransformer.
+func (jt *JSONTransformer) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of JSONTransformer.
+func (jt *JSONTransformer) DefaultSpec() interface{} {
+	return &Spec{}
+}
+
+// Description returns the description of JSONTransformer.
+func (jt *JSONTransformer) Description() string {
+	return "JSONTransformer transforms JSON bodies of requests and responses."
+}
+
+// Results returns the results of JSONTransformer.
+func (jt *JSONTransformer) Results() []string {
+	return results
+}
+
+// Init initializes JSONTransformer.
+func (jt *JSONTransformer) Init(filterSpec *httppipeline.FilterSpec) {
+	jt.filterSpec, jt.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	jt.reload()
+}
+
+// Inherit inherits previous generation of JSONTransformer.
+func (jt *JSONTransformer) Inherit(filterSpec *httppipeline.FilterSpec, previousGeneration httppipeline.Filter) {
+	previousGeneration.Close()
+	jt.Init(filterSpec)
+}
+
+func newTransformer(spec *TransformSpec) *transformer {
+	if spec == nil {
+		return nil
+	}
+
+	t := &transformer{operations: newOperations(spec.Operations)}
+	for _, op := range t.operations {
+		if op.usesBody() {
+			t.usesBody = true
+			break
+		}
+	}
+	return t
+}
+
+func (jt *JSONTransformer) reload() {
+	jt.maxBodyBytes = defaultMaxBodyBytes
+	if jt.spec.MaxBodyBytes > 0 {
+		jt.maxBodyBytes = jt.spec.MaxBodyBytes
+	}
+
+	jt.request = newTransformer(jt.spec.Request)
+	jt.response = newTransformer(jt.spec.Response)
+}
+
+// Handle transforms the request, and the response after the following
+// filters are called.
+func (jt *JSONTransformer) Handle(ctx context.HTTPContext) string {
+	if result := jt.transformRequest(ctx); result != "" {
+		return ctx.CallNextHandler(result)
+	}
+
+	result := ctx.CallNextHandler("")
+	jt.transformResponse(ctx)
+	return result
+}
+
+func (jt *JSONTransformer) transformRequest(ctx context.HTTPContext) string {
+	if jt.request == nil {
+		return ""
+	}
+
+	r, w := ctx.Request(), ctx.Response()
+	query, err := url.ParseQuery(r.Query())
+	if err != nil {
+		query = url.Values{}
+	}
+	doc := &document{header: r.Header(), query: query}
+
+	if jt.request.usesBody {
+		data, body, err := iotool.ReadBody(r.Body(), jt.maxBodyBytes)
+		if err != nil {
+			ctx.AddTag(fmt.Sprintf("jsonTransformer: read request body failed: %v", err))
+			w.SetStatusCode(http.StatusBadRequest)
+			return resultInvalidJSON
+		}
+		r.SetBody(body)
+		if data == nil {
+			w.SetStatusCode(http.StatusRequestEntityTooLarge)
+			return resultBodyTooLarge
+		}
+
+		doc.body, err = decodeBody(data)
+		if err != nil {
+			ctx.AddTag(fmt.Sprintf("jsonTransformer: invalid request body: %v", err))
+			w.SetStatusCode(http.StatusBadRequest)
+			return resultInvalidJSON
+		}
+	}
+
+	if err := doc.apply(jt.request.operations); err != nil {
+		ctx.AddTag(fmt.Sprintf("jsonTransformer: transform request failed: %v", err))
+		w.SetStatusCode(http.StatusBadRequest)
+		return resultTransformFail
+	}
+
+	if doc.queryChanged {
+		r.SetQuery(doc.query.Encode())
+	}
+	if doc.bodyChanged {
+		data, err := json.Marshal(doc.body)
+		if err != nil {
+			ctx.AddTag(fmt.Sprintf("jsonTransformer: marshal request body failed: %v", err))
+			w.SetStatusCode(http.StatusInternalServerError)
+			return resultTransformFail
+		}
+		r.SetBody(bytes.NewReader(data))
+		r.Header().Set(httpheader.KeyContentLength, strconv.Itoa(len(data)))
+	}
+
+	return ""
+}
+
+// transformResponse transforms the response, the response is kept as it
+// is if it fails.
+func (jt *JSONTransformer) transformResponse(ctx context.HTTPContext) {
+	if jt.response == nil {
+		return
+	}
+
+	// Operations are applied to a copy of the header, so that the
+	// response is untouched if any of them fails.
+	w := ctx.Response()
+	doc := &document{header: w.Header().Copy()}
+
+	if jt.response.usesBody {
+		data, body, err := iotool.ReadBody(w.Body(), jt.maxBodyBytes)
+		if err != nil {
+			ctx.AddTag(fmt.Sprintf("jsonTransformer: read response body failed: %v", err))
+			return
+		}
+		w.SetBody(body)
+		if data == nil {
+			ctx.AddTag("jsonTransformer: response body too large")
+			return
+		}
+
+		doc.body, err = decodeBody(data)
+		if err != nil {
+			ctx.AddTag(fmt.Sprintf("jsonTransformer: invalid response body: %v", err))
+			return
+		}
+	}
+
+	if err := doc.apply(jt.response.operations); err != nil {
+		ctx.AddTag(fmt.Sprintf("jsonTransformer: transform response failed: %v", err))
+		return
+	}
+
+	var data []byte
+	if doc.bodyChanged {
+		var err error
+		if data, err = json.Marshal(doc.body); err != nil {
+			ctx.AddTag(fmt.Sprintf("jsonTransformer: marshal response body failed: %v", err))
+			return
+		}
+	}
+
+	w.Header().Reset(doc.header.Std())
+	if doc.bodyChanged {
+		w.SetBody(bytes.NewReader(data))
+		w.Header().Set(httpheader.KeyContentLength, strconv.Itoa(len(data)))
+	}
+}
+
+// Status returns status.
+func (jt *JSONTransformer) Status() interface{} {
+	return nil
+}
+
+// Close closes JSONTransformer.
+func (jt *JSONTransformer) Close() {}
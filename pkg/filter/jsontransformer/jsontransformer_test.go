@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsontransformer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/yamltool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newJSONTransformer(t *testing.T, yamlSpec string) *JSONTransformer {
+	rawSpec := make(map[string]interface{})
+	yamltool.Unmarshal([]byte(yamlSpec), &rawSpec)
+
+	spec, err := httppipeline.NewFilterSpec(rawSpec, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	jt := &JSONTransformer{}
+	jt.Init(spec)
+	return jt
+}
+
+type backend struct {
+	query  string
+	header http.Header
+	body   string
+}
+
+// do runs the transformer with a backend which records the request and
+// responds the body.
+func do(jt *JSONTransformer, req *http.Request, respBody string) (*backend, context.HTTPContext, string) {
+	b := &backend{}
+	ctx := context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+	ctx.SetHandlerCaller(func(lastResult string) string {
+		if lastResult != "" {
+			return lastResult
+		}
+		r := ctx.Request()
+		b.query = r.Query()
+		b.header = r.Header().Std().Clone()
+		data, _ := io.ReadAll(r.Body())
+		b.body = string(data)
+
+		ctx.Response().Header().Set("Content-Type", "application/json")
+		ctx.Response().SetBody(strings.NewReader(respBody))
+		return ""
+	})
+
+	result := jt.Handle(ctx)
+	return b, ctx, result
+}
+
+func readResponse(ctx context.HTTPContext) string {
+	data, _ := io.ReadAll(ctx.Response().Body())
+	return string(data)
+}
+
+func assertJSON(t *testing.T, got, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("invalid json %q: %v", got, err)
+	}
+	json.Unmarshal([]byte(want), &w)
+
+	gb, _ := json.Marshal(g)
+	wb, _ := json.Marshal(w)
+	if string(gb) != string(wb) {
+		t.Errorf("got %s, want %s", gb, wb)
+	}
+}
+
+func TestRequestTransform(t *testing.T) {
+	jt := newJSONTransformer(t, `
+name: transformer
+kind: JSONTransformer
+request:
+  operations:
+  - op: add
+    path: body.source
+    value: gateway
+  - op: add
+    path: body.meta
+    value: {version: 2, tags: [a, b]}
+  - op: remove
+    path: body.password
+  - op: rename
+    from: body.user_name
+    path: body.user.name
+  - op: move
+    from: header.X-User-Id
+    path: body.user.id
+  - op: copy
+    from: body.user.name
+    path: query.user
+  - op: move
+    from: query.debug
+    path: header.X-Debug
+  - op: map
+    path: body.items
+    operations:
+    - op: rename
+      from: body.qty
+      path: body.quantity
+`)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/orders?debug=1&page=2",
+		strings.NewReader(`{"user_name":"bob","password":"secret","items":[{"qty":1},{"qty":2}]}`))
+	req.Header.Set("X-User-Id", "42")
+
+	b, _, result := do(jt, req, `{}`)
+	if result != "" {
+		t.Fatalf("unexpected result %s", result)
+	}
+
+	assertJSON(t, b.body, `{
+		"source": "gateway",
+		"meta": {"version": 2, "tags": ["a", "b"]},
+		"user": {"name": "bob", "id": "42"},
+		"items": [{"quantity": 1}, {"quantity": 2}]
+	}`)
+	if b.query != "page=2&user=bob" {
+		t.Errorf("unexpected query %s", b.query)
+	}
+	if b.header.Get("X-User-Id") != "" || b.header.Get("X-Debug") != "1" {
+		t.Errorf("unexpected header %v", b.header)
+	}
+	if b.header.Get("Content-Length") != "" && b.header.Get("Content-Length") != strconv.Itoa(len(b.body)) {
+		t.Errorf("content length %s mismatches body", b.header.Get("Content-Length"))
+	}
+}
+
+func TestResponseTransform(t *testing.T) {
+	jt := newJSONTransformer(t, `
+name: transformer
+kind: JSONTransformer
+response:
+  operations:
+  - op: project
+    expression: "{total:data.count,names:data.users.#.name}"
+  - op: move
+    from: body.total
+    path: header.X-Total-Count
+`)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/users", nil)
+	_, ctx, _ := do(jt, req, `{"data":{"count":2,"users":[{"name":"a","age":1},{"name":"b","age":2}]}}`)
+
+	body := readResponse(ctx)
+	assertJSON(t, body, `{"names":["a","b"]}`)
+	if ctx.Response().Header().Get("X-Total-Count") != "2" {
+		t.Errorf("unexpected header %v", ctx.Response().Header().Std())
+	}
+	if ctx.Response().Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("content length %s mismatches body", ctx.Response().Header().Get("Content-Length"))
+	}
+
+	// The response is kept as it is if it isn't JSON.
+	_, ctx, _ = do(jt, req, `not json`)
+	if body := readResponse(ctx); body != "not json" {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	jt := newJSONTransformer(t, `
+name: transformer
+kind: JSONTransformer
+maxBodyBytes: 16
+request:
+  operations:
+  - op: add
+    path: body.a.b
+    value: 1
+`)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(`{"a":1}`))
+	if _, ctx, result := do(jt, req, ""); result != resultTransformFail || ctx.Response().StatusCode() != http.StatusBadRequest {
+		t.Errorf("unexpected result %s", result)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(`{"a":`))
+	if _, _, result := do(jt, req, ""); result != resultInvalidJSON {
+		t.Errorf("unexpected result %s", result)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(`{"a":"0123456789abcdef"}`))
+	if _, ctx, result := do(jt, req, ""); result != resultBodyTooLarge || ctx.Response().StatusCode() != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected result %s", result)
+	}
+
+	// An empty body is an empty object.
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	b, _, result := do(jt, req, "")
+	if result != "" {
+		t.Fatalf("unexpected result %s", result)
+	}
+	assertJSON(t, b.body, `{"a":{"b":1}}`)
+}
+
+func TestSpecValidate(t *testing.T) {
+	cases := map[string]string{
+		"empty": `{}`,
+		"invalid location": `
+request:
+  operations:
+  - {op: remove, path: cookie.a}`,
+		"query in response": `
+response:
+  operations:
+  - {op: remove, path: query.a}`,
+		"rename header": `
+request:
+  operations:
+  - {op: rename, from: header.A, path: header.B}`,
+		"add without value": `
+request:
+  operations:
+  - {op: add, path: body.a}`,
+		"invalid nested operation": `
+request:
+  operations:
+  - op: map
+    path: body.items
+    operations:
+    - {op: copy, path: body.a}`,
+	}
+
+	for name, c := range cases {
+		spec := &Spec{}
+		yamltool.Unmarshal([]byte(c), spec)
+		if err := spec.Validate(); err == nil {
+			t.Errorf("%s: spec should be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsontransformer
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	opAdd     = "add"
+	opRemove  = "remove"
+	opRename  = "rename"
+	opMove    = "move"
+	opCopy    = "copy"
+	opMap     = "map"
+	opProject = "project"
+)
+
+type (
+	// Spec describes the JSONTransformer.
+	Spec struct {
+		// MaxBodyBytes is the max size of bodies to transform.
+		MaxBodyBytes int64          `yaml:"maxBodyBytes,omitempty" jsonschema:"omitempty,minimum=1"`
+		Request      *TransformSpec `yaml:"request,omitempty" jsonschema:"omitempty"`
+		Response     *TransformSpec `yaml:"response,omitempty" jsonschema:"omitempty"`
+	}
+
+	// TransformSpec describes the operations on a request or a response,
+	// they are applied in order.
+	TransformSpec struct {
+		Operations []*Operation `yaml:"operations" jsonschema:"required,minItems=1"`
+	}
+
+	// BasicOperation describes a transform operation other than map.
+	//
+	// Path and From are locations in the message, which are header.{name},
+	// query.{name} or body.{field path}, the field path is a dot separated
+	// list of object keys or array indexes, and body itself is the whole
+	// body. Path is the location to change, and From is the location of
+	// the source value for rename, move and copy.
+	BasicOperation struct {
+		Op   string `yaml:"op" jsonschema:"required,enum=add,enum=remove,enum=rename,enum=move,enum=copy,enum=map,enum=project"`
+		Path string `yaml:"path,omitempty" jsonschema:"omitempty"`
+		From string `yaml:"from,omitempty" jsonschema:"omitempty"`
+		// Value is the value to add.
+		Value interface{} `yaml:"value,omitempty" jsonschema:"omitempty"`
+		// Expression is the JSONPath-style expression of project, whose
+		// result is put to Path, see https://github.com/tidwall/gjson for
+		// the syntax.
+		Expression string `yaml:"expression,omitempty" jsonschema:"omitempty"`
+	}
+
+	// Operation describes a transform operation.
+	Operation struct {
+		BasicOperation `yaml:",inline"`
+		// Operations are applied to every element of the array at Path by
+		// map, in which the body is the element, they can't be map again.
+		Operations []*BasicOperation `yaml:"operations,omitempty" jsonschema:"omitempty"`
+	}
+)
+
+// Validate validates Spec.
+func (spec Spec) Validate() error {
+	if spec.Request == nil && spec.Response == nil {
+		return fmt.Errorf("none of request and response is specified")
+	}
+
+	if spec.Request != nil {
+		if err := validateOperations(spec.Request.Operations, true); err != nil {
+			return fmt.Errorf("request: %v", err)
+		}
+	}
+	if spec.Response != nil {
+		if err := validateOperations(spec.Response.Operations, false); err != nil {
+			return fmt.Errorf("response: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func validateOperations(ops []*Operation, isRequest bool) error {
+	for i, op := range ops {
+		if err := op.validate(isRequest); err != nil {
+			return fmt.Errorf("operation %d (%s): %v", i, op.Op, err)
+		}
+	}
+	return nil
+}
+
+func (op *Operation) validate(isRequest bool) error {
+	if op.Op != opMap {
+		if len(op.Operations) > 0 {
+			return fmt.Errorf("operations are only for map")
+		}
+		return op.BasicOperation.validate(isRequest)
+	}
+
+	loc, err := parseLocation(op.Path)
+	if err != nil {
+		return fmt.Errorf("path: %v", err)
+	}
+	if loc.kind != locationBody {
+		return fmt.Errorf("path of map must be in body")
+	}
+	if len(op.Operations) == 0 {
+		return fmt.Errorf("operations are empty")
+	}
+
+	for i, elemOp := range op.Operations {
+		if elemOp.Op == opMap {
+			return fmt.Errorf("operation %d: map can't be nested", i)
+		}
+		if err := elemOp.validate(isRequest); err != nil {
+			return fmt.Errorf("operation %d (%s): %v", i, elemOp.Op, err)
+		}
+	}
+	return nil
+}
+
+func (op *BasicOperation) validate(isRequest bool) error {
+	checkLocation := func(name, value string) error {
+		loc, err := parseLocation(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if loc.kind == locationQuery && !isRequest {
+			return fmt.Errorf("%s: query is not available in response", name)
+		}
+		return nil
+	}
+
+	if op.Op != opProject || op.Path != "" {
+		if err := checkLocation("path", op.Path); err != nil {
+			return err
+		}
+	}
+
+	switch op.Op {
+	case opAdd:
+		if op.Value == nil {
+			return fmt.Errorf("value is empty")
+		}
+	case opRename:
+		if !strings.HasPrefix(op.Path, locationBody+".") || !strings.HasPrefix(op.From, locationBody+".") {
+			return fmt.Errorf("rename only works on body fields, use move instead")
+		}
+		fallthrough
+	case opMove, opCopy:
+		if err := checkLocation("from", op.From); err != nil {
+			return err
+		}
+	case opProject:
+		if op.Expression == "" {
+			return fmt.Errorf("expression is empty")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,426 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsontransformer
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	json "github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+
+	"github.com/megaease/easegress/pkg/util/httpheader"
+)
+
+const (
+	locationHeader = "header"
+	locationQuery  = "query"
+	locationBody   = "body"
+)
+
+type (
+	location struct {
+		kind string
+		// name is the name of the header or the query parameter.
+		name string
+		// fields is the field path in body, empty for the whole body.
+		fields []string
+	}
+
+	// document is the message being transformed.
+	document struct {
+		header *httpheader.HTTPHeader
+		// query is nil for responses.
+		query url.Values
+		body  interface{}
+
+		queryChanged bool
+		bodyChanged  bool
+	}
+
+	operation struct {
+		op         string
+		path       *location
+		from       *location
+		value      interface{}
+		expression string
+		operations []*operation
+	}
+)
+
+func parseLocation(s string) (*location, error) {
+	if s == locationBody {
+		return &location{kind: locationBody}, nil
+	}
+
+	i := strings.IndexByte(s, '.')
+	if i < 0 || i == len(s)-1 {
+		return nil, fmt.Errorf("invalid location %q", s)
+	}
+
+	loc := &location{kind: s[:i]}
+	switch loc.kind {
+	case locationHeader, locationQuery:
+		loc.name = s[i+1:]
+	case locationBody:
+		loc.fields = strings.Split(s[i+1:], ".")
+		for _, f := range loc.fields {
+			if f == "" {
+				return nil, fmt.Errorf("invalid location %q: empty field", s)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid location %q: must begin with header, query or body", s)
+	}
+
+	return loc, nil
+}
+
+// newOperations converts the specs to operations, the specs must have
+// been validated.
+func newOperations(specs []*Operation) []*operation {
+	ops := make([]*operation, 0, len(specs))
+	for _, spec := range specs {
+		op := newOperation(&spec.BasicOperation)
+		for _, elemSpec := range spec.Operations {
+			op.operations = append(op.operations, newOperation(elemSpec))
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func newOperation(spec *BasicOperation) *operation {
+	op := &operation{
+		op:         spec.Op,
+		value:      normalizeValue(spec.Value),
+		expression: spec.Expression,
+	}
+
+	path := spec.Path
+	if path == "" {
+		path = locationBody
+	}
+	op.path, _ = parseLocation(path)
+	if spec.From != "" {
+		op.from, _ = parseLocation(spec.From)
+	}
+
+	return op
+}
+
+// normalizeValue converts the value decoded from YAML to the one decoded
+// from JSON, e.g. map[interface{}]interface{} to map[string]interface{}.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalizeValue(val)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, val := range v {
+			a[i] = normalizeValue(val)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+func (op *operation) usesBody() bool {
+	if op.op == opProject || op.path.kind == locationBody {
+		return true
+	}
+	return op.from != nil && op.from.kind == locationBody
+}
+
+func decodeBody(data []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var body interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// stringValue converts the value to the one of a header or a query
+// parameter, objects and arrays are encoded in JSON.
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		buff, _ := json.Marshal(v)
+		return string(buff)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (d *document) get(loc *location) (interface{}, bool) {
+	switch loc.kind {
+	case locationHeader:
+		values := d.header.GetAll(loc.name)
+		if len(values) == 0 {
+			return nil, false
+		}
+		return values[0], true
+	case locationQuery:
+		values, ok := d.query[loc.name]
+		if !ok || len(values) == 0 {
+			return nil, false
+		}
+		return values[0], true
+	}
+
+	current := d.body
+	for _, f := range loc.fields {
+		switch c := current.(type) {
+		case map[string]interface{}:
+			v, ok := c[f]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case []interface{}:
+			i, err := strconv.Atoi(f)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			current = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (d *document) set(loc *location, value interface{}) error {
+	switch loc.kind {
+	case locationHeader:
+		d.header.Set(loc.name, stringValue(value))
+		return nil
+	case locationQuery:
+		d.query.Set(loc.name, stringValue(value))
+		d.queryChanged = true
+		return nil
+	}
+
+	d.bodyChanged = true
+	if len(loc.fields) == 0 {
+		d.body = value
+		return nil
+	}
+
+	if d.body == nil {
+		d.body = map[string]interface{}{}
+	}
+	return setField(d.body, loc.fields, value)
+}
+
+// setField sets the value to the field path of the container, missing
+// objects are created, and an array index equal to the length appends.
+func setField(container interface{}, fields []string, value interface{}) error {
+	f, last := fields[0], len(fields) == 1
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		if last {
+			c[f] = value
+			return nil
+		}
+		next, ok := c[f]
+		if !ok || next == nil {
+			next = map[string]interface{}{}
+			c[f] = next
+		}
+		return setField(next, fields[1:], value)
+
+	case []interface{}:
+		i, err := strconv.Atoi(f)
+		if err != nil || i < 0 || i >= len(c) {
+			return fmt.Errorf("invalid index %s of array with length %d", f, len(c))
+		}
+		if last {
+			c[i] = value
+			return nil
+		}
+		if c[i] == nil {
+			c[i] = map[string]interface{}{}
+		}
+		return setField(c[i], fields[1:], value)
+
+	default:
+		return fmt.Errorf("field %s is not in an object or an array", f)
+	}
+}
+
+func (d *document) remove(loc *location) {
+	switch loc.kind {
+	case locationHeader:
+		d.header.Del(loc.name)
+		return
+	case locationQuery:
+		if _, ok := d.query[loc.name]; ok {
+			d.query.Del(loc.name)
+			d.queryChanged = true
+		}
+		return
+	}
+
+	if len(loc.fields) == 0 {
+		d.body, d.bodyChanged = nil, true
+		return
+	}
+
+	parent, ok := d.get(&location{kind: locationBody, fields: loc.fields[:len(loc.fields)-1]})
+	if !ok {
+		return
+	}
+
+	f := loc.fields[len(loc.fields)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := p[f]; ok {
+			delete(p, f)
+			d.bodyChanged = true
+		}
+	case []interface{}:
+		// Removing an element changes the length of the array, so the
+		// parent must be replaced.
+		i, err := strconv.Atoi(f)
+		if err != nil || i < 0 || i >= len(p) {
+			return
+		}
+		n := append(append([]interface{}{}, p[:i]...), p[i+1:]...)
+		d.set(&location{kind: locationBody, fields: loc.fields[:len(loc.fields)-1]}, n)
+	}
+}
+
+// apply applies the operations to the document, operations on missing
+// values are ignored.
+func (d *document) apply(ops []*operation) error {
+	for _, op := range ops {
+		if err := d.applyOne(op); err != nil {
+			return fmt.Errorf("%s %s: %v", op.op, op.path.String(), err)
+		}
+	}
+	return nil
+}
+
+func (d *document) applyOne(op *operation) error {
+	switch op.op {
+	case opAdd:
+		return d.set(op.path, deepCopy(op.value))
+
+	case opRemove:
+		d.remove(op.path)
+
+	case opRename, opMove, opCopy:
+		value, ok := d.get(op.from)
+		if !ok {
+			return nil
+		}
+		if op.op == opCopy {
+			value = deepCopy(value)
+		} else {
+			d.remove(op.from)
+		}
+		return d.set(op.path, value)
+
+	case opMap:
+		value, ok := d.get(op.path)
+		if !ok {
+			return nil
+		}
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("value is not an array")
+		}
+		for i := range array {
+			elem := &document{header: d.header, query: d.query, body: array[i]}
+			if err := elem.apply(op.operations); err != nil {
+				return fmt.Errorf("element %d: %v", i, err)
+			}
+			array[i] = elem.body
+			d.queryChanged = d.queryChanged || elem.queryChanged
+		}
+		d.bodyChanged = true
+
+	case opProject:
+		data, err := json.Marshal(d.body)
+		if err != nil {
+			return err
+		}
+		result := gjson.GetBytes(data, op.expression)
+		var value interface{}
+		if result.Exists() {
+			if value, err = decodeBody([]byte(result.Raw)); err != nil {
+				return err
+			}
+		}
+		return d.set(op.path, value)
+	}
+
+	return nil
+}
+
+func (l *location) String() string {
+	switch l.kind {
+	case locationHeader, locationQuery:
+		return l.kind + "." + l.name
+	}
+	if len(l.fields) == 0 {
+		return locationBody
+	}
+	return locationBody + "." + strings.Join(l.fields, ".")
+}
+
+// deepCopy copies objects and arrays, so that a value is never shared by
+// two locations.
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = deepCopy(val)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, val := range v {
+			a[i] = deepCopy(val)
+		}
+		return a
+	default:
+		return v
+	}
+}
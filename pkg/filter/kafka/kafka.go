@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	"github.com/Shopify/sarama"
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/pipeline"
@@ -31,6 +32,11 @@ const (
 	Kind = "Kafka"
 
 	resultGetDataFailed = "GetDataFailed"
+
+	// headers of kafka message for MQTT 5.0 properties
+	headerContentType     = "mqtt-content-type"
+	headerResponseTopic   = "mqtt-response-topic"
+	headerCorrelationData = "mqtt-correlation-data"
 )
 
 func init() {
@@ -189,16 +195,41 @@ func (k *Kafka) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult {
 		return &context.MQTTResult{ErrString: resultGetDataFailed}
 	}
 
-	kafkaHeaders := []sarama.RecordHeader{}
-	for k, v := range headers {
-		kafkaHeaders = append(kafkaHeaders, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
-	}
-
 	msg := &sarama.ProducerMessage{
 		Topic:   topic,
-		Headers: kafkaHeaders,
+		Headers: kafkaHeaders(headers, ctx.Properties()),
 		Value:   sarama.ByteEncoder(payload),
 	}
 	k.producer.Input() <- msg
 	return &context.MQTTResult{}
 }
+
+// kafkaHeaders returns headers of kafka message. MQTT 5.0 user properties, content type,
+// response topic and correlation data are sent as headers, headers from kv map take
+// precedence over them.
+func kafkaHeaders(headers map[string]string, props *packets5.Properties) []sarama.RecordHeader {
+	all := make(map[string]string, len(headers))
+	if props != nil {
+		for _, u := range props.User {
+			all[u.Key] = u.Value
+		}
+		if props.ContentType != "" {
+			all[headerContentType] = props.ContentType
+		}
+		if props.ResponseTopic != "" {
+			all[headerResponseTopic] = props.ResponseTopic
+		}
+		if props.CorrelationData != nil {
+			all[headerCorrelationData] = string(props.CorrelationData)
+		}
+	}
+	for k, v := range headers {
+		all[k] = v
+	}
+
+	kafkaHeaders := []sarama.RecordHeader{}
+	for k, v := range all {
+		kafkaHeaders = append(kafkaHeaders, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	return kafkaHeaders
+}
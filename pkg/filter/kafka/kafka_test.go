@@ -27,6 +27,7 @@ import (
 	"github.com/megaease/easegress/pkg/object/pipeline"
 
 	"github.com/Shopify/sarama"
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/stretchr/testify/assert"
 )
@@ -134,3 +135,48 @@ func TestKafkaWithKVMap(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal("text", string(value))
 }
+
+func TestKafkaWithMQTT5Properties(t *testing.T) {
+	assert := assert.New(t)
+	spec := &Spec{
+		Backend: []string{"localhost:1234"},
+		KVMap: &KVMap{
+			HeaderKey: "headers",
+		},
+	}
+
+	kafka := Kafka{
+		spec:     spec,
+		producer: newMockAsyncProducer(),
+		done:     make(chan struct{}),
+	}
+	kafka.setKV()
+	defer kafka.Close()
+
+	client := &context.MockMQTTClient{MockClientID: "test"}
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = "a/b/c"
+	packet.Payload = []byte("text")
+	props := &packets5.Properties{
+		ContentType:     "application/json",
+		ResponseTopic:   "reply",
+		CorrelationData: []byte("123"),
+		User:            []packets5.User{{Key: "1", Value: "b"}, {Key: "2", Value: "c"}},
+	}
+	mqttCtx := context.NewMQTT5Context(stdcontext.Background(), client, packet, props)
+	mqttCtx.SetKV("headers", map[string]string{"1": "a"})
+
+	kafka.HandleMQTT(mqttCtx)
+	msg := <-kafka.producer.(*mockAsyncProducer).ch
+	headers := map[string]string{}
+	for _, h := range msg.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	assert.Equal(map[string]string{
+		"1":                   "a",
+		"2":                   "c",
+		headerContentType:     "application/json",
+		headerResponseTopic:   "reply",
+		headerCorrelationData: "123",
+	}, headers)
+}
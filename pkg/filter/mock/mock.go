@@ -18,12 +18,14 @@
 package mock
 
 import (
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/stringtool"
 	"github.com/megaease/easegress/pkg/util/urlrule"
 )
 
@@ -67,8 +69,12 @@ type (
 	MatchRule struct {
 		Path            string                          `yaml:"path,omitempty" jsonschema:"omitempty,pattern=^/"`
 		PathPrefix      string                          `yaml:"pathPrefix,omitempty" jsonschema:"omitempty,pattern=^/"`
+		PathRegexp      string                          `yaml:"pathRegexp,omitempty" jsonschema:"omitempty,format=regexp"`
+		Methods         []string                        `yaml:"methods,omitempty" jsonschema:"omitempty,uniqueItems=true,format=httpmethod-array"`
 		Headers         map[string]*urlrule.StringMatch `yaml:"headers" jsonschema:"omitempty"`
 		MatchAllHeaders bool                            `yaml:"matchAllHeaders" jsonschema:"omitempty"`
+
+		pathRE *regexp.Regexp
 	}
 )
 
@@ -106,6 +112,9 @@ func (m *Mock) Inherit(filterSpec *httppipeline.FilterSpec, previousGeneration h
 
 func (m *Mock) reload() {
 	for _, r := range m.spec.Rules {
+		if r.Match.PathRegexp != "" {
+			r.Match.pathRE = regexp.MustCompile(r.Match.PathRegexp)
+		}
 		if r.Delay == "" {
 			continue
 		}
@@ -125,10 +134,11 @@ func (m *Mock) Handle(ctx context.HTTPContext) string {
 
 func (m *Mock) match(ctx context.HTTPContext) *Rule {
 	path := ctx.Request().Path()
+	method := ctx.Request().Method()
 	header := ctx.Request().Header()
 
 	matchPath := func(rule *Rule) bool {
-		if rule.Match.Path == "" && rule.Match.PathPrefix == "" {
+		if rule.Match.Path == "" && rule.Match.PathPrefix == "" && rule.Match.pathRE == nil {
 			return true
 		}
 
@@ -136,11 +146,18 @@ func (m *Mock) match(ctx context.HTTPContext) *Rule {
 			return true
 		}
 
-		if rule.Match.PathPrefix == "" {
-			return false
+		if rule.Match.PathPrefix != "" && strings.HasPrefix(path, rule.Match.PathPrefix) {
+			return true
 		}
 
-		return strings.HasPrefix(path, rule.Match.PathPrefix)
+		return rule.Match.pathRE != nil && rule.Match.pathRE.MatchString(path)
+	}
+
+	matchMethod := func(rule *Rule) bool {
+		if len(rule.Match.Methods) == 0 {
+			return true
+		}
+		return stringtool.StrInSlice(method, rule.Match.Methods)
 	}
 
 	matchOneHeader := func(key string, rule *urlrule.StringMatch) bool {
@@ -182,7 +199,7 @@ func (m *Mock) match(ctx context.HTTPContext) *Rule {
 	}
 
 	for _, rule := range m.spec.Rules {
-		if matchPath(rule) && matchHeader(rule) {
+		if matchPath(rule) && matchMethod(rule) && matchHeader(rule) {
 			return rule
 		}
 	}
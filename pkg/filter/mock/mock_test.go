@@ -83,6 +83,11 @@ rules:
   body: 'mocked body'
   headers:
     X-Test: test2
+- match:
+    pathRegexp: ^/owners/[^/]+$
+    methods: [POST]
+  code: 201
+  body: 'mocked body'
 - code: 204
   body: 'mocked body 2'
   headers:
@@ -217,6 +222,27 @@ rules:
 		t.Errorf("status code is %d, not 204", resp.Code)
 	}
 
+	resp = httptest.NewRecorder()
+	ctx.MockedRequest.MockedPath = func() string {
+		return "/owners/12"
+	}
+	m.Handle(ctx)
+	if resp.Code != 204 {
+		t.Errorf("status code is %d, not 204", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	ctx.MockedRequest.MockedMethod = func() string {
+		return http.MethodPost
+	}
+	m.Handle(ctx)
+	if resp.Code != 201 {
+		t.Errorf("status code is %d, not 201", resp.Code)
+	}
+	ctx.MockedRequest.MockedMethod = func() string {
+		return http.MethodGet
+	}
+
 	if m.Status() != nil {
 		t.Error("behavior changed, please update this case")
 	}
@@ -0,0 +1,394 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttacl
+
+import (
+	stdcontext "context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+)
+
+const (
+	// Kind is the kind of MQTTACL
+	Kind = "MQTTACL"
+
+	resultDenied = "Denied"
+
+	// customDataPrefix is prefix of rules in cluster storage
+	customDataPrefix = "/custom-data/"
+
+	permissionAllow = "allow"
+	permissionDeny  = "deny"
+
+	actionPublish   = "publish"
+	actionSubscribe = "subscribe"
+	actionAll       = "all"
+
+	reasonDenied  = "Denied"
+	reasonNoMatch = "NoMatch"
+
+	sharedTopicPrefix = "$share/"
+)
+
+func init() {
+	pipeline.Register(&MQTTACL{})
+}
+
+type (
+	// MQTTACL allows or denies MQTT clients to publish or subscribe topics by rules.
+	MQTTACL struct {
+		filterSpec *pipeline.FilterSpec
+		spec       *Spec
+		rules      []*Rule
+		// storeRules is []*Rule synced from cluster storage
+		storeRules atomic.Value
+		allowed    uint64
+
+		mu      sync.Mutex
+		denied  map[string]uint64
+		cluster cluster.Cluster
+		cancel  stdcontext.CancelFunc
+	}
+)
+
+var _ pipeline.Filter = (*MQTTACL)(nil)
+var _ pipeline.MQTTFilter = (*MQTTACL)(nil)
+
+// Kind return kind of MQTTACL
+func (a *MQTTACL) Kind() string {
+	return Kind
+}
+
+// DefaultSpec return default spec of MQTTACL
+func (a *MQTTACL) DefaultSpec() interface{} {
+	return &Spec{}
+}
+
+// Description return description of MQTTACL
+func (a *MQTTACL) Description() string {
+	return "MQTTACL allows or denies MQTT clients to publish or subscribe topics"
+}
+
+// Results return possible results of MQTTACL
+func (a *MQTTACL) Results() []string {
+	return []string{resultDenied}
+}
+
+// Init init MQTTACL
+func (a *MQTTACL) Init(filterSpec *pipeline.FilterSpec) {
+	if filterSpec.Protocol() != context.MQTT {
+		panic("filter MQTTACL only support MQTT protocol for now")
+	}
+	a.filterSpec, a.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	a.denied = make(map[string]uint64)
+	a.storeRules.Store([]*Rule(nil))
+
+	a.rules = append(a.rules, a.spec.Rules...)
+	a.rules = append(a.rules, loadRulesFromFile(a.spec.RuleFile)...)
+
+	var ctx stdcontext.Context
+	ctx, a.cancel = stdcontext.WithCancel(stdcontext.Background())
+	if a.spec.EtcdPrefix != "" && filterSpec.Super() != nil && filterSpec.Super().Cluster() != nil {
+		a.cluster = filterSpec.Super().Cluster()
+		go a.syncRules(ctx)
+	}
+}
+
+func loadRulesFromFile(fileName string) []*Rule {
+	if fileName == "" {
+		return nil
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		panic(fmt.Errorf("read rule file %s failed, %v", fileName, err))
+	}
+	rules := []*Rule{}
+	err = yaml.Unmarshal(data, &rules)
+	if err != nil {
+		panic(fmt.Errorf("file %s unmarshal failed, %v", fileName, err))
+	}
+	return rules
+}
+
+func (a *MQTTACL) etcdPrefix() string {
+	return customDataPrefix + strings.Trim(a.spec.EtcdPrefix, "/") + "/"
+}
+
+// syncRules syncs rules from cluster storage until ctx is done.
+func (a *MQTTACL) syncRules(ctx stdcontext.Context) {
+	var (
+		syncer *cluster.Syncer
+		err    error
+		ch     <-chan map[string]string
+	)
+
+	for {
+		syncer, err = a.cluster.Syncer(time.Minute)
+		if err != nil {
+			logger.Errorf("create syncer for acl rules failed: %v", err)
+		} else if ch, err = syncer.SyncPrefix(a.etcdPrefix()); err != nil {
+			logger.Errorf("sync acl rules with prefix %v failed: %v", a.etcdPrefix(), err)
+			syncer.Close()
+		} else {
+			break
+		}
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+	defer syncer.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case kvs := <-ch:
+			a.setStoreRules(kvs)
+		}
+	}
+}
+
+// setStoreRules sets rules in cluster storage, rules of invalid values are ignored.
+func (a *MQTTACL) setStoreRules(kvs map[string]string) {
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var rules []*Rule
+	for _, k := range keys {
+		r := []*Rule{}
+		err := yaml.Unmarshal([]byte(kvs[k]), &r)
+		if err != nil {
+			logger.Errorf("unmarshal acl rules of key %v failed: %v", k, err)
+			continue
+		}
+		rules = append(rules, r...)
+	}
+	a.storeRules.Store(rules)
+}
+
+// Inherit init MQTTACL based on previous generation
+func (a *MQTTACL) Inherit(filterSpec *pipeline.FilterSpec, previousGeneration pipeline.Filter) {
+	previousGeneration.Close()
+	a.Init(filterSpec)
+}
+
+// Close close MQTTACL
+func (a *MQTTACL) Close() {
+	a.cancel()
+}
+
+// Status return status of MQTTACL
+func (a *MQTTACL) Status() interface{} {
+	status := &Status{
+		Rules:         len(a.rules) + len(a.storeRules.Load().([]*Rule)),
+		Allowed:       atomic.LoadUint64(&a.allowed),
+		DeniedReasons: make(map[string]uint64),
+	}
+	a.mu.Lock()
+	for k, v := range a.denied {
+		status.DeniedReasons[k] = v
+	}
+	a.mu.Unlock()
+	return status
+}
+
+// HandleMQTT handle MQTT context
+func (a *MQTTACL) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult {
+	var action string
+	var topics []string
+	switch ctx.PacketType() {
+	case context.MQTTPublish:
+		action, topics = actionPublish, []string{ctx.PublishPacket().TopicName}
+	case context.MQTTSubscribe:
+		action, topics = actionSubscribe, ctx.SubscribePacket().Topics
+	default:
+		return &context.MQTTResult{}
+	}
+
+	client := ctx.Client()
+	for _, topic := range topics {
+		allowed, matched := a.check(client.UserName(), client.ClientID(), action, topic)
+		if allowed {
+			continue
+		}
+		reason := action + reasonDenied
+		if !matched {
+			reason = action + reasonNoMatch
+		}
+		a.mu.Lock()
+		a.denied[reason]++
+		a.mu.Unlock()
+		logger.Debugf("client %v of user %v %v topic %v denied by acl, reason %v", client.ClientID(), client.UserName(), action, topic, reason)
+
+		// a subscribe packet is denied if any of its topic filters is denied
+		ctx.SetDrop()
+		ctx.SetEarlyStop()
+		if action == actionPublish {
+			ctx.SetReasonCode(packets5.PubackNotAuthorized)
+		} else {
+			ctx.SetReasonCode(packets5.SubackNotauthorized)
+		}
+		return &context.MQTTResult{ErrString: resultDenied}
+	}
+	atomic.AddUint64(&a.allowed, 1)
+	return &context.MQTTResult{}
+}
+
+// check returns whether the client is allowed to do the action on topic,
+// and whether any rule matches.
+func (a *MQTTACL) check(username, clientID, action, topic string) (allowed bool, matched bool) {
+	for _, rules := range [][]*Rule{a.rules, a.storeRules.Load().([]*Rule)} {
+		for _, r := range rules {
+			if r.match(username, clientID, action, topic) {
+				return r.Permission == permissionAllow, true
+			}
+		}
+	}
+	return a.spec.NoMatch == permissionAllow, false
+}
+
+// match checks whether the rule applies to the action of the client on topic. For subscribe,
+// an allow rule matches if its topic filter covers the subscribed filter, while a deny
+// rule matches if any topic matches both filters, so wildcards can't bypass deny rules.
+func (r *Rule) match(username, clientID, action, topic string) bool {
+	if r.Action != "" && r.Action != actionAll && r.Action != action {
+		return false
+	}
+	if r.Username != "" && r.Username != username {
+		return false
+	}
+	if r.ClientID != "" && r.ClientID != clientID {
+		return false
+	}
+
+	if action == actionSubscribe {
+		topic = trimSharedPrefix(topic)
+	}
+	for _, t := range r.Topics {
+		filter, ok := replacePlaceholders(t, username, clientID)
+		if !ok {
+			continue
+		}
+		switch {
+		case action == actionPublish && matchTopic(filter, topic):
+			return true
+		case action == actionSubscribe && r.Permission == permissionAllow && coverFilter(filter, topic):
+			return true
+		case action == actionSubscribe && r.Permission != permissionAllow && intersectFilter(filter, topic):
+			return true
+		}
+	}
+	return false
+}
+
+// replacePlaceholders replaces %u and %c in topic filter by username and client id,
+// it fails if the value to replace is empty or contains characters of topic levels.
+func replacePlaceholders(filter, username, clientID string) (string, bool) {
+	for placeholder, value := range map[string]string{"%u": username, "%c": clientID} {
+		if !strings.Contains(filter, placeholder) {
+			continue
+		}
+		if value == "" || strings.ContainsAny(value, "/+#") {
+			return "", false
+		}
+		filter = strings.ReplaceAll(filter, placeholder, value)
+	}
+	return filter, true
+}
+
+// trimSharedPrefix returns topic filter of shared subscription $share/{group}/{filter}.
+func trimSharedPrefix(topic string) string {
+	if !strings.HasPrefix(topic, sharedTopicPrefix) {
+		return topic
+	}
+	levels := strings.SplitN(topic, "/", 3)
+	if len(levels) < 3 {
+		return topic
+	}
+	return levels[2]
+}
+
+// matchTopic checks whether topic name matches topic filter.
+func matchTopic(filter, topic string) bool {
+	// topics beginning with $ are not matched by filters beginning with wildcards
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	return coverFilter(filter, topic)
+}
+
+// coverFilter checks whether all topics matching sub also match filter.
+func coverFilter(filter, sub string) bool {
+	fs, ss := strings.Split(filter, "/"), strings.Split(sub, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ss) {
+			return false
+		}
+		if ss[i] == "#" {
+			return false
+		}
+		if f != "+" && f != ss[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ss)
+}
+
+// intersectFilter checks whether any topic matches both filters.
+func intersectFilter(f1, f2 string) bool {
+	l1, l2 := strings.Split(f1, "/"), strings.Split(f2, "/")
+	for i := 0; i < len(l1) && i < len(l2); i++ {
+		if l1[i] == "#" || l2[i] == "#" {
+			return true
+		}
+		if l1[i] != "+" && l2[i] != "+" && l1[i] != l2[i] {
+			return false
+		}
+	}
+	switch {
+	case len(l1) == len(l2):
+		return true
+	case len(l1) == len(l2)+1:
+		return l1[len(l2)] == "#"
+	case len(l2) == len(l1)+1:
+		return l2[len(l1)] == "#"
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttacl
+
+import (
+	stdcontext "context"
+	"os"
+	"testing"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+func newClient(username, cid string) *context.MockMQTTClient {
+	return &context.MockMQTTClient{MockClientID: cid, MockUserName: username}
+}
+
+func newPublishContext(client context.MQTTClient, topic string) context.MQTTContext {
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	return context.NewMQTTContext(stdcontext.Background(), client, packet)
+}
+
+func newSubscribeContext(client context.MQTTClient, topics ...string) context.MQTTContext {
+	packet := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	packet.Topics = topics
+	packet.Qoss = make([]byte, len(topics))
+	return context.NewMQTTContext(stdcontext.Background(), client, packet)
+}
+
+func newACL(spec *Spec) *MQTTACL {
+	meta := &pipeline.FilterMetaSpec{Name: "acl-demo", Kind: Kind, Pipeline: "pipeline-demo", Protocol: context.MQTT}
+	a := &MQTTACL{}
+	a.Init(pipeline.MockFilterSpec(nil, nil, "", meta, spec))
+	return a
+}
+
+func TestTopicFilters(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/b", "a", false},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+	} {
+		assert.Equal(c.match, matchTopic(c.filter, c.topic), "%v %v", c.filter, c.topic)
+	}
+
+	for _, c := range []struct {
+		filter, sub string
+		cover       bool
+	}{
+		{"a/#", "a/+/c", true},
+		{"a/+/c", "a/+/c", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"a/#", "a/#", true},
+		{"#", "#", true},
+	} {
+		assert.Equal(c.cover, coverFilter(c.filter, c.sub), "%v %v", c.filter, c.sub)
+	}
+
+	for _, c := range []struct {
+		f1, f2    string
+		intersect bool
+	}{
+		{"a/secret", "a/#", true},
+		{"a/secret", "a/+", true},
+		{"a/+/c", "a/b/+", true},
+		{"a/b/#", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b/c", "a/+", false},
+	} {
+		assert.Equal(c.intersect, intersectFilter(c.f1, c.f2), "%v %v", c.f1, c.f2)
+		assert.Equal(c.intersect, intersectFilter(c.f2, c.f1), "%v %v", c.f2, c.f1)
+	}
+
+	assert.Equal("a/b", trimSharedPrefix("$share/g/a/b"))
+	assert.Equal("a/b", trimSharedPrefix("a/b"))
+
+	filter, ok := replacePlaceholders("users/%u/%c/#", "alice", "phone")
+	assert.True(ok)
+	assert.Equal("users/alice/phone/#", filter)
+	_, ok = replacePlaceholders("users/%u/#", "", "phone")
+	assert.False(ok)
+	_, ok = replacePlaceholders("users/%c/#", "alice", "a/+")
+	assert.False(ok)
+}
+
+func TestMQTTACL(t *testing.T) {
+	assert := assert.New(t)
+
+	a := &MQTTACL{}
+	assert.Equal(Kind, a.Kind())
+	assert.NotNil(a.DefaultSpec())
+	assert.NotEmpty(a.Description())
+	assert.Equal([]string{resultDenied}, a.Results())
+
+	a = newACL(&Spec{
+		Rules: []*Rule{
+			{Permission: "deny", Topics: []string{"users/+/secret"}},
+			{Permission: "allow", Topics: []string{"users/%u/#"}},
+			{Permission: "allow", Action: "subscribe", Topics: []string{"broadcast/#"}},
+			{Permission: "allow", Action: "publish", ClientID: "admin", Topics: []string{"#"}},
+		},
+	})
+	defer a.Close()
+
+	alice := newClient("alice", "phone")
+	admin := newClient("root", "admin")
+	for _, c := range []struct {
+		ctx    context.MQTTContext
+		result string
+	}{
+		{newPublishContext(alice, "users/alice/status"), ""},
+		{newPublishContext(alice, "users/bob/status"), resultDenied},
+		{newPublishContext(alice, "users/alice/secret"), resultDenied},
+		{newPublishContext(alice, "broadcast/news"), resultDenied},
+		{newPublishContext(admin, "broadcast/news"), ""},
+		{newSubscribeContext(alice, "users/alice/status", "broadcast/#", "$share/g/users/alice/cmd"), ""},
+		// wildcards can't bypass deny rules
+		{newSubscribeContext(alice, "users/alice/+"), resultDenied},
+		{newSubscribeContext(alice, "users/alice/status", "users/bob/status"), resultDenied},
+		{newSubscribeContext(admin, "broadcast/#"), ""},
+		{newSubscribeContext(admin, "users/root/#"), resultDenied},
+	} {
+		assert.Equal(c.result, a.HandleMQTT(c.ctx).ErrString)
+		assert.Equal(c.result != "", c.ctx.Drop())
+		assert.Equal(c.result != "", c.ctx.EarlyStop())
+	}
+
+	ctx := newPublishContext(alice, "users/bob/status")
+	a.HandleMQTT(ctx)
+	assert.Equal(byte(packets5.PubackNotAuthorized), ctx.ReasonCode())
+
+	// other packets are not checked
+	packet := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	packet.Topics = []string{"users/bob/status"}
+	ctx = context.NewMQTTContext(stdcontext.Background(), alice, packet)
+	assert.Equal("", a.HandleMQTT(ctx).ErrString)
+
+	status := a.Status().(*Status)
+	assert.Equal(4, status.Rules)
+	assert.Equal(uint64(4), status.Allowed)
+	assert.Equal(map[string]uint64{
+		"publishDenied":    1,
+		"publishNoMatch":   3,
+		"subscribeDenied":  2,
+		"subscribeNoMatch": 1,
+	}, status.DeniedReasons)
+
+	a = newACL(&Spec{NoMatch: "allow"})
+	defer a.Close()
+	assert.Equal("", a.HandleMQTT(newPublishContext(alice, "a/b")).ErrString)
+}
+
+func TestRuleSources(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Panics(func() { newACL(&Spec{RuleFile: "not-exist.yaml"}) })
+
+	file, err := os.CreateTemp("", "acl-*.yaml")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+	file.WriteString(`
+- permission: allow
+  action: publish
+  username: alice
+  topics: ["file/#"]
+`)
+	file.Close()
+
+	a := newACL(&Spec{
+		Rules:      []*Rule{{Permission: "deny", Topics: []string{"file/secret"}}},
+		RuleFile:   file.Name(),
+		EtcdPrefix: "acl",
+	})
+	defer a.Close()
+	assert.Equal("/custom-data/acl/", a.etcdPrefix())
+
+	alice := newClient("alice", "phone")
+	assert.Equal("", a.HandleMQTT(newPublishContext(alice, "file/a")).ErrString)
+	assert.Equal(resultDenied, a.HandleMQTT(newPublishContext(alice, "file/secret")).ErrString)
+	assert.Equal(resultDenied, a.HandleMQTT(newPublishContext(alice, "store/a")).ErrString)
+
+	// rules in cluster storage are checked in order of keys, invalid ones are ignored
+	a.setStoreRules(map[string]string{
+		"/custom-data/acl/2": "- permission: allow\n  topics: [store/#]",
+		"/custom-data/acl/1": "- permission: deny\n  topics: [store/secret]",
+		"/custom-data/acl/0": "invalid: [",
+	})
+	assert.Equal(4, a.Status().(*Status).Rules)
+	assert.Equal("", a.HandleMQTT(newPublishContext(alice, "store/a")).ErrString)
+	assert.Equal(resultDenied, a.HandleMQTT(newPublishContext(alice, "store/secret")).ErrString)
+}
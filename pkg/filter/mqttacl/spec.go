@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttacl
+
+type (
+	// Spec is spec of MQTTACL. Rules are checked in order of rules, rules of
+	// ruleFile and rules in cluster storage, and the first matched rule wins.
+	// etcdPrefix: rules are stored in cluster storage with keys /custom-data/{etcdPrefix}/{name},
+	// value of every key is a yaml list of rules, keys are checked in order.
+	// noMatch: permission when no rule matches, default deny.
+	Spec struct {
+		Rules      []*Rule `yaml:"rules" jsonschema:"omitempty"`
+		RuleFile   string  `yaml:"ruleFile" jsonschema:"omitempty"`
+		EtcdPrefix string  `yaml:"etcdPrefix" jsonschema:"omitempty"`
+		NoMatch    string  `yaml:"noMatch" jsonschema:"omitempty,enum=,enum=allow,enum=deny"`
+	}
+
+	// Rule allows or denies clients to publish or subscribe topics.
+	// action: publish, subscribe or all, default all
+	// username, clientID: the rule only applies to the client, empty for all clients
+	// topics: topic filters, %u is replaced by username and %c by client id
+	Rule struct {
+		Permission string   `yaml:"permission" jsonschema:"required,enum=allow,enum=deny"`
+		Action     string   `yaml:"action" jsonschema:"omitempty,enum=,enum=publish,enum=subscribe,enum=all"`
+		Username   string   `yaml:"username" jsonschema:"omitempty"`
+		ClientID   string   `yaml:"clientID" jsonschema:"omitempty"`
+		Topics     []string `yaml:"topics" jsonschema:"required"`
+	}
+
+	// Status is status of MQTTACL.
+	// deniedReasons: number of denied packets of reasons publishDenied, publishNoMatch,
+	// subscribeDenied and subscribeNoMatch.
+	Status struct {
+		Rules         int               `yaml:"rules"`
+		Allowed       uint64            `yaml:"allowed"`
+		DeniedReasons map[string]uint64 `yaml:"deniedReasons"`
+	}
+)
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttclientauth
+
+import (
+	stdcontext "context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const (
+	// customDataPrefix is prefix of credentials in cluster storage
+	customDataPrefix = "/custom-data/"
+
+	pbkdf2Prefix = "pbkdf2:"
+	// verifiedCacheSize is the size of cache of verified passwords, since
+	// bcrypt and pbkdf2 are slow by design.
+	verifiedCacheSize = 10000
+)
+
+type (
+	// Credentials authenticates clients with salted password hashes stored in cluster storage
+	// with keys /custom-data/{etcdPrefix}/{username}, value of a key is the password hash in
+	// bcrypt format like $2a$10$..., or pbkdf2 format pbkdf2:{sha1|sha256|sha512}:{iterations}${salt}${hex hash}.
+	Credentials struct {
+		EtcdPrefix string `yaml:"etcdPrefix" jsonschema:"required"`
+	}
+
+	credentialAuth struct {
+		spec *Credentials
+		// hashes is map[string]string from username to password hash
+		hashes   atomic.Value
+		verified *lru.Cache
+		cluster  cluster.Cluster
+		cancel   stdcontext.CancelFunc
+	}
+)
+
+func newCredentialAuth(spec *Credentials, cls cluster.Cluster) *credentialAuth {
+	a := &credentialAuth{spec: spec}
+	a.hashes.Store(map[string]string{})
+	a.verified, _ = lru.New(verifiedCacheSize)
+
+	var ctx stdcontext.Context
+	ctx, a.cancel = stdcontext.WithCancel(stdcontext.Background())
+	if cls != nil {
+		a.cluster = cls
+		go a.sync(ctx)
+	}
+	return a
+}
+
+func (a *credentialAuth) etcdPrefix() string {
+	return customDataPrefix + strings.Trim(a.spec.EtcdPrefix, "/") + "/"
+}
+
+// sync syncs password hashes from cluster storage until ctx is done.
+func (a *credentialAuth) sync(ctx stdcontext.Context) {
+	var (
+		syncer *cluster.Syncer
+		err    error
+		ch     <-chan map[string]string
+	)
+
+	for {
+		syncer, err = a.cluster.Syncer(time.Minute)
+		if err != nil {
+			logger.Errorf("create syncer for credentials failed: %v", err)
+		} else if ch, err = syncer.SyncPrefix(a.etcdPrefix()); err != nil {
+			logger.Errorf("sync credentials with prefix %v failed: %v", a.etcdPrefix(), err)
+			syncer.Close()
+		} else {
+			break
+		}
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+	defer syncer.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case kvs := <-ch:
+			a.setHashes(kvs)
+		}
+	}
+}
+
+func (a *credentialAuth) setHashes(kvs map[string]string) {
+	hashes := make(map[string]string, len(kvs))
+	for k, v := range kvs {
+		hashes[strings.TrimPrefix(k, a.etcdPrefix())] = strings.TrimSpace(v)
+	}
+	a.hashes.Store(hashes)
+}
+
+func (a *credentialAuth) authenticate(connect *packets.ConnectPacket) error {
+	hash, ok := a.hashes.Load().(map[string]string)[connect.Username]
+	if !ok {
+		return fmt.Errorf("credential of user %v not found", connect.Username)
+	}
+	// the cache key changes when the hash changes, so old passwords don't work anymore
+	key := hash + "\x00" + sha256Sum(connect.Password)
+	if a.verified.Contains(key) {
+		return nil
+	}
+	if err := verifyPassword(hash, connect.Password); err != nil {
+		return err
+	}
+	a.verified.Add(key, struct{}{})
+	return nil
+}
+
+func (a *credentialAuth) close() {
+	a.cancel()
+}
+
+// verifyPassword verifies password by its hash in bcrypt or pbkdf2 format.
+func verifyPassword(hashed string, password []byte) error {
+	if !strings.HasPrefix(hashed, pbkdf2Prefix) {
+		return bcrypt.CompareHashAndPassword([]byte(hashed), password)
+	}
+
+	// pbkdf2:sha256:260000$salt$hash
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid pbkdf2 hash")
+	}
+	method := strings.Split(strings.TrimPrefix(parts[0], pbkdf2Prefix), ":")
+	if len(method) != 2 {
+		return fmt.Errorf("invalid pbkdf2 method %v", parts[0])
+	}
+	var h func() hash.Hash
+	switch method[0] {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha512":
+		h = sha512.New
+	default:
+		return fmt.Errorf("unsupported pbkdf2 hash function %v", method[0])
+	}
+	iterations, err := strconv.Atoi(method[1])
+	if err != nil || iterations <= 0 {
+		return fmt.Errorf("invalid pbkdf2 iterations %v", method[1])
+	}
+	want, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid pbkdf2 hash: %v", err)
+	}
+	got := pbkdf2.Key(password, []byte(parts[1]), iterations, len(want), h)
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return fmt.Errorf("password mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttclientauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	defaultHookTimeout   = 3 * time.Second
+	defaultHookCacheSize = 10000
+
+	hookResultDeny = "deny"
+)
+
+type (
+	// HTTPHook asks an external service whether a client is allowed to connect. The hook
+	// is sent a POST request with json body {"clientID", "username", "password"}, the client is
+	// allowed if the status code is 200 or 204, unless the json body of response is {"result": "deny"}.
+	// timeout: timeout of requests, default 3s
+	// cacheTTL: time to cache results, results are not cached if it is empty
+	// cacheSize: max number of cached results, default 10000
+	HTTPHook struct {
+		URL       string            `yaml:"url" jsonschema:"required,format=uri"`
+		Headers   map[string]string `yaml:"headers" jsonschema:"omitempty"`
+		Timeout   string            `yaml:"timeout" jsonschema:"omitempty,format=duration"`
+		CacheTTL  string            `yaml:"cacheTTL" jsonschema:"omitempty,format=duration"`
+		CacheSize int               `yaml:"cacheSize" jsonschema:"omitempty,minimum=1"`
+	}
+
+	hookAuth struct {
+		spec   *HTTPHook
+		client *http.Client
+		ttl    time.Duration
+		cache  *lru.Cache
+
+		requests  uint64
+		cacheHits uint64
+	}
+
+	hookRequest struct {
+		ClientID string `json:"clientID"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	hookResponse struct {
+		Result string `json:"result"`
+	}
+
+	hookResult struct {
+		err    error
+		expire time.Time
+	}
+)
+
+func newHookAuth(spec *HTTPHook) (*hookAuth, error) {
+	a := &hookAuth{spec: spec}
+	timeout := defaultHookTimeout
+	var err error
+	if spec.Timeout != "" {
+		timeout, err = time.ParseDuration(spec.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout of http hook: %v", err)
+		}
+	}
+	a.client = &http.Client{Timeout: timeout}
+
+	if spec.CacheTTL != "" {
+		a.ttl, err = time.ParseDuration(spec.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache ttl of http hook: %v", err)
+		}
+		size := spec.CacheSize
+		if size <= 0 {
+			size = defaultHookCacheSize
+		}
+		a.cache, _ = lru.New(size)
+	}
+	return a, nil
+}
+
+func (a *hookAuth) authenticate(connect *packets.ConnectPacket) error {
+	var key string
+	if a.cache != nil {
+		key = sha256Sum([]byte(connect.ClientIdentifier + "\x00" + connect.Username + "\x00" + string(connect.Password)))
+		if v, ok := a.cache.Get(key); ok {
+			r := v.(*hookResult)
+			if time.Now().Before(r.expire) {
+				atomic.AddUint64(&a.cacheHits, 1)
+				return r.err
+			}
+			a.cache.Remove(key)
+		}
+	}
+
+	allowed, err := a.request(connect)
+	if err != nil {
+		// failures of the hook are not cached
+		return err
+	}
+	if !allowed {
+		err = fmt.Errorf("client %v of user %v denied by http hook", connect.ClientIdentifier, connect.Username)
+	}
+	if a.cache != nil {
+		a.cache.Add(key, &hookResult{err: err, expire: time.Now().Add(a.ttl)})
+	}
+	return err
+}
+
+// request sends request to the hook, and returns whether the client is allowed.
+func (a *hookAuth) request(connect *packets.ConnectPacket) (bool, error) {
+	atomic.AddUint64(&a.requests, 1)
+	body, _ := json.Marshal(&hookRequest{
+		ClientID: connect.ClientIdentifier,
+		Username: connect.Username,
+		Password: string(connect.Password),
+	})
+	req, err := http.NewRequest(http.MethodPost, a.spec.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range a.spec.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("request http hook %v failed: %v", a.spec.URL, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return false, fmt.Errorf("read response of http hook %v failed: %v", a.spec.URL, err)
+		}
+		result := &hookResponse{}
+		// body is optional
+		if json.Unmarshal(data, result) == nil && result.Result == hookResultDeny {
+			return false, nil
+		}
+		return true, nil
+	case http.StatusNoContent:
+		return true, nil
+	default:
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode >= 500 {
+			return false, fmt.Errorf("http hook %v responded with status code %d", a.spec.URL, resp.StatusCode)
+		}
+		return false, nil
+	}
+}
+
+func (a *hookAuth) close() {
+	a.client.CloseIdleConnections()
+}
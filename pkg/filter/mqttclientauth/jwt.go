@@ -0,0 +1,258 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttclientauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	defaultJWKSRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits refreshing keys for tokens with unknown key id
+	jwksMinRefreshInterval = 10 * time.Second
+	jwksTimeout            = 5 * time.Second
+)
+
+type (
+	// JWT authenticates clients with JSON Web Token in password, the token is verified by
+	// one of secret, publicKey or keys from jwksURL.
+	// algorithm: signing algorithm of tokens, any algorithm supported by the key if empty
+	// secret: hex encoded secret for HMAC algorithms
+	// publicKey: PEM encoded RSA or ECDSA public key
+	// jwksURL: URL of JSON Web Key Set, keys are chosen by key id of tokens
+	// jwksRefreshInterval: interval to refresh keys from jwksURL, default 1h
+	// usernameClaim, clientIDClaim: claims must be equal to username or client id if set
+	JWT struct {
+		Algorithm           string `yaml:"algorithm" jsonschema:"omitempty,enum=,enum=HS256,enum=HS384,enum=HS512,enum=RS256,enum=RS384,enum=RS512,enum=ES256,enum=ES384,enum=ES512"`
+		Secret              string `yaml:"secret" jsonschema:"omitempty,pattern=^[A-Fa-f0-9]+$"`
+		PublicKey           string `yaml:"publicKey" jsonschema:"omitempty"`
+		JWKSURL             string `yaml:"jwksURL" jsonschema:"omitempty,format=uri"`
+		JWKSRefreshInterval string `yaml:"jwksRefreshInterval" jsonschema:"omitempty,format=duration"`
+		UsernameClaim       string `yaml:"usernameClaim" jsonschema:"omitempty"`
+		ClientIDClaim       string `yaml:"clientIDClaim" jsonschema:"omitempty"`
+	}
+
+	jwtAuth struct {
+		spec *JWT
+		key  interface{}
+		jwks *jwks
+	}
+
+	// jwks caches keys of JSON Web Key Set
+	jwks struct {
+		url      string
+		interval time.Duration
+		client   *http.Client
+
+		mu      sync.Mutex
+		keys    map[string]interface{}
+		fetched time.Time
+	}
+
+	jsonWebKey struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		K   string `json:"k"`
+	}
+)
+
+func newJWTAuth(spec *JWT) (*jwtAuth, error) {
+	a := &jwtAuth{spec: spec}
+	var err error
+	switch {
+	case spec.Secret != "":
+		a.key, err = hex.DecodeString(spec.Secret)
+	case spec.PublicKey != "":
+		a.key, err = jwt.ParseRSAPublicKeyFromPEM([]byte(spec.PublicKey))
+		if err != nil {
+			a.key, err = jwt.ParseECPublicKeyFromPEM([]byte(spec.PublicKey))
+		}
+	case spec.JWKSURL != "":
+		interval := defaultJWKSRefreshInterval
+		if spec.JWKSRefreshInterval != "" {
+			interval, err = time.ParseDuration(spec.JWKSRefreshInterval)
+		}
+		a.jwks = &jwks{
+			url:      spec.JWKSURL,
+			interval: interval,
+			client:   &http.Client{Timeout: jwksTimeout},
+		}
+	default:
+		err = fmt.Errorf("one of secret, publicKey and jwksURL is required")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt spec: %v", err)
+	}
+	return a, nil
+}
+
+func (a *jwtAuth) authenticate(connect *packets.ConnectPacket) error {
+	claims := jwt.MapClaims{}
+	// jwt.ParseWithClaims verifies signature and time based claims
+	_, err := jwt.ParseWithClaims(string(connect.Password), claims, func(token *jwt.Token) (interface{}, error) {
+		if a.spec.Algorithm != "" && token.Method.Alg() != a.spec.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Method.Alg())
+		}
+		if a.jwks == nil {
+			return a.key, nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		return a.jwks.key(kid)
+	})
+	if err != nil {
+		return err
+	}
+
+	for claim, want := range map[string]string{a.spec.UsernameClaim: connect.Username, a.spec.ClientIDClaim: connect.ClientIdentifier} {
+		if claim == "" {
+			continue
+		}
+		if got, _ := claims[claim].(string); got != want {
+			return fmt.Errorf("claim %v is %v, but want %v", claim, claims[claim], want)
+		}
+	}
+	return nil
+}
+
+func (a *jwtAuth) close() {}
+
+// key returns key of key id, keys are refreshed if they are out of date or the key id is unknown.
+func (j *jwks) key(kid string) (interface{}, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key, ok := j.find(kid)
+	since := time.Since(j.fetched)
+	if (!ok && since > jwksMinRefreshInterval) || since > j.interval {
+		keys, err := j.fetch()
+		if err != nil {
+			// keep using the old keys if refresh fails
+			if ok {
+				return key, nil
+			}
+			return nil, err
+		}
+		j.keys, j.fetched = keys, time.Now()
+		key, ok = j.find(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("key of id %q not found in jwks", kid)
+	}
+	return key, nil
+}
+
+// find finds key of key id, the only key is used if token has no key id.
+func (j *jwks) find(kid string) (interface{}, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, k := range j.keys {
+			return k, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func (j *jwks) fetch() (map[string]interface{}, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, fmt.Errorf("get jwks from %v failed: %v", j.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get jwks from %v failed: status code %d", j.url, resp.StatusCode)
+	}
+
+	set := struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return nil, fmt.Errorf("decode jwks from %v failed: %v", j.url, err)
+	}
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in jwks from %v: %v", k.Kid, j.url, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "oct":
+		return decode(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
@@ -23,8 +23,10 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"sync/atomic"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/cluster"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/pipeline"
@@ -45,17 +47,40 @@ func init() {
 type (
 	// MQTTClientAuth is used to check authentication for MQTT client
 	MQTTClientAuth struct {
-		filterSpec *pipeline.FilterSpec
-		spec       *Spec
-		authMap    map[string]string
+		filterSpec     *pipeline.FilterSpec
+		spec           *Spec
+		authMap        map[string]string
+		authenticators []authenticator
+		hook           *hookAuth
+
+		allowed uint64
+		denied  uint64
 	}
 
-	// Spec is spec for MQTTClientAuth
+	// Spec is spec for MQTTClientAuth, a client is allowed to connect if
+	// any of authFile, credentials, jwt and httpHook authenticates it.
 	// authFile format:
 	// - username: test
 	//   passBase64: dGVzdA==
 	Spec struct {
-		AuthFile string `yaml:"authFile" jsonschema:"required"`
+		AuthFile    string       `yaml:"authFile" jsonschema:"omitempty"`
+		Credentials *Credentials `yaml:"credentials" jsonschema:"omitempty"`
+		JWT         *JWT         `yaml:"jwt" jsonschema:"omitempty"`
+		HTTPHook    *HTTPHook    `yaml:"httpHook" jsonschema:"omitempty"`
+	}
+
+	// Status is status of MQTTClientAuth
+	Status struct {
+		Allowed       uint64 `yaml:"allowed"`
+		Denied        uint64 `yaml:"denied"`
+		HookRequests  uint64 `yaml:"hookRequests,omitempty"`
+		HookCacheHits uint64 `yaml:"hookCacheHits,omitempty"`
+	}
+
+	// authenticator authenticates client by CONNECT packet
+	authenticator interface {
+		authenticate(connect *packets.ConnectPacket) error
+		close()
 	}
 
 	// Auth describes username and password for MQTTProxy
@@ -128,7 +153,31 @@ func (a *MQTTClientAuth) Init(filterSpec *pipeline.FilterSpec) {
 		a.updateAuth(auth)
 	}
 
-	if len(a.authMap) == 0 {
+	a.authenticators = nil
+	if a.spec.Credentials != nil {
+		var cls cluster.Cluster
+		if filterSpec.Super() != nil {
+			cls = filterSpec.Super().Cluster()
+		}
+		a.authenticators = append(a.authenticators, newCredentialAuth(a.spec.Credentials, cls))
+	}
+	if a.spec.JWT != nil {
+		jwtAuth, err := newJWTAuth(a.spec.JWT)
+		if err != nil {
+			panic(err)
+		}
+		a.authenticators = append(a.authenticators, jwtAuth)
+	}
+	if a.spec.HTTPHook != nil {
+		hook, err := newHookAuth(a.spec.HTTPHook)
+		if err != nil {
+			panic(err)
+		}
+		a.hook = hook
+		a.authenticators = append(a.authenticators, hook)
+	}
+
+	if len(a.authMap) == 0 && len(a.authenticators) == 0 {
 		logger.Errorf("empty valid authentication for MQTT filter %v", filterSpec.Name())
 	}
 }
@@ -141,11 +190,22 @@ func (a *MQTTClientAuth) Inherit(filterSpec *pipeline.FilterSpec, previousGenera
 
 // Close close MQTTClientAuth
 func (a *MQTTClientAuth) Close() {
+	for _, auth := range a.authenticators {
+		auth.close()
+	}
 }
 
 // Status return status of MQTTClientAuth
 func (a *MQTTClientAuth) Status() interface{} {
-	return nil
+	status := &Status{
+		Allowed: atomic.LoadUint64(&a.allowed),
+		Denied:  atomic.LoadUint64(&a.denied),
+	}
+	if a.hook != nil {
+		status.HookRequests = atomic.LoadUint64(&a.hook.requests)
+		status.HookCacheHits = atomic.LoadUint64(&a.hook.cacheHits)
+	}
+	return status
 }
 
 func sha256Sum(data []byte) string {
@@ -157,14 +217,17 @@ func (a *MQTTClientAuth) checkAuth(connect *packets.ConnectPacket) string {
 	if connect.ClientIdentifier == "" {
 		return resultAuthFail
 	}
-	pass, ok := a.authMap[connect.Username]
-	if !ok {
-		return resultAuthFail
+	if pass, ok := a.authMap[connect.Username]; ok && pass == sha256Sum(connect.Password) {
+		return ""
 	}
-	if pass != sha256Sum(connect.Password) {
-		return resultAuthFail
+	for _, auth := range a.authenticators {
+		err := auth.authenticate(connect)
+		if err == nil {
+			return ""
+		}
+		logger.Debugf("client %v of user %v authentication failed: %v", connect.ClientIdentifier, connect.Username, err)
 	}
-	return ""
+	return resultAuthFail
 }
 
 // HandleMQTT handle MQTT context
@@ -174,8 +237,10 @@ func (a *MQTTClientAuth) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult
 	}
 	result := a.checkAuth(ctx.ConnectPacket())
 	if result != "" {
+		atomic.AddUint64(&a.denied, 1)
 		ctx.SetDisconnect()
 		return &context.MQTTResult{ErrString: resultAuthFail}
 	}
+	atomic.AddUint64(&a.allowed, 1)
 	return &context.MQTTResult{ErrString: ""}
 }
@@ -19,18 +19,35 @@ package mqttclientauth
 
 import (
 	stdcontext "context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/golang-jwt/jwt"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/pipeline"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func init() {
@@ -74,7 +91,7 @@ func TestAuth(t *testing.T) {
 	assert.Equal(&Spec{}, auth.DefaultSpec())
 	assert.NotEmpty(auth.Description())
 	assert.Equal(1, len(auth.Results()), "please update this case if add more results")
-	assert.Nil(auth.Status(), "please update this case if return status")
+	assert.Equal(&Status{}, auth.Status())
 
 	newAuth := &MQTTClientAuth{}
 	newAuth.Inherit(filterSpec, auth)
@@ -128,3 +145,209 @@ func TestAuthFile(t *testing.T) {
 		assert.Equal(test.disconnect, ctx.Disconnect(), fmt.Errorf("test case %+v got wrong result", test))
 	}
 }
+
+func checkAuth(t *testing.T, auth *MQTTClientAuth, cid, username, password string, allowed bool) {
+	ctx := newContext(cid, username, password)
+	auth.HandleMQTT(ctx)
+	assert.Equal(t, allowed, !ctx.Disconnect(), "client %v user %v password %v", cid, username, password)
+}
+
+func TestCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	assert.Nil(err)
+	pbkdf2Hash := "pbkdf2:sha256:1000$salt$" + hex.EncodeToString(pbkdf2.Key([]byte("pbkdf2-pass"), []byte("salt"), 1000, 32, sha256.New))
+
+	auth := &MQTTClientAuth{}
+	auth.Init(defaultFilterSpec(&Spec{Credentials: &Credentials{EtcdPrefix: "/mqtt-users/"}}))
+	defer auth.Close()
+	credential := auth.authenticators[0].(*credentialAuth)
+	assert.Equal("/custom-data/mqtt-users/", credential.etcdPrefix())
+	credential.setHashes(map[string]string{
+		"/custom-data/mqtt-users/alice": string(bcryptHash),
+		"/custom-data/mqtt-users/bob":   pbkdf2Hash + "\n",
+		"/custom-data/mqtt-users/eve":   "pbkdf2:md5:1000$salt$abcd",
+	})
+
+	for i := 0; i < 2; i++ {
+		checkAuth(t, auth, "c1", "alice", "bcrypt-pass", true)
+	}
+	checkAuth(t, auth, "c1", "alice", "wrong", false)
+	checkAuth(t, auth, "c2", "bob", "pbkdf2-pass", true)
+	checkAuth(t, auth, "c2", "bob", "wrong", false)
+	checkAuth(t, auth, "c3", "eve", "pass", false)
+	checkAuth(t, auth, "c4", "unknown", "pass", false)
+	checkAuth(t, auth, "", "alice", "bcrypt-pass", false)
+	assert.Equal(&Status{Allowed: 3, Denied: 5}, auth.Status())
+
+	// password doesn't work after the hash is changed
+	credential.setHashes(map[string]string{"/custom-data/mqtt-users/alice": pbkdf2Hash})
+	checkAuth(t, auth, "c1", "alice", "bcrypt-pass", false)
+
+	for _, hash := range []string{"pbkdf2:sha256$salt$abcd", "pbkdf2:sha256:x$salt$abcd", "pbkdf2:sha1:1$salt$xyz", "pbkdf2:sha512:1$salt"} {
+		assert.NotNil(verifyPassword(hash, []byte("pass")), hash)
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.Nil(t, err)
+	return s
+}
+
+func TestJWT(t *testing.T) {
+	assert := assert.New(t)
+
+	// secret
+	auth := &MQTTClientAuth{}
+	auth.Init(defaultFilterSpec(&Spec{JWT: &JWT{Algorithm: "HS256", Secret: "313233", UsernameClaim: "sub", ClientIDClaim: "cid"}}))
+	defer auth.Close()
+	claims := jwt.MapClaims{"sub": "alice", "cid": "phone", "exp": time.Now().Add(time.Hour).Unix()}
+	token := signToken(t, jwt.SigningMethodHS256, []byte("123"), "", claims)
+	checkAuth(t, auth, "phone", "alice", token, true)
+	checkAuth(t, auth, "phone", "bob", token, false)
+	checkAuth(t, auth, "tablet", "alice", token, false)
+	checkAuth(t, auth, "phone", "alice", signToken(t, jwt.SigningMethodHS256, []byte("456"), "", claims), false)
+	checkAuth(t, auth, "phone", "alice", signToken(t, jwt.SigningMethodHS384, []byte("123"), "", claims), false)
+	expired := jwt.MapClaims{"sub": "alice", "cid": "phone", "exp": time.Now().Add(-time.Hour).Unix()}
+	checkAuth(t, auth, "phone", "alice", signToken(t, jwt.SigningMethodHS256, []byte("123"), "", expired), false)
+	checkAuth(t, auth, "phone", "alice", "not a token", false)
+
+	// public key
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.Nil(t, err)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	auth = &MQTTClientAuth{}
+	auth.Init(defaultFilterSpec(&Spec{JWT: &JWT{PublicKey: publicKey}}))
+	defer auth.Close()
+	checkAuth(t, auth, "phone", "alice", signToken(t, jwt.SigningMethodRS256, rsaKey, "", claims), true)
+	// public key can't be used as HMAC secret
+	checkAuth(t, auth, "phone", "alice", signToken(t, jwt.SigningMethodHS256, []byte(publicKey), "", claims), false)
+
+	assert.Panics(func() { auth.Init(defaultFilterSpec(&Spec{JWT: &JWT{}})) })
+	assert.Panics(func() { auth.Init(defaultFilterSpec(&Spec{JWT: &JWT{PublicKey: "invalid"}})) })
+}
+
+func TestJWKS(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	encode := base64.RawURLEncoding.EncodeToString
+
+	var fetched int32
+	keys := []map[string]string{{
+		"kty": "RSA", "kid": "rsa", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	auth := &MQTTClientAuth{}
+	auth.Init(defaultFilterSpec(&Spec{JWT: &JWT{JWKSURL: server.URL}}))
+	defer auth.Close()
+	claims := jwt.MapClaims{"sub": "alice"}
+	checkAuth(t, auth, "phone", "alice", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims), true)
+	// the only key is used for token without key id
+	checkAuth(t, auth, "phone", "alice", signToken(t, jwt.SigningMethodRS256, rsaKey, "", claims), true)
+	assert.Equal(int32(1), atomic.LoadInt32(&fetched))
+
+	// keys are refreshed for unknown key id, but not too often
+	keys = append(keys, map[string]string{
+		"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes()),
+	}, map[string]string{"kty": "RSA", "kid": "enc", "use": "enc"})
+	ecToken := signToken(t, jwt.SigningMethodES256, ecKey, "ec", claims)
+	checkAuth(t, auth, "phone", "alice", ecToken, false)
+	assert.Equal(int32(1), atomic.LoadInt32(&fetched))
+	jwks := auth.authenticators[0].(*jwtAuth).jwks
+	jwks.fetched = time.Now().Add(-time.Minute)
+	checkAuth(t, auth, "phone", "alice", ecToken, true)
+	assert.Equal(int32(2), atomic.LoadInt32(&fetched))
+
+	_, err = (&jsonWebKey{Kty: "EC", Crv: "P-224"}).publicKey()
+	assert.NotNil(err)
+	_, err = (&jsonWebKey{Kty: "unknown"}).publicKey()
+	assert.NotNil(err)
+	key, err := (&jsonWebKey{Kty: "oct", K: encode([]byte("123"))}).publicKey()
+	assert.Nil(err)
+	assert.Equal([]byte("123"), key)
+}
+
+func TestHTTPHook(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		req := &hookRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		if r.Header.Get("X-Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.Username {
+		case "alice":
+			if req.Password == "pass" && req.ClientID == "phone" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Write([]byte(`{"result": "deny"}`))
+		case "bob":
+			w.Write([]byte(`{"result": "allow"}`))
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	auth := &MQTTClientAuth{}
+	auth.Init(defaultFilterSpec(&Spec{HTTPHook: &HTTPHook{
+		URL:      server.URL,
+		Headers:  map[string]string{"X-Token": "token"},
+		CacheTTL: "1h",
+	}}))
+	defer auth.Close()
+
+	for i := 0; i < 2; i++ {
+		checkAuth(t, auth, "phone", "alice", "pass", true)
+		checkAuth(t, auth, "phone", "alice", "wrong", false)
+		checkAuth(t, auth, "phone", "bob", "pass", true)
+		checkAuth(t, auth, "phone", "eve", "pass", false)
+		// failures of the hook are not cached
+		checkAuth(t, auth, "phone", "error", "pass", false)
+	}
+	assert.Equal(int32(6), atomic.LoadInt32(&requests))
+	assert.Equal(&Status{Allowed: 4, Denied: 6, HookRequests: 6, HookCacheHits: 4}, auth.Status())
+
+	// results expire
+	hook := auth.hook
+	hook.ttl = time.Millisecond
+	hook.cache.Purge()
+	checkAuth(t, auth, "phone", "bob", "pass", true)
+	time.Sleep(5 * time.Millisecond)
+	checkAuth(t, auth, "phone", "bob", "pass", true)
+	assert.Equal(int32(8), atomic.LoadInt32(&requests))
+
+	// without cache and with wrong header
+	auth = &MQTTClientAuth{}
+	auth.Init(defaultFilterSpec(&Spec{HTTPHook: &HTTPHook{URL: server.URL}}))
+	defer auth.Close()
+	checkAuth(t, auth, "phone", "alice", "pass", false)
+	checkAuth(t, auth, "phone", "alice", "pass", false)
+	assert.Equal(int32(10), atomic.LoadInt32(&requests))
+
+	assert.Panics(func() { auth.Init(defaultFilterSpec(&Spec{HTTPHook: &HTTPHook{URL: server.URL, Timeout: "x"}})) })
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	natsgo "github.com/nats-io/nats.go"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+	"github.com/megaease/easegress/pkg/util/mqttbackend"
+)
+
+const (
+	// Kind is the kind of NATS
+	Kind = "NATS"
+
+	resultGetDataFailed = "GetDataFailed"
+	resultSendFailed    = "SendFailed"
+)
+
+func init() {
+	pipeline.Register(&NATS{})
+}
+
+type (
+	// NATS is NATS backend for MQTT proxy
+	NATS struct {
+		filterSpec *pipeline.FilterSpec
+		spec       *Spec
+		conn       natsConn
+		sender     *mqttbackend.Sender
+
+		defaultTopic string
+	}
+
+	// natsConn is the part of *natsgo.Conn used by NATS
+	natsConn interface {
+		PublishMsg(m *natsgo.Msg) error
+		FlushTimeout(timeout time.Duration) error
+		Close()
+	}
+
+	// jetStream is the part of natsgo.JetStreamContext used by NATS
+	jetStream interface {
+		PublishMsg(m *natsgo.Msg, opts ...natsgo.PubOpt) (*natsgo.PubAck, error)
+	}
+
+	publisher struct {
+		conn    natsConn
+		js      jetStream
+		flush   bool
+		timeout time.Duration
+	}
+)
+
+var _ pipeline.Filter = (*NATS)(nil)
+var _ pipeline.MQTTFilter = (*NATS)(nil)
+
+// Kind return kind of NATS
+func (n *NATS) Kind() string {
+	return Kind
+}
+
+// DefaultSpec return default spec of NATS
+func (n *NATS) DefaultSpec() interface{} {
+	return &Spec{}
+}
+
+// Description return description of NATS
+func (n *NATS) Description() string {
+	return "NATS is a backend of MQTTProxy"
+}
+
+// Results return possible results of NATS
+func (n *NATS) Results() []string {
+	return []string{resultGetDataFailed, resultSendFailed}
+}
+
+// Init init NATS
+func (n *NATS) Init(filterSpec *pipeline.FilterSpec) {
+	if filterSpec.Protocol() != context.MQTT {
+		panic("filter NATS only support MQTT protocol for now")
+	}
+	n.filterSpec, n.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	if n.spec.Topic != nil {
+		n.defaultTopic = n.spec.Topic.Default
+	}
+
+	timeout := n.spec.Delivery.AttemptTimeout()
+	conn, err := natsgo.Connect(strings.Join(n.spec.Servers, ","), natsgo.Name(filterSpec.Name()),
+		natsgo.Timeout(timeout), natsgo.RetryOnFailedConnect(true), natsgo.MaxReconnects(-1))
+	if err != nil {
+		panic(fmt.Errorf("connect to nats %v failed: %v", n.spec.Servers, err))
+	}
+	var js jetStream
+	if n.spec.JetStream {
+		js, err = conn.JetStream(natsgo.MaxWait(timeout))
+		if err != nil {
+			conn.Close()
+			panic(fmt.Errorf("get jetstream of nats %v failed: %v", n.spec.Servers, err))
+		}
+	}
+	n.setConn(conn, js)
+}
+
+func (n *NATS) setConn(conn natsConn, js jetStream) {
+	n.conn = conn
+	p := &publisher{
+		conn:    conn,
+		js:      js,
+		flush:   n.spec.Delivery.AtLeastOnce(),
+		timeout: n.spec.Delivery.AttemptTimeout(),
+	}
+	n.sender = mqttbackend.NewSender(n.spec.Delivery, p)
+}
+
+// Inherit init NATS based on previous generation
+func (n *NATS) Inherit(filterSpec *pipeline.FilterSpec, previousGeneration pipeline.Filter) {
+	previousGeneration.Close()
+	n.Init(filterSpec)
+}
+
+// Close close NATS
+func (n *NATS) Close() {
+	n.sender.Close()
+	n.conn.Close()
+}
+
+// Status return status of NATS
+func (n *NATS) Status() interface{} {
+	return n.sender.Status()
+}
+
+// HandleMQTT handle MQTT context
+func (n *NATS) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult {
+	msg, ok := mqttbackend.GetMessage(ctx, n.spec.KVMap, n.defaultTopic, subject)
+	if !ok {
+		return &context.MQTTResult{ErrString: resultGetDataFailed}
+	}
+	if err := n.sender.Send(msg); err != nil {
+		logger.SpanErrorf(nil, "send message of client %v to nats subject %v failed: %v", msg.ClientID, msg.Topic, err)
+		ctx.SetDrop()
+		ctx.SetReasonCode(packets5.PubackUnspecifiedError)
+		return &context.MQTTResult{ErrString: resultSendFailed}
+	}
+	return &context.MQTTResult{}
+}
+
+// subject converts MQTT topic to NATS subject, levels of MQTT topic
+// are separated by '/', while tokens of NATS subject are separated by '.'.
+func subject(topic string) string {
+	return strings.ReplaceAll(topic, "/", ".")
+}
+
+func (p *publisher) Publish(msg *mqttbackend.Message) error {
+	m := natsgo.NewMsg(msg.Topic)
+	m.Data = msg.Payload
+	for k, v := range msg.Headers {
+		m.Header.Set(k, v)
+	}
+
+	if p.js != nil {
+		_, err := p.js.PublishMsg(m)
+		return err
+	}
+	if err := p.conn.PublishMsg(m); err != nil {
+		return err
+	}
+	// flush makes sure the message is received by the server
+	if p.flush {
+		return p.conn.FlushTimeout(p.timeout)
+	}
+	return nil
+}
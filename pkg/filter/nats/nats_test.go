@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nats
+
+import (
+	stdcontext "context"
+	"sync"
+	"testing"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+	"github.com/megaease/easegress/pkg/util/mqttbackend"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+// mockConn is an in-process NATS connection, it fails the first failures publishes.
+type mockConn struct {
+	mu       sync.Mutex
+	failures int
+	msgs     []*natsgo.Msg
+	flushed  int
+	closed   bool
+}
+
+func (m *mockConn) PublishMsg(msg *natsgo.Msg) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return natsgo.ErrConnectionClosed
+	}
+	m.msgs = append(m.msgs, msg)
+	return nil
+}
+
+func (m *mockConn) PublishMsgJS(msg *natsgo.Msg, opts ...natsgo.PubOpt) (*natsgo.PubAck, error) {
+	if err := m.PublishMsg(msg); err != nil {
+		return nil, err
+	}
+	return &natsgo.PubAck{Stream: "stream"}, nil
+}
+
+func (m *mockConn) FlushTimeout(timeout time.Duration) error {
+	m.mu.Lock()
+	m.flushed++
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *mockConn) Close() {
+	m.closed = true
+}
+
+type mockJetStream struct {
+	conn *mockConn
+}
+
+func (m *mockJetStream) PublishMsg(msg *natsgo.Msg, opts ...natsgo.PubOpt) (*natsgo.PubAck, error) {
+	return m.conn.PublishMsgJS(msg, opts...)
+}
+
+func defaultFilterSpec(spec *Spec) *pipeline.FilterSpec {
+	meta := &pipeline.FilterMetaSpec{
+		Name:     "nats-demo",
+		Kind:     Kind,
+		Pipeline: "pipeline-demo",
+		Protocol: context.MQTT,
+	}
+	return pipeline.MockFilterSpec(nil, nil, "", meta, spec)
+}
+
+func newContext(cid string, topic string, payload []byte, props *packets5.Properties) context.MQTTContext {
+	client := &context.MockMQTTClient{
+		MockClientID: cid,
+	}
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Payload = payload
+	return context.NewMQTT5Context(stdcontext.Background(), client, packet, props)
+}
+
+func newNATS(spec *Spec, conn *mockConn, js jetStream) *NATS {
+	n := &NATS{spec: spec}
+	n.setConn(conn, js)
+	return n
+}
+
+func TestNATS(t *testing.T) {
+	assert := assert.New(t)
+
+	n := &NATS{}
+	assert.Equal(Kind, n.Kind())
+	assert.NotNil(n.DefaultSpec())
+	assert.NotEmpty(n.Description())
+	assert.Len(n.Results(), 2)
+
+	meta := &pipeline.FilterMetaSpec{Name: "nats-demo", Kind: Kind, Pipeline: "pipeline-demo", Protocol: context.HTTP}
+	assert.Panics(func() { n.Init(pipeline.MockFilterSpec(nil, nil, "", meta, &Spec{})) })
+
+	conn := &mockConn{}
+	n = newNATS(&Spec{Servers: []string{"nats://localhost:4222"}}, conn, nil)
+	props := &packets5.Properties{ContentType: "application/json", User: []packets5.User{{Key: "k", Value: "v"}}}
+	ctx := newContext("client", "a/b/c", []byte("text"), props)
+	assert.Equal("", n.HandleMQTT(ctx).ErrString)
+
+	assert.Len(conn.msgs, 1)
+	msg := conn.msgs[0]
+	assert.Equal("a.b.c", msg.Subject)
+	assert.Equal("text", string(msg.Data))
+	assert.Equal("v", msg.Header.Get("k"))
+	assert.Equal("application/json", msg.Header.Get(mqttbackend.HeaderContentType))
+	assert.Equal(1, conn.flushed)
+
+	// topic from kv map is not converted
+	n.spec.KVMap = &mqttbackend.KVMap{TopicKey: "topic"}
+	ctx = newContext("client", "a/b/c", []byte("text"), nil)
+	assert.Equal(resultGetDataFailed, n.HandleMQTT(ctx).ErrString)
+	ctx.SetKV("topic", "mapped/topic")
+	assert.Equal("", n.HandleMQTT(ctx).ErrString)
+	assert.Equal("mapped/topic", conn.msgs[1].Subject)
+
+	assert.Equal(&mqttbackend.Stats{Sent: 2}, n.Status())
+	n.Close()
+	assert.True(conn.closed)
+}
+
+func TestNATSJetStream(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &mockConn{failures: 2}
+	spec := &Spec{
+		Servers:   []string{"nats://localhost:4222"},
+		JetStream: true,
+		Topic:     &Topic{Default: "default"},
+		KVMap:     &mqttbackend.KVMap{PayloadKey: "payload"},
+		Delivery:  &mqttbackend.Delivery{MaxRetries: 2, RetryInterval: "1ms"},
+	}
+	n := newNATS(spec, conn, &mockJetStream{conn: conn})
+	n.defaultTopic = spec.Topic.Default
+	defer n.Close()
+
+	ctx := newContext("client", "a/b/c", []byte("text"), nil)
+	ctx.SetKV("payload", []byte("mapped"))
+	assert.Equal("", n.HandleMQTT(ctx).ErrString)
+	assert.Len(conn.msgs, 1)
+	assert.Equal("mapped", string(conn.msgs[0].Data))
+	assert.Equal(0, conn.flushed)
+	assert.Equal(&mqttbackend.Stats{Sent: 1, Retried: 2}, n.Status())
+
+	// publish is dropped when message fails after retries
+	conn.failures = 3
+	ctx = newContext("client", "a/b/c", []byte("text"), nil)
+	ctx.SetKV("payload", []byte("mapped"))
+	assert.Equal(resultSendFailed, n.HandleMQTT(ctx).ErrString)
+	assert.True(ctx.Drop())
+	assert.Equal(byte(packets5.PubackUnspecifiedError), ctx.ReasonCode())
+}
+
+func TestNATSAtMostOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &mockConn{failures: 1}
+	spec := &Spec{
+		Servers:  []string{"nats://localhost:4222"},
+		Delivery: &mqttbackend.Delivery{Guarantee: mqttbackend.AtMostOnce},
+	}
+	n := newNATS(spec, conn, nil)
+	defer n.Close()
+
+	ctx := newContext("client", "a/b/c", []byte("text"), nil)
+	assert.Equal("", n.HandleMQTT(ctx).ErrString)
+	assert.Eventually(func() bool {
+		return n.sender.Status().Failed == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(0, conn.flushed)
+}
@@ -19,53 +19,139 @@ package proxy
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/util/httpheader"
 )
 
-// TODO: Expose more options: compression level, mime types.
+const (
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+	encodingZstd     = "zstd"
+	encodingDeflate  = "deflate"
+	encodingIdentity = "identity"
 
-var bodyFlushSize = 8 * int64(os.Getpagesize())
+	// 32MB
+	defaultMaxDecompressedBytes = 32 << 20
+)
+
+var (
+	bodyFlushSize = 8 * int64(os.Getpagesize())
+
+	errDecompressedBodyTooLarge = fmt.Errorf("decompressed body too large")
+)
 
 type (
-	gzipBody struct {
+	// compressBody compresses the body while it is being read.
+	compressBody struct {
 		body     io.Reader
 		buff     *bytes.Buffer
-		gw       *gzip.Writer
+		w        io.WriteCloser
 		complete bool
 	}
 
+	// decompressBody decompresses the body while it is being read.
+	decompressBody struct {
+		newReader func() (io.Reader, io.Closer, error)
+		r         io.Reader
+		closer    io.Closer
+		err       error
+		maxBytes  int64
+		count     int64
+		// exceeded is accessed atomically, since the body may be read
+		// by another goroutine, like the one sending the request.
+		exceeded int32
+	}
+
 	// compression is filter compression.
 	compression struct {
 		spec *CompressionSpec
+		// encodings are the encodings of the spec, or the default one
+		// if the spec doesn't specify any.
+		encodings []string
 	}
 
 	// CompressionSpec describes the compression.
 	CompressionSpec struct {
 		MinLength uint32 `yaml:"minLength"`
+		// Encodings are the encodings to compress responses, in the order
+		// of preference, the supported ones are gzip, br and zstd, default
+		// is gzip only.
+		Encodings []string `yaml:"encodings,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		// ContentTypes are the media types of responses to be compressed,
+		// wildcards like text/* are supported, all responses are compressed
+		// if empty.
+		ContentTypes []string `yaml:"contentTypes,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	}
+
+	// DecompressionSpec describes the decompression.
+	DecompressionSpec struct {
+		// Request decompresses request bodies for backends which can't.
+		Request bool `yaml:"request" jsonschema:"omitempty"`
+		// Response decompresses upstream-compressed response bodies, so
+		// that the filters could inspect them.
+		Response bool `yaml:"response" jsonschema:"omitempty"`
+		// MaxBytes limits the size of decompressed bodies, which protects
+		// backends and filters from compression bombs, default is 32MB.
+		MaxBytes int64 `yaml:"maxBytes" jsonschema:"omitempty,minimum=0"`
 	}
 )
 
+func (spec *DecompressionSpec) maxBytes() int64 {
+	if spec.MaxBytes > 0 {
+		return spec.MaxBytes
+	}
+	return defaultMaxDecompressedBytes
+}
+
+// Validate validates CompressionSpec.
+func (spec CompressionSpec) Validate() error {
+	for _, e := range spec.Encodings {
+		switch e {
+		case encodingGzip, encodingBrotli, encodingZstd:
+		default:
+			return fmt.Errorf("unsupported encoding %s", e)
+		}
+	}
+	return nil
+}
+
 func newCompression(spec *CompressionSpec) *compression {
+	encodings := spec.Encodings
+	if len(encodings) == 0 {
+		encodings = []string{encodingGzip}
+	}
 	return &compression{
-		spec: spec,
+		spec:      spec,
+		encodings: encodings,
 	}
 }
 
 func (c *compression) compress(ctx context.HTTPContext) {
-	if !c.acceptGzip(ctx) {
+	encoding := c.negotiate(ctx)
+	if encoding == "" {
+		return
+	}
+
+	if c.alreadyEncoded(ctx) {
 		return
 	}
 
-	if c.alreadyGziped(ctx) {
+	if !c.acceptContentType(ctx) {
 		return
 	}
 
@@ -78,19 +164,26 @@ func (c *compression) compress(ctx context.HTTPContext) {
 		return
 	}
 
+	body, err := newCompressBody(w.Body(), encoding)
+	if err != nil {
+		logger.Errorf("BUG: create %s body failed: %v", encoding, err)
+		return
+	}
+
 	ctx.Response().Header().Del(httpheader.KeyContentLength)
 
-	w.Header().Set(httpheader.KeyContentEncoding, "gzip")
+	w.Header().Set(httpheader.KeyContentEncoding, encoding)
 	w.Header().Add(httpheader.KeyVary, httpheader.KeyContentEncoding)
 
-	ctx.AddTag("gzip")
+	ctx.AddTag(encoding)
 
-	w.SetBody(newGzipBody(w.Body()))
+	w.SetBody(body)
 }
 
-func (c *compression) alreadyGziped(ctx context.HTTPContext) bool {
+func (c *compression) alreadyEncoded(ctx context.HTTPContext) bool {
 	for _, ce := range ctx.Response().Header().GetAll(httpheader.KeyContentEncoding) {
-		if strings.Contains(ce, "gzip") {
+		ce = strings.TrimSpace(ce)
+		if ce != "" && !strings.EqualFold(ce, encodingIdentity) {
 			return true
 		}
 	}
@@ -98,22 +191,96 @@ func (c *compression) alreadyGziped(ctx context.HTTPContext) bool {
 	return false
 }
 
-func (c *compression) acceptGzip(ctx context.HTTPContext) bool {
+// negotiate returns the encoding of the highest qvalue in the
+// Accept-Encoding header, the preference of the spec breaks ties.
+// It returns an empty string if none of the encodings is acceptable.
+// Reference: https://datatracker.ietf.org/doc/html/rfc7231#section-5.3.4
+func (c *compression) negotiate(ctx context.HTTPContext) string {
 	acceptEncodings := ctx.Request().Header().GetAll(httpheader.KeyAcceptEncoding)
 
-	// NOTE: Easegress does not support parsing qvalue for performance.
-	// Reference: https://tools.ietf.org/html/rfc2616#section-14.3
-	if len(acceptEncodings) > 0 {
-		for _, ae := range acceptEncodings {
-			if strings.Contains(ae, "*/*") ||
-				strings.Contains(ae, "gzip") {
-				return true
+	// For compatibility, gzip is used without Accept-Encoding.
+	if len(acceptEncodings) == 0 {
+		for _, e := range c.encodings {
+			if e == encodingGzip {
+				return e
+			}
+		}
+		return ""
+	}
+
+	qvalues := map[string]float64{}
+	wildcard := -1.0
+	for _, ae := range acceptEncodings {
+		for _, item := range strings.Split(ae, ",") {
+			coding, q := parseQValue(item)
+			switch coding {
+			case "":
+			// NOTE: */* is not a valid coding, but it was accepted
+			// by previous versions.
+			case "*", "*/*":
+				wildcard = q
+			case "x-gzip":
+				qvalues[encodingGzip] = q
+			default:
+				qvalues[coding] = q
 			}
 		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range c.encodings {
+		q, ok := qvalues[e]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// parseQValue parses an item of Accept-Encoding like 'gzip;q=0.8'.
+func parseQValue(item string) (string, float64) {
+	params := strings.Split(item, ";")
+	coding := strings.ToLower(strings.TrimSpace(params[0]))
+
+	q := 1.0
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if len(p) < 2 || (p[0] != 'q' && p[0] != 'Q') || p[1] != '=' {
+			continue
+		}
+		v, err := strconv.ParseFloat(p[2:], 64)
+		if err != nil || v < 0 || v > 1 {
+			v = 0
+		}
+		q = v
+	}
+
+	return coding, q
+}
+
+func (c *compression) acceptContentType(ctx context.HTTPContext) bool {
+	if len(c.spec.ContentTypes) == 0 {
+		return true
+	}
+
+	ct := ctx.Response().Header().Get(httpheader.KeyContentType)
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
 		return false
 	}
 
-	return true
+	for _, t := range c.spec.ContentTypes {
+		if t == mediaType {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *compression) parseContentLength(ctx context.HTTPContext) int {
@@ -130,46 +297,184 @@ func (c *compression) parseContentLength(ctx context.HTTPContext) int {
 	return int(cl)
 }
 
-func newGzipBody(body io.Reader) *gzipBody {
+func newCompressBody(body io.Reader, encoding string) (*compressBody, error) {
 	buff := bytes.NewBuffer(nil)
-	return &gzipBody{
+	cb := &compressBody{
 		body: body,
 		buff: buff,
-		gw:   gzip.NewWriter(buff),
 	}
+
+	switch encoding {
+	case encodingGzip:
+		cb.w = gzip.NewWriter(buff)
+	case encodingBrotli:
+		cb.w = brotli.NewWriter(buff)
+	case encodingZstd:
+		zw, err := zstd.NewWriter(buff, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		cb.w = zw
+	default:
+		return nil, fmt.Errorf("unsupported encoding %s", encoding)
+	}
+
+	return cb, nil
 }
 
-// body -> gw -> p
-func (gb *gzipBody) Read(p []byte) (int, error) {
-	if gb.complete {
+// body -> w -> p
+func (cb *compressBody) Read(p []byte) (int, error) {
+	if cb.complete {
 		return 0, io.EOF
 	}
 
-	if len(gb.buff.Bytes()) < len(p) {
-		gb.pull()
+	if len(cb.buff.Bytes()) < len(p) {
+		cb.pull()
 	}
 
-	n, err := gb.buff.Read(p)
-	if err == io.EOF && !gb.complete {
+	n, err := cb.buff.Read(p)
+	if err == io.EOF && !cb.complete {
 		err = nil
 	}
 
 	return n, err
 }
 
-func (gb *gzipBody) pull() {
-	_, err := io.CopyN(gb.gw, gb.body, bodyFlushSize)
+func (cb *compressBody) pull() {
+	_, err := io.CopyN(cb.w, cb.body, bodyFlushSize)
 	switch err {
 	case nil:
 		// Nothing to do.
 	case io.EOF:
-		err := gb.gw.Close()
+		err := cb.w.Close()
 		if err != nil {
-			logger.Errorf("BUG: close gzip failed: %v", err)
+			logger.Errorf("BUG: close compression writer failed: %v", err)
 		}
-		gb.complete = true
+		cb.complete = true
 	default:
-		gb.complete = true
-		logger.Errorf("BUG: copy body to gzip failed: %v", err)
+		cb.complete = true
+		logger.Errorf("BUG: copy body to compression writer failed: %v", err)
+	}
+}
+
+// decompress returns the decompressed body if it is compressed by a
+// supported encoding, Content-Encoding and Content-Length are removed
+// from the header at the same time. Reading the decompressed body fails
+// once it exceeds maxBytes. It returns nil if the body is not compressed.
+func decompress(header *httpheader.HTTPHeader, body io.Reader, maxBytes int64) (*decompressBody, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get(httpheader.KeyContentEncoding)))
+	if encoding == "" || encoding == encodingIdentity || body == nil {
+		return nil, nil
+	}
+
+	var newReader func() (io.Reader, io.Closer, error)
+	switch encoding {
+	case encodingGzip, "x-gzip":
+		newReader = func() (io.Reader, io.Closer, error) {
+			gr, err := gzip.NewReader(body)
+			return gr, gr, err
+		}
+	case encodingDeflate:
+		newReader = func() (io.Reader, io.Closer, error) {
+			fr := flate.NewReader(body)
+			return fr, fr, nil
+		}
+	case encodingBrotli:
+		newReader = func() (io.Reader, io.Closer, error) {
+			return brotli.NewReader(body), nil, nil
+		}
+	case encodingZstd:
+		newReader = func() (io.Reader, io.Closer, error) {
+			zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, nil, err
+			}
+			rc := zr.IOReadCloser()
+			return rc, rc, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %s", encoding)
+	}
+
+	header.Del(httpheader.KeyContentEncoding)
+	header.Del(httpheader.KeyContentLength)
+	return &decompressBody{newReader: newReader, maxBytes: maxBytes}, nil
+}
+
+// Read creates the reader lazily, because creating some of them reads
+// the body, and the body may not be ready yet.
+func (db *decompressBody) Read(p []byte) (int, error) {
+	if db.err != nil {
+		return 0, db.err
+	}
+
+	if db.r == nil {
+		db.r, db.closer, db.err = db.newReader()
+		if db.err != nil {
+			return 0, db.err
+		}
+	}
+
+	n, err := db.r.Read(p)
+	db.count += int64(n)
+	if db.count > db.maxBytes {
+		atomic.StoreInt32(&db.exceeded, 1)
+		n, err = 0, errDecompressedBodyTooLarge
+	}
+	if err != nil {
+		db.err = err
+		if db.closer != nil {
+			db.closer.Close()
+		}
+	}
+	return n, err
+}
+
+// tooLarge returns whether the decompressed body exceeded the limit.
+func (db *decompressBody) tooLarge() bool {
+	return atomic.LoadInt32(&db.exceeded) == 1
+}
+
+// decompressRequest decompresses the request body, it returns the
+// decompressed body, or nil if the body is not decompressed.
+func decompressRequest(ctx context.HTTPContext, maxBytes int64) *decompressBody {
+	r := ctx.Request()
+	body, err := decompress(r.Header(), r.Body(), maxBytes)
+	if err != nil {
+		ctx.AddTag(fmt.Sprintf("decompress request failed: %v", err))
+		return nil
+	}
+	if body != nil {
+		r.SetBody(body)
+	}
+	return body
+}
+
+// rejectDecompressedRequest replaces the response with 413 when the
+// decompressed request body is too large.
+func rejectDecompressedRequest(ctx context.HTTPContext) {
+	ctx.AddTag(errDecompressedBodyTooLarge.Error())
+
+	w := ctx.Response()
+	if closer, ok := w.Body().(io.Closer); ok {
+		closer.Close()
+	}
+	w.SetBody(nil)
+	w.Header().Del(httpheader.KeyContentLength)
+	// The rest of the request body is not read, so the connection can't
+	// be reused.
+	w.Header().Set("Connection", "close")
+	w.SetStatusCode(http.StatusRequestEntityTooLarge)
+}
+
+func decompressResponse(ctx context.HTTPContext, maxBytes int64) {
+	w := ctx.Response()
+	body, err := decompress(w.Header(), w.Body(), maxBytes)
+	if err != nil {
+		ctx.AddTag(fmt.Sprintf("decompress response failed: %v", err))
+		return
+	}
+	if body != nil {
+		w.SetBody(body)
 	}
 }
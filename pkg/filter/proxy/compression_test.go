@@ -18,12 +18,17 @@
 package proxy
 
 import (
+	"bytes"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+
 	"github.com/megaease/easegress/pkg/context/contexttest"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/util/httpheader"
@@ -35,8 +40,12 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-func TestAcceptGzip(t *testing.T) {
-	c := newCompression(&CompressionSpec{MinLength: 100})
+func TestNegotiate(t *testing.T) {
+	spec := &CompressionSpec{MinLength: 100}
+	c := newCompression(spec)
+	if spec.Encodings != nil {
+		t.Error("the default encoding should not be written to the spec")
+	}
 
 	header := http.Header{}
 	ctx := &contexttest.MockedHTTPContext{}
@@ -44,28 +53,54 @@ func TestAcceptGzip(t *testing.T) {
 		return httpheader.New(header)
 	}
 
-	if !c.acceptGzip(ctx) {
-		t.Error("accept gzip should be true")
+	if c.negotiate(ctx) != "gzip" {
+		t.Error("gzip should be accepted")
 	}
 
 	header.Add(httpheader.KeyAcceptEncoding, "text/text")
-	if c.acceptGzip(ctx) {
-		t.Error("accept gzip should be false")
+	if c.negotiate(ctx) != "" {
+		t.Error("gzip should not be accepted")
 	}
 
 	header.Add(httpheader.KeyAcceptEncoding, "*/*")
-	if !c.acceptGzip(ctx) {
-		t.Error("accept gzip should be true")
+	if c.negotiate(ctx) != "gzip" {
+		t.Error("gzip should be accepted")
 	}
 
 	header.Del(httpheader.KeyAcceptEncoding)
 	header.Add(httpheader.KeyAcceptEncoding, "gzip")
-	if !c.acceptGzip(ctx) {
-		t.Error("accept gzip should be true")
+	if c.negotiate(ctx) != "gzip" {
+		t.Error("gzip should be accepted")
+	}
+
+	c = newCompression(&CompressionSpec{Encodings: []string{"br", "zstd", "gzip"}})
+	cases := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1.0, br;q=0.5, zstd;q=0.8", "gzip"},
+		{"gzip;q=0, *;q=0.1", "br"},
+		{"*;q=0.5, br;q=0", "zstd"},
+		{"identity", ""},
+		{"br;q=0, zstd;q=0, gzip;q=0", ""},
+		{"ZSTD, GZIP;Q=0.9", "zstd"},
+		{"x-gzip", "gzip"},
+		{"br;q=abc, gzip", "gzip"},
+	}
+	for _, cs := range cases {
+		header.Del(httpheader.KeyAcceptEncoding)
+		if cs.acceptEncoding != "" {
+			header.Set(httpheader.KeyAcceptEncoding, cs.acceptEncoding)
+		}
+		if e := c.negotiate(ctx); e != cs.encoding {
+			t.Errorf("encoding of %q should be %q, but got %q", cs.acceptEncoding, cs.encoding, e)
+		}
 	}
 }
 
-func TestAlreadyGziped(t *testing.T) {
+func TestAlreadyEncoded(t *testing.T) {
 	c := newCompression(&CompressionSpec{MinLength: 100})
 
 	header := http.Header{}
@@ -74,18 +109,54 @@ func TestAlreadyGziped(t *testing.T) {
 		return httpheader.New(header)
 	}
 
-	if c.alreadyGziped(ctx) {
-		t.Error("already gziped should be false")
+	if c.alreadyEncoded(ctx) {
+		t.Error("already encoded should be false")
 	}
 
-	header.Add(httpheader.KeyContentEncoding, "text")
-	if c.alreadyGziped(ctx) {
-		t.Error("already gziped should be false")
+	header.Add(httpheader.KeyContentEncoding, "identity")
+	if c.alreadyEncoded(ctx) {
+		t.Error("already encoded should be false")
 	}
 
 	header.Add(httpheader.KeyContentEncoding, "gzip")
-	if !c.alreadyGziped(ctx) {
-		t.Error("already gziped should be true")
+	if !c.alreadyEncoded(ctx) {
+		t.Error("already encoded should be true")
+	}
+
+	header.Set(httpheader.KeyContentEncoding, "br")
+	if !c.alreadyEncoded(ctx) {
+		t.Error("already encoded should be true")
+	}
+}
+
+func TestAcceptContentType(t *testing.T) {
+	c := newCompression(&CompressionSpec{ContentTypes: []string{"application/json", "text/*"}})
+
+	header := http.Header{}
+	ctx := &contexttest.MockedHTTPContext{}
+	ctx.MockedResponse.MockedHeader = func() *httpheader.HTTPHeader {
+		return httpheader.New(header)
+	}
+
+	cases := map[string]bool{
+		"":                                false,
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"text/html":                       true,
+		"image/png":                       false,
+		"application/jsonp":               false,
+	}
+	for ct, accepted := range cases {
+		header.Set(httpheader.KeyContentType, ct)
+		if c.acceptContentType(ctx) != accepted {
+			t.Errorf("content type %q accepted should be %v", ct, accepted)
+		}
+	}
+
+	c = newCompression(&CompressionSpec{})
+	header.Set(httpheader.KeyContentType, "image/png")
+	if !c.acceptContentType(ctx) {
+		t.Error("all content types should be accepted")
 	}
 }
 
@@ -148,3 +219,150 @@ func TestCompress(t *testing.T) {
 	}
 
 }
+
+func TestCompressAndDecompress(t *testing.T) {
+	rawBody := strings.Repeat("this is the raw body. ", 1000)
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		c := newCompression(&CompressionSpec{Encodings: []string{encoding}})
+
+		reqHeader, respHeader := http.Header{}, http.Header{}
+		reqHeader.Set(httpheader.KeyAcceptEncoding, encoding)
+		ctx := &contexttest.MockedHTTPContext{}
+		ctx.MockedRequest.MockedHeader = func() *httpheader.HTTPHeader {
+			return httpheader.New(reqHeader)
+		}
+		ctx.MockedResponse.MockedHeader = func() *httpheader.HTTPHeader {
+			return httpheader.New(respHeader)
+		}
+		var body io.Reader = strings.NewReader(rawBody)
+		ctx.MockedResponse.MockedBody = func() io.Reader {
+			return body
+		}
+		ctx.MockedResponse.MockedSetBody = func(b io.Reader) {
+			body = b
+		}
+
+		c.compress(ctx)
+		if respHeader.Get(httpheader.KeyContentEncoding) != encoding {
+			t.Fatalf("body should be compressed by %s", encoding)
+		}
+		compressed, _ := io.ReadAll(body)
+		if len(compressed) >= len(rawBody) {
+			t.Errorf("body should be compressed by %s", encoding)
+		}
+
+		body = bytes.NewReader(compressed)
+		respHeader.Set(httpheader.KeyContentLength, strconv.Itoa(len(compressed)))
+		decompressResponse(ctx, defaultMaxDecompressedBytes)
+		if respHeader.Get(httpheader.KeyContentEncoding) != "" || respHeader.Get(httpheader.KeyContentLength) != "" {
+			t.Errorf("content encoding and length should be removed")
+		}
+		data, err := io.ReadAll(body)
+		if err != nil || string(data) != rawBody {
+			t.Errorf("decompress %s failed: %v", encoding, err)
+		}
+	}
+}
+
+func TestDecompressRequest(t *testing.T) {
+	header := http.Header{}
+	ctx := &contexttest.MockedHTTPContext{}
+	ctx.MockedRequest.MockedHeader = func() *httpheader.HTTPHeader {
+		return httpheader.New(header)
+	}
+	var body io.Reader = strings.NewReader("not compressed")
+	ctx.MockedRequest.MockedBody = func() io.Reader {
+		return body
+	}
+	ctx.MockedRequest.MockedSetBody = func(b io.Reader) {
+		body = b
+	}
+	ctx.MockedAddTag = func(tag string) {}
+
+	decompressRequest(ctx, defaultMaxDecompressedBytes)
+	if data, _ := io.ReadAll(body); string(data) != "not compressed" {
+		t.Error("body should not be changed")
+	}
+
+	buff := bytes.NewBuffer(nil)
+	fw, _ := flate.NewWriter(buff, flate.DefaultCompression)
+	fw.Write([]byte("compressed"))
+	fw.Close()
+	body = buff
+	header.Set(httpheader.KeyContentEncoding, "deflate")
+	decompressRequest(ctx, defaultMaxDecompressedBytes)
+	if data, _ := io.ReadAll(body); string(data) != "compressed" {
+		t.Error("body should be decompressed")
+	}
+
+	body = strings.NewReader("not gzip")
+	header.Set(httpheader.KeyContentEncoding, "gzip")
+	decompressRequest(ctx, defaultMaxDecompressedBytes)
+	if _, err := io.ReadAll(body); err == nil {
+		t.Error("decompress should fail")
+	}
+
+	body = strings.NewReader("unknown")
+	header.Set(httpheader.KeyContentEncoding, "compress")
+	decompressRequest(ctx, defaultMaxDecompressedBytes)
+	if header.Get(httpheader.KeyContentEncoding) != "compress" {
+		t.Error("unsupported encoding should be kept")
+	}
+}
+
+func TestDecompressBomb(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(buff)
+	gw.Write(make([]byte, 1<<20))
+	gw.Close()
+
+	reqHeader, respHeader := http.Header{}, http.Header{}
+	reqHeader.Set(httpheader.KeyContentEncoding, "gzip")
+	ctx := &contexttest.MockedHTTPContext{}
+	ctx.MockedRequest.MockedHeader = func() *httpheader.HTTPHeader {
+		return httpheader.New(reqHeader)
+	}
+	var body io.Reader = buff
+	ctx.MockedRequest.MockedBody = func() io.Reader {
+		return body
+	}
+	ctx.MockedRequest.MockedSetBody = func(b io.Reader) {
+		body = b
+	}
+	ctx.MockedResponse.MockedHeader = func() *httpheader.HTTPHeader {
+		return httpheader.New(respHeader)
+	}
+	var respBody io.Reader = strings.NewReader("response")
+	ctx.MockedResponse.MockedBody = func() io.Reader {
+		return respBody
+	}
+	ctx.MockedResponse.MockedSetBody = func(b io.Reader) {
+		respBody = b
+	}
+	code := 0
+	ctx.MockedResponse.MockedSetStatusCode = func(c int) {
+		code = c
+	}
+	ctx.MockedAddTag = func(tag string) {}
+
+	db := decompressRequest(ctx, 1024)
+	if db == nil {
+		t.Fatalf("body should be decompressed")
+	}
+	data, err := io.ReadAll(body)
+	if err != errDecompressedBodyTooLarge {
+		t.Errorf("want error %v, got %v", errDecompressedBodyTooLarge, err)
+	}
+	if len(data) > 1024 {
+		t.Errorf("read %d bytes, more than the limit", len(data))
+	}
+	if !db.tooLarge() {
+		t.Fatalf("decompressed body should be too large")
+	}
+
+	rejectDecompressedRequest(ctx)
+	if code != http.StatusRequestEntityTooLarge || respBody != nil {
+		t.Errorf("response should be replaced by 413, got %d", code)
+	}
+}
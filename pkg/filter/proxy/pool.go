@@ -18,11 +18,13 @@
 package proxy
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	gohttpstat "github.com/tcnksm/go-httpstat"
@@ -36,6 +38,7 @@ import (
 	"github.com/megaease/easegress/pkg/util/httpheader"
 	"github.com/megaease/easegress/pkg/util/httpstat"
 	"github.com/megaease/easegress/pkg/util/memorycache"
+	"github.com/megaease/easegress/pkg/util/signer"
 	"github.com/megaease/easegress/pkg/util/stringtool"
 )
 
@@ -51,6 +54,7 @@ type (
 		servers     *servers
 		httpStat    *httpstat.HTTPStat
 		memoryCache *memorycache.MemoryCache
+		signer      *signer.Signer
 	}
 
 	// PoolSpec describes a pool of servers.
@@ -63,6 +67,7 @@ type (
 		ServiceName     string            `yaml:"serviceName" jsonschema:"omitempty"`
 		LoadBalance     *LoadBalance      `yaml:"loadBalance" jsonschema:"required"`
 		MemoryCache     *memorycache.Spec `yaml:"memoryCache,omitempty" jsonschema:"omitempty"`
+		RequestSigner   *signer.Spec      `yaml:"requestSigner,omitempty" jsonschema:"omitempty"`
 	}
 
 	// PoolStatus is the status of Pool.
@@ -95,6 +100,12 @@ func (s PoolSpec) Validate() error {
 		}
 	}
 
+	if s.RequestSigner != nil {
+		if s.RequestSigner.AccessKeyID == "" || s.RequestSigner.AccessKeySecret == "" {
+			return fmt.Errorf("requestSigner: accessKeyId and accessKeySecret are required")
+		}
+	}
+
 	return nil
 }
 
@@ -111,6 +122,11 @@ func newPool(super *supervisor.Supervisor, spec *PoolSpec, tagPrefix string,
 		memoryCache = memorycache.New(spec.MemoryCache)
 	}
 
+	var requestSigner *signer.Signer
+	if spec.RequestSigner != nil {
+		requestSigner = signer.CreateFromSpec(spec.RequestSigner)
+	}
+
 	return &pool{
 		spec: spec,
 
@@ -121,6 +137,7 @@ func newPool(super *supervisor.Supervisor, spec *PoolSpec, tagPrefix string,
 		servers:     newServers(super, spec),
 		httpStat:    httpstat.New(),
 		memoryCache: memoryCache,
+		signer:      requestSigner,
 	}
 }
 
@@ -181,6 +198,14 @@ func (p *pool) handle(ctx context.HTTPContext, reqBody io.Reader, client *http.C
 		return resultInternalError
 	}
 
+	if p.signer != nil {
+		if err := p.signRequest(req); err != nil {
+			addLazyTag("signErr", err.Error(), -1)
+			setStatusCode(http.StatusInternalServerError)
+			return resultInternalError
+		}
+	}
+
 	resp, span, err := p.doRequest(ctx, req, client)
 	if err != nil {
 		// NOTE: May add option to cancel the tracing if failed here.
@@ -235,6 +260,32 @@ func (p *pool) prepareRequest(
 	return p.newRequest(ctx, server, reqBody, requestPool, httpstatResultPool)
 }
 
+// signRequest signs the request to the upstream server, it must be called
+// after the request was prepared, because the host is part of the signature.
+func (p *pool) signRequest(req *request) error {
+	stdr := req.std
+
+	// the header is shared with the context and other pools.
+	stdr.Header = stdr.Header.Clone()
+
+	// the body must have a known length, otherwise it will be sent in chunks
+	// and the Content-Length header which may be signed is dropped.
+	if !p.spec.RequestSigner.ExcludeBody && stdr.Body != nil && stdr.Body != http.NoBody {
+		body, err := io.ReadAll(stdr.Body)
+		if err != nil {
+			return fmt.Errorf("read body failed: %v", err)
+		}
+		stdr.Body.Close()
+		stdr.Body = io.NopCloser(bytes.NewReader(body))
+		stdr.ContentLength = int64(len(body))
+		stdr.Header.Set(httpheader.KeyContentLength, strconv.Itoa(len(body)))
+	} else {
+		stdr.Header.Del(httpheader.KeyContentLength)
+	}
+
+	return p.signer.NewContext(time.Now(), p.spec.RequestSigner.Scopes...).Sign(stdr)
+}
+
 func (p *pool) doRequest(ctx context.HTTPContext, req *request, client *http.Client) (*http.Response, tracing.Span, error) {
 	req.start()
 
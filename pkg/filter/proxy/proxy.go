@@ -30,6 +30,7 @@ import (
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/cachepurge"
 	"github.com/megaease/easegress/pkg/util/fallback"
 )
 
@@ -73,19 +74,22 @@ type (
 		client *http.Client
 
 		compression *compression
+
+		purgeWatcher *cachepurge.Watcher
 	}
 
 	// Spec describes the Proxy.
 	Spec struct {
-		Fallback            *FallbackSpec    `yaml:"fallback,omitempty" jsonschema:"omitempty"`
-		MainPool            *PoolSpec        `yaml:"mainPool" jsonschema:"required"`
-		CandidatePools      []*PoolSpec      `yaml:"candidatePools,omitempty" jsonschema:"omitempty"`
-		MirrorPool          *PoolSpec        `yaml:"mirrorPool,omitempty" jsonschema:"omitempty"`
-		FailureCodes        []int            `yaml:"failureCodes" jsonschema:"omitempty,uniqueItems=true,format=httpcode-array"`
-		Compression         *CompressionSpec `yaml:"compression,omitempty" jsonschema:"omitempty"`
-		MTLS                *MTLS            `yaml:"mtls,omitempty" jsonschema:"omitempty"`
-		MaxIdleConns        int              `yaml:"maxIdleConns" jsonschema:"omitempty"`
-		MaxIdleConnsPerHost int              `yaml:"maxIdleConnsPerHost" jsonschema:"omitempty"`
+		Fallback            *FallbackSpec      `yaml:"fallback,omitempty" jsonschema:"omitempty"`
+		MainPool            *PoolSpec          `yaml:"mainPool" jsonschema:"required"`
+		CandidatePools      []*PoolSpec        `yaml:"candidatePools,omitempty" jsonschema:"omitempty"`
+		MirrorPool          *PoolSpec          `yaml:"mirrorPool,omitempty" jsonschema:"omitempty"`
+		FailureCodes        []int              `yaml:"failureCodes" jsonschema:"omitempty,uniqueItems=true,format=httpcode-array"`
+		Compression         *CompressionSpec   `yaml:"compression,omitempty" jsonschema:"omitempty"`
+		Decompression       *DecompressionSpec `yaml:"decompression,omitempty" jsonschema:"omitempty"`
+		MTLS                *MTLS              `yaml:"mtls,omitempty" jsonschema:"omitempty"`
+		MaxIdleConns        int                `yaml:"maxIdleConns" jsonschema:"omitempty"`
+		MaxIdleConnsPerHost int                `yaml:"maxIdleConnsPerHost" jsonschema:"omitempty"`
 	}
 
 	// FallbackSpec describes the fallback policy.
@@ -240,6 +244,11 @@ func (b *Proxy) reload() {
 		b.compression = newCompression(b.spec.Compression)
 	}
 
+	if super != nil && b.hasMemoryCache() {
+		b.purgeWatcher = cachepurge.Watch(super.Cluster(),
+			b.filterSpec.Pipeline(), b.filterSpec.Name(), b.purgeMemoryCache)
+	}
+
 	b.client = &http.Client{
 		// NOTE: Timeout could be no limit, real client or server could cancel it.
 		Timeout: 0,
@@ -266,6 +275,32 @@ func (b *Proxy) reload() {
 	}
 }
 
+func (b *Proxy) hasMemoryCache() bool {
+	if b.mainPool.memoryCache != nil {
+		return true
+	}
+	for _, p := range b.candidatePools {
+		if p.memoryCache != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeMemoryCache purges the memory cache of all pools.
+func (b *Proxy) purgeMemoryCache(key string, prefix bool) int {
+	count := 0
+	if b.mainPool.memoryCache != nil {
+		count += b.mainPool.memoryCache.Purge(key, prefix)
+	}
+	for _, p := range b.candidatePools {
+		if p.memoryCache != nil {
+			count += p.memoryCache.Purge(key, prefix)
+		}
+	}
+	return count
+}
+
 // Status returns Proxy status.
 func (b *Proxy) Status() interface{} {
 	s := &Status{
@@ -284,6 +319,10 @@ func (b *Proxy) Status() interface{} {
 
 // Close closes Proxy.
 func (b *Proxy) Close() {
+	if b.purgeWatcher != nil {
+		b.purgeWatcher.Close()
+	}
+
 	b.mainPool.close()
 
 	if b.candidatePools != nil {
@@ -316,6 +355,11 @@ func (b *Proxy) Handle(ctx context.HTTPContext) (result string) {
 }
 
 func (b *Proxy) handle(ctx context.HTTPContext) (result string) {
+	var decompressed *decompressBody
+	if b.spec.Decompression != nil && b.spec.Decompression.Request {
+		decompressed = decompressRequest(ctx, b.spec.Decompression.maxBytes())
+	}
+
 	if b.mirrorPool != nil && b.mirrorPool.filter.Filter(ctx) {
 		primaryBody, secondaryBody := newPrimarySecondaryReader(ctx.Request().Body())
 		ctx.Request().SetBody(primaryBody)
@@ -344,11 +388,26 @@ func (b *Proxy) handle(ctx context.HTTPContext) (result string) {
 		p = b.mainPool
 	}
 
-	if p.memoryCache != nil && p.memoryCache.Load(ctx) {
-		return ""
+	if p.memoryCache != nil {
+		if p.memoryCache.Load(ctx) {
+			return ""
+		}
+		// Concurrent misses of the same key wait for the first one,
+		// instead of stampeding the backend.
+		if p.memoryCache.Coalesce(ctx) && p.memoryCache.Load(ctx) {
+			return ""
+		}
 	}
 
 	result = p.handle(ctx, ctx.Request().Body(), b.client)
+
+	// NOTE: The size of the decompressed body is only known while it is
+	// being sent, so the response is replaced afterwards.
+	if decompressed != nil && decompressed.tooLarge() {
+		rejectDecompressedRequest(ctx)
+		return resultClientError
+	}
+
 	if result != "" {
 		return result
 	}
@@ -357,9 +416,15 @@ func (b *Proxy) handle(ctx context.HTTPContext) (result string) {
 		return resultFallback
 	}
 
-	// compression and memoryCache only work for
+	// decompression, compression and memoryCache only work for
 	// normal traffic from real proxy servers.
-	if b.compression != nil {
+	if b.spec.Decompression != nil && b.spec.Decompression.Response {
+		decompressResponse(ctx, b.spec.Decompression.maxBytes())
+	}
+
+	// NOTE: Compressors buffer data, which delays the chunks of
+	// streaming responses.
+	if b.compression != nil && !ctx.Response().Streaming() {
 		b.compression.compress(ctx)
 	}
 
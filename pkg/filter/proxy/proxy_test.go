@@ -30,6 +30,7 @@ import (
 	"github.com/megaease/easegress/pkg/util/httpfilter"
 	"github.com/megaease/easegress/pkg/util/httpheader"
 	"github.com/megaease/easegress/pkg/util/memorycache"
+	"github.com/megaease/easegress/pkg/util/signer"
 	"github.com/megaease/easegress/pkg/util/yamltool"
 )
 
@@ -236,4 +237,60 @@ func TestPoolSpecValidate(t *testing.T) {
 	if spec.Validate() != nil {
 		t.Error("validate should succeed")
 	}
+
+	spec.RequestSigner = &signer.Spec{AccessKeyID: "AKID"}
+	if spec.Validate() == nil {
+		t.Error("validate should fail")
+	}
+
+	spec.RequestSigner.AccessKeySecret = "SECRET"
+	if spec.Validate() != nil {
+		t.Error("validate should succeed")
+	}
+}
+
+func TestPoolSignRequest(t *testing.T) {
+	spec := &signer.Spec{
+		LiteralPreset:   signer.LiteralPresetAWS4,
+		AccessKeyID:     "AKID",
+		AccessKeySecret: "SECRET",
+		Scopes:          []string{"us-east-1", "s3"},
+	}
+	p := &pool{
+		spec:   &PoolSpec{RequestSigner: spec},
+		signer: signer.CreateFromSpec(spec),
+	}
+
+	header := http.Header{}
+	header.Set("X-Test", "test")
+	header.Set(httpheader.KeyContentLength, "100")
+	stdr, _ := http.NewRequest(http.MethodPut, "http://127.0.0.1:9095/bucket/key", io.NopCloser(strings.NewReader("hello")))
+	stdr.Header = header
+
+	if err := p.signRequest(&request{std: stdr}); err != nil {
+		t.Fatalf("sign request failed: %v", err)
+	}
+
+	if header.Get("Authorization") != "" {
+		t.Error("header of the original request should not be changed")
+	}
+	if stdr.ContentLength != 5 || stdr.Header.Get(httpheader.KeyContentLength) != "5" {
+		t.Error("content length should be the length of the body")
+	}
+	if !strings.Contains(stdr.Header.Get("Authorization"), "/us-east-1/s3/aws4_request") {
+		t.Errorf("unexpected authorization header: %s", stdr.Header.Get("Authorization"))
+	}
+
+	verifier := signer.CreateFromSpec(&signer.Spec{
+		LiteralPreset: signer.LiteralPresetAWS4,
+		AccessKeys:    map[string]string{"AKID": "SECRET"},
+	})
+	if err := verifier.Verify(stdr); err != nil {
+		t.Errorf("signature verification failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(stdr.Body)
+	if string(body) != "hello" {
+		t.Errorf("body should not be changed, got %s", body)
+	}
 }
@@ -82,8 +82,31 @@ type (
 		Policy        string `yaml:"policy" jsonschema:"required,enum=roundRobin,enum=random,enum=weightedRandom,enum=ipHash,enum=headerHash"`
 		HeaderHashKey string `yaml:"headerHashKey" jsonschema:"omitempty"`
 	}
+
+	// ServerPool selects servers of a pool by its load balance, the servers
+	// are static ones or instances of the service registry. It is for the
+	// filters proxying other protocols.
+	ServerPool struct {
+		servers *servers
+	}
 )
 
+// NewServerPool creates a ServerPool, only the servers and the load balance
+// of the pool spec are used.
+func NewServerPool(super *supervisor.Supervisor, poolSpec *PoolSpec) *ServerPool {
+	return &ServerPool{servers: newServers(super, poolSpec)}
+}
+
+// Next returns the server for the request.
+func (sp *ServerPool) Next(ctx context.HTTPContext) (*Server, error) {
+	return sp.servers.next(ctx)
+}
+
+// Close closes the ServerPool.
+func (sp *ServerPool) Close() {
+	sp.servers.close()
+}
+
 // String implements the Stringer interface.
 func (s *Server) String() string {
 	return fmt.Sprintf("%s,%v,%d", s.URL, s.Tags, s.Weight)
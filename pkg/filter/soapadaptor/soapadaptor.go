@@ -0,0 +1,358 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package soapadaptor
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	json "github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+	"github.com/megaease/easegress/pkg/util/iotool"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+	"github.com/megaease/easegress/pkg/util/texttemplate"
+)
+
+const (
+	// Kind is the kind of SOAPAdaptor.
+	Kind = "SOAPAdaptor"
+
+	resultBodyTooLarge = "bodyTooLarge"
+	resultInvalidJSON  = "invalidJSON"
+	resultRenderFail   = "renderFail"
+
+	defaultMaxBodyBytes = 4 << 20
+
+	templateReqMethod = "req.method"
+	templateReqPath   = "req.path"
+	templateReqBody   = "req.body"
+	templateReqQuery  = "req.query."
+	templateReqHeader = "req.header."
+)
+
+var (
+	results = []string{resultBodyTooLarge, resultInvalidJSON, resultRenderFail}
+
+	// metaTemplates are the templates available in the SOAP header and
+	// the SOAP body, e.g. [[req.body.user.id]], [[req.header.X-Id]].
+	metaTemplates = []string{
+		"req.method",
+		"req.path",
+		"req.body",
+		"req.body.{gjson}",
+		"req.query.{}",
+		"req.header.{}",
+	}
+)
+
+func init() {
+	httppipeline.Register(&SOAPAdaptor{})
+}
+
+type (
+	// SOAPAdaptor converts JSON requests to SOAP requests, and converts
+	// SOAP responses back to JSON responses.
+	SOAPAdaptor struct {
+		filterSpec *httppipeline.FilterSpec
+		spec       *Spec
+
+		maxBodyBytes int64
+		operations   []*operation
+	}
+
+	operation struct {
+		spec    *OperationSpec
+		methods map[string]bool
+		arrays  map[string]bool
+	}
+)
+
+var _ httppipeline.Filter = (*SOAPAdaptor)(nil)
+
+// Kind returns the kind of SOAPAdaptor.
+func (sa *SOAPAdaptor) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of SOAPAdaptor.
+func (sa *SOAPAdaptor) DefaultSpec() interface{} {
+	return &Spec{Version: soapVersion11}
+}
+
+// Description returns the description of SOAPAdaptor.
+func (sa *SOAPAdaptor) Description() string {
+	return "SOAPAdaptor converts JSON requests to SOAP requests and SOAP responses to JSON responses."
+}
+
+// Results returns the results of SOAPAdaptor.
+func (sa *SOAPAdaptor) Results() []string {
+	return results
+}
+
+// Init initializes SOAPAdaptor.
+func (sa *SOAPAdaptor) Init(filterSpec *httppipeline.FilterSpec) {
+	sa.filterSpec, sa.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	sa.reload()
+}
+
+// Inherit inherits previous generation of SOAPAdaptor.
+func (sa *SOAPAdaptor) Inherit(filterSpec *httppipeline.FilterSpec, previousGeneration httppipeline.Filter) {
+	previousGeneration.Close()
+	sa.Init(filterSpec)
+}
+
+func (sa *SOAPAdaptor) reload() {
+	if sa.spec.Version == "" {
+		sa.spec.Version = soapVersion11
+	}
+
+	sa.maxBodyBytes = defaultMaxBodyBytes
+	if sa.spec.MaxBodyBytes > 0 {
+		sa.maxBodyBytes = sa.spec.MaxBodyBytes
+	}
+
+	sa.operations = nil
+	for _, spec := range sa.spec.Operations {
+		op := &operation{
+			spec:    spec,
+			methods: map[string]bool{},
+			arrays:  map[string]bool{},
+		}
+		for _, m := range spec.Methods {
+			op.methods[m] = true
+		}
+		for _, name := range spec.Arrays {
+			op.arrays[name] = true
+		}
+		sa.operations = append(sa.operations, op)
+	}
+}
+
+func (op *operation) match(r context.HTTPRequest) bool {
+	if len(op.methods) > 0 && !op.methods[r.Method()] {
+		return false
+	}
+	if op.spec.Path != "" && r.Path() != op.spec.Path {
+		return false
+	}
+	if op.spec.PathPrefix != "" && !strings.HasPrefix(r.Path(), op.spec.PathPrefix) {
+		return false
+	}
+	return true
+}
+
+// Handle converts the request to a SOAP request, and converts the response
+// back after the following filters are called.
+func (sa *SOAPAdaptor) Handle(ctx context.HTTPContext) string {
+	var op *operation
+	for _, o := range sa.operations {
+		if o.match(ctx.Request()) {
+			op = o
+			break
+		}
+	}
+	if op == nil {
+		return ctx.CallNextHandler("")
+	}
+
+	if result := sa.handleRequest(ctx, op); result != "" {
+		return ctx.CallNextHandler(result)
+	}
+
+	result := ctx.CallNextHandler("")
+	sa.handleResponse(ctx, op)
+	return result
+}
+
+// newTemplateEngine creates a template engine for a request, an engine
+// can't be shared by requests because it stores the values of a request.
+func newTemplateEngine(r context.HTTPRequest, body []byte) (texttemplate.TemplateEngine, error) {
+	engine, err := texttemplate.NewDefaultWithEscaper(metaTemplates, escapeXML)
+	if err != nil {
+		return nil, err
+	}
+
+	engine.SetDict(templateReqMethod, r.Method())
+	engine.SetDict(templateReqPath, r.Path())
+	engine.SetDict(templateReqBody, string(body))
+
+	query, _ := url.ParseQuery(r.Query())
+	for k := range query {
+		engine.SetDict(templateReqQuery+k, query.Get(k))
+	}
+	r.Header().VisitAll(func(k, v string) {
+		engine.SetDict(templateReqHeader+k, v)
+	})
+
+	return engine, nil
+}
+
+func (sa *SOAPAdaptor) handleRequest(ctx context.HTTPContext, op *operation) string {
+	r, w := ctx.Request(), ctx.Response()
+
+	data, body, err := iotool.ReadBody(r.Body(), sa.maxBodyBytes)
+	if err != nil {
+		ctx.AddTag(fmt.Sprintf("soapAdaptor: read request body failed: %v", err))
+		w.SetStatusCode(http.StatusBadRequest)
+		return resultInvalidJSON
+	}
+	r.SetBody(body)
+	if data == nil {
+		w.SetStatusCode(http.StatusRequestEntityTooLarge)
+		return resultBodyTooLarge
+	}
+	spec := op.spec
+	if len(bytes.TrimSpace(data)) > 0 {
+		// The body must be an object to be converted to the content of
+		// the operation element.
+		if !gjson.ValidBytes(data) || (spec.Body == "" && !gjson.ParseBytes(data).IsObject()) {
+			w.SetStatusCode(http.StatusBadRequest)
+			return resultInvalidJSON
+		}
+	}
+
+	header, soapBody := spec.Header, spec.Body
+	if header != "" || soapBody != "" {
+		engine, err := newTemplateEngine(r, data)
+		if err != nil {
+			logger.Errorf("BUG: create template engine failed: %v", err)
+			w.SetStatusCode(http.StatusInternalServerError)
+			return resultRenderFail
+		}
+		if header, err = engine.Render(header); err == nil {
+			soapBody, err = engine.Render(soapBody)
+		}
+		if err != nil {
+			ctx.AddTag(fmt.Sprintf("soapAdaptor: render template failed: %v", err))
+			w.SetStatusCode(http.StatusBadRequest)
+			return resultRenderFail
+		}
+	}
+
+	if spec.Body == "" {
+		buff := &bytes.Buffer{}
+		if spec.Namespace != "" {
+			fmt.Fprintf(buff, `<%s xmlns="%s">`, spec.Name, escapeXML(spec.Namespace))
+		} else {
+			fmt.Fprintf(buff, "<%s>", spec.Name)
+		}
+		gjson.ParseBytes(data).ForEach(func(k, v gjson.Result) bool {
+			writeJSONAsXML(buff, k.String(), v)
+			return true
+		})
+		fmt.Fprintf(buff, "</%s>", spec.Name)
+		soapBody = buff.String()
+	}
+
+	envelope := &bytes.Buffer{}
+	writeEnvelope(envelope, sa.spec.Version, header, soapBody)
+
+	h := r.Header()
+	if sa.spec.Version == soapVersion12 {
+		contentType := "application/soap+xml; charset=utf-8"
+		if spec.SOAPAction != "" {
+			contentType = stringtool.Cat(contentType, `; action="`, spec.SOAPAction, `"`)
+		}
+		h.Set(httpheader.KeyContentType, contentType)
+	} else {
+		h.Set(httpheader.KeyContentType, "text/xml; charset=utf-8")
+		h.Set("SOAPAction", strconv.Quote(spec.SOAPAction))
+	}
+	h.Set(httpheader.KeyContentLength, strconv.Itoa(envelope.Len()))
+	h.Del(httpheader.KeyContentEncoding)
+
+	r.SetMethod(http.MethodPost)
+	if spec.Endpoint != "" {
+		r.SetPath(spec.Endpoint)
+	}
+	r.SetBody(envelope)
+
+	return ""
+}
+
+// handleResponse converts the SOAP response to JSON, SOAP faults are
+// converted to HTTP errors. The response is kept as it is if it is not a
+// SOAP response.
+func (sa *SOAPAdaptor) handleResponse(ctx context.HTTPContext, op *operation) {
+	w := ctx.Response()
+
+	data, body, err := iotool.ReadBody(w.Body(), sa.maxBodyBytes)
+	if err != nil {
+		ctx.AddTag(fmt.Sprintf("soapAdaptor: read response body failed: %v", err))
+		return
+	}
+	w.SetBody(body)
+	if data == nil {
+		ctx.AddTag("soapAdaptor: response body too large")
+		return
+	}
+
+	root, err := parseXML(data)
+	if err != nil || root.name.Local != "Envelope" {
+		ctx.AddTag("soapAdaptor: response is not a SOAP envelope")
+		return
+	}
+	soapBody := root.child("Body")
+	if soapBody == nil {
+		ctx.AddTag("soapAdaptor: response has no SOAP body")
+		return
+	}
+
+	var value interface{}
+	if f := soapBody.child("Fault"); f != nil {
+		fault := parseFault(f, op.arrays)
+		ctx.AddTag(fmt.Sprintf("soapAdaptor: fault %s: %s", fault.Code, fault.Message))
+		w.SetStatusCode(fault.statusCode())
+		value = fault
+	} else if op.spec.Result != "" {
+		if n := soapBody.path(op.spec.Result); n != nil {
+			value = n.toJSON(op.arrays)
+		}
+	} else if len(soapBody.children) > 0 {
+		value = soapBody.children[0].toJSON(op.arrays)
+	}
+
+	data, err = json.Marshal(value)
+	if err != nil {
+		ctx.AddTag(fmt.Sprintf("soapAdaptor: marshal response failed: %v", err))
+		return
+	}
+
+	h := w.Header()
+	h.Set(httpheader.KeyContentType, "application/json")
+	h.Set(httpheader.KeyContentLength, strconv.Itoa(len(data)))
+	h.Del(httpheader.KeyContentEncoding)
+	w.SetBody(bytes.NewReader(data))
+}
+
+// Status returns status.
+func (sa *SOAPAdaptor) Status() interface{} {
+	return nil
+}
+
+// Close closes SOAPAdaptor.
+func (sa *SOAPAdaptor) Close() {}
@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package soapadaptor
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/yamltool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newSOAPAdaptor(t *testing.T, yamlSpec string) *SOAPAdaptor {
+	rawSpec := make(map[string]interface{})
+	yamltool.Unmarshal([]byte(yamlSpec), &rawSpec)
+
+	spec, err := httppipeline.NewFilterSpec(rawSpec, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sa := &SOAPAdaptor{}
+	sa.Init(spec)
+	return sa
+}
+
+type upstream struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// do runs the adaptor with an upstream which records the request and
+// responds the code and the body.
+func do(sa *SOAPAdaptor, req *http.Request, code int, respBody string) (*upstream, context.HTTPContext, string) {
+	u := &upstream{}
+	ctx := context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+	ctx.SetHandlerCaller(func(lastResult string) string {
+		if lastResult != "" {
+			return lastResult
+		}
+		r := ctx.Request()
+		u.method, u.path = r.Method(), r.Path()
+		u.header = r.Header().Std().Clone()
+		data, _ := io.ReadAll(r.Body())
+		u.body = string(data)
+
+		ctx.Response().SetStatusCode(code)
+		ctx.Response().Header().Set("Content-Type", "text/xml")
+		ctx.Response().SetBody(strings.NewReader(respBody))
+		return ""
+	})
+
+	result := sa.Handle(ctx)
+	return u, ctx, result
+}
+
+func assertJSON(t *testing.T, ctx context.HTTPContext, want string) {
+	t.Helper()
+	got, _ := io.ReadAll(ctx.Response().Body())
+
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid json %q: %v", got, err)
+	}
+	json.Unmarshal([]byte(want), &w)
+
+	gb, _ := json.Marshal(g)
+	wb, _ := json.Marshal(w)
+	if string(gb) != string(wb) {
+		t.Errorf("got %s, want %s", gb, wb)
+	}
+}
+
+const getUserResponse = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <soap:Body>
+    <m:GetUserResponse xmlns:m="http://example.com/users">
+      <m:User id="42">
+        <m:Name>Bob</m:Name>
+        <m:Email xsi:nil="true"/>
+        <m:Role>admin</m:Role>
+        <m:Role>dev</m:Role>
+        <m:Group>ops</m:Group>
+      </m:User>
+    </m:GetUserResponse>
+  </soap:Body>
+</soap:Envelope>`
+
+func TestConvert(t *testing.T) {
+	sa := newSOAPAdaptor(t, `
+name: soap
+kind: SOAPAdaptor
+operations:
+- name: GetUser
+  namespace: http://example.com/users
+  soapAction: http://example.com/users/GetUser
+  methods: [GET, POST]
+  path: /users/get
+  endpoint: /UserService.asmx
+  arrays: [Group]
+`)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/users/get",
+		strings.NewReader(`{"id":42,"filter":{"name":"<b>","active":true},"tags":["a","b"],"extra":null}`))
+	u, ctx, result := do(sa, req, http.StatusOK, getUserResponse)
+	if result != "" {
+		t.Fatalf("unexpected result %s", result)
+	}
+
+	if u.method != http.MethodPost || u.path != "/UserService.asmx" {
+		t.Errorf("unexpected request %s %s", u.method, u.path)
+	}
+	if u.header.Get("SOAPAction") != `"http://example.com/users/GetUser"` ||
+		!strings.HasPrefix(u.header.Get("Content-Type"), "text/xml") {
+		t.Errorf("unexpected header %v", u.header)
+	}
+	body := `<GetUser xmlns="http://example.com/users"><id>42</id>` +
+		`<filter><name>&lt;b&gt;</name><active>true</active></filter>` +
+		`<tags>a</tags><tags>b</tags><extra xsi:nil="true"/></GetUser>`
+	if !strings.Contains(u.body, "<soap:Body>"+body+"</soap:Body>") ||
+		!strings.Contains(u.body, `xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"`) {
+		t.Errorf("unexpected request body %s", u.body)
+	}
+
+	assertJSON(t, ctx, `{"User":{"@id":"42","Name":"Bob","Email":null,"Role":["admin","dev"],"Group":["ops"]}}`)
+	if ctx.Response().Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected content type %s", ctx.Response().Header().Get("Content-Type"))
+	}
+
+	// Requests matching no operation are passed through.
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/orders", strings.NewReader(`{}`))
+	u, _, _ = do(sa, req, http.StatusOK, "{}")
+	if u.method != http.MethodGet || u.body != "{}" {
+		t.Errorf("request should be passed through")
+	}
+
+	// Arrays can't be converted to the content of the operation element.
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/users/get", strings.NewReader(`[1]`))
+	if _, _, result = do(sa, req, http.StatusOK, ""); result != resultInvalidJSON {
+		t.Errorf("unexpected result %s", result)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	sa := newSOAPAdaptor(t, `
+name: soap
+kind: SOAPAdaptor
+version: "1.2"
+operations:
+- name: GetUser
+  soapAction: GetUser
+  header: <Auth><Token>[[req.header.X-Token]]</Token></Auth>
+  body: <GetUser><Id>[[req.body.user.id]]</Id><Lang>[[req.query.lang]]</Lang></GetUser>
+  result: GetUserResponse.User
+`)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/users?lang=en&x=1",
+		strings.NewReader(`{"user":{"id":"a&b"}}`))
+	req.Header.Set("X-Token", "t<1>")
+	u, ctx, _ := do(sa, req, http.StatusOK, getUserResponse)
+
+	if !strings.Contains(u.body, "<soap:Header><Auth><Token>t&lt;1&gt;</Token></Auth></soap:Header>") ||
+		!strings.Contains(u.body, "<GetUser><Id>a&amp;b</Id><Lang>en</Lang></GetUser>") ||
+		!strings.Contains(u.body, "http://www.w3.org/2003/05/soap-envelope") {
+		t.Errorf("unexpected request body %s", u.body)
+	}
+	if ct := u.header.Get("Content-Type"); ct != `application/soap+xml; charset=utf-8; action="GetUser"` {
+		t.Errorf("unexpected content type %s", ct)
+	}
+
+	assertJSON(t, ctx, `{"@id":"42","Name":"Bob","Email":null,"Role":["admin","dev"],"Group":"ops"}`)
+}
+
+func TestFault(t *testing.T) {
+	sa := newSOAPAdaptor(t, `
+name: soap
+kind: SOAPAdaptor
+operations:
+- name: GetUser
+`)
+
+	fault11 := `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+<soap:Fault><faultcode>soap:Client</faultcode><faultstring>invalid id</faultstring>
+<detail><Field>id</Field></detail></soap:Fault></soap:Body></soap:Envelope>`
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/users", nil)
+	_, ctx, _ := do(sa, req, http.StatusInternalServerError, fault11)
+	if ctx.Response().StatusCode() != http.StatusBadRequest {
+		t.Errorf("unexpected status code %d", ctx.Response().StatusCode())
+	}
+	assertJSON(t, ctx, `{"code":"Client","message":"invalid id","detail":{"Field":"id"}}`)
+
+	fault12 := `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body>
+<env:Fault><env:Code><env:Value>env:Receiver</env:Value></env:Code>
+<env:Reason><env:Text xml:lang="en">database down</env:Text></env:Reason></env:Fault></env:Body></env:Envelope>`
+	_, ctx, _ = do(sa, req, http.StatusInternalServerError, fault12)
+	if ctx.Response().StatusCode() != http.StatusBadGateway {
+		t.Errorf("unexpected status code %d", ctx.Response().StatusCode())
+	}
+	assertJSON(t, ctx, `{"code":"Receiver","message":"database down"}`)
+
+	// Responses other than SOAP are kept as they are.
+	_, ctx, _ = do(sa, req, http.StatusServiceUnavailable, "service unavailable")
+	data, _ := io.ReadAll(ctx.Response().Body())
+	if string(data) != "service unavailable" || ctx.Response().StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("unexpected response %d %s", ctx.Response().StatusCode(), data)
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	cases := map[string]string{
+		"path and prefix": `
+operations:
+- {name: A, path: /a, pathPrefix: /a}`,
+		"invalid template": `
+operations:
+- {name: A, body: "<A>[[resp.body]]</A>"}`,
+		"invalid result": `
+operations:
+- {name: A, result: "A..B"}`,
+	}
+
+	for name, c := range cases {
+		spec := &Spec{}
+		yamltool.Unmarshal([]byte(c), spec)
+		if err := spec.Validate(); err == nil {
+			t.Errorf("%s: spec should be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package soapadaptor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/util/texttemplate"
+)
+
+const (
+	soapVersion11 = "1.1"
+	soapVersion12 = "1.2"
+)
+
+type (
+	// Spec describes the SOAPAdaptor.
+	Spec struct {
+		Version string `yaml:"version,omitempty" jsonschema:"omitempty,enum=1.1,enum=1.2"`
+		// MaxBodyBytes is the max size of bodies to convert.
+		MaxBodyBytes int64 `yaml:"maxBodyBytes,omitempty" jsonschema:"omitempty,minimum=1"`
+		// Operations maps requests to the operations of the SOAP service,
+		// the first matched one is used, and requests matching none of
+		// them are passed through.
+		Operations []*OperationSpec `yaml:"operations" jsonschema:"required,minItems=1"`
+	}
+
+	// OperationSpec describes an operation of the SOAP service, which is
+	// defined in its WSDL.
+	OperationSpec struct {
+		Name string `yaml:"name" jsonschema:"required"`
+		// Namespace is the target namespace of the operation element.
+		Namespace  string `yaml:"namespace,omitempty" jsonschema:"omitempty"`
+		SOAPAction string `yaml:"soapAction,omitempty" jsonschema:"omitempty"`
+
+		// Methods, Path and PathPrefix match the requests of the operation,
+		// all requests are matched if none of them is specified.
+		Methods    []string `yaml:"methods,omitempty" jsonschema:"omitempty,uniqueItems=true,format=httpmethod-array"`
+		Path       string   `yaml:"path,omitempty" jsonschema:"omitempty,pattern=^/"`
+		PathPrefix string   `yaml:"pathPrefix,omitempty" jsonschema:"omitempty,pattern=^/"`
+
+		// Endpoint is the path of the SOAP service in the upstream, the
+		// path of the request is kept if it is empty.
+		Endpoint string `yaml:"endpoint,omitempty" jsonschema:"omitempty,pattern=^/"`
+
+		// Header and Body are the templates of the content of the SOAP
+		// header and the SOAP body. The body is converted from the JSON
+		// request body and wrapped by the operation element if it is empty.
+		Header string `yaml:"header,omitempty" jsonschema:"omitempty"`
+		Body   string `yaml:"body,omitempty" jsonschema:"omitempty"`
+
+		// Result is the dot separated path of the element in the SOAP body
+		// of the response to convert to JSON, which is the first element
+		// of the SOAP body by default.
+		Result string `yaml:"result,omitempty" jsonschema:"omitempty"`
+		// Arrays are the names of the elements always converted to JSON
+		// arrays, even if they appear only once.
+		Arrays []string `yaml:"arrays,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	}
+)
+
+// Validate validates Spec.
+func (spec Spec) Validate() error {
+	for i, op := range spec.Operations {
+		if op.Path != "" && op.PathPrefix != "" {
+			return fmt.Errorf("operation %d (%s): both path and pathPrefix are specified", i, op.Name)
+		}
+		if err := validateTemplate(op.Header); err != nil {
+			return fmt.Errorf("operation %d (%s): header: %v", i, op.Name, err)
+		}
+		if err := validateTemplate(op.Body); err != nil {
+			return fmt.Errorf("operation %d (%s): body: %v", i, op.Name, err)
+		}
+		if op.Result != "" {
+			for _, name := range strings.Split(op.Result, ".") {
+				if name == "" {
+					return fmt.Errorf("operation %d (%s): invalid result %q", i, op.Name, op.Result)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateTemplate(template string) error {
+	engine, err := texttemplate.NewDefault(metaTemplates)
+	if err != nil {
+		return err
+	}
+	for k, v := range engine.ExtractRawTemplateRuleMap(template) {
+		if v == "" {
+			return fmt.Errorf("invalid template [[%s]]", k)
+		}
+	}
+	return nil
+}
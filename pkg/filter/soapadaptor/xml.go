@@ -0,0 +1,280 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package soapadaptor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	namespaceSOAP11 = "http://schemas.xmlsoap.org/soap/envelope/"
+	namespaceSOAP12 = "http://www.w3.org/2003/05/soap-envelope"
+	namespaceXSI    = "http://www.w3.org/2001/XMLSchema-instance"
+	namespaceXMLNS  = "xmlns"
+)
+
+type (
+	// xmlNode is an element of a parsed XML document.
+	xmlNode struct {
+		name     xml.Name
+		attrs    []xml.Attr
+		children []*xmlNode
+		text     strings.Builder
+	}
+
+	// fault is a SOAP fault converted to JSON.
+	fault struct {
+		Code    string      `json:"code"`
+		Message string      `json:"message"`
+		Detail  interface{} `json:"detail,omitempty"`
+	}
+)
+
+func escapeXML(s string) string {
+	var buff bytes.Buffer
+	xml.EscapeText(&buff, []byte(s))
+	return buff.String()
+}
+
+// writeEnvelope writes the SOAP envelope with the content of the header
+// and the body.
+func writeEnvelope(buff *bytes.Buffer, version, header, body string) {
+	ns := namespaceSOAP11
+	if version == soapVersion12 {
+		ns = namespaceSOAP12
+	}
+
+	buff.WriteString(xml.Header)
+	fmt.Fprintf(buff, `<soap:Envelope xmlns:soap="%s" xmlns:xsi="%s">`, ns, namespaceXSI)
+	if header != "" {
+		buff.WriteString("<soap:Header>")
+		buff.WriteString(header)
+		buff.WriteString("</soap:Header>")
+	}
+	buff.WriteString("<soap:Body>")
+	buff.WriteString(body)
+	buff.WriteString("</soap:Body></soap:Envelope>")
+}
+
+// writeJSONAsXML writes the members of the JSON object as XML elements in
+// the order of the JSON document, an array is written as the repeated
+// elements of its name.
+func writeJSONAsXML(buff *bytes.Buffer, name string, value gjson.Result) {
+	switch {
+	case value.IsArray():
+		for _, elem := range value.Array() {
+			writeJSONAsXML(buff, name, elem)
+		}
+
+	case value.IsObject():
+		fmt.Fprintf(buff, "<%s>", name)
+		value.ForEach(func(k, v gjson.Result) bool {
+			writeJSONAsXML(buff, k.String(), v)
+			return true
+		})
+		fmt.Fprintf(buff, "</%s>", name)
+
+	case value.Type == gjson.Null:
+		fmt.Fprintf(buff, `<%s xsi:nil="true"/>`, name)
+
+	default:
+		fmt.Fprintf(buff, "<%s>%s</%s>", name, escapeXML(value.String()), name)
+	}
+}
+
+// parseXML parses the XML document and returns its root element.
+func parseXML(data []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name, attrs: t.Attr}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, fmt.Errorf("multiple root elements")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+	return root, nil
+}
+
+func (n *xmlNode) child(local string) *xmlNode {
+	for _, c := range n.children {
+		if c.name.Local == local {
+			return c
+		}
+	}
+	return nil
+}
+
+// path returns the descendant of the dot separated path of local names.
+func (n *xmlNode) path(path string) *xmlNode {
+	for _, local := range strings.Split(path, ".") {
+		if n = n.child(local); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (n *xmlNode) isNil() bool {
+	for _, attr := range n.attrs {
+		if attr.Name.Space == namespaceXSI && attr.Name.Local == "nil" {
+			return attr.Value == "true" || attr.Value == "1"
+		}
+	}
+	return false
+}
+
+// toJSON converts the element to a JSON value. An element with neither
+// child elements nor attributes is converted to its text, otherwise it is
+// converted to an object, in which attributes are prefixed with "@", the
+// text is "#text", and repeated child elements are converted to arrays.
+func (n *xmlNode) toJSON(arrays map[string]bool) interface{} {
+	if n.isNil() {
+		return nil
+	}
+
+	var attrs []xml.Attr
+	for _, attr := range n.attrs {
+		if attr.Name.Space == namespaceXMLNS || attr.Name.Local == namespaceXMLNS || attr.Name.Space == namespaceXSI {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+
+	text := strings.TrimSpace(n.text.String())
+	if len(n.children) == 0 && len(attrs) == 0 {
+		return text
+	}
+
+	obj := map[string]interface{}{}
+	for _, attr := range attrs {
+		obj["@"+attr.Name.Local] = attr.Value
+	}
+	if text != "" {
+		obj["#text"] = text
+	}
+
+	for _, c := range n.children {
+		name := c.name.Local
+		value := c.toJSON(arrays)
+
+		existing, ok := obj[name]
+		switch {
+		case !ok && arrays[name]:
+			obj[name] = []interface{}{value}
+		case !ok:
+			obj[name] = value
+		default:
+			// toJSON never returns an array, so an existing array is
+			// created for the repeated elements.
+			if a, isArray := existing.([]interface{}); isArray {
+				obj[name] = append(a, value)
+			} else {
+				obj[name] = []interface{}{existing, value}
+			}
+		}
+	}
+
+	return obj
+}
+
+// localName removes the namespace prefix of a qualified name.
+func localName(qname string) string {
+	if i := strings.IndexByte(qname, ':'); i >= 0 {
+		return qname[i+1:]
+	}
+	return qname
+}
+
+// parseFault parses the SOAP 1.1 or SOAP 1.2 fault.
+func parseFault(n *xmlNode, arrays map[string]bool) *fault {
+	f := &fault{}
+
+	if c := n.child("faultcode"); c != nil {
+		// SOAP 1.1
+		f.Code = localName(strings.TrimSpace(c.text.String()))
+		if s := n.child("faultstring"); s != nil {
+			f.Message = strings.TrimSpace(s.text.String())
+		}
+		if d := n.child("detail"); d != nil {
+			f.Detail = d.toJSON(arrays)
+		}
+		return f
+	}
+
+	// SOAP 1.2
+	if v := n.path("Code.Value"); v != nil {
+		f.Code = localName(strings.TrimSpace(v.text.String()))
+	}
+	if t := n.path("Reason.Text"); t != nil {
+		f.Message = strings.TrimSpace(t.text.String())
+	}
+	if d := n.child("Detail"); d != nil {
+		f.Detail = d.toJSON(arrays)
+	}
+	return f
+}
+
+// statusCode returns the HTTP status code of the fault, faults caused by
+// the request are client errors, and others are bad gateway.
+func (f *fault) statusCode() int {
+	switch f.Code {
+	case "Client", "Sender":
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
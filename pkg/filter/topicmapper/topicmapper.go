@@ -106,6 +106,14 @@ func (k *TopicMapper) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult {
 		ctx.SetEarlyStop()
 		return &context.MQTTResult{ErrString: resultMQTTTopicMapFailed}
 	}
+	// MQTT 5.0 user properties are added to headers if not conflict with mapped ones
+	if props := ctx.Properties(); props != nil {
+		for _, u := range props.User {
+			if _, ok := headers[u.Key]; !ok {
+				headers[u.Key] = u.Value
+			}
+		}
+	}
 	ctx.SetKV(k.spec.SetKV.Topic, topic)
 	ctx.SetKV(k.spec.SetKV.Headers, headers)
 	return &context.MQTTResult{ErrString: ""}
@@ -21,6 +21,7 @@ import (
 	stdcontext "context"
 	"testing"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/object/pipeline"
@@ -91,3 +92,25 @@ func TestTopicMapper(t *testing.T) {
 		assert.Equal(t, tt.headers, ctx.GetKV("headers").(map[string]string))
 	}
 }
+
+func TestTopicMapperWithUserProperties(t *testing.T) {
+	spec := getDefaultSpec()
+	filterSpec := defaultFilterSpec(spec)
+	topicMapper := &TopicMapper{}
+	topicMapper.Init(filterSpec)
+	defer topicMapper.Close()
+
+	client := &context.MockMQTTClient{
+		MockClientID: "client",
+	}
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = "/d2s/opq/car/345/raw"
+	props := &packets5.Properties{
+		User: []packets5.User{{Key: "tenant", Value: "xyz"}, {Key: "trace", Value: "abc"}},
+	}
+	ctx := context.NewMQTT5Context(stdcontext.Background(), client, packet, props)
+	topicMapper.HandleMQTT(ctx)
+	assert.Equal(t, "to_raw", ctx.GetKV("topic").(string))
+	headers := map[string]string{"d2s": "d2s", "tenant": "opq", "device_type": "car", "things_id": "345", "event": "raw", "trace": "abc"}
+	assert.Equal(t, headers, ctx.GetKV("headers").(map[string]string))
+}
@@ -0,0 +1,640 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+	"github.com/megaease/easegress/pkg/util/iotool"
+	"github.com/megaease/easegress/pkg/util/openapi"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+type (
+	// OpenAPIValidatorSpec defines the configuration of OpenAPI validator,
+	// which validates requests against an OpenAPI 3 document.
+	OpenAPIValidatorSpec struct {
+		// Document is the OpenAPI 3 document in JSON or YAML format.
+		Document string `yaml:"document,omitempty" jsonschema:"omitempty"`
+		// File is the path of a file containing the OpenAPI 3 document,
+		// it is used only if Document is empty.
+		File string `yaml:"file,omitempty" jsonschema:"omitempty"`
+		// BasePath is stripped from the request path before matching
+		// the paths of the document.
+		BasePath string `yaml:"basePath,omitempty" jsonschema:"omitempty,pattern=^/"`
+		// AllowUnknownOperations lets requests which are not defined in
+		// the document pass, they are rejected with 404/405 by default.
+		AllowUnknownOperations bool `yaml:"allowUnknownOperations" jsonschema:"omitempty"`
+		// ValidateResponse validates responses in report-only mode, the
+		// violations are reported but the responses are never changed.
+		ValidateResponse bool `yaml:"validateResponse" jsonschema:"omitempty"`
+		// MaxBodyBytes is the max size of the body to be validated.
+		MaxBodyBytes int64 `yaml:"maxBodyBytes,omitempty" jsonschema:"omitempty,minimum=0"`
+	}
+
+	// OpenAPIValidator defines the OpenAPI validator
+	OpenAPIValidator struct {
+		spec               *OpenAPIValidatorSpec
+		operations         []*openAPIOperation
+		maxBodyBytes       int64
+		err                error
+		responseViolations uint64
+	}
+
+	openAPIOperation struct {
+		method     string
+		path       string
+		segments   []string
+		templated  int
+		parameters []*openAPIParameter
+		body       *openAPIContent
+		responses  map[string]*openAPIContent
+	}
+
+	openAPIParameter struct {
+		name     string
+		in       string
+		required bool
+		typ      string
+		itemType string
+		schema   *gojsonschema.Schema
+	}
+
+	// openAPIContent is a request body or a response, media maps media
+	// types to their schemas, the schema is nil if not defined.
+	openAPIContent struct {
+		required bool
+		media    map[string]*gojsonschema.Schema
+	}
+
+	openAPIParser struct {
+		root       map[string]interface{}
+		components interface{}
+	}
+)
+
+// Validate validates the OpenAPIValidatorSpec.
+func (spec OpenAPIValidatorSpec) Validate() error {
+	if spec.Document == "" && spec.File == "" {
+		return fmt.Errorf("neither document nor file is specified")
+	}
+	if spec.Document != "" {
+		if _, err := parseOpenAPI([]byte(spec.Document)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewOpenAPIValidator creates a new OpenAPI validator.
+func NewOpenAPIValidator(spec *OpenAPIValidatorSpec) *OpenAPIValidator {
+	v := &OpenAPIValidator{
+		spec:         spec,
+		maxBodyBytes: spec.MaxBodyBytes,
+	}
+	if v.maxBodyBytes <= 0 {
+		v.maxBodyBytes = defaultMaxBodyBytes
+	}
+
+	data := []byte(spec.Document)
+	if len(data) == 0 {
+		data, v.err = ioutil.ReadFile(spec.File)
+		if v.err != nil {
+			v.err = fmt.Errorf("read OpenAPI file %s failed: %v", spec.File, v.err)
+			return v
+		}
+	}
+	v.operations, v.err = parseOpenAPI(data)
+	return v
+}
+
+// ValidateRequest validates the path parameters, query, headers, cookies
+// and body of the request.
+func (v *OpenAPIValidator) ValidateRequest(req context.HTTPRequest) *ValidationError {
+	if v.err != nil {
+		return &ValidationError{
+			StatusCode: http.StatusInternalServerError,
+			Message:    v.err.Error(),
+		}
+	}
+
+	op, pathParams, verr := v.operation(req)
+	if op == nil {
+		return verr
+	}
+
+	errs := []*FieldError{}
+	query, err := url.ParseQuery(req.Query())
+	if err != nil {
+		errs = append(errs, &FieldError{In: "query", Message: err.Error()})
+	}
+
+	for _, p := range op.parameters {
+		var values []string
+		switch p.in {
+		case "path":
+			values = []string{pathParams[p.name]}
+		case "query":
+			values = query[p.name]
+		case "header":
+			values = req.Header().GetAll(p.name)
+		case "cookie":
+			if c, err := req.Cookie(p.name); err == nil {
+				values = []string{c.Value}
+			}
+		}
+
+		if len(values) == 0 {
+			if p.required {
+				errs = append(errs, &FieldError{In: p.in, Field: p.name, Message: "is required"})
+			}
+			continue
+		}
+		if p.schema == nil {
+			continue
+		}
+
+		value, err := coerceParameter(values, p.typ, p.itemType)
+		if err != nil {
+			errs = append(errs, &FieldError{In: p.in, Field: p.name, Message: err.Error()})
+			continue
+		}
+		errs = append(errs, validateValue(p.schema, value, p.in, p.name)...)
+	}
+
+	statusCode := http.StatusBadRequest
+	if op.body != nil {
+		code, bodyErrs := op.body.validate(req.Header(), req.Body(), req.SetBody, v.maxBodyBytes)
+		if len(bodyErrs) > 0 {
+			statusCode = code
+			errs = append(errs, bodyErrs...)
+		}
+	}
+
+	if len(errs) > 0 {
+		return newValidationError(statusCode, "request validation failed", errs)
+	}
+	return nil
+}
+
+// operation finds the operation of the request, it returns nil and the
+// error if no operation is found, the error is nil if unknown operations
+// are allowed.
+func (v *OpenAPIValidator) operation(req context.HTTPRequest) (*openAPIOperation, map[string]string, *ValidationError) {
+	path := req.Path()
+	notFound := func(statusCode int) (*openAPIOperation, map[string]string, *ValidationError) {
+		if v.spec.AllowUnknownOperations {
+			return nil, nil, nil
+		}
+		msg := fmt.Sprintf("operation %s %s is not defined", req.Method(), path)
+		return nil, nil, newValidationError(statusCode, msg, nil)
+	}
+
+	if v.spec.BasePath != "" {
+		if !strings.HasPrefix(path, v.spec.BasePath) {
+			return notFound(http.StatusNotFound)
+		}
+		path = path[len(v.spec.BasePath):]
+	}
+
+	segments := splitPath(path)
+	method := strings.ToUpper(req.Method())
+	pathMatched := false
+	for _, op := range v.operations {
+		params, ok := op.match(segments)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if op.method == method {
+			return op, params, nil
+		}
+	}
+
+	if pathMatched {
+		return notFound(http.StatusMethodNotAllowed)
+	}
+	return notFound(http.StatusNotFound)
+}
+
+// validateResponse validates the response against the operation and
+// reports the violations, it never changes the response.
+func (v *OpenAPIValidator) validateResponse(ctx context.HTTPContext, op *openAPIOperation) {
+	w := ctx.Response()
+
+	var errs []*FieldError
+	content := op.response(w.StatusCode())
+	if content == nil {
+		errs = []*FieldError{{
+			In:      "status",
+			Message: fmt.Sprintf("status code %d is not documented", w.StatusCode()),
+		}}
+	} else {
+		_, errs = content.validate(w.Header(), w.Body(), w.SetBody, v.maxBodyBytes)
+	}
+
+	if len(errs) == 0 {
+		return
+	}
+
+	atomic.AddUint64(&v.responseViolations, 1)
+	msgs := make([]string, 0, len(errs))
+	for _, fe := range errs {
+		msgs = append(msgs, fe.String())
+	}
+	ctx.AddTag(stringtool.Cat("openapi validator: response of ", op.method, " ", op.path,
+		" violates the document: ", strings.Join(msgs, "; ")))
+}
+
+// ResponseViolations returns the number of responses violating the document.
+func (v *OpenAPIValidator) ResponseViolations() uint64 {
+	return atomic.LoadUint64(&v.responseViolations)
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func (op *openAPIOperation) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(op.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, s := range op.segments {
+		if len(s) > 2 && s[0] == '{' && s[len(s)-1] == '}' {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (op *openAPIOperation) response(statusCode int) *openAPIContent {
+	keys := []string{strconv.Itoa(statusCode), fmt.Sprintf("%dXX", statusCode/100), "default"}
+	for _, key := range keys {
+		if c := op.responses[key]; c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// validate validates the body against the content, the returned status
+// code is only meaningful for requests.
+func (c *openAPIContent) validate(header *httpheader.HTTPHeader, body io.Reader,
+	setBody func(io.Reader), maxBodyBytes int64) (int, []*FieldError) {
+	data, body, err := iotool.ReadBody(body, maxBodyBytes)
+	if err != nil {
+		return http.StatusBadRequest, []*FieldError{{In: "body", Message: fmt.Sprintf("read body failed: %v", err)}}
+	}
+	setBody(body)
+	if data == nil {
+		return http.StatusRequestEntityTooLarge, []*FieldError{{In: "body", Message: "body is too large to validate"}}
+	}
+
+	if len(data) == 0 {
+		if c.required {
+			return http.StatusBadRequest, []*FieldError{{In: "body", Message: "is required"}}
+		}
+		return 0, nil
+	}
+	if len(c.media) == 0 {
+		return 0, nil
+	}
+
+	mediaType := parseMediaType(header.Get(httpheader.KeyContentType))
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	schema, ok := c.lookup(mediaType)
+	if !ok {
+		return http.StatusUnsupportedMediaType, []*FieldError{{
+			In:      "header",
+			Field:   httpheader.KeyContentType,
+			Message: fmt.Sprintf("media type %s is not supported", mediaType),
+		}}
+	}
+	if schema == nil || !isJSONMediaType(mediaType) {
+		return 0, nil
+	}
+	if encoding := header.Get(httpheader.KeyContentEncoding); encoding != "" && encoding != "identity" {
+		return 0, nil
+	}
+
+	errs, err := validateJSON(schema, data, "body")
+	if err != nil {
+		return http.StatusBadRequest, []*FieldError{{In: "body", Message: err.Error()}}
+	}
+	return http.StatusBadRequest, errs
+}
+
+func (c *openAPIContent) lookup(mediaType string) (*gojsonschema.Schema, bool) {
+	if schema, ok := c.media[mediaType]; ok {
+		return schema, true
+	}
+	if i := strings.IndexByte(mediaType, '/'); i > 0 {
+		if schema, ok := c.media[mediaType[:i]+"/*"]; ok {
+			return schema, true
+		}
+	}
+	schema, ok := c.media["*/*"]
+	return schema, ok
+}
+
+// coerceParameter converts the string values of a parameter to the type
+// defined by its schema, so that they can be validated by the schema.
+func coerceParameter(values []string, typ, itemType string) (interface{}, error) {
+	if typ != "array" {
+		return coerceScalar(values[0], typ)
+	}
+
+	items := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			item, err := coerceScalar(s, itemType)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func coerceScalar(s, typ string) (interface{}, error) {
+	switch typ {
+	case "integer":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", s)
+		}
+		return n, nil
+	case "number":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return f, nil
+	case "boolean":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", s)
+		}
+		return b, nil
+	}
+	return s, nil
+}
+
+// parseOpenAPI parses an OpenAPI 3 document into operations, literal
+// paths are placed before templated ones so they are matched first.
+func parseOpenAPI(data []byte) ([]*openAPIOperation, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode OpenAPI document failed: %v", err)
+	}
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid OpenAPI document")
+	}
+	if version, _ := root["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		return nil, fmt.Errorf("only OpenAPI 3 documents are supported")
+	}
+
+	normalizeNullable(root)
+	p := &openAPIParser{root: root, components: root["components"]}
+
+	paths, _ := root["paths"].(map[string]interface{})
+	keys := make([]string, 0, len(paths))
+	for path := range paths {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+
+	ops := []*openAPIOperation{}
+	for _, path := range keys {
+		item, err := p.resolve(paths[path])
+		if err != nil {
+			return nil, fmt.Errorf("path %s: %v", path, err)
+		}
+		for _, method := range openAPIMethods {
+			if item[method] == nil {
+				continue
+			}
+			op, err := p.parseOperation(path, method, item["parameters"], item[method])
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", strings.ToUpper(method), path, err)
+			}
+			ops = append(ops, op)
+		}
+	}
+
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].templated < ops[j].templated
+	})
+	return ops, nil
+}
+
+func (p *openAPIParser) parseOperation(path, method string, common, v interface{}) (*openAPIOperation, error) {
+	op := &openAPIOperation{
+		method:    strings.ToUpper(method),
+		path:      path,
+		segments:  splitPath(path),
+		responses: map[string]*openAPIContent{},
+	}
+	for _, s := range op.segments {
+		if strings.HasPrefix(s, "{") {
+			op.templated++
+		}
+	}
+
+	m, err := p.resolve(v)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]*openAPIParameter{}
+	order := []string{}
+	for _, list := range []interface{}{common, m["parameters"]} {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			param, err := p.parseParameter(item)
+			if err != nil {
+				return nil, err
+			}
+			key := param.in + ":" + param.name
+			if _, ok := params[key]; !ok {
+				order = append(order, key)
+			}
+			params[key] = param
+		}
+	}
+	for _, key := range order {
+		op.parameters = append(op.parameters, params[key])
+	}
+
+	if m["requestBody"] != nil {
+		op.body, err = p.parseContent(m["requestBody"])
+		if err != nil {
+			return nil, fmt.Errorf("requestBody: %v", err)
+		}
+	}
+
+	responses, _ := m["responses"].(map[string]interface{})
+	for code, resp := range responses {
+		op.responses[strings.ToUpper(code)], err = p.parseContent(resp)
+		if err != nil {
+			return nil, fmt.Errorf("response %s: %v", code, err)
+		}
+		// required is meaningless for responses
+		op.responses[strings.ToUpper(code)].required = false
+	}
+
+	return op, nil
+}
+
+func (p *openAPIParser) parseParameter(v interface{}) (*openAPIParameter, error) {
+	m, err := p.resolve(v)
+	if err != nil {
+		return nil, err
+	}
+
+	param := &openAPIParameter{}
+	param.name, _ = m["name"].(string)
+	param.in, _ = m["in"].(string)
+	param.required, _ = m["required"].(bool)
+	if param.name == "" {
+		return nil, fmt.Errorf("parameter without name")
+	}
+	switch param.in {
+	case "path":
+		param.required = true
+	case "query", "header", "cookie":
+	default:
+		return nil, fmt.Errorf("parameter %s: invalid location %q", param.name, param.in)
+	}
+
+	if m["schema"] == nil {
+		return param, nil
+	}
+	schema, err := p.resolve(m["schema"])
+	if err != nil {
+		return nil, fmt.Errorf("parameter %s: %v", param.name, err)
+	}
+	param.typ, _ = schema["type"].(string)
+	if param.typ == "array" && schema["items"] != nil {
+		items, err := p.resolve(schema["items"])
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %v", param.name, err)
+		}
+		param.itemType, _ = items["type"].(string)
+	}
+	param.schema, err = p.compile(m["schema"])
+	if err != nil {
+		return nil, fmt.Errorf("parameter %s: %v", param.name, err)
+	}
+	return param, nil
+}
+
+func (p *openAPIParser) parseContent(v interface{}) (*openAPIContent, error) {
+	m, err := p.resolve(v)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &openAPIContent{media: map[string]*gojsonschema.Schema{}}
+	c.required, _ = m["required"].(bool)
+	content, _ := m["content"].(map[string]interface{})
+	for mediaType, mt := range content {
+		mediaType = strings.ToLower(mediaType)
+		mtm, _ := mt.(map[string]interface{})
+		if mtm == nil || mtm["schema"] == nil {
+			c.media[mediaType] = nil
+			continue
+		}
+		c.media[mediaType], err = p.compile(mtm["schema"])
+		if err != nil {
+			return nil, fmt.Errorf("media type %s: %v", mediaType, err)
+		}
+	}
+	return c, nil
+}
+
+// compile compiles a schema of the document, the components are attached
+// to the schema so that its references could be resolved.
+func (p *openAPIParser) compile(v interface{}) (*gojsonschema.Schema, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid schema")
+	}
+
+	schema := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		schema[k] = v
+	}
+	if p.components != nil {
+		schema["components"] = p.components
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewGoLoader(schema))
+}
+
+// resolve follows the local reference of v, and returns the referenced object.
+func (p *openAPIParser) resolve(v interface{}) (map[string]interface{}, error) {
+	return openapi.Resolve(p.root, v)
+}
+
+// normalizeNullable converts the OpenAPI 'nullable' keyword to
+// its JSON Schema equivalent.
+func normalizeNullable(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if nullable, _ := v["nullable"].(bool); nullable {
+			if typ, ok := v["type"].(string); ok {
+				v["type"] = []interface{}{typ, "null"}
+			}
+		}
+		for _, child := range v {
+			normalizeNullable(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			normalizeNullable(child)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	yamljsontool "github.com/ghodss/yaml"
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+	"github.com/megaease/easegress/pkg/util/iotool"
+)
+
+const (
+	defaultMaxBodyBytes = 4 * 1024 * 1024
+)
+
+type (
+	// JSONSchemaValidatorSpec defines the configuration of JSON Schema validator,
+	// which validates the request body against a JSON Schema.
+	JSONSchemaValidatorSpec struct {
+		// Schema is the JSON Schema in JSON or YAML format.
+		Schema string `yaml:"schema,omitempty" jsonschema:"omitempty"`
+		// File is the path of a file containing the JSON Schema,
+		// it is used only if Schema is empty.
+		File string `yaml:"file,omitempty" jsonschema:"omitempty"`
+		// MaxBodyBytes is the max size of the request body to be validated.
+		MaxBodyBytes int64 `yaml:"maxBodyBytes,omitempty" jsonschema:"omitempty,minimum=0"`
+	}
+
+	// JSONSchemaValidator defines the JSON Schema validator
+	JSONSchemaValidator struct {
+		spec         *JSONSchemaValidatorSpec
+		schema       *gojsonschema.Schema
+		maxBodyBytes int64
+		err          error
+	}
+
+	// FieldError describes a validation failure of a part of a request or response.
+	FieldError struct {
+		// In is the location of the field: path, query, header, cookie or body.
+		In      string `json:"in"`
+		Field   string `json:"field,omitempty"`
+		Message string `json:"message"`
+	}
+
+	// ValidationError is the error of schema validations, it is also the
+	// body of the error response.
+	ValidationError struct {
+		StatusCode int           `json:"-"`
+		Message    string        `json:"message"`
+		Errors     []*FieldError `json:"errors,omitempty"`
+	}
+)
+
+// Validate validates the JSONSchemaValidatorSpec.
+func (spec JSONSchemaValidatorSpec) Validate() error {
+	if spec.Schema == "" && spec.File == "" {
+		return fmt.Errorf("neither schema nor file is specified")
+	}
+	if spec.Schema != "" {
+		if _, err := compileJSONSchema([]byte(spec.Schema)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewJSONSchemaValidator creates a new JSON Schema validator.
+func NewJSONSchemaValidator(spec *JSONSchemaValidatorSpec) *JSONSchemaValidator {
+	v := &JSONSchemaValidator{
+		spec:         spec,
+		maxBodyBytes: spec.MaxBodyBytes,
+	}
+	if v.maxBodyBytes <= 0 {
+		v.maxBodyBytes = defaultMaxBodyBytes
+	}
+
+	data := []byte(spec.Schema)
+	if len(data) == 0 {
+		data, v.err = ioutil.ReadFile(spec.File)
+		if v.err != nil {
+			v.err = fmt.Errorf("read schema file %s failed: %v", spec.File, v.err)
+			return v
+		}
+	}
+	v.schema, v.err = compileJSONSchema(data)
+	return v
+}
+
+// Validate validates the body of the request.
+func (v *JSONSchemaValidator) Validate(req context.HTTPRequest) *ValidationError {
+	if v.err != nil {
+		return &ValidationError{
+			StatusCode: http.StatusInternalServerError,
+			Message:    v.err.Error(),
+		}
+	}
+
+	data, body, err := iotool.ReadBody(req.Body(), v.maxBodyBytes)
+	if err != nil {
+		return newBodyError(http.StatusBadRequest, fmt.Sprintf("read body failed: %v", err))
+	}
+	req.SetBody(body)
+	if data == nil {
+		return newBodyError(http.StatusRequestEntityTooLarge, "body is too large to validate")
+	}
+
+	errs, err := validateJSON(v.schema, data, "body")
+	if err != nil {
+		return newBodyError(http.StatusBadRequest, err.Error())
+	}
+	if len(errs) > 0 {
+		return newValidationError(http.StatusBadRequest, "request validation failed", errs)
+	}
+	return nil
+}
+
+func newValidationError(statusCode int, message string, errs []*FieldError) *ValidationError {
+	return &ValidationError{StatusCode: statusCode, Message: message, Errors: errs}
+}
+
+func newBodyError(statusCode int, message string) *ValidationError {
+	errs := []*FieldError{{In: "body", Message: message}}
+	return newValidationError(statusCode, "request validation failed", errs)
+}
+
+// Error implements the error interface.
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 0 {
+		return e.Message
+	}
+
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.String())
+	}
+	return e.Message + ": " + strings.Join(msgs, "; ")
+}
+
+// WriteTo writes the error to the response as a JSON body.
+func (e *ValidationError) WriteTo(w context.HTTPResponse) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		// should never happen
+		data = []byte(`{"message":"request validation failed"}`)
+	}
+	w.SetStatusCode(e.StatusCode)
+	w.Header().Set(httpheader.KeyContentType, "application/json")
+	w.Header().Set(httpheader.KeyContentLength, strconv.Itoa(len(data)))
+	w.SetBody(bytes.NewReader(data))
+}
+
+func (fe *FieldError) String() string {
+	if fe.Field == "" {
+		return fe.In + ": " + fe.Message
+	}
+	return fe.In + " " + fe.Field + ": " + fe.Message
+}
+
+// decodeDocument decodes a JSON or YAML document.
+func decodeDocument(data []byte) (interface{}, error) {
+	data, err := yamljsontool.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err = d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func compileJSONSchema(data []byte) (*gojsonschema.Schema, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode schema failed: %v", err)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return nil, fmt.Errorf("compile schema failed: %v", err)
+	}
+	return schema, nil
+}
+
+// validateJSON validates the JSON data against the schema, it returns
+// an error if the data is not valid JSON.
+func validateJSON(schema *gojsonschema.Schema, data []byte, in string) ([]*FieldError, error) {
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return resultErrors(result, in, ""), nil
+}
+
+func validateValue(schema *gojsonschema.Schema, value interface{}, in, field string) []*FieldError {
+	result, err := schema.Validate(gojsonschema.NewGoLoader(value))
+	if err != nil {
+		return []*FieldError{{In: in, Field: field, Message: err.Error()}}
+	}
+	return resultErrors(result, in, field)
+}
+
+func resultErrors(result *gojsonschema.Result, in, field string) []*FieldError {
+	if result.Valid() {
+		return nil
+	}
+
+	errs := make([]*FieldError, 0, len(result.Errors()))
+	for _, re := range result.Errors() {
+		fe := &FieldError{In: in, Field: field, Message: re.Description()}
+		if field == "" {
+			fe.Field = re.Field()
+		}
+		errs = append(errs, fe)
+	}
+	return errs
+}
+
+// isJSONMediaType returns whether the media type is JSON.
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// parseMediaType returns the media type of a Content-Type header value.
+func parseMediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
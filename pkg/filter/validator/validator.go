@@ -48,20 +48,29 @@ type (
 		filterSpec *httppipeline.FilterSpec
 		spec       *Spec
 
-		headers   *httpheader.Validator
-		jwt       *JWTValidator
-		signer    *signer.Signer
-		oauth2    *OAuth2Validator
-		basicAuth *BasicAuthValidator
+		headers    *httpheader.Validator
+		jwt        *JWTValidator
+		signer     *signer.Signer
+		oauth2     *OAuth2Validator
+		basicAuth  *BasicAuthValidator
+		jsonSchema *JSONSchemaValidator
+		openAPI    *OpenAPIValidator
 	}
 
 	// Spec describes the Validator.
 	Spec struct {
-		Headers   *httpheader.ValidatorSpec `yaml:"headers,omitempty" jsonschema:"omitempty"`
-		JWT       *JWTValidatorSpec         `yaml:"jwt,omitempty" jsonschema:"omitempty"`
-		Signature *signer.Spec              `yaml:"signature,omitempty" jsonschema:"omitempty"`
-		OAuth2    *OAuth2ValidatorSpec      `yaml:"oauth2,omitempty" jsonschema:"omitempty"`
-		BasicAuth *BasicAuthValidatorSpec   `yaml:"basicAuth,omitempty" jsonschema:"omitempty"`
+		Headers    *httpheader.ValidatorSpec `yaml:"headers,omitempty" jsonschema:"omitempty"`
+		JWT        *JWTValidatorSpec         `yaml:"jwt,omitempty" jsonschema:"omitempty"`
+		Signature  *signer.Spec              `yaml:"signature,omitempty" jsonschema:"omitempty"`
+		OAuth2     *OAuth2ValidatorSpec      `yaml:"oauth2,omitempty" jsonschema:"omitempty"`
+		BasicAuth  *BasicAuthValidatorSpec   `yaml:"basicAuth,omitempty" jsonschema:"omitempty"`
+		JSONSchema *JSONSchemaValidatorSpec  `yaml:"jsonSchema,omitempty" jsonschema:"omitempty"`
+		OpenAPI    *OpenAPIValidatorSpec     `yaml:"openAPI,omitempty" jsonschema:"omitempty"`
+	}
+
+	// Status is the status of Validator.
+	Status struct {
+		OpenAPIResponseViolations uint64 `yaml:"openAPIResponseViolations"`
 	}
 )
 
@@ -121,12 +130,29 @@ func (v *Validator) reload() {
 	if v.spec.BasicAuth != nil {
 		v.basicAuth = NewBasicAuthValidator(v.spec.BasicAuth, v.filterSpec.Super())
 	}
+	if v.spec.JSONSchema != nil {
+		v.jsonSchema = NewJSONSchemaValidator(v.spec.JSONSchema)
+	}
+	if v.spec.OpenAPI != nil {
+		v.openAPI = NewOpenAPIValidator(v.spec.OpenAPI)
+	}
 }
 
 // Handle validates HTTPContext.
 func (v *Validator) Handle(ctx context.HTTPContext) string {
 	result := v.handle(ctx)
-	return ctx.CallNextHandler(result)
+	if result != "" || v.openAPI == nil || !v.spec.OpenAPI.ValidateResponse {
+		return ctx.CallNextHandler(result)
+	}
+
+	// the operation must be found before calling the next handler,
+	// because the request could be modified by the following filters.
+	op, _, _ := v.openAPI.operation(ctx.Request())
+	result = ctx.CallNextHandler(result)
+	if op != nil {
+		v.openAPI.validateResponse(ctx, op)
+	}
+	return result
 }
 
 func (v *Validator) handle(ctx context.HTTPContext) string {
@@ -136,6 +162,10 @@ func (v *Validator) handle(ctx context.HTTPContext) string {
 		ctx.Response().SetStatusCode(status)
 		ctx.AddTag(stringtool.Cat(tagPrefix, err.Error()))
 	}
+	writeValidationError := func(tagPrefix string, err *ValidationError) {
+		err.WriteTo(ctx.Response())
+		ctx.AddTag(stringtool.Cat(tagPrefix, err.Error()))
+	}
 
 	if v.headers != nil {
 		if err := v.headers.Validate(req.Header()); err != nil {
@@ -167,12 +197,29 @@ func (v *Validator) handle(ctx context.HTTPContext) string {
 			return resultInvalid
 		}
 	}
+	if v.jsonSchema != nil {
+		if err := v.jsonSchema.Validate(req); err != nil {
+			writeValidationError("JSON schema validator: ", err)
+			return resultInvalid
+		}
+	}
+	if v.openAPI != nil {
+		if err := v.openAPI.ValidateRequest(req); err != nil {
+			writeValidationError("openapi validator: ", err)
+			return resultInvalid
+		}
+	}
 
 	return ""
 }
 
 // Status returns status.
-func (v *Validator) Status() interface{} { return nil }
+func (v *Validator) Status() interface{} {
+	if v.openAPI == nil || !v.spec.OpenAPI.ValidateResponse {
+		return nil
+	}
+	return &Status{OpenAPIResponseViolations: v.openAPI.ResponseViolations()}
+}
 
 // Close closes validations.
 func (v *Validator) Close() {
@@ -19,10 +19,12 @@ package validator
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"sync"
@@ -30,10 +32,12 @@ import (
 	"time"
 
 	cluster "github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/context/contexttest"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/httppipeline"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/tracing"
 	"github.com/megaease/easegress/pkg/util/httpheader"
 	"github.com/megaease/easegress/pkg/util/yamltool"
 )
@@ -544,3 +548,269 @@ lastEntry: "byebye"
 		wg.Wait()
 	})
 }
+
+func newSchemaTestContext(method, url, contentType, body string, status int, respBody string) context.HTTPContext {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	ctx := context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+	ctx.SetHandlerCaller(func(lastResult string) string {
+		if lastResult != "" {
+			return lastResult
+		}
+		ctx.Response().SetStatusCode(status)
+		ctx.Response().Header().Set("Content-Type", "application/json")
+		ctx.Response().SetBody(strings.NewReader(respBody))
+		return ""
+	})
+	return ctx
+}
+
+func decodeValidationError(t *testing.T, ctx context.HTTPContext) *ValidationError {
+	data, _ := ioutil.ReadAll(ctx.Response().Body())
+	ve := &ValidationError{}
+	if err := json.Unmarshal(data, ve); err != nil {
+		t.Fatalf("invalid error body %q: %v", data, err)
+	}
+	return ve
+}
+
+func TestJSONSchema(t *testing.T) {
+	const yamlSpec = `
+kind: Validator
+name: validator
+jsonSchema:
+  schema: |
+    type: object
+    required: [name]
+    properties:
+      name:
+        type: string
+      age:
+        type: integer
+        minimum: 0
+`
+	v := createValidator(yamlSpec, nil, nil)
+
+	ctx := newSchemaTestContext(http.MethodPost, "http://localhost/users", "application/json", `{"name":"bob","age":3}`, 200, "")
+	if result := v.Handle(ctx); result != "" {
+		t.Errorf("request should be valid")
+	}
+
+	ctx = newSchemaTestContext(http.MethodPost, "http://localhost/users", "application/json", `{"age":-1}`, 200, "")
+	if result := v.Handle(ctx); result != resultInvalid {
+		t.Fatalf("request should be invalid")
+	}
+	if ctx.Response().StatusCode() != http.StatusBadRequest {
+		t.Errorf("status code should be 400")
+	}
+	if ve := decodeValidationError(t, ctx); len(ve.Errors) != 2 {
+		t.Errorf("there should be 2 errors, but got %v", ve.Errors)
+	}
+
+	ctx = newSchemaTestContext(http.MethodPost, "http://localhost/users", "application/json", `{bad json`, 200, "")
+	if result := v.Handle(ctx); result != resultInvalid {
+		t.Errorf("request should be invalid")
+	}
+
+	spec := &JSONSchemaValidatorSpec{}
+	if spec.Validate() == nil {
+		t.Errorf("spec should be invalid")
+	}
+	spec.Schema = "type: [unknown"
+	if spec.Validate() == nil {
+		t.Errorf("spec should be invalid")
+	}
+}
+
+const openAPIDocument = `
+openapi: 3.0.0
+info:
+  title: pets
+  version: 1.0.0
+paths:
+  /pets:
+    get:
+      parameters:
+      - name: limit
+        in: query
+        required: true
+        schema:
+          type: integer
+          maximum: 100
+      - name: tags
+        in: query
+        schema:
+          type: array
+          items:
+            type: string
+            enum: [cat, dog]
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: "#/components/schemas/Pet"
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/Pet"
+      responses:
+        "201":
+          description: created
+  /pets/{id}:
+    parameters:
+    - name: id
+      in: path
+      schema:
+        type: integer
+    get:
+      parameters:
+      - $ref: "#/components/parameters/TraceID"
+      responses:
+        2XX:
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Pet"
+  /pets/mine:
+    get:
+      responses:
+        default:
+          description: anything
+components:
+  parameters:
+    TraceID:
+      name: X-Trace-ID
+      in: header
+      required: true
+      schema:
+        type: string
+  schemas:
+    Pet:
+      type: object
+      required: [name]
+      properties:
+        name:
+          type: string
+        tag:
+          type: string
+          nullable: true
+`
+
+func TestOpenAPI(t *testing.T) {
+	yamlSpec := `
+kind: Validator
+name: validator
+openAPI:
+  basePath: /api
+  validateResponse: true
+  document: |
+` + "    " + strings.ReplaceAll(strings.TrimSpace(openAPIDocument), "\n", "\n    ")
+	v := createValidator(yamlSpec, nil, nil)
+	if v.openAPI.err != nil {
+		t.Fatalf("unexpected error: %v", v.openAPI.err)
+	}
+
+	cases := []struct {
+		method      string
+		url         string
+		contentType string
+		body        string
+		header      string
+		status      int
+		errors      int
+	}{
+		{http.MethodGet, "http://localhost/api/pets?limit=10&tags=cat,dog", "", "", "", 0, 0},
+		{http.MethodGet, "http://localhost/api/pets?limit=1000&tags=cat&tags=fish", "", "", "", 400, 2},
+		{http.MethodGet, "http://localhost/api/pets?limit=abc", "", "", "", 400, 1},
+		{http.MethodGet, "http://localhost/api/pets", "", "", "", 400, 1},
+		{http.MethodPost, "http://localhost/api/pets", "application/json", `{"name":"kitty","tag":null}`, "", 0, 0},
+		{http.MethodPost, "http://localhost/api/pets", "application/json", `{"tag":1}`, "", 400, 2},
+		{http.MethodPost, "http://localhost/api/pets", "application/json", ``, "", 400, 1},
+		{http.MethodPost, "http://localhost/api/pets", "text/plain", `hello`, "", 415, 1},
+		{http.MethodGet, "http://localhost/api/pets/12", "", "", "abc", 0, 0},
+		{http.MethodGet, "http://localhost/api/pets/abc", "", "", "", 400, 2},
+		{http.MethodGet, "http://localhost/api/pets/mine", "", "", "", 0, 0},
+		{http.MethodDelete, "http://localhost/api/pets/12", "", "", "", 405, 0},
+		{http.MethodGet, "http://localhost/api/users", "", "", "", 404, 0},
+		{http.MethodGet, "http://localhost/pets", "", "", "", 404, 0},
+	}
+
+	for i, c := range cases {
+		ctx := newSchemaTestContext(c.method, c.url, c.contentType, c.body, 200, `[]`)
+		if c.header != "" {
+			ctx.Request().Header().Set("X-Trace-ID", c.header)
+		}
+		result := v.Handle(ctx)
+		if c.status == 0 {
+			if result != "" {
+				t.Errorf("case %d: request should be valid", i)
+			}
+			continue
+		}
+		if result != resultInvalid {
+			t.Errorf("case %d: request should be invalid", i)
+			continue
+		}
+		if ctx.Response().StatusCode() != c.status {
+			t.Errorf("case %d: status code should be %d, but got %d", i, c.status, ctx.Response().StatusCode())
+		}
+		if ve := decodeValidationError(t, ctx); len(ve.Errors) != c.errors {
+			t.Errorf("case %d: there should be %d errors, but got %v", i, c.errors, ve.Errors)
+		}
+	}
+}
+
+func TestOpenAPIResponse(t *testing.T) {
+	spec := &OpenAPIValidatorSpec{Document: openAPIDocument, ValidateResponse: true}
+	if err := spec.Validate(); err != nil {
+		t.Fatalf("spec should be valid: %v", err)
+	}
+	v := &Validator{spec: &Spec{OpenAPI: spec}, openAPI: NewOpenAPIValidator(spec)}
+
+	ctx := newSchemaTestContext(http.MethodGet, "http://localhost/pets?limit=1", "", "", 200, `[{"name":"kitty"}]`)
+	if result := v.Handle(ctx); result != "" {
+		t.Errorf("request should be valid")
+	}
+	if v.openAPI.ResponseViolations() != 0 {
+		t.Errorf("response should be valid")
+	}
+
+	// the response is reported, but never changed
+	ctx = newSchemaTestContext(http.MethodGet, "http://localhost/pets?limit=1", "", "", 200, `[{"tag":"cat"}]`)
+	v.Handle(ctx)
+	data, _ := ioutil.ReadAll(ctx.Response().Body())
+	if string(data) != `[{"tag":"cat"}]` || ctx.Response().StatusCode() != 200 {
+		t.Errorf("response should not be changed")
+	}
+	if v.openAPI.ResponseViolations() != 1 {
+		t.Errorf("response violation should be reported")
+	}
+
+	ctx = newSchemaTestContext(http.MethodGet, "http://localhost/pets?limit=1", "", "", 500, `{}`)
+	v.Handle(ctx)
+	if v.openAPI.ResponseViolations() != 2 {
+		t.Errorf("undocumented status code should be reported")
+	}
+
+	ctx = newSchemaTestContext(http.MethodGet, "http://localhost/pets/1", "", "", 204, ``)
+	ctx.Request().Header().Set("X-Trace-ID", "abc")
+	v.Handle(ctx)
+	if v.openAPI.ResponseViolations() != 2 {
+		t.Errorf("response should be valid")
+	}
+	if status := v.Status().(*Status); status.OpenAPIResponseViolations != 2 {
+		t.Errorf("status should report 2 violations")
+	}
+
+	if (&OpenAPIValidatorSpec{Document: "swagger: '2.0'"}).Validate() == nil {
+		t.Errorf("swagger 2.0 should be rejected")
+	}
+}
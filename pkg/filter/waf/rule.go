@@ -0,0 +1,401 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package waf
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// Categories of the builtin rules, the rule ids follow the
+// numbering of OWASP Core Rule Set.
+const (
+	categoryProtocol      = "protocol"
+	categoryPathTraversal = "pathTraversal"
+	categoryXSS           = "xss"
+	categorySQLInjection  = "sqlInjection"
+	categoryCustom        = "custom"
+)
+
+// Targets are the parts of the request a rule inspects.
+const (
+	targetRawURI      = "rawURI"
+	targetPath        = "path"
+	targetArgs        = "args"
+	targetArgNames    = "argNames"
+	targetHeaders     = "headers"
+	targetCookies     = "cookies"
+	targetBody        = "body"
+	targetMethod      = "method"
+	targetUserAgent   = "userAgent"
+	targetContentType = "contentType"
+)
+
+// Anomaly scores of different severities, the same as OWASP CRS.
+const (
+	scoreCritical = 5
+	scoreError    = 4
+	scoreWarning  = 3
+	scoreNotice   = 2
+)
+
+var (
+	allCategories = []string{
+		categoryProtocol,
+		categoryPathTraversal,
+		categoryXSS,
+		categorySQLInjection,
+	}
+
+	allTargets = []string{
+		targetRawURI, targetPath, targetArgs, targetArgNames, targetHeaders,
+		targetCookies, targetBody, targetMethod, targetUserAgent, targetContentType,
+	}
+
+	userInputTargets = []string{targetPath, targetArgs, targetArgNames, targetCookies, targetBody}
+)
+
+type (
+	rule struct {
+		id       int
+		category string
+		message  string
+		score    int
+		paranoia int
+		targets  []string
+
+		// One of re and check must be set.
+		re    *regexp.Regexp
+		check func(tx *transaction) (matched string, ok bool)
+	}
+
+	// variable is a named value extracted from the request,
+	// value is the normalized one.
+	variable struct {
+		name  string
+		value string
+	}
+)
+
+func isValidCategory(c string) bool {
+	for _, category := range allCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidTarget(t string) bool {
+	for _, target := range allTargets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the name and value of the first variable matching the rule.
+func (r *rule) match(tx *transaction) (string, bool) {
+	if r.check != nil {
+		return r.check(tx)
+	}
+
+	for _, t := range r.targets {
+		for _, v := range tx.variables(t) {
+			if r.re.MatchString(v.value) {
+				return v.name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+var builtinRules = []*rule{
+	// Protocol anomalies.
+	{
+		id:       920100,
+		category: categoryProtocol,
+		message:  "Invalid HTTP request method",
+		score:    scoreWarning,
+		paranoia: 1,
+		targets:  []string{targetMethod},
+		re:       regexp.MustCompile(`[^A-Za-z0-9!#$%&'*+.^_|~-]`),
+	},
+	{
+		id:       920160,
+		category: categoryProtocol,
+		message:  "Content-Length header is not numeric",
+		score:    scoreCritical,
+		paranoia: 1,
+		check: func(tx *transaction) (string, bool) {
+			cl := tx.header.Get("Content-Length")
+			if cl == "" {
+				return "", false
+			}
+			if _, err := strconv.ParseUint(cl, 10, 63); err != nil {
+				return "header:Content-Length", true
+			}
+			return "", false
+		},
+	},
+	{
+		id:       920170,
+		category: categoryProtocol,
+		message:  "GET or HEAD request with body content",
+		score:    scoreCritical,
+		paranoia: 1,
+		check: func(tx *transaction) (string, bool) {
+			if tx.method != "GET" && tx.method != "HEAD" {
+				return "", false
+			}
+			cl := tx.header.Get("Content-Length")
+			if cl != "" && cl != "0" {
+				return "header:Content-Length", true
+			}
+			return "", false
+		},
+	},
+	{
+		id:       920270,
+		category: categoryProtocol,
+		message:  "Invalid character in request (null character)",
+		score:    scoreError,
+		paranoia: 1,
+		targets:  []string{targetPath, targetArgs, targetHeaders},
+		re:       regexp.MustCompile(`\x00`),
+	},
+	{
+		id:       920280,
+		category: categoryProtocol,
+		message:  "Request missing a Host header",
+		score:    scoreWarning,
+		paranoia: 1,
+		check: func(tx *transaction) (string, bool) {
+			if tx.host == "" {
+				return "header:Host", true
+			}
+			return "", false
+		},
+	},
+	{
+		id:       921110,
+		category: categoryProtocol,
+		message:  "HTTP request smuggling attack: both Content-Length and Transfer-Encoding",
+		score:    scoreCritical,
+		paranoia: 1,
+		check: func(tx *transaction) (string, bool) {
+			if tx.header.Get("Content-Length") != "" && tx.header.Get("Transfer-Encoding") != "" {
+				return "header:Transfer-Encoding", true
+			}
+			return "", false
+		},
+	},
+	{
+		id:       920300,
+		category: categoryProtocol,
+		message:  "Request missing an Accept header",
+		score:    scoreNotice,
+		paranoia: 2,
+		check: func(tx *transaction) (string, bool) {
+			if tx.method != "OPTIONS" && tx.header.Get("Accept") == "" {
+				return "header:Accept", true
+			}
+			return "", false
+		},
+	},
+	{
+		id:       920350,
+		category: categoryProtocol,
+		message:  "Host header is a numeric IP address",
+		score:    scoreWarning,
+		paranoia: 2,
+		check: func(tx *transaction) (string, bool) {
+			if hostIPRegexp.MatchString(tx.host) {
+				return "header:Host", true
+			}
+			return "", false
+		},
+	},
+
+	// Path traversal.
+	{
+		id:       930100,
+		category: categoryPathTraversal,
+		message:  "Path traversal attack (/../) in encoded form",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  []string{targetRawURI},
+		re:       regexp.MustCompile(`(?i)(?:%c0%ae|%2e|%252e|\.)(?:%c0%ae|%2e|%252e)(?:%2f|%5c|%252f|%255c|%c0%af)`),
+	},
+	{
+		id:       930110,
+		category: categoryPathTraversal,
+		message:  "Path traversal attack (/../)",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  append([]string{targetHeaders}, userInputTargets...),
+		re:       regexp.MustCompile(`(?:^|[\\/])\.\.(?:[\\/]|$)`),
+	},
+	{
+		id:       930120,
+		category: categoryPathTraversal,
+		message:  "OS file access attempt",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re: regexp.MustCompile(`(?i)(?:/etc/(?:passwd|shadow|group|hosts|issue)|/proc/self/|` +
+			`(?:boot|win|system)\.ini|\.htaccess|\.htpasswd|web\.config|\.git/)`),
+	},
+
+	// Cross site scripting.
+	{
+		id:       941110,
+		category: categoryXSS,
+		message:  "XSS filter: script tag vector",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  append([]string{targetUserAgent}, userInputTargets...),
+		re:       regexp.MustCompile(`(?i)<script[^>]*>`),
+	},
+	{
+		id:       941120,
+		category: categoryXSS,
+		message:  "XSS filter: event handler vector",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)[\s"'/;]on(?:error|load|click|dblclick|mouse\w+|focus|blur|submit|change|key\w+|abort|toggle|animation\w+|pointer\w+)\s*=`),
+	},
+	{
+		id:       941170,
+		category: categoryXSS,
+		message:  "XSS filter: attribute injection with javascript or vbscript URI",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)(?:java|vb)script\s*:|data\s*:\s*text/html`),
+	},
+	{
+		id:       941160,
+		category: categoryXSS,
+		message:  "XSS filter: HTML injection",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)<(?:iframe|object|embed|svg|img|body|link|meta|style|base|form|math|video|audio)\b[^>]*>?`),
+	},
+	{
+		id:       941180,
+		category: categoryXSS,
+		message:  "XSS filter: DOM access or script execution",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)\b(?:document\s*\.\s*(?:cookie|write|domain)|window\s*\.\s*location|eval\s*\(|alert\s*\(|prompt\s*\(|fromcharcode)`),
+	},
+
+	// SQL injection.
+	{
+		id:       942100,
+		category: categorySQLInjection,
+		message:  "SQL injection: UNION based query",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)\bunion\b(?:\s|/\*.*?\*/)+(?:all\b(?:\s|/\*.*?\*/)+)?select\b`),
+	},
+	{
+		id:       942130,
+		category: categorySQLInjection,
+		message:  "SQL injection: tautology",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re: regexp.MustCompile(`(?i)['"\x60)]\s*(?:or|and|\|\||&&)\s+['"\x60(]?\s*[\w'"]+\s*['"\x60]?\s*(?:=|<>|!=|<|>|\blike\b|\bis\b)|` +
+			`\b(?:or|and)\s+(\d+)\s*=\s*(\d+)\b`),
+	},
+	{
+		id:       942140,
+		category: categorySQLInjection,
+		message:  "SQL injection: common database names",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)\b(?:information_schema|mysql\.user|pg_catalog|sysobjects|syscolumns|sqlite_master|msdb|xp_cmdshell)\b`),
+	},
+	{
+		id:       942160,
+		category: categorySQLInjection,
+		message:  "SQL injection: blind injection with sleep or benchmark",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)\b(?:sleep|benchmark|pg_sleep)\s*\(|\bwaitfor\s+delay\b`),
+	},
+	{
+		id:       942190,
+		category: categorySQLInjection,
+		message:  "SQL injection: stacked query or comment termination",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re: regexp.MustCompile(`(?i);\s*(?:drop|delete|insert|update|alter|create|truncate|exec|execute|shutdown|declare)\b|` +
+			`['"\x60]\s*(?:--|#|/\*)`),
+	},
+	{
+		id:       942200,
+		category: categorySQLInjection,
+		message:  "SQL injection: file access",
+		score:    scoreCritical,
+		paranoia: 1,
+		targets:  userInputTargets,
+		re:       regexp.MustCompile(`(?i)\bload_file\s*\(|\binto\s+(?:out|dump)file\b`),
+	},
+	{
+		id:       942430,
+		category: categorySQLInjection,
+		message:  "SQL injection: restricted SQL character anomaly",
+		score:    scoreWarning,
+		paranoia: 2,
+		targets:  []string{targetArgs, targetCookies},
+		re:       regexp.MustCompile(`(?:[~!@#$%^&*()\-+={}\[\]|:;"'\x60<>][^~!@#$%^&*()\-+={}\[\]|:;"'\x60<>]*?){12}`),
+	},
+}
+
+var hostIPRegexp = regexp.MustCompile(`^(?:\d{1,3}\.){3}\d{1,3}(?::\d+)?$|^\[[0-9a-fA-F:]+\](?::\d+)?$`)
+
+func newCustomRule(spec *CustomRule) *rule {
+	r := &rule{
+		id:       spec.ID,
+		category: spec.Category,
+		message:  spec.Message,
+		score:    spec.Score,
+		paranoia: 1,
+		targets:  spec.Targets,
+		re:       regexp.MustCompile(spec.Regexp),
+	}
+	if r.category == "" {
+		r.category = categoryCustom
+	}
+	if r.score == 0 {
+		r.score = scoreCritical
+	}
+	return r
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package waf
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/megaease/easegress/pkg/util/urlrule"
+)
+
+const (
+	// ModeDetection only records the matched rules.
+	ModeDetection = "Detection"
+	// ModeBlocking rejects the request when the anomaly score reaches the threshold.
+	ModeBlocking = "Blocking"
+)
+
+type (
+	// Spec describes the WAF.
+	Spec struct {
+		Mode             string        `yaml:"mode" jsonschema:"omitempty,enum=Detection,enum=Blocking"`
+		AnomalyThreshold int           `yaml:"anomalyThreshold" jsonschema:"omitempty,minimum=1"`
+		ParanoiaLevel    int           `yaml:"paranoiaLevel" jsonschema:"omitempty,minimum=1,maximum=4"`
+		MaxBodyBytes     int64         `yaml:"maxBodyBytes" jsonschema:"omitempty,minimum=0"`
+		Categories       []string      `yaml:"categories" jsonschema:"omitempty,uniqueItems=true"`
+		DisabledRules    []int         `yaml:"disabledRules" jsonschema:"omitempty,uniqueItems=true"`
+		CustomRules      []*CustomRule `yaml:"customRules" jsonschema:"omitempty"`
+		Exclusions       []*Exclusion  `yaml:"exclusions" jsonschema:"omitempty"`
+		BlockCode        int           `yaml:"blockCode" jsonschema:"omitempty,format=httpcode"`
+		BlockBody        string        `yaml:"blockBody" jsonschema:"omitempty"`
+	}
+
+	// CustomRule is a user defined regular expression rule.
+	CustomRule struct {
+		ID       int      `yaml:"id" jsonschema:"required,minimum=1"`
+		Message  string   `yaml:"message" jsonschema:"omitempty"`
+		Category string   `yaml:"category" jsonschema:"omitempty"`
+		Targets  []string `yaml:"targets" jsonschema:"required,minItems=1,uniqueItems=true"`
+		Regexp   string   `yaml:"regexp" jsonschema:"required,format=regexp"`
+		Score    int      `yaml:"score" jsonschema:"omitempty,minimum=1"`
+	}
+
+	// Exclusion disables some rules for the requests matching the URL rule.
+	Exclusion struct {
+		urlrule.URLRule `yaml:",inline"`
+		RuleIDs         []int    `yaml:"ruleIDs" jsonschema:"omitempty,uniqueItems=true"`
+		Categories      []string `yaml:"categories" jsonschema:"omitempty,uniqueItems=true"`
+	}
+)
+
+// Validate validates Spec.
+func (spec Spec) Validate() error {
+	for _, c := range spec.Categories {
+		if !isValidCategory(c) {
+			return fmt.Errorf("unknown category %s", c)
+		}
+	}
+
+	// Custom rules can be excluded by their categories too.
+	customCategories := map[string]struct{}{categoryCustom: {}}
+	ids := map[int]struct{}{}
+	for _, r := range builtinRules {
+		ids[r.id] = struct{}{}
+	}
+	for _, r := range spec.CustomRules {
+		if _, exists := ids[r.ID]; exists {
+			return fmt.Errorf("duplicated rule id %d", r.ID)
+		}
+		ids[r.ID] = struct{}{}
+		if r.Category != "" {
+			customCategories[r.Category] = struct{}{}
+		}
+
+		for _, t := range r.Targets {
+			if !isValidTarget(t) {
+				return fmt.Errorf("rule %d: unknown target %s", r.ID, t)
+			}
+		}
+		if _, err := regexp.Compile(r.Regexp); err != nil {
+			return fmt.Errorf("rule %d: %v", r.ID, err)
+		}
+	}
+
+	for _, e := range spec.Exclusions {
+		if len(e.RuleIDs) == 0 && len(e.Categories) == 0 {
+			return fmt.Errorf("exclusion for url %+v excludes nothing", e.URL)
+		}
+		for _, c := range e.Categories {
+			if _, exists := customCategories[c]; !exists && !isValidCategory(c) {
+				return fmt.Errorf("exclusion for url %+v: unknown category %s", e.URL, c)
+			}
+		}
+	}
+
+	return nil
+}
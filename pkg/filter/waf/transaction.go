@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+	"github.com/megaease/easegress/pkg/util/iotool"
+)
+
+type (
+	// transaction holds the inspected parts of one request,
+	// variables are extracted lazily and cached by target.
+	transaction struct {
+		req    context.HTTPRequest
+		method string
+		host   string
+		header *httpheader.HTTPHeader
+
+		body          []byte
+		bodyTruncated bool
+
+		cache map[string][]variable
+	}
+)
+
+func newTransaction(req context.HTTPRequest, maxBodyBytes int64) *transaction {
+	tx := &transaction{
+		req:    req,
+		method: req.Method(),
+		host:   req.Host(),
+		header: req.Header(),
+		cache:  map[string][]variable{},
+	}
+
+	if maxBodyBytes > 0 && req.Body() != nil {
+		tx.readBody(maxBodyBytes)
+	}
+
+	return tx
+}
+
+// readBody reads at most n bytes of the body, and puts them back to the
+// request so that the following filters can still read the whole body.
+func (tx *transaction) readBody(n int64) {
+	data, truncated, body, err := iotool.PeekBody(tx.req.Body(), n)
+	tx.req.SetBody(body)
+	if err != nil {
+		return
+	}
+	tx.body, tx.bodyTruncated = data, truncated
+}
+
+func (tx *transaction) variables(target string) []variable {
+	if vars, exists := tx.cache[target]; exists {
+		return vars
+	}
+
+	var vars []variable
+	switch target {
+	case targetRawURI:
+		vars = []variable{{name: "rawURI", value: tx.rawURI()}}
+	case targetPath:
+		vars = []variable{{name: "path", value: normalize(tx.req.Path())}}
+	case targetArgs, targetArgNames:
+		args, names := tx.args()
+		tx.cache[targetArgs], tx.cache[targetArgNames] = args, names
+		return tx.cache[target]
+	case targetHeaders:
+		tx.header.VisitAll(func(key, value string) {
+			if key == "Cookie" {
+				return
+			}
+			vars = append(vars, variable{name: "header:" + key, value: normalize(value)})
+		})
+	case targetCookies:
+		stdr := &http.Request{Header: http.Header{"Cookie": tx.header.GetAll("Cookie")}}
+		for _, c := range stdr.Cookies() {
+			vars = append(vars,
+				variable{name: "cookieName:" + c.Name, value: normalize(c.Name)},
+				variable{name: "cookie:" + c.Name, value: normalize(c.Value)})
+		}
+	case targetBody:
+		vars = tx.bodyVariables()
+	case targetMethod:
+		vars = []variable{{name: "method", value: tx.method}}
+	case targetUserAgent:
+		vars = []variable{{name: "header:User-Agent", value: normalize(tx.header.Get("User-Agent"))}}
+	case targetContentType:
+		vars = []variable{{name: "header:Content-Type", value: tx.header.Get("Content-Type")}}
+	}
+
+	tx.cache[target] = vars
+	return vars
+}
+
+func (tx *transaction) rawURI() string {
+	if uri := tx.req.Std().RequestURI; uri != "" {
+		return uri
+	}
+
+	uri := tx.req.EscapedPath()
+	if q := tx.req.Query(); q != "" {
+		uri += "?" + q
+	}
+	return uri
+}
+
+// args returns the query arguments, and also the arguments
+// in the body when it is a url encoded form.
+func (tx *transaction) args() (args []variable, names []variable) {
+	appendArgs := func(prefix, raw string) {
+		for _, pair := range strings.Split(raw, "&") {
+			if pair == "" {
+				continue
+			}
+			key, value := pair, ""
+			if i := strings.IndexByte(pair, '='); i >= 0 {
+				key, value = pair[:i], pair[i+1:]
+			}
+			key = normalize(key)
+			names = append(names, variable{name: prefix + "Name:" + key, value: key})
+			args = append(args, variable{name: prefix + ":" + key, value: normalize(value)})
+		}
+	}
+
+	appendArgs("arg", tx.req.Query())
+	if tx.mediaType() == "application/x-www-form-urlencoded" {
+		appendArgs("bodyArg", string(tx.body))
+	}
+
+	return args, names
+}
+
+func (tx *transaction) mediaType() string {
+	mediaType, _, _ := mime.ParseMediaType(tx.header.Get("Content-Type"))
+	return mediaType
+}
+
+func (tx *transaction) bodyVariables() []variable {
+	if len(tx.body) == 0 {
+		return nil
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(tx.header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		// NOTE: They are inspected as arguments.
+		return nil
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if vars, ok := tx.multipartVariables(params["boundary"]); ok {
+			return vars
+		}
+	case strings.Contains(mediaType, "json") && !tx.bodyTruncated:
+		var v interface{}
+		if json.Unmarshal(tx.body, &v) == nil {
+			var vars []variable
+			walkJSON("json", v, &vars)
+			return vars
+		}
+	}
+
+	return []variable{{name: "body", value: normalize(string(tx.body))}}
+}
+
+func (tx *transaction) multipartVariables(boundary string) ([]variable, bool) {
+	if boundary == "" {
+		return nil, false
+	}
+
+	var vars []variable
+	mr := multipart.NewReader(bytes.NewReader(tx.body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return vars, true
+		}
+		if err != nil {
+			// NOTE: The body may be truncated, what we got so far is still useful.
+			return vars, len(vars) > 0
+		}
+
+		name := part.FormName()
+		if fileName := part.FileName(); fileName != "" {
+			vars = append(vars, variable{name: "fileName:" + name, value: normalize(fileName)})
+			continue
+		}
+
+		data, _ := io.ReadAll(part)
+		vars = append(vars, variable{name: "multipart:" + name, value: normalize(string(data))})
+	}
+}
+
+func walkJSON(name string, v interface{}, vars *[]variable) {
+	switch v := v.(type) {
+	case string:
+		*vars = append(*vars, variable{name: name, value: normalize(v)})
+	case map[string]interface{}:
+		for key, value := range v {
+			*vars = append(*vars, variable{name: name + "Key:" + key, value: normalize(key)})
+			walkJSON(name+"."+key, value, vars)
+		}
+	case []interface{}:
+		for _, value := range v {
+			walkJSON(name+"[]", value, vars)
+		}
+	}
+}
+
+// normalize applies the transformations before matching,
+// it decodes the url encoding twice to defeat double encoding.
+func normalize(s string) string {
+	for i := 0; i < 2; i++ {
+		decoded := urlDecode(s)
+		if decoded == s {
+			break
+		}
+		s = decoded
+	}
+
+	return html.UnescapeString(s)
+}
+
+// urlDecode is a lenient url decoder, invalid escapes are kept as is.
+func urlDecode(s string) string {
+	if strings.IndexByte(s, '%') < 0 && strings.IndexByte(s, '+') < 0 {
+		return s
+	}
+
+	var buff strings.Builder
+	buff.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			buff.WriteByte(' ')
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			buff.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			buff.WriteByte(c)
+		}
+	}
+
+	return buff.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package waf
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+const (
+	// Kind is the kind of WAF.
+	Kind = "WAF"
+
+	resultBlocked = "blocked"
+
+	defaultAnomalyThreshold = 5
+	defaultParanoiaLevel    = 1
+	// 64KB
+	defaultMaxBodyBytes = 64 * 1024
+
+	maxRecentMatches = 20
+)
+
+var results = []string{resultBlocked}
+
+func init() {
+	httppipeline.Register(&WAF{})
+}
+
+type (
+	// WAF is the filter inspecting requests against attack rules.
+	WAF struct {
+		filterSpec *httppipeline.FilterSpec
+		spec       *Spec
+
+		rules      []*rule
+		exclusions []*Exclusion
+
+		inspected uint64
+		detected  uint64
+		blocked   uint64
+
+		statusLock    sync.Mutex
+		ruleHits      map[int]uint64
+		recentMatches []*MatchEvent
+	}
+
+	// Status is the status of WAF.
+	Status struct {
+		Mode          string         `yaml:"mode"`
+		Inspected     uint64         `yaml:"inspected"`
+		Detected      uint64         `yaml:"detected"`
+		Blocked       uint64         `yaml:"blocked"`
+		RuleHits      map[int]uint64 `yaml:"ruleHits"`
+		RecentMatches []*MatchEvent  `yaml:"recentMatches"`
+	}
+
+	// MatchEvent is the detail of a request matching some rules.
+	MatchEvent struct {
+		Time          time.Time      `yaml:"time"`
+		RealIP        string         `yaml:"realIP"`
+		Method        string         `yaml:"method"`
+		Path          string         `yaml:"path"`
+		Score         int            `yaml:"score"`
+		Blocked       bool           `yaml:"blocked"`
+		Matches       []*MatchedRule `yaml:"matches"`
+		BodyTruncated bool           `yaml:"bodyTruncated,omitempty"`
+	}
+
+	// MatchedRule is the detail of a matched rule.
+	MatchedRule struct {
+		ID       int    `yaml:"id"`
+		Category string `yaml:"category"`
+		Message  string `yaml:"message"`
+		Score    int    `yaml:"score"`
+		Variable string `yaml:"variable"`
+	}
+)
+
+// Kind returns the kind of WAF.
+func (w *WAF) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of WAF.
+func (w *WAF) DefaultSpec() interface{} {
+	return &Spec{
+		Mode:             ModeBlocking,
+		AnomalyThreshold: defaultAnomalyThreshold,
+		ParanoiaLevel:    defaultParanoiaLevel,
+		MaxBodyBytes:     defaultMaxBodyBytes,
+		BlockCode:        http.StatusForbidden,
+	}
+}
+
+// Description returns the description of WAF.
+func (w *WAF) Description() string {
+	return "WAF inspects requests against SQL injection, XSS, path traversal and protocol anomaly rules."
+}
+
+// Results returns the results of WAF.
+func (w *WAF) Results() []string {
+	return results
+}
+
+// Init initializes WAF.
+func (w *WAF) Init(filterSpec *httppipeline.FilterSpec) {
+	w.filterSpec, w.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	w.reload()
+}
+
+// Inherit inherits previous generation of WAF.
+func (w *WAF) Inherit(filterSpec *httppipeline.FilterSpec, previousGeneration httppipeline.Filter) {
+	previousGeneration.Close()
+	w.Init(filterSpec)
+}
+
+func (w *WAF) reload() {
+	w.ruleHits = map[int]uint64{}
+
+	categories := w.spec.Categories
+	if len(categories) == 0 {
+		categories = allCategories
+	}
+
+	paranoiaLevel := w.spec.ParanoiaLevel
+	if paranoiaLevel == 0 {
+		paranoiaLevel = defaultParanoiaLevel
+	}
+
+	w.rules = nil
+	for _, r := range builtinRules {
+		if r.paranoia > paranoiaLevel {
+			continue
+		}
+		if !stringtool.StrInSlice(r.category, categories) {
+			continue
+		}
+		if intInSlice(r.id, w.spec.DisabledRules) {
+			continue
+		}
+		w.rules = append(w.rules, r)
+	}
+
+	for _, r := range w.spec.CustomRules {
+		if intInSlice(r.ID, w.spec.DisabledRules) {
+			continue
+		}
+		w.rules = append(w.rules, newCustomRule(r))
+	}
+
+	w.exclusions = w.spec.Exclusions
+	for _, e := range w.exclusions {
+		e.Init()
+	}
+}
+
+func intInSlice(i int, slice []int) bool {
+	for _, v := range slice {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle inspects the request of HTTPContext.
+func (w *WAF) Handle(ctx context.HTTPContext) string {
+	result := w.handle(ctx)
+	return ctx.CallNextHandler(result)
+}
+
+func (w *WAF) excluded(req context.HTTPRequest, r *rule) bool {
+	for _, e := range w.exclusions {
+		if !e.Match(req) {
+			continue
+		}
+		if intInSlice(r.id, e.RuleIDs) || stringtool.StrInSlice(r.category, e.Categories) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *WAF) handle(ctx context.HTTPContext) string {
+	atomic.AddUint64(&w.inspected, 1)
+
+	req := ctx.Request()
+	tx := newTransaction(req, w.spec.MaxBodyBytes)
+
+	score := 0
+	var matches []*MatchedRule
+	for _, r := range w.rules {
+		if w.excluded(req, r) {
+			continue
+		}
+
+		variable, matched := r.match(tx)
+		if !matched {
+			continue
+		}
+
+		score += r.score
+		matches = append(matches, &MatchedRule{
+			ID:       r.id,
+			Category: r.category,
+			Message:  r.message,
+			Score:    r.score,
+			Variable: variable,
+		})
+	}
+
+	if len(matches) == 0 {
+		return ""
+	}
+
+	atomic.AddUint64(&w.detected, 1)
+	blocked := w.spec.Mode != ModeDetection && score >= w.anomalyThreshold()
+
+	w.record(&MatchEvent{
+		Time:          time.Now(),
+		RealIP:        req.RealIP(),
+		Method:        req.Method(),
+		Path:          req.Path(),
+		Score:         score,
+		Blocked:       blocked,
+		Matches:       matches,
+		BodyTruncated: tx.bodyTruncated,
+	})
+
+	ctx.AddLazyTag(func() string {
+		ids := make([]string, 0, len(matches))
+		for _, m := range matches {
+			ids = append(ids, stringtool.Cat(strconv.Itoa(m.ID), "(", m.Category, ":", m.Variable, ")"))
+		}
+		return fmt.Sprintf("waf: score %d, blocked %v, rules %s", score, blocked, strings.Join(ids, ","))
+	})
+
+	if !blocked {
+		return ""
+	}
+
+	atomic.AddUint64(&w.blocked, 1)
+	w.block(ctx)
+	return resultBlocked
+}
+
+func (w *WAF) anomalyThreshold() int {
+	if w.spec.AnomalyThreshold > 0 {
+		return w.spec.AnomalyThreshold
+	}
+	return defaultAnomalyThreshold
+}
+
+func (w *WAF) block(ctx context.HTTPContext) {
+	code := w.spec.BlockCode
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+
+	resp := ctx.Response()
+	resp.SetStatusCode(code)
+	resp.Std().Header().Set("X-EG-WAF", "blocked")
+	if w.spec.BlockBody != "" {
+		resp.SetBody(strings.NewReader(w.spec.BlockBody))
+	}
+}
+
+func (w *WAF) record(event *MatchEvent) {
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+
+	for _, m := range event.Matches {
+		w.ruleHits[m.ID]++
+	}
+
+	w.recentMatches = append(w.recentMatches, event)
+	if len(w.recentMatches) > maxRecentMatches {
+		w.recentMatches = w.recentMatches[len(w.recentMatches)-maxRecentMatches:]
+	}
+}
+
+// Status returns the status of WAF.
+func (w *WAF) Status() interface{} {
+	s := &Status{
+		Mode:      w.spec.Mode,
+		Inspected: atomic.LoadUint64(&w.inspected),
+		Detected:  atomic.LoadUint64(&w.detected),
+		Blocked:   atomic.LoadUint64(&w.blocked),
+		RuleHits:  map[int]uint64{},
+	}
+
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+
+	for id, hits := range w.ruleHits {
+		s.RuleHits[id] = hits
+	}
+	s.RecentMatches = append(s.RecentMatches, w.recentMatches...)
+	sort.Slice(s.RecentMatches, func(i, j int) bool {
+		return s.RecentMatches[i].Time.After(s.RecentMatches[j].Time)
+	})
+
+	return s
+}
+
+// Close closes WAF.
+func (w *WAF) Close() {}
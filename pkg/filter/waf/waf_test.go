@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package waf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/yamltool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newWAF(t *testing.T, yamlSpec string) *WAF {
+	rawSpec := make(map[string]interface{})
+	yamltool.Unmarshal([]byte(yamlSpec), &rawSpec)
+
+	spec, err := httppipeline.NewFilterSpec(rawSpec, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := &WAF{}
+	w.Init(spec)
+	return w
+}
+
+func newContext(method, url string, body io.Reader, header map[string]string) context.HTTPContext {
+	req := httptest.NewRequest(method, url, body)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	ctx := context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+	ctx.SetHandlerCaller(func(lastResult string) string {
+		return lastResult
+	})
+	return ctx
+}
+
+func TestWAFBlocking(t *testing.T) {
+	w := newWAF(t, `
+kind: WAF
+name: waf
+`)
+
+	cases := []struct {
+		method  string
+		url     string
+		body    string
+		header  map[string]string
+		blocked bool
+	}{
+		{method: http.MethodGet, url: "/users?id=1", blocked: false},
+		{method: http.MethodGet, url: "/search?q=hello+world&page=2", blocked: false},
+		{method: http.MethodGet, url: "/users?id=1%20UNION%20SELECT%20password%20FROM%20users", blocked: true},
+		{method: http.MethodGet, url: "/users?id=1'%20or%20'1'='1", blocked: true},
+		{method: http.MethodGet, url: "/users?id=1;%20DROP%20TABLE%20users", blocked: true},
+		{method: http.MethodGet, url: "/search?q=%3Cscript%3Ealert(1)%3C/script%3E", blocked: true},
+		{method: http.MethodGet, url: "/search?q=%253Cscript%253E", blocked: true},
+		{method: http.MethodGet, url: "/files?name=..%2f..%2fetc%2fpasswd", blocked: true},
+		{method: http.MethodGet, url: "/static/..%252f..%252fsecret", blocked: true},
+		{
+			method: http.MethodGet, url: "/profile",
+			header:  map[string]string{"Cookie": "session=<img src=x onerror=alert(1)>"},
+			blocked: true,
+		},
+		{
+			method: http.MethodPost, url: "/login",
+			body:    "user=admin&pass=x'%20or%201=1--",
+			header:  map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			blocked: true,
+		},
+		{
+			method: http.MethodPost, url: "/comments",
+			body:    `{"comment": {"text": "<svg onload=alert(1)>"}}`,
+			header:  map[string]string{"Content-Type": "application/json"},
+			blocked: true,
+		},
+		{
+			method: http.MethodPost, url: "/comments",
+			body:    `{"comment": {"text": "nice article, thanks"}}`,
+			header:  map[string]string{"Content-Type": "application/json"},
+			blocked: false,
+		},
+	}
+
+	for i, c := range cases {
+		var body io.Reader
+		if c.body != "" {
+			body = strings.NewReader(c.body)
+		}
+		ctx := newContext(c.method, c.url, body, c.header)
+		result := w.Handle(ctx)
+		if blocked := result == resultBlocked; blocked != c.blocked {
+			t.Errorf("case %d: %s %s: want blocked %v, got %v", i, c.method, c.url, c.blocked, blocked)
+			continue
+		}
+		if c.blocked && ctx.Response().StatusCode() != http.StatusForbidden {
+			t.Errorf("case %d: want status code 403, got %d", i, ctx.Response().StatusCode())
+		}
+		if c.body != "" {
+			data, _ := io.ReadAll(ctx.Request().Body())
+			if string(data) != c.body {
+				t.Errorf("case %d: body is not restored, got %q", i, data)
+			}
+		}
+	}
+
+	status := w.Status().(*Status)
+	if status.Blocked == 0 || status.RuleHits[942100] == 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if len(status.RecentMatches) == 0 || len(status.RecentMatches[0].Matches) == 0 {
+		t.Errorf("recent matches should be recorded")
+	}
+}
+
+func TestWAFDetectionAndExclusion(t *testing.T) {
+	w := newWAF(t, `
+kind: WAF
+name: waf
+mode: Detection
+`)
+	ctx := newContext(http.MethodGet, "/users?id=1%20UNION%20SELECT%201", nil, nil)
+	if result := w.Handle(ctx); result != "" {
+		t.Errorf("detection mode should not block, got result %s", result)
+	}
+	if s := w.Status().(*Status); s.Detected != 1 || s.Blocked != 0 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	w = newWAF(t, `
+kind: WAF
+name: waf
+exclusions:
+- url:
+    prefix: /cms/
+  categories: [xss]
+- url:
+    exact: /sql
+  ruleIDs: [942100]
+`)
+	ctx = newContext(http.MethodGet, "/cms/page?html=%3Cscript%3E", nil, nil)
+	if result := w.Handle(ctx); result != "" {
+		t.Errorf("xss should be excluded for /cms/, got result %s", result)
+	}
+	ctx = newContext(http.MethodGet, "/sql?q=union%20select", nil, nil)
+	if result := w.Handle(ctx); result != "" {
+		t.Errorf("rule 942100 should be excluded for /sql, got result %s", result)
+	}
+	ctx = newContext(http.MethodGet, "/other?html=%3Cscript%3E", nil, nil)
+	if result := w.Handle(ctx); result != resultBlocked {
+		t.Errorf("xss should be blocked for /other")
+	}
+}
+
+func TestWAFAnomalyScore(t *testing.T) {
+	w := newWAF(t, `
+kind: WAF
+name: waf
+anomalyThreshold: 8
+blockCode: 406
+customRules:
+- id: 100001
+  targets: [headers]
+  regexp: (?i)badbot
+  score: 3
+`)
+
+	ctx := newContext(http.MethodGet, "/", nil, map[string]string{"X-Client": "BadBot"})
+	if result := w.Handle(ctx); result != "" {
+		t.Errorf("score 3 should not reach threshold 8")
+	}
+
+	ctx = newContext(http.MethodGet, "/?q=%3Cscript%3E", nil, map[string]string{"X-Client": "BadBot"})
+	if result := w.Handle(ctx); result != resultBlocked {
+		t.Errorf("score 8 should reach threshold 8")
+	}
+	if code := ctx.Response().StatusCode(); code != 406 {
+		t.Errorf("want status code 406, got %d", code)
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	spec := Spec{Categories: []string{"unknown"}}
+	if spec.Validate() == nil {
+		t.Errorf("unknown category should be invalid")
+	}
+
+	spec = Spec{CustomRules: []*CustomRule{{ID: 942100, Targets: []string{targetArgs}, Regexp: "a"}}}
+	if spec.Validate() == nil {
+		t.Errorf("duplicated rule id should be invalid")
+	}
+
+	spec = Spec{CustomRules: []*CustomRule{{ID: 1, Targets: []string{"unknown"}, Regexp: "a"}}}
+	if spec.Validate() == nil {
+		t.Errorf("unknown target should be invalid")
+	}
+
+	spec = Spec{Exclusions: []*Exclusion{{Categories: []string{"unknown"}}}}
+	if spec.Validate() == nil {
+		t.Errorf("unknown exclusion category should be invalid")
+	}
+
+	spec = Spec{
+		CustomRules: []*CustomRule{
+			{ID: 1, Targets: []string{targetArgs}, Regexp: "a"},
+			{ID: 2, Category: "scanner", Targets: []string{targetUserAgent}, Regexp: "b"},
+		},
+		Exclusions: []*Exclusion{{Categories: []string{categoryCustom, "scanner", categoryXSS}}},
+	}
+	if err := spec.Validate(); err != nil {
+		t.Errorf("categories of custom rules should be valid for exclusions, got %v", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cases := map[string]string{
+		"a+b":         "a b",
+		"%253Cscript": "<script",
+		"%zz%41":      "%zzA",
+		"&lt;img&gt;": "<img>",
+	}
+	for in, want := range cases {
+		if got := normalize(in); got != want {
+			t.Errorf("normalize(%q): want %q, got %q", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+	"github.com/megaease/easegress/pkg/util/mqttbackend"
+)
+
+const (
+	// Kind is the kind of Webhook
+	Kind = "Webhook"
+
+	// HeaderTopic is the HTTP header of the topic of the message
+	HeaderTopic = "X-Mqtt-Topic"
+	// HeaderClientID is the HTTP header of the id of the client publishing the message
+	HeaderClientID = "X-Mqtt-Client-Id"
+
+	resultGetDataFailed = "GetDataFailed"
+	resultSendFailed    = "SendFailed"
+)
+
+func init() {
+	pipeline.Register(&Webhook{})
+}
+
+type (
+	// Webhook is HTTP webhook backend for MQTT proxy
+	Webhook struct {
+		filterSpec *pipeline.FilterSpec
+		spec       *Spec
+		client     *http.Client
+		sender     *mqttbackend.Sender
+
+		defaultTopic string
+	}
+
+	publisher struct {
+		client  *http.Client
+		url     string
+		method  string
+		headers map[string]string
+	}
+)
+
+var _ pipeline.Filter = (*Webhook)(nil)
+var _ pipeline.MQTTFilter = (*Webhook)(nil)
+
+// Kind return kind of Webhook
+func (w *Webhook) Kind() string {
+	return Kind
+}
+
+// DefaultSpec return default spec of Webhook
+func (w *Webhook) DefaultSpec() interface{} {
+	return &Spec{}
+}
+
+// Description return description of Webhook
+func (w *Webhook) Description() string {
+	return "Webhook is a backend of MQTTProxy, it sends messages to an HTTP endpoint"
+}
+
+// Results return possible results of Webhook
+func (w *Webhook) Results() []string {
+	return []string{resultGetDataFailed, resultSendFailed}
+}
+
+// Init init Webhook
+func (w *Webhook) Init(filterSpec *pipeline.FilterSpec) {
+	if filterSpec.Protocol() != context.MQTT {
+		panic("filter Webhook only support MQTT protocol for now")
+	}
+	w.filterSpec, w.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	if w.spec.Topic != nil {
+		w.defaultTopic = w.spec.Topic.Default
+	}
+
+	w.client = &http.Client{Timeout: w.spec.Delivery.AttemptTimeout()}
+	method := w.spec.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	p := &publisher{
+		client:  w.client,
+		url:     w.spec.URL,
+		method:  method,
+		headers: w.spec.Headers,
+	}
+	w.sender = mqttbackend.NewSender(w.spec.Delivery, p)
+}
+
+// Inherit init Webhook based on previous generation
+func (w *Webhook) Inherit(filterSpec *pipeline.FilterSpec, previousGeneration pipeline.Filter) {
+	previousGeneration.Close()
+	w.Init(filterSpec)
+}
+
+// Close close Webhook
+func (w *Webhook) Close() {
+	w.sender.Close()
+	w.client.CloseIdleConnections()
+}
+
+// Status return status of Webhook
+func (w *Webhook) Status() interface{} {
+	return w.sender.Status()
+}
+
+// HandleMQTT handle MQTT context
+func (w *Webhook) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult {
+	msg, ok := mqttbackend.GetMessage(ctx, w.spec.KVMap, w.defaultTopic, nil)
+	if !ok {
+		return &context.MQTTResult{ErrString: resultGetDataFailed}
+	}
+	if err := w.sender.Send(msg); err != nil {
+		logger.SpanErrorf(nil, "send message of client %v topic %v to webhook %v failed: %v", msg.ClientID, msg.Topic, w.spec.URL, err)
+		ctx.SetDrop()
+		ctx.SetReasonCode(packets5.PubackUnspecifiedError)
+		return &context.MQTTResult{ErrString: resultSendFailed}
+	}
+	return &context.MQTTResult{}
+}
+
+func (p *publisher) Publish(msg *mqttbackend.Message) error {
+	req, err := http.NewRequest(p.method, p.url, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return mqttbackend.Permanent(err)
+	}
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range msg.Headers {
+		req.Header.Set(k, v)
+	}
+	if ct := msg.Headers[mqttbackend.HeaderContentType]; ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	req.Header.Set(HeaderTopic, msg.Topic)
+	req.Header.Set(HeaderClientID, msg.ClientID)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain the body so the connection could be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook responded with status code %d", resp.StatusCode)
+	// other client errors are caused by the message itself, retry won't help
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return mqttbackend.Permanent(err)
+	}
+	return err
+}
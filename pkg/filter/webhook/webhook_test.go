@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	stdcontext "context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+	"github.com/megaease/easegress/pkg/util/mqttbackend"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+type request struct {
+	method string
+	header http.Header
+	body   string
+}
+
+// mockServer records requests and responds with status codes in turn.
+type mockServer struct {
+	sync.Mutex
+	codes    []int
+	requests []request
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.Lock()
+	defer s.Unlock()
+	s.requests = append(s.requests, request{method: r.Method, header: r.Header, body: string(body)})
+	code := http.StatusOK
+	if len(s.codes) > 0 {
+		code, s.codes = s.codes[0], s.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func newContext(cid string, topic string, payload []byte, props *packets5.Properties) context.MQTTContext {
+	client := &context.MockMQTTClient{
+		MockClientID: cid,
+	}
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Payload = payload
+	return context.NewMQTT5Context(stdcontext.Background(), client, packet, props)
+}
+
+func newWebhook(spec *Spec) *Webhook {
+	meta := &pipeline.FilterMetaSpec{Name: "webhook-demo", Kind: Kind, Pipeline: "pipeline-demo", Protocol: context.MQTT}
+	w := &Webhook{}
+	w.Init(pipeline.MockFilterSpec(nil, nil, "", meta, spec))
+	return w
+}
+
+func TestWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &mockServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	w := &Webhook{}
+	assert.Equal(Kind, w.Kind())
+	assert.NotNil(w.DefaultSpec())
+	assert.NotEmpty(w.Description())
+	assert.Len(w.Results(), 2)
+
+	spec := &Spec{
+		URL:     ts.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+	w = newWebhook(spec)
+	defer w.Close()
+
+	props := &packets5.Properties{ContentType: "application/json", User: []packets5.User{{Key: "k", Value: "v"}}}
+	ctx := newContext("client", "a/b/c", []byte(`{"a":1}`), props)
+	assert.Equal("", w.HandleMQTT(ctx).ErrString)
+
+	assert.Len(server.requests, 1)
+	r := server.requests[0]
+	assert.Equal(http.MethodPost, r.method)
+	assert.Equal(`{"a":1}`, r.body)
+	assert.Equal("a/b/c", r.header.Get(HeaderTopic))
+	assert.Equal("client", r.header.Get(HeaderClientID))
+	assert.Equal("application/json", r.header.Get("Content-Type"))
+	assert.Equal("Bearer token", r.header.Get("Authorization"))
+	assert.Equal("v", r.header.Get("k"))
+	assert.Equal(&mqttbackend.Stats{Sent: 1}, w.Status())
+}
+
+func TestWebhookFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &mockServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	spec := &Spec{
+		URL:      ts.URL,
+		Method:   http.MethodPut,
+		Topic:    &Topic{Default: "default"},
+		KVMap:    &mqttbackend.KVMap{PayloadKey: "payload"},
+		Delivery: &mqttbackend.Delivery{MaxRetries: 2, RetryInterval: "1ms"},
+	}
+	w := newWebhook(spec)
+	defer w.Close()
+
+	ctx := newContext("client", "a/b/c", []byte("text"), nil)
+	assert.Equal(resultGetDataFailed, w.HandleMQTT(ctx).ErrString)
+
+	// server errors are retried
+	server.codes = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+	ctx.SetKV("payload", []byte("data"))
+	assert.Equal("", w.HandleMQTT(ctx).ErrString)
+	assert.Len(server.requests, 3)
+	assert.Equal(http.MethodPut, server.requests[2].method)
+	assert.Equal("data", server.requests[2].body)
+
+	// client errors are not retried
+	server.codes = []int{http.StatusBadRequest}
+	assert.Equal(resultSendFailed, w.HandleMQTT(ctx).ErrString)
+	assert.True(ctx.Drop())
+	assert.Len(server.requests, 4)
+
+	server.codes = []int{500, 500, 500}
+	ctx = newContext("client", "a/b/c", []byte("text"), nil)
+	ctx.SetKV("payload", []byte("data"))
+	assert.Equal(resultSendFailed, w.HandleMQTT(ctx).ErrString)
+	assert.Len(server.requests, 7)
+	assert.Equal(&mqttbackend.Stats{Sent: 1, Failed: 2, Retried: 4}, w.Status())
+}
@@ -0,0 +1,399 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocketproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filter/proxy"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/util/wsproxy"
+)
+
+const (
+	// Kind is the kind of WebSocketProxy.
+	Kind = "WebSocketProxy"
+
+	resultClientError = "clientError"
+	resultServerError = "serverError"
+
+	defaultHandshakeTimeout = 30 * time.Second
+
+	xForwardedFor   = "X-Forwarded-For"
+	xForwardedHost  = "X-Forwarded-Host"
+	xForwardedProto = "X-Forwarded-Proto"
+)
+
+var results = []string{resultClientError, resultServerError}
+
+// headersToSkip are the request headers set by the websocket library, they
+// are not copied to the backend.
+var headersToSkip = map[string]struct{}{
+	"Upgrade":                  {},
+	"Connection":               {},
+	"Sec-Websocket-Key":        {},
+	"Sec-Websocket-Version":    {},
+	"Sec-Websocket-Extensions": {},
+	"Sec-Websocket-Protocol":   {},
+}
+
+func init() {
+	httppipeline.Register(&WebSocketProxy{})
+}
+
+type (
+	// WebSocketProxy is the filter proxying websocket connections to a pool
+	// of backend servers.
+	WebSocketProxy struct {
+		filterSpec *httppipeline.FilterSpec
+		spec       *Spec
+
+		pool       *proxy.ServerPool
+		dialer     *websocket.Dialer
+		controller *wsproxy.Controller
+
+		// conns is shared by generations of the filter, so the
+		// connections survive the updates of the pipeline.
+		conns *conns
+	}
+
+	// Spec describes the WebSocketProxy.
+	Spec struct {
+		ServersTags     []string           `yaml:"serversTags" jsonschema:"omitempty,uniqueItems=true"`
+		Servers         []*proxy.Server    `yaml:"servers" jsonschema:"omitempty"`
+		ServiceRegistry string             `yaml:"serviceRegistry" jsonschema:"omitempty"`
+		ServiceName     string             `yaml:"serviceName" jsonschema:"omitempty"`
+		LoadBalance     *proxy.LoadBalance `yaml:"loadBalance" jsonschema:"required"`
+
+		HandshakeTimeout string        `yaml:"handshakeTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		Controls         *wsproxy.Spec `yaml:"controls,omitempty" jsonschema:"omitempty"`
+	}
+
+	// Status is the status of WebSocketProxy.
+	Status struct {
+		ActiveConnections int64  `yaml:"activeConnections"`
+		TotalConnections  uint64 `yaml:"totalConnections"`
+		FailedConnections uint64 `yaml:"failedConnections"`
+
+		wsproxy.Stats `yaml:",inline"`
+	}
+
+	conns struct {
+		stats  wsproxy.Stats
+		active int64
+		total  uint64
+		failed uint64
+
+		done chan struct{}
+	}
+)
+
+// Validate validates Spec.
+func (spec Spec) Validate() error {
+	if err := spec.poolSpec().Validate(); err != nil {
+		return err
+	}
+
+	for _, s := range spec.Servers {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return fmt.Errorf("invalid server url %s: %v", s.URL, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "ws", "wss":
+		default:
+			return fmt.Errorf("unsupported scheme %s of server %s", u.Scheme, s.URL)
+		}
+	}
+
+	return nil
+}
+
+func (spec *Spec) poolSpec() *proxy.PoolSpec {
+	return &proxy.PoolSpec{
+		ServersTags:     spec.ServersTags,
+		Servers:         spec.Servers,
+		ServiceRegistry: spec.ServiceRegistry,
+		ServiceName:     spec.ServiceName,
+		LoadBalance:     spec.LoadBalance,
+	}
+}
+
+// Kind returns the kind of WebSocketProxy.
+func (p *WebSocketProxy) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of WebSocketProxy.
+func (p *WebSocketProxy) DefaultSpec() interface{} {
+	return &Spec{}
+}
+
+// Description returns the description of WebSocketProxy.
+func (p *WebSocketProxy) Description() string {
+	return "WebSocketProxy proxies websocket connections to backend servers"
+}
+
+// Results returns the results of WebSocketProxy.
+func (p *WebSocketProxy) Results() []string {
+	return results
+}
+
+// Init initializes WebSocketProxy.
+func (p *WebSocketProxy) Init(filterSpec *httppipeline.FilterSpec) {
+	p.filterSpec, p.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	p.conns = &conns{done: make(chan struct{})}
+	p.reload()
+}
+
+// Inherit inherits previous generation of WebSocketProxy.
+func (p *WebSocketProxy) Inherit(filterSpec *httppipeline.FilterSpec, previousGeneration httppipeline.Filter) {
+	prev := previousGeneration.(*WebSocketProxy)
+	prev.pool.Close()
+	prev.controller.Close()
+
+	p.filterSpec, p.spec = filterSpec, filterSpec.FilterSpec().(*Spec)
+	p.conns = prev.conns
+	p.reload()
+}
+
+func (p *WebSocketProxy) reload() {
+	p.pool = proxy.NewServerPool(p.filterSpec.Super(), p.spec.poolSpec())
+	controller, err := wsproxy.New(p.spec.Controls)
+	if err != nil {
+		panic(err)
+	}
+	p.controller = controller
+
+	handshakeTimeout := defaultHandshakeTimeout
+	if p.spec.HandshakeTimeout != "" {
+		d, err := time.ParseDuration(p.spec.HandshakeTimeout)
+		if err != nil {
+			logger.Errorf("BUG: parse duration %s failed: %v", p.spec.HandshakeTimeout, err)
+		} else {
+			handshakeTimeout = d
+		}
+	}
+
+	p.dialer = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: handshakeTimeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+}
+
+// Handle proxies the websocket connection of the request.
+func (p *WebSocketProxy) Handle(ctx context.HTTPContext) string {
+	result := p.handle(ctx)
+	return ctx.CallNextHandler(result)
+}
+
+func (p *WebSocketProxy) handle(ctx context.HTTPContext) string {
+	stdr := ctx.Request().Std()
+	if !websocket.IsWebSocketUpgrade(stdr) {
+		ctx.AddTag("websocketProxy: not a websocket upgrade request")
+		ctx.Response().SetStatusCode(http.StatusBadRequest)
+		return resultClientError
+	}
+
+	protocols, err := p.controller.Subprotocols(stdr)
+	if err != nil {
+		ctx.AddTag(fmt.Sprintf("websocketProxy: %v", err))
+		ctx.Response().SetStatusCode(http.StatusBadRequest)
+		return resultClientError
+	}
+
+	server, err := p.pool.Next(ctx)
+	if err != nil {
+		atomic.AddUint64(&p.conns.failed, 1)
+		ctx.AddTag(fmt.Sprintf("websocketProxy: %v", err))
+		ctx.Response().SetStatusCode(http.StatusServiceUnavailable)
+		return resultServerError
+	}
+
+	backendURL := p.backendURL(server, ctx)
+	dialer := *p.dialer
+	dialer.Subprotocols = protocols
+	connBackend, resp, err := dialer.Dial(backendURL, p.requestHeader(stdr))
+	if err != nil {
+		atomic.AddUint64(&p.conns.failed, 1)
+		ctx.AddTag(fmt.Sprintf("websocketProxy: dial %s failed: %v", backendURL, err))
+		if resp != nil {
+			// NOTE: The handshake response is passed to the client for
+			// redirection, authentication and so on.
+			copyResponse(ctx, resp)
+		} else {
+			ctx.Response().SetStatusCode(http.StatusServiceUnavailable)
+		}
+		return resultServerError
+	}
+	defer connBackend.Close()
+
+	// The error response of the upgrader goes to the context, as the
+	// response is written when the context finishes.
+	upgrader := &websocket.Upgrader{
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			ctx.AddTag(fmt.Sprintf("websocketProxy: upgrade failed: %v", reason))
+			ctx.Response().SetStatusCode(status)
+		},
+	}
+	connClient, err := upgrader.Upgrade(ctx.Response().Std(), stdr, upgradeHeader(resp))
+	if err != nil {
+		atomic.AddUint64(&p.conns.failed, 1)
+		return resultClientError
+	}
+	defer connClient.Close()
+
+	// NOTE: The deadlines set by the HTTP server according to its read
+	// and write timeouts would break the long-lived connection.
+	connClient.UnderlyingConn().SetDeadline(time.Time{})
+
+	ctx.Response().SetStatusCode(http.StatusSwitchingProtocols)
+	p.serve(connClient, connBackend)
+
+	return ""
+}
+
+// backendURL builds the websocket URL of the server for the request.
+func (p *WebSocketProxy) backendURL(server *proxy.Server, ctx context.HTTPContext) string {
+	u := server.URL
+	switch {
+	case strings.HasPrefix(u, "http://"):
+		u = "ws://" + u[len("http://"):]
+	case strings.HasPrefix(u, "https://"):
+		u = "wss://" + u[len("https://"):]
+	}
+
+	r := ctx.Request()
+	u += r.Path()
+	if r.Query() != "" {
+		u += "?" + r.Query()
+	}
+	return u
+}
+
+// requestHeader copies the header of the request to the backend, except the
+// ones set by the websocket library.
+func (p *WebSocketProxy) requestHeader(req *http.Request) http.Header {
+	header := http.Header{}
+	for k, values := range req.Header {
+		if _, ok := headersToSkip[k]; ok {
+			continue
+		}
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if xff := header.Get(xForwardedFor); xff == "" {
+			header.Set(xForwardedFor, clientIP)
+		} else if !strings.Contains(xff, clientIP) {
+			header.Set(xForwardedFor, xff+", "+clientIP)
+		}
+	}
+
+	if header.Get(xForwardedHost) == "" && req.Host != "" {
+		header.Set(xForwardedHost, req.Host)
+	}
+
+	if req.TLS != nil {
+		header.Set(xForwardedProto, "https")
+	} else {
+		header.Set(xForwardedProto, "http")
+	}
+
+	return header
+}
+
+// upgradeHeader passes only selected headers of the backend handshake
+// response to the client.
+func upgradeHeader(resp *http.Response) http.Header {
+	header := http.Header{}
+	if v := resp.Header.Get("Sec-Websocket-Protocol"); v != "" {
+		header.Set("Sec-Websocket-Protocol", v)
+	}
+	for _, v := range resp.Header.Values("Set-Cookie") {
+		header.Add("Set-Cookie", v)
+	}
+	return header
+}
+
+func copyResponse(ctx context.HTTPContext, resp *http.Response) {
+	w := ctx.Response()
+	w.SetStatusCode(resp.StatusCode)
+	for k, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+
+	// The body has been read by the websocket library.
+	body, err := io.ReadAll(resp.Body)
+	if err == nil && len(body) > 0 {
+		w.SetBody(bytes.NewReader(body))
+	}
+}
+
+// serve passes messages between the client and the backend until one of
+// them closes the connection or the filter is closed.
+func (p *WebSocketProxy) serve(connClient, connBackend *websocket.Conn) {
+	atomic.AddInt64(&p.conns.active, 1)
+	atomic.AddUint64(&p.conns.total, 1)
+	defer atomic.AddInt64(&p.conns.active, -1)
+
+	err := p.controller.Pass(connClient, connBackend, &p.conns.stats, p.conns.done)
+
+	// Closures are expected, no need to log them.
+	if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
+		logger.Debugf("websocket connection closed: %v", err)
+	}
+}
+
+// Status returns the status of WebSocketProxy.
+func (p *WebSocketProxy) Status() interface{} {
+	c := p.conns
+	return &Status{
+		ActiveConnections: atomic.LoadInt64(&c.active),
+		TotalConnections:  atomic.LoadUint64(&c.total),
+		FailedConnections: atomic.LoadUint64(&c.failed),
+		Stats:             c.stats.Load(),
+	}
+}
+
+// Close closes WebSocketProxy, the active connections are closed too.
+func (p *WebSocketProxy) Close() {
+	p.pool.Close()
+	p.controller.Close()
+	close(p.conns.done)
+}
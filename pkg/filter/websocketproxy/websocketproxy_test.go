@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocketproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filter/proxy"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httppipeline"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/yamltool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newEchoServer() *httptest.Server {
+	upgrader := &websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, http.Header{"Set-Cookie": []string{"session=1"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			reply := fmt.Sprintf("%s %s %s", r.URL.Path, r.Header.Get("X-Forwarded-Proto"), msg)
+			conn.WriteMessage(msgType, []byte(reply))
+		}
+	}))
+}
+
+func newWebSocketProxy(t *testing.T, backend string, extraSpec ...string) *WebSocketProxy {
+	yamlSpec := `
+kind: WebSocketProxy
+name: websocket
+servers:
+- url: ` + backend + `
+loadBalance:
+  policy: roundRobin
+` + strings.Join(extraSpec, "\n")
+	rawSpec := make(map[string]interface{})
+	yamltool.Unmarshal([]byte(yamlSpec), &rawSpec)
+	spec, err := httppipeline.NewFilterSpec(rawSpec, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p := &WebSocketProxy{}
+	p.Init(spec)
+	return p
+}
+
+func newFrontServer(p *WebSocketProxy, results chan string) *httptest.Server {
+	return httptest.NewServer(frontHandler(p, results))
+}
+
+func frontHandler(p *WebSocketProxy, results chan string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.New(w, r, tracing.NoopTracing, "")
+		ctx.SetHandlerCaller(func(lastResult string) string {
+			return lastResult
+		})
+		result := p.Handle(ctx)
+		if ctx.Response().StatusCode() != http.StatusSwitchingProtocols {
+			ctx.Finish()
+		}
+		results <- result
+	})
+}
+
+func TestSpecValidate(t *testing.T) {
+	spec := Spec{
+		Servers:     []*proxy.Server{{URL: "ftp://127.0.0.1"}},
+		LoadBalance: &proxy.LoadBalance{Policy: "roundRobin"},
+	}
+	if spec.Validate() == nil {
+		t.Errorf("ftp server should be invalid")
+	}
+
+	spec.Servers[0].URL = "ws://127.0.0.1:8080"
+	if err := spec.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	spec.Servers = nil
+	if spec.Validate() == nil {
+		t.Errorf("empty servers should be invalid")
+	}
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+
+	p := newWebSocketProxy(t, backend.URL)
+	results := make(chan string, 10)
+	front := newFrontServer(p, results)
+	defer front.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(front.URL, "http") + "/chat"
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if resp.Header.Get("Set-Cookie") != "session=1" {
+		t.Errorf("cookie of backend should be passed")
+	}
+
+	for i := 0; i < 3; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read message failed: %v", err)
+		}
+		if string(msg) != "/chat http hello" {
+			t.Errorf("unexpected message %q", msg)
+		}
+	}
+
+	status := p.Status().(*Status)
+	if status.ActiveConnections != 1 || status.TotalConnections != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.ClientMessages != 3 || status.BackendMessages != 3 || status.ClientBytes != 15 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	select {
+	case result := <-results:
+		if result != "" {
+			t.Errorf("unexpected result %q", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection should be closed")
+	}
+	if status := p.Status().(*Status); status.ActiveConnections != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	p.Close()
+}
+
+func TestWebSocketProxyServerTimeout(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+
+	p := newWebSocketProxy(t, backend.URL)
+	defer p.Close()
+	results := make(chan string, 10)
+	front := httptest.NewUnstartedServer(frontHandler(p, results))
+	front.Config.ReadTimeout = 200 * time.Millisecond
+	front.Config.WriteTimeout = 200 * time.Millisecond
+	front.Start()
+	defer front.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(front.URL, "http") + "/chat"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// The connection outlives the timeouts of the server.
+	time.Sleep(500 * time.Millisecond)
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read message failed: %v", err)
+	}
+	if string(msg) != "/chat http hello" {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestWebSocketProxyFailures(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+
+	p := newWebSocketProxy(t, backend.URL)
+	defer p.Close()
+	results := make(chan string, 10)
+	front := newFrontServer(p, results)
+	defer front.Close()
+
+	// Not an upgrade request.
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || <-results != resultClientError {
+		t.Errorf("want status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// The handshake response of the backend is passed to the client.
+	wsURL := "ws" + strings.TrimPrefix(front.URL, "http") + "/forbidden"
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatalf("dial should fail")
+	}
+	if resp.StatusCode != http.StatusForbidden || <-results != resultServerError {
+		t.Errorf("want status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	if status := p.Status().(*Status); status.FailedConnections != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestWebSocketProxyClose(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+
+	p := newWebSocketProxy(t, backend.URL)
+	results := make(chan string, 10)
+	front := newFrontServer(p, results)
+	defer front.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(front.URL, "http") + "/chat"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Connections survive the updates of the pipeline.
+	p2 := &WebSocketProxy{}
+	p2.Inherit(p.filterSpec, p)
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if _, _, err = conn.ReadMessage(); err != nil {
+		t.Fatalf("read message failed: %v", err)
+	}
+
+	p2.Close()
+	_, _, err = conn.ReadMessage()
+	if e, ok := err.(*websocket.CloseError); !ok || e.Code != websocket.CloseGoingAway {
+		t.Errorf("want going away closure, got %v", err)
+	}
+}
+
+func TestWebSocketProxyMessageTooBig(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+
+	p := newWebSocketProxy(t, backend.URL, "controls:\n  maxMessageBytes: 64")
+	results := make(chan string, 10)
+	front := newFrontServer(p, results)
+	defer front.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(front.URL, "http") + "/chat"
+	for _, c := range []struct {
+		sender string
+		size   int
+	}{
+		{"client", 100},
+		// The reply of the echo server is longer than the message.
+		{"backend", 60},
+	} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", c.size)))
+		_, _, err = conn.ReadMessage()
+		if e, ok := err.(*websocket.CloseError); !ok || e.Code != websocket.CloseMessageTooBig {
+			t.Errorf("too large message from %s: want message too big closure, got %v", c.sender, err)
+		}
+		conn.Close()
+	}
+}
@@ -36,6 +36,7 @@ type (
 		notFound         bool
 		methodNotAllowed bool
 		path             *muxPath
+		clientCert       *ClientCertRule
 	}
 )
 
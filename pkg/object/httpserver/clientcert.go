@@ -0,0 +1,402 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/urlrule"
+)
+
+const (
+	// ClientAuthNone doesn't request client certificates.
+	ClientAuthNone = "none"
+	// ClientAuthRequest requests client certificates, and verifies them if given.
+	ClientAuthRequest = "request"
+	// ClientAuthRequire requires and verifies client certificates.
+	ClientAuthRequire = "require"
+
+	defaultClientCertSubjectHeader     = "X-Client-Cert-Subject"
+	defaultClientCertSANHeader         = "X-Client-Cert-San"
+	defaultClientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+
+	defaultOCSPTimeout = 3 * time.Second
+	// 16KB
+	maxOCSPResponseBytes = 16 * 1024
+	// ocspCacheSize bounds the number of cached OCSP responses.
+	ocspCacheSize = 10240
+)
+
+type (
+	// ClientCertRevocation describes how to check the revocation of client certificates.
+	ClientCertRevocation struct {
+		// CRLs are in PEM format, which could be in base64 encoding or plain text.
+		CRLs          []string `yaml:"crls,omitempty" jsonschema:"omitempty"`
+		OCSP          bool     `yaml:"ocsp" jsonschema:"omitempty"`
+		OCSPResponder string   `yaml:"ocspResponder,omitempty" jsonschema:"omitempty,format=uri"`
+		OCSPTimeout   string   `yaml:"ocspTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		// SoftFail allows the certificate when its OCSP status can't be got.
+		SoftFail bool `yaml:"softFail" jsonschema:"omitempty"`
+	}
+
+	// ClientCertHeaders describes the request headers to carry the
+	// identity of the client certificate to backends.
+	ClientCertHeaders struct {
+		Subject     string `yaml:"subject,omitempty" jsonschema:"omitempty"`
+		SAN         string `yaml:"san,omitempty" jsonschema:"omitempty"`
+		Fingerprint string `yaml:"fingerprint,omitempty" jsonschema:"omitempty"`
+	}
+
+	// ClientCertRule describes the client certificates allowed by a rule.
+	ClientCertRule struct {
+		// Required rejects requests without a verified client certificate,
+		// it makes sense when the clientAuth of the server is request.
+		Required        bool                   `yaml:"required" jsonschema:"omitempty"`
+		AllowedSubjects []*urlrule.StringMatch `yaml:"allowedSubjects,omitempty" jsonschema:"omitempty"`
+		AllowedSANs     []*urlrule.StringMatch `yaml:"allowedSANs,omitempty" jsonschema:"omitempty"`
+	}
+
+	revocationChecker struct {
+		crls          []*pkix.CertificateList
+		ocsp          bool
+		ocspResponder string
+		softFail      bool
+		client        *http.Client
+		ocspCache     *lru.Cache
+	}
+)
+
+func (r *ClientCertRule) init() {
+	for _, sm := range r.AllowedSubjects {
+		sm.Init()
+	}
+	for _, sm := range r.AllowedSANs {
+		sm.Init()
+	}
+}
+
+// clientCert returns the verified leaf certificate of the client.
+func clientCert(ctx context.HTTPContext) *x509.Certificate {
+	state := ctx.Request().Std().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+func matchAny(matchers []*urlrule.StringMatch, values ...string) bool {
+	for _, sm := range matchers {
+		for _, v := range values {
+			if sm.Match(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check returns an empty string if the client certificate of the request
+// is allowed, or the reason otherwise.
+func (r *ClientCertRule) check(ctx context.HTTPContext) string {
+	cert := clientCert(ctx)
+	if cert == nil {
+		if r.Required || len(r.AllowedSubjects) != 0 || len(r.AllowedSANs) != 0 {
+			return "client certificate required"
+		}
+		return ""
+	}
+
+	if len(r.AllowedSubjects) != 0 && !matchAny(r.AllowedSubjects, cert.Subject.String()) {
+		return "client certificate subject " + cert.Subject.String() + " not allowed"
+	}
+
+	if len(r.AllowedSANs) != 0 && !matchAny(r.AllowedSANs, certSANs(cert)...) {
+		return "client certificate SANs not allowed"
+	}
+
+	return ""
+}
+
+func (h *ClientCertHeaders) subjectHeader() string {
+	if h.Subject != "" {
+		return h.Subject
+	}
+	return defaultClientCertSubjectHeader
+}
+
+func (h *ClientCertHeaders) sanHeader() string {
+	if h.SAN != "" {
+		return h.SAN
+	}
+	return defaultClientCertSANHeader
+}
+
+func (h *ClientCertHeaders) fingerprintHeader() string {
+	if h.Fingerprint != "" {
+		return h.Fingerprint
+	}
+	return defaultClientCertFingerprintHeader
+}
+
+// inject sets the identity of the client certificate to the request headers,
+// the headers from the client are always removed to prevent spoofing.
+func (h *ClientCertHeaders) inject(ctx context.HTTPContext) {
+	header := ctx.Request().Header()
+	header.Del(h.subjectHeader())
+	header.Del(h.sanHeader())
+	header.Del(h.fingerprintHeader())
+
+	cert := clientCert(ctx)
+	if cert == nil {
+		return
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	header.Set(h.subjectHeader(), cert.Subject.String())
+	if sans := certSANs(cert); len(sans) != 0 {
+		header.Set(h.sanHeader(), strings.Join(sans, ","))
+	}
+	header.Set(h.fingerprintHeader(), hex.EncodeToString(fingerprint[:]))
+}
+
+func (spec *Spec) clientAuthType() tls.ClientAuthType {
+	switch spec.ClientAuth {
+	case ClientAuthNone:
+		return tls.NoClientCert
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	}
+
+	// NOTE: For backward compatibility, client certificates are
+	// required when caCertBase64 is provided.
+	if spec.CaCertBase64 != "" {
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+func parseCRLs(crls []string) ([]*pkix.CertificateList, error) {
+	var result []*pkix.CertificateList
+	for i, c := range crls {
+		data := tryDecodeBase64Pem(c)
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			crl, err := x509.ParseDERCRL(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse crls[%d] failed: %v", i, err)
+			}
+			result = append(result, crl)
+		}
+	}
+
+	if len(crls) != 0 && len(result) == 0 {
+		return nil, fmt.Errorf("no valid crl found")
+	}
+	return result, nil
+}
+
+func newRevocationChecker(spec *ClientCertRevocation) (*revocationChecker, error) {
+	crls, err := parseCRLs(spec.CRLs)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultOCSPTimeout
+	if spec.OCSPTimeout != "" {
+		timeout, err = time.ParseDuration(spec.OCSPTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("parse ocspTimeout %s failed: %v", spec.OCSPTimeout, err)
+		}
+	}
+
+	ocspCache, err := lru.New(ocspCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &revocationChecker{
+		crls:          crls,
+		ocsp:          spec.OCSP,
+		ocspResponder: spec.OCSPResponder,
+		softFail:      spec.SoftFail,
+		client:        &http.Client{Timeout: timeout},
+		ocspCache:     ocspCache,
+	}, nil
+}
+
+// verifyConnection is used as tls.Config.VerifyConnection, it is called
+// on every handshake, including the resumed ones.
+func (rc *revocationChecker) verifyConnection(cs tls.ConnectionState) error {
+	verifiedChains := cs.VerifiedChains
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil
+	}
+
+	chain := verifiedChains[0]
+	cert := chain[0]
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	} else {
+		// NOTE: A self-signed certificate is its own issuer.
+		issuer = cert
+	}
+
+	if err := rc.checkCRL(cert, issuer); err != nil {
+		return err
+	}
+
+	if rc.ocsp {
+		return rc.checkOCSP(cert, issuer)
+	}
+
+	return nil
+}
+
+func (rc *revocationChecker) checkCRL(cert, issuer *x509.Certificate) error {
+	for _, crl := range rc.crls {
+		var crlIssuer pkix.Name
+		crlIssuer.FillFromRDNSequence(&crl.TBSCertList.Issuer)
+		if crlIssuer.String() != cert.Issuer.String() {
+			continue
+		}
+		if err := issuer.CheckCRLSignature(crl); err != nil {
+			logger.Warnf("check signature of crl from %s failed: %v", issuer.Subject, err)
+			continue
+		}
+
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("client certificate %s is revoked", cert.SerialNumber)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rc *revocationChecker) checkOCSP(cert, issuer *x509.Certificate) error {
+	resp, err := rc.ocspResponse(cert, issuer)
+	if err != nil {
+		if rc.softFail {
+			logger.Warnf("get ocsp status of client certificate %s failed: %v", cert.SerialNumber, err)
+			return nil
+		}
+		return fmt.Errorf("get ocsp status of client certificate %s failed: %v", cert.SerialNumber, err)
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("client certificate %s is revoked", cert.SerialNumber)
+	default:
+		if rc.softFail {
+			return nil
+		}
+		return fmt.Errorf("ocsp status of client certificate %s is unknown", cert.SerialNumber)
+	}
+}
+
+func (rc *revocationChecker) ocspResponse(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	key := string(cert.RawIssuer) + cert.SerialNumber.String()
+
+	if v, ok := rc.ocspCache.Get(key); ok {
+		resp := v.(*ocsp.Response)
+		if time.Now().Before(resp.NextUpdate) {
+			return resp, nil
+		}
+		rc.ocspCache.Remove(key)
+	}
+
+	responder := rc.ocspResponder
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, fmt.Errorf("no ocsp responder")
+		}
+		responder = cert.OCSPServer[0]
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create ocsp request failed: %v", err)
+	}
+
+	httpResp, err := rc.client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp responder responded %d", httpResp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("parse ocsp response failed: %v", err)
+	}
+
+	// NOTE: Only cache the response with NextUpdate, otherwise
+	// newer information is always available.
+	if !resp.NextUpdate.IsZero() {
+		rc.ocspCache.Add(key, resp)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,328 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/urlrule"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("create ca failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, dnsNames ...string) *x509.Certificate {
+	cert, _ := ca.issueKeyPair(t, serial, cn, dnsNames...)
+	return cert
+}
+
+func (ca *testCA) issueKeyPair(t *testing.T, serial int64, cn string, dnsNames ...string) (*x509.Certificate, tls.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"megaease"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatalf("create certificate failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func newTLSContext(cert *x509.Certificate, header map[string]string) context.HTTPContext {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+}
+
+func verifiedState(chain ...*x509.Certificate) tls.ConnectionState {
+	return tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{chain}}
+}
+
+func TestClientAuthType(t *testing.T) {
+	cases := []struct {
+		spec Spec
+		want tls.ClientAuthType
+	}{
+		{Spec{}, tls.NoClientCert},
+		{Spec{CaCertBase64: "ca"}, tls.RequireAndVerifyClientCert},
+		{Spec{CaCertBase64: "ca", ClientAuth: ClientAuthRequest}, tls.VerifyClientCertIfGiven},
+		{Spec{CaCertBase64: "ca", ClientAuth: ClientAuthNone}, tls.NoClientCert},
+		{Spec{ClientAuth: ClientAuthRequire}, tls.RequireAndVerifyClientCert},
+	}
+	for i, c := range cases {
+		if got := c.spec.clientAuthType(); got != c.want {
+			t.Errorf("case %d: want %v, got %v", i, c.want, got)
+		}
+	}
+
+	spec := &Spec{HTTPS: true, AutoCert: true, ClientAuth: ClientAuthRequire}
+	if spec.Validate() == nil {
+		t.Errorf("clientAuth require without caCertBase64 should be invalid")
+	}
+
+	spec = &Spec{Rules: []*Rule{{ClientCert: &ClientCertRule{Required: true}}}}
+	if spec.Validate() == nil {
+		t.Errorf("clientCert of rules without https should be invalid")
+	}
+}
+
+func TestClientCertRule(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, 2, "order-service", "order.megaease.com")
+
+	rule := &ClientCertRule{
+		AllowedSubjects: []*urlrule.StringMatch{{RegEx: "CN=order-service"}},
+		AllowedSANs:     []*urlrule.StringMatch{{Exact: "order.megaease.com"}},
+	}
+	rule.init()
+
+	if reason := rule.check(newTLSContext(cert, nil)); reason != "" {
+		t.Errorf("certificate should be allowed, got %s", reason)
+	}
+	if rule.check(newTLSContext(nil, nil)) == "" {
+		t.Errorf("request without certificate should be rejected")
+	}
+
+	other := ca.issue(t, 3, "order-service", "user.megaease.com")
+	if rule.check(newTLSContext(other, nil)) == "" {
+		t.Errorf("certificate with other SANs should be rejected")
+	}
+
+	rule = &ClientCertRule{}
+	rule.init()
+	if reason := rule.check(newTLSContext(nil, nil)); reason != "" {
+		t.Errorf("certificate is not required, got %s", reason)
+	}
+}
+
+func TestClientCertHeaders(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, 2, "order-service", "order.megaease.com")
+
+	h := &ClientCertHeaders{Fingerprint: "X-Fingerprint"}
+	ctx := newTLSContext(cert, map[string]string{defaultClientCertSubjectHeader: "CN=admin"})
+	h.inject(ctx)
+
+	header := ctx.Request().Header()
+	if got := header.Get(defaultClientCertSubjectHeader); got != cert.Subject.String() {
+		t.Errorf("unexpected subject header %s", got)
+	}
+	if got := header.Get(defaultClientCertSANHeader); got != "order.megaease.com" {
+		t.Errorf("unexpected SAN header %s", got)
+	}
+	if got := header.Get("X-Fingerprint"); len(got) != 64 {
+		t.Errorf("unexpected fingerprint header %s", got)
+	}
+
+	ctx = newTLSContext(nil, map[string]string{defaultClientCertSubjectHeader: "CN=admin"})
+	h.inject(ctx)
+	if got := ctx.Request().Header().Get(defaultClientCertSubjectHeader); got != "" {
+		t.Errorf("spoofed subject header should be removed, got %s", got)
+	}
+}
+
+func TestCRL(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, 2, "revoked")
+	good := ca.issue(t, 3, "good")
+
+	crlDER, err := ca.cert.CreateCRL(rand.Reader, ca.key, []pkix.RevokedCertificate{
+		{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()},
+	}, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("create crl failed: %v", err)
+	}
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+
+	rc, err := newRevocationChecker(&ClientCertRevocation{
+		CRLs: []string{base64.StdEncoding.EncodeToString(crlPEM)},
+	})
+	if err != nil {
+		t.Fatalf("new revocation checker failed: %v", err)
+	}
+
+	if rc.verifyConnection(verifiedState(revoked, ca.cert)) == nil {
+		t.Errorf("revoked certificate should be rejected")
+	}
+	if err := rc.verifyConnection(verifiedState(good, ca.cert)); err != nil {
+		t.Errorf("good certificate should be allowed, got %v", err)
+	}
+
+	_, err = newRevocationChecker(&ClientCertRevocation{CRLs: []string{"invalid"}})
+	if err == nil {
+		t.Errorf("invalid crl should fail")
+	}
+}
+
+func TestOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, 2, "revoked")
+	good := ca.issue(t, 3, "good")
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tmpl := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if req.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
+			tmpl.Status = ocsp.Revoked
+			tmpl.RevokedAt = time.Now()
+		}
+
+		resp, _ := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+		w.Write(resp)
+	}))
+	defer server.Close()
+
+	rc, _ := newRevocationChecker(&ClientCertRevocation{OCSP: true, OCSPResponder: server.URL})
+	if rc.verifyConnection(verifiedState(revoked, ca.cert)) == nil {
+		t.Errorf("revoked certificate should be rejected")
+	}
+	for i := 0; i < 2; i++ {
+		if err := rc.verifyConnection(verifiedState(good, ca.cert)); err != nil {
+			t.Errorf("good certificate should be allowed, got %v", err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("ocsp responses should be cached, got %d requests", requests)
+	}
+
+	rc, _ = newRevocationChecker(&ClientCertRevocation{OCSP: true, OCSPResponder: "http://127.0.0.1:1"})
+	if rc.verifyConnection(verifiedState(good, ca.cert)) == nil {
+		t.Errorf("unreachable responder should reject the certificate")
+	}
+	rc, _ = newRevocationChecker(&ClientCertRevocation{OCSP: true, OCSPResponder: "http://127.0.0.1:1", SoftFail: true})
+	if err := rc.verifyConnection(verifiedState(good, ca.cert)); err != nil {
+		t.Errorf("soft fail should allow the certificate, got %v", err)
+	}
+}
+
+func TestRevocationOfResumedSession(t *testing.T) {
+	ca := newTestCA(t)
+	cert, keyPair := ca.issueKeyPair(t, 2, "client")
+
+	rc, _ := newRevocationChecker(&ClientCertRevocation{})
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		ClientCAs:        pool,
+		VerifyConnection: rc.verifyConnection,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{keyPair},
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+	}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("good certificate should be allowed, got %v", err)
+	}
+	resp.Body.Close()
+
+	crlDER, _ := ca.cert.CreateCRL(rand.Reader, ca.key, []pkix.RevokedCertificate{
+		{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()},
+	}, time.Now(), time.Now().Add(time.Hour))
+	crl, _ := x509.ParseDERCRL(crlDER)
+	rc.crls = []*pkix.CertificateList{crl}
+
+	resp, err = client.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("revoked certificate should be rejected on resumed session, resumed: %v", resp.TLS.DidResume)
+	}
+}
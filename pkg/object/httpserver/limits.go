@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/httpheader"
+)
+
+const defaultUploadGracePeriod = 5 * time.Second
+
+var (
+	errBodyTooLarge  = fmt.Errorf("request body too large")
+	errUploadTooSlow = fmt.Errorf("request body upload rate too low")
+)
+
+type (
+	// Limits limits the size and the upload rate of requests. The limits
+	// of a path override the ones of the server field by field.
+	Limits struct {
+		MaxHeaderBytes uint32 `yaml:"maxHeaderBytes,omitempty" jsonschema:"omitempty,minimum=1"`
+		MaxBodyBytes   int64  `yaml:"maxBodyBytes,omitempty" jsonschema:"omitempty,minimum=1"`
+		// MinUploadRate is in bytes per second, a client which sends the
+		// request body slower than it after the grace period is cut off.
+		MinUploadRate     uint32 `yaml:"minUploadRate,omitempty" jsonschema:"omitempty,minimum=1"`
+		UploadGracePeriod string `yaml:"uploadGracePeriod,omitempty" jsonschema:"omitempty,format=duration"`
+
+		gracePeriod time.Duration
+	}
+
+	// bodyLimiter wraps the request body to enforce the body limits.
+	bodyLimiter struct {
+		reader io.Reader
+		limits *Limits
+
+		// conn is the underlying connection of HTTP/1.x requests, its read
+		// deadline is used to cut off clients sending nothing at all.
+		conn     net.Conn
+		deadline time.Time
+
+		start time.Time
+		count int64
+
+		mutex sync.Mutex
+		err   error
+	}
+
+	connContextKey struct{}
+)
+
+// Validate validates Limits.
+func (l Limits) Validate() error {
+	if l.UploadGracePeriod != "" && l.MinUploadRate == 0 {
+		return fmt.Errorf("uploadGracePeriod is configured without minUploadRate")
+	}
+	return nil
+}
+
+func (l *Limits) init() {
+	l.gracePeriod = defaultUploadGracePeriod
+	if l.UploadGracePeriod != "" {
+		d, err := time.ParseDuration(l.UploadGracePeriod)
+		if err != nil {
+			logger.Errorf("BUG: parse duration %s failed: %v", l.UploadGracePeriod, err)
+		} else {
+			l.gracePeriod = d
+		}
+	}
+}
+
+// mergeLimits returns the limits of a path, the non-zero fields of the path
+// limits take precedence over the server ones. It returns nil if both are nil.
+func mergeLimits(server, path *Limits) *Limits {
+	if server == nil && path == nil {
+		return nil
+	}
+
+	l := &Limits{}
+	for _, x := range []*Limits{server, path} {
+		if x == nil {
+			continue
+		}
+		if x.MaxHeaderBytes > 0 {
+			l.MaxHeaderBytes = x.MaxHeaderBytes
+		}
+		if x.MaxBodyBytes > 0 {
+			l.MaxBodyBytes = x.MaxBodyBytes
+		}
+		if x.MinUploadRate > 0 {
+			l.MinUploadRate = x.MinUploadRate
+			l.UploadGracePeriod = x.UploadGracePeriod
+		}
+	}
+	l.init()
+
+	return l
+}
+
+// withConn saves the connection to the context of requests, it is used as
+// the ConnContext of the http.Server.
+func withConn(ctx stdcontext.Context, conn net.Conn) stdcontext.Context {
+	return stdcontext.WithValue(ctx, connContextKey{}, conn)
+}
+
+// check checks the header and the declared body size of the request, it
+// returns the status code to reject the request, or 0 if it passes.
+func (l *Limits) check(ctx context.HTTPContext) int {
+	r := ctx.Request()
+
+	if l.MaxHeaderBytes > 0 && r.Header().Length() > int(l.MaxHeaderBytes) {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+
+	if l.MaxBodyBytes > 0 && r.Std().ContentLength > l.MaxBodyBytes {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return 0
+}
+
+func newBodyLimiter(ctx context.HTTPContext, limits *Limits, readTimeout time.Duration) *bodyLimiter {
+	bl := &bodyLimiter{
+		reader: ctx.Request().Body(),
+		limits: limits,
+		start:  time.Now(),
+	}
+
+	stdr := ctx.Request().Std()
+	if limits.MinUploadRate > 0 && stdr.ProtoMajor == 1 {
+		// NOTE: The read deadline of HTTP/2 connections is shared by
+		// all streams, so only the upload rate is checked for them.
+		bl.conn, _ = stdr.Context().Value(connContextKey{}).(net.Conn)
+		if readTimeout > 0 {
+			bl.deadline = bl.start.Add(readTimeout)
+		}
+	}
+
+	return bl
+}
+
+func (bl *bodyLimiter) Read(p []byte) (int, error) {
+	if err := bl.getError(); err != nil {
+		return 0, err
+	}
+
+	if bl.conn != nil {
+		bl.conn.SetReadDeadline(bl.readDeadline())
+	}
+
+	n, err := bl.reader.Read(p)
+	bl.count += int64(n)
+
+	if max := bl.limits.MaxBodyBytes; max > 0 && bl.count > max {
+		bl.setError(errBodyTooLarge)
+		return 0, errBodyTooLarge
+	}
+
+	if err == nil && bl.tooSlow(time.Now()) {
+		bl.setError(errUploadTooSlow)
+		return 0, errUploadTooSlow
+	}
+
+	if err != nil && err != io.EOF {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && bl.limits.MinUploadRate > 0 {
+			bl.setError(errUploadTooSlow)
+			return n, errUploadTooSlow
+		}
+	}
+
+	return n, err
+}
+
+// readDeadline returns the time before which the next byte must arrive to
+// keep the upload rate.
+func (bl *bodyLimiter) readDeadline() time.Time {
+	rate := int64(bl.limits.MinUploadRate)
+	d := bl.limits.gracePeriod + time.Duration((bl.count+1)*int64(time.Second)/rate)
+	deadline := bl.start.Add(d)
+	if !bl.deadline.IsZero() && bl.deadline.Before(deadline) {
+		return bl.deadline
+	}
+	return deadline
+}
+
+func (bl *bodyLimiter) tooSlow(now time.Time) bool {
+	if bl.limits.MinUploadRate == 0 {
+		return false
+	}
+
+	elapsed := now.Sub(bl.start) - bl.limits.gracePeriod
+	if elapsed <= 0 {
+		return false
+	}
+
+	return float64(bl.count) < elapsed.Seconds()*float64(bl.limits.MinUploadRate)
+}
+
+func (bl *bodyLimiter) setError(err error) {
+	bl.mutex.Lock()
+	bl.err = err
+	bl.mutex.Unlock()
+}
+
+func (bl *bodyLimiter) getError() error {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	return bl.err
+}
+
+// Close closes the underlying reader if it is a closer.
+func (bl *bodyLimiter) Close() error {
+	if closer, ok := bl.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// statusCode returns the status code for the error of the limiter, or 0 if
+// no limit is exceeded.
+func (bl *bodyLimiter) statusCode() int {
+	switch bl.getError() {
+	case errBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errUploadTooSlow:
+		return http.StatusRequestTimeout
+	}
+	return 0
+}
+
+func handleLimitExceeded(ctx context.HTTPContext, code int) {
+	w := ctx.Response()
+	if closer, ok := w.Body().(io.Closer); ok {
+		closer.Close()
+	}
+	w.SetBody(nil)
+	w.Header().Del(httpheader.KeyContentLength)
+	// The rest of the request body is not read, so the connection can't
+	// be reused.
+	w.Header().Set("Connection", "close")
+	w.SetStatusCode(code)
+}
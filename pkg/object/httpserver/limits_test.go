@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/tracing"
+)
+
+func newLimitsContext(body string, header map[string]string) context.HTTPContext {
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+}
+
+func TestMergeLimits(t *testing.T) {
+	if mergeLimits(nil, nil) != nil {
+		t.Errorf("limits should be nil")
+	}
+
+	server := &Limits{MaxHeaderBytes: 1024, MaxBodyBytes: 4096}
+	path := &Limits{MaxBodyBytes: 1 << 20, MinUploadRate: 100, UploadGracePeriod: "1s"}
+	l := mergeLimits(server, path)
+	if l.MaxHeaderBytes != 1024 || l.MaxBodyBytes != 1<<20 || l.MinUploadRate != 100 {
+		t.Errorf("unexpected limits %+v", l)
+	}
+	if l.gracePeriod != time.Second {
+		t.Errorf("unexpected grace period %v", l.gracePeriod)
+	}
+
+	l = mergeLimits(server, nil)
+	if l.MaxBodyBytes != 4096 || l.gracePeriod != defaultUploadGracePeriod {
+		t.Errorf("unexpected limits %+v", l)
+	}
+
+	if (Limits{UploadGracePeriod: "1s"}).Validate() == nil {
+		t.Errorf("uploadGracePeriod without minUploadRate should be invalid")
+	}
+}
+
+func TestLimitsCheck(t *testing.T) {
+	l := mergeLimits(&Limits{MaxHeaderBytes: 64, MaxBodyBytes: 8}, nil)
+
+	ctx := newLimitsContext("", map[string]string{"X-Large": strings.Repeat("a", 64)})
+	if code := l.check(ctx); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("want status %d, got %d", http.StatusRequestHeaderFieldsTooLarge, code)
+	}
+
+	ctx = newLimitsContext("0123456789", nil)
+	if code := l.check(ctx); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("want status %d, got %d", http.StatusRequestEntityTooLarge, code)
+	}
+
+	ctx = newLimitsContext("01234567", nil)
+	if code := l.check(ctx); code != 0 {
+		t.Errorf("request should pass, got %d", code)
+	}
+}
+
+func TestBodyLimiterMaxBodyBytes(t *testing.T) {
+	l := mergeLimits(&Limits{MaxBodyBytes: 8}, nil)
+
+	ctx := newLimitsContext("0123456789", nil)
+	// Simulate a chunked request whose length is unknown.
+	ctx.Request().Std().ContentLength = -1
+
+	bl := newBodyLimiter(ctx, l, 0)
+	if _, err := io.ReadAll(bl); err != errBodyTooLarge {
+		t.Errorf("want error %v, got %v", errBodyTooLarge, err)
+	}
+	if code := bl.statusCode(); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("want status %d, got %d", http.StatusRequestEntityTooLarge, code)
+	}
+
+	ctx = newLimitsContext("01234567", nil)
+	bl = newBodyLimiter(ctx, l, 0)
+	if body, err := io.ReadAll(bl); err != nil || string(body) != "01234567" {
+		t.Errorf("unexpected body %s, error %v", body, err)
+	}
+	if code := bl.statusCode(); code != 0 {
+		t.Errorf("limits should not be exceeded, got %d", code)
+	}
+}
+
+func TestBodyLimiterTooSlow(t *testing.T) {
+	l := mergeLimits(&Limits{MinUploadRate: 100, UploadGracePeriod: "1s"}, nil)
+	bl := &bodyLimiter{limits: l, start: time.Now()}
+
+	if bl.tooSlow(bl.start.Add(500 * time.Millisecond)) {
+		t.Errorf("upload in grace period should not be too slow")
+	}
+	if !bl.tooSlow(bl.start.Add(2 * time.Second)) {
+		t.Errorf("upload should be too slow")
+	}
+	bl.count = 200
+	if bl.tooSlow(bl.start.Add(2 * time.Second)) {
+		t.Errorf("upload should not be too slow")
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	l := mergeLimits(&Limits{MinUploadRate: 1000, UploadGracePeriod: "100ms"}, nil)
+
+	result := make(chan error, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.New(w, r, tracing.NoopTracing, "")
+		_, err := io.ReadAll(newBodyLimiter(ctx, l, 0))
+		result <- err
+	}))
+	server.Config.ConnContext = withConn
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Send the headers and a few bytes of the body, and then stall.
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100000\r\n\r\n0123456789")
+
+	select {
+	case err := <-result:
+		if err != errUploadTooSlow {
+			t.Errorf("want error %v, got %v", errUploadTooSlow, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("slow client is not cut off")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"regexp"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/megaease/easegress/pkg/object/globalfilter"
 
@@ -59,6 +60,7 @@ type (
 		tracer       *tracing.Tracing
 		ipFilter     *ipfilter.IPFilter
 		ipFilterChan *ipfilter.IPFilters
+		readTimeout  time.Duration
 
 		rules []*muxRule
 	}
@@ -70,6 +72,7 @@ type (
 		host       string
 		hostRegexp string
 		hostRE     *regexp.Regexp
+		clientCert *ClientCertRule
 		paths      []*muxPath
 	}
 
@@ -85,6 +88,8 @@ type (
 		rewriteTarget string
 		backend       string
 		headers       []*Header
+		limits        *Limits
+		streaming     *context.StreamingOptions
 	}
 )
 
@@ -159,6 +164,10 @@ func newMuxRule(parentIPFilters *ipfilter.IPFilters, rule *Rule, paths []*muxPat
 		}
 	}
 
+	if rule.ClientCert != nil {
+		rule.ClientCert.init()
+	}
+
 	return &muxRule{
 		ipFilter:      newIPFilter(rule.IPFilter),
 		ipFilterChain: newIPFilterChain(parentIPFilters, rule.IPFilter),
@@ -166,6 +175,7 @@ func newMuxRule(parentIPFilters *ipfilter.IPFilters, rule *Rule, paths []*muxPat
 		host:       rule.Host,
 		hostRegexp: rule.HostRegexp,
 		hostRE:     hostRE,
+		clientCert: rule.ClientCert,
 		paths:      paths,
 	}
 }
@@ -198,7 +208,7 @@ func (mr *muxRule) match(ctx context.HTTPContext) bool {
 	return false
 }
 
-func newMuxPath(parentIPFilters *ipfilter.IPFilters, path *Path) *muxPath {
+func newMuxPath(parentIPFilters *ipfilter.IPFilters, path *Path, serverLimits *Limits, writeTimeout time.Duration) *muxPath {
 	var pathRE *regexp.Regexp
 	if path.PathRegexp != "" {
 		var err error
@@ -214,6 +224,12 @@ func newMuxPath(parentIPFilters *ipfilter.IPFilters, path *Path) *muxPath {
 		p.initHeaderRoute()
 	}
 
+	var streaming *context.StreamingOptions
+	if path.Streaming != nil {
+		streaming = path.Streaming.options()
+		streaming.WriteTimeout = writeTimeout
+	}
+
 	return &muxPath{
 		ipFilter:      newIPFilter(path.IPFilter),
 		ipFilterChain: newIPFilterChain(parentIPFilters, path.IPFilter),
@@ -226,6 +242,8 @@ func newMuxPath(parentIPFilters *ipfilter.IPFilters, path *Path) *muxPath {
 		methods:       path.Methods,
 		backend:       path.Backend,
 		headers:       path.Headers,
+		limits:        mergeLimits(serverLimits, path.Limits),
+		streaming:     streaming,
 	}
 }
 
@@ -329,12 +347,14 @@ func (m *mux) reloadRules(superSpec *supervisor.Spec, muxMapper protocol.MuxMapp
 		ipFilterChan: newIPFilterChain(nil, spec.IPFilter),
 		rules:        make([]*muxRule, len(spec.Rules)),
 		tracer:       tracer,
+		readTimeout:  parseTimeout("readTimeout", spec.ReadTimeout),
 	}
 
 	if spec.CacheSize > 0 {
 		rules.cache = newCache(spec.CacheSize)
 	}
 
+	writeTimeout := parseTimeout("writeTimeout", spec.WriteTimeout)
 	for i := 0; i < len(rules.rules); i++ {
 		specRule := spec.Rules[i]
 
@@ -342,7 +362,7 @@ func (m *mux) reloadRules(superSpec *supervisor.Spec, muxMapper protocol.MuxMapp
 
 		paths := make([]*muxPath, len(specRule.Paths))
 		for j := 0; j < len(paths); j++ {
-			paths[j] = newMuxPath(ruleIPFilterChain, specRule.Paths[j])
+			paths[j] = newMuxPath(ruleIPFilterChain, specRule.Paths[j], spec.Limits, writeTimeout)
 		}
 
 		// NOTE: Given the parent ipFilters not its own.
@@ -363,6 +383,10 @@ func (m *mux) ServeHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 
 	rules := m.rules.Load().(*muxRules)
 
+	if isUpgradeRequest(stdr) {
+		stdw = &upgradeResponseWriter{ResponseWriter: stdw}
+	}
+
 	ctx := context.New(stdw, stdr, rules.tracer, rules.superSpec.Name())
 	defer ctx.Finish()
 	ctx.OnFinish(func() {
@@ -398,7 +422,7 @@ func (m *mux) ServeHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 			}
 
 			if !path.matchMethod(ctx) {
-				ci = &cacheItem{ipFilterChan: path.ipFilterChain, methodNotAllowed: true}
+				ci = &cacheItem{ipFilterChan: path.ipFilterChain, clientCert: host.clientCert, methodNotAllowed: true}
 				rules.putCacheItem(ctx, ci)
 				m.handleRequestWithCache(rules, ctx, ci)
 				return
@@ -410,7 +434,7 @@ func (m *mux) ServeHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 			}
 
 			if !path.hasHeaders() {
-				ci = &cacheItem{ipFilterChan: path.ipFilterChain, path: path}
+				ci = &cacheItem{ipFilterChan: path.ipFilterChain, clientCert: host.clientCert, path: path}
 				rules.putCacheItem(ctx, ci)
 				m.handleRequestWithCache(rules, ctx, ci)
 				return
@@ -418,7 +442,7 @@ func (m *mux) ServeHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 
 			if path.matchHeaders(ctx) {
 				// NOTE: No cache for the request matching headers.
-				ci = &cacheItem{ipFilterChan: path.ipFilterChain, path: path}
+				ci = &cacheItem{ipFilterChan: path.ipFilterChain, clientCert: host.clientCert, path: path}
 				m.handleRequestWithCache(rules, ctx, ci)
 				return
 			}
@@ -435,6 +459,16 @@ func (m *mux) handleIPNotAllow(ctx context.HTTPContext) {
 	ctx.Response().SetStatusCode(http.StatusForbidden)
 }
 
+func (m *mux) handleClientCertNotAllow(ctx context.HTTPContext, reason string) {
+	ctx.AddTag(reason)
+	ctx.Response().SetStatusCode(http.StatusForbidden)
+}
+
+func (m *mux) handleLimitNotAllow(ctx context.HTTPContext, code int) {
+	ctx.AddTag(stringtool.Cat("request exceeds limits: ", http.StatusText(code)))
+	handleLimitExceeded(ctx, code)
+}
+
 func (m *mux) handleRequestWithCache(rules *muxRules, ctx context.HTTPContext, ci *cacheItem) {
 	if ci.ipFilterChan != nil {
 		if !ci.ipFilterChan.AllowHTTPContext(ctx) {
@@ -443,6 +477,13 @@ func (m *mux) handleRequestWithCache(rules *muxRules, ctx context.HTTPContext, c
 		}
 	}
 
+	if ci.clientCert != nil {
+		if reason := ci.clientCert.check(ctx); reason != "" {
+			m.handleClientCertNotAllow(ctx, reason)
+			return
+		}
+	}
+
 	switch {
 	case ci.notFound:
 		ctx.Response().SetStatusCode(http.StatusNotFound)
@@ -460,6 +501,26 @@ func (m *mux) handleRequestWithCache(rules *muxRules, ctx context.HTTPContext, c
 			m.appendXForwardedFor(ctx)
 		}
 
+		if rules.spec.ClientCertHeaders != nil {
+			rules.spec.ClientCertHeaders.inject(ctx)
+		}
+
+		var limiter *bodyLimiter
+		if limits := ci.path.limits; limits != nil {
+			if code := limits.check(ctx); code != 0 {
+				m.handleLimitNotAllow(ctx, code)
+				return
+			}
+			if limits.MaxBodyBytes > 0 || limits.MinUploadRate > 0 {
+				limiter = newBodyLimiter(ctx, limits, rules.readTimeout)
+				ctx.Request().SetBody(limiter)
+			}
+		}
+
+		if ci.path.streaming != nil {
+			ctx.Response().SetStreaming(ci.path.streaming)
+		}
+
 		if ci.path.pathRE != nil && ci.path.rewriteTarget != "" {
 			path := ctx.Request().Path()
 			path = ci.path.pathRE.ReplaceAllString(path, ci.path.rewriteTarget)
@@ -469,9 +530,17 @@ func (m *mux) handleRequestWithCache(rules *muxRules, ctx context.HTTPContext, c
 		globalFilter := m.getGlobalFilter(rules)
 		if globalFilter == nil {
 			handler.Handle(ctx)
-			return
+		} else {
+			globalFilter.Handle(ctx, handler)
+		}
+
+		// NOTE: The limits of the request body can only be checked while
+		// the body is being read, so the response is replaced afterwards.
+		if limiter != nil {
+			if code := limiter.statusCode(); code != 0 {
+				m.handleLimitNotAllow(ctx, code)
+			}
 		}
-		globalFilter.Handle(ctx, handler)
 	}
 }
 
@@ -225,14 +225,35 @@ func (r *runtime) needRestartServer(nextSpec *Spec) bool {
 	x.MaxConnections, y.MaxConnections = 0, 0
 	x.CacheSize, y.CacheSize = 0, 0
 	x.XForwardedFor, y.XForwardedFor = false, false
+	x.ClientCertHeaders, y.ClientCertHeaders = nil, nil
 	x.Tracing, y.Tracing = nil, nil
 	x.IPFilter, y.IPFilter = nil, nil
 	x.Rules, y.Rules = nil, nil
 
+	// Only the max header bytes of the limits is applied to the server.
+	if x.maxHeaderBytes() != y.maxHeaderBytes() {
+		return true
+	}
+	x.Limits, y.Limits = nil, nil
+
 	// The update of rules need not to shutdown server.
 	return !reflect.DeepEqual(x, y)
 }
 
+func parseTimeout(name, timeout string) time.Duration {
+	if timeout == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		logger.Errorf("BUG: parse %s %s failed: %v", name, timeout, err)
+		return 0
+	}
+
+	return d
+}
+
 func (r *runtime) startServer() {
 	keepAliveTimeout := defaultKeepAliveTimeout
 	if r.spec.KeepAliveTimeout != "" {
@@ -246,9 +267,14 @@ func (r *runtime) startServer() {
 	}
 
 	srv := &http.Server{
-		Addr:        fmt.Sprintf(":%d", r.spec.Port),
-		Handler:     r.mux,
-		IdleTimeout: keepAliveTimeout,
+		Addr:              fmt.Sprintf(":%d", r.spec.Port),
+		Handler:           r.mux,
+		IdleTimeout:       keepAliveTimeout,
+		ReadHeaderTimeout: parseTimeout("readHeaderTimeout", r.spec.ReadHeaderTimeout),
+		ReadTimeout:       parseTimeout("readTimeout", r.spec.ReadTimeout),
+		WriteTimeout:      parseTimeout("writeTimeout", r.spec.WriteTimeout),
+		MaxHeaderBytes:    r.spec.maxHeaderBytes(),
+		ConnContext:       withConn,
 	}
 	srv.SetKeepAlivesEnabled(r.spec.KeepAlive)
 
@@ -44,6 +44,12 @@ type (
 		Tracing          *tracing.Spec `yaml:"tracing" jsonschema:"omitempty"`
 		CaCertBase64     string        `yaml:"caCertBase64" jsonschema:"omitempty,format=base64"`
 
+		// ClientAuth is one of none, request and require, it defaults to
+		// require if caCertBase64 is provided, none otherwise.
+		ClientAuth           string                `yaml:"clientAuth,omitempty" jsonschema:"omitempty,enum=none,enum=request,enum=require"`
+		ClientCertRevocation *ClientCertRevocation `yaml:"clientCertRevocation,omitempty" jsonschema:"omitempty"`
+		ClientCertHeaders    *ClientCertHeaders    `yaml:"clientCertHeaders,omitempty" jsonschema:"omitempty"`
+
 		// Support multiple certs, preserve the certbase64 and keybase64
 		// for backward compatibility
 		CertBase64 string `yaml:"certBase64" jsonschema:"omitempty,format=base64"`
@@ -58,6 +64,12 @@ type (
 		Rules    []*Rule        `yaml:"rules" jsonschema:"omitempty"`
 
 		GlobalFilter string `yaml:"globalFilter,omitempty" jsonschema:"omitempty"`
+
+		ReadHeaderTimeout string `yaml:"readHeaderTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		ReadTimeout       string `yaml:"readTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		WriteTimeout      string `yaml:"writeTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		// Limits of the server are the defaults of all paths.
+		Limits *Limits `yaml:"limits,omitempty" jsonschema:"omitempty"`
 	}
 
 	// Rule is first level entry of router.
@@ -69,10 +81,11 @@ type (
 		// Reference: https://github.com/alecthomas/jsonschema/issues/30
 		// In the future if we have the scenario where we need marshal the field, but omitempty
 		// in the schema, we are suppose to support multiple types on our own.
-		IPFilter   *ipfilter.Spec `yaml:"ipFilter,omitempty" jsonschema:"omitempty"`
-		Host       string         `yaml:"host" jsonschema:"omitempty"`
-		HostRegexp string         `yaml:"hostRegexp" jsonschema:"omitempty,format=regexp"`
-		Paths      []*Path        `yaml:"paths" jsonschema:"omitempty"`
+		IPFilter   *ipfilter.Spec  `yaml:"ipFilter,omitempty" jsonschema:"omitempty"`
+		Host       string          `yaml:"host" jsonschema:"omitempty"`
+		HostRegexp string          `yaml:"hostRegexp" jsonschema:"omitempty,format=regexp"`
+		ClientCert *ClientCertRule `yaml:"clientCert,omitempty" jsonschema:"omitempty"`
+		Paths      []*Path         `yaml:"paths" jsonschema:"omitempty"`
 	}
 
 	// Path is second level entry of router.
@@ -85,6 +98,8 @@ type (
 		Methods       []string       `yaml:"methods,omitempty" jsonschema:"omitempty,uniqueItems=true,format=httpmethod-array"`
 		Backend       string         `yaml:"backend" jsonschema:"required"`
 		Headers       []*Header      `yaml:"headers" jsonschema:"omitempty"`
+		Limits        *Limits        `yaml:"limits,omitempty" jsonschema:"omitempty"`
+		Streaming     *Streaming     `yaml:"streaming,omitempty" jsonschema:"omitempty"`
 	}
 
 	// Header is the third level entry of router. A header entry is always under a specific path entry, that is to mean
@@ -105,9 +120,31 @@ func (spec *Spec) Validate() error {
 		if spec.HTTP3 {
 			return fmt.Errorf("https is disabled when http3 enabled")
 		}
+		if spec.ClientAuth != "" || spec.ClientCertRevocation != nil || spec.ClientCertHeaders != nil {
+			return fmt.Errorf("https is disabled when client certificate options configured")
+		}
+		for _, rule := range spec.Rules {
+			if rule.ClientCert != nil {
+				return fmt.Errorf("https is disabled when clientCert of rules configured")
+			}
+		}
 		return nil
 	}
 
+	if spec.clientAuthType() != tls.NoClientCert && spec.CaCertBase64 == "" {
+		return fmt.Errorf("caCertBase64 is required when clientAuth is %s", spec.ClientAuth)
+	}
+	if spec.clientAuthType() == tls.NoClientCert {
+		if spec.ClientCertRevocation != nil {
+			return fmt.Errorf("clientCertRevocation is configured when clientAuth is none")
+		}
+		for _, rule := range spec.Rules {
+			if rule.ClientCert != nil {
+				return fmt.Errorf("clientCert of rules is configured when clientAuth is none")
+			}
+		}
+	}
+
 	if spec.CertBase64 == "" && spec.KeyBase64 == "" && len(spec.Certs) == 0 && len(spec.Keys) == 0 && !spec.AutoCert {
 		return fmt.Errorf("certBase64/keyBase64, certs/keys are both empty and autocert is disabled when https enabled")
 	}
@@ -115,6 +152,15 @@ func (spec *Spec) Validate() error {
 	return err
 }
 
+// maxHeaderBytes returns the max header bytes of the server, 0 means the
+// default of the http.Server.
+func (spec *Spec) maxHeaderBytes() int {
+	if spec.Limits == nil {
+		return 0
+	}
+	return int(spec.Limits.MaxHeaderBytes)
+}
+
 func tryDecodeBase64Pem(pem string) []byte {
 	// The pem could in base64 encoding or plain text. It starts with '-' if it is
 	// in plain text, and '-' is not a valid character in standard base64 encoding.
@@ -173,16 +219,26 @@ func (spec *Spec) tlsConfig() (*tls.Config, error) {
 	}
 
 	// if caCertBase64 configuration is provided, should enable tls.ClientAuth and
-	// add the root cert
+	// add the root cert, the client certificates are required by default
 	if len(spec.CaCertBase64) != 0 {
 		rootCertPem, _ := base64.StdEncoding.DecodeString(spec.CaCertBase64)
 		certPool := x509.NewCertPool()
 		certPool.AppendCertsFromPEM(rootCertPem)
 
-		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConf.ClientAuth = spec.clientAuthType()
 		tlsConf.ClientCAs = certPool
 	}
 
+	if spec.ClientCertRevocation != nil {
+		rc, err := newRevocationChecker(spec.ClientCertRevocation)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clientCertRevocation: %v", err)
+		}
+		// NOTE: VerifyPeerCertificate is not called on resumed connections,
+		// so the revocation must be checked in VerifyConnection.
+		tlsConf.VerifyConnection = rc.verifyConnection
+	}
+
 	return tlsConf, nil
 }
 
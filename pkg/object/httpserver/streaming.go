@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+// Streaming makes the responses of a path be written to clients chunk by
+// chunk, without buffering. Responses of Server-Sent Events are always
+// streamed, but only the paths with streaming configured have idle
+// timeouts and heartbeats.
+type Streaming struct {
+	// IdleTimeout ends the stream if the backend sends nothing for the
+	// duration, heartbeats are not counted.
+	IdleTimeout string `yaml:"idleTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+	// HeartbeatInterval is the interval of the comments injected into
+	// idle Server-Sent Events streams to keep the connection alive.
+	HeartbeatInterval string `yaml:"heartbeatInterval,omitempty" jsonschema:"omitempty,format=duration"`
+}
+
+// Validate validates Streaming.
+func (s Streaming) Validate() error {
+	if s.IdleTimeout == "" || s.HeartbeatInterval == "" {
+		return nil
+	}
+
+	idle, _ := time.ParseDuration(s.IdleTimeout)
+	heartbeat, _ := time.ParseDuration(s.HeartbeatInterval)
+	if heartbeat >= idle {
+		return fmt.Errorf("heartbeatInterval must be less than idleTimeout")
+	}
+	return nil
+}
+
+func (s *Streaming) options() *context.StreamingOptions {
+	opts := &context.StreamingOptions{}
+	if s.IdleTimeout != "" {
+		d, err := time.ParseDuration(s.IdleTimeout)
+		if err != nil {
+			logger.Errorf("BUG: parse duration %s failed: %v", s.IdleTimeout, err)
+		} else {
+			opts.IdleTimeout = d
+		}
+	}
+	if s.HeartbeatInterval != "" {
+		d, err := time.ParseDuration(s.HeartbeatInterval)
+		if err != nil {
+			logger.Errorf("BUG: parse duration %s failed: %v", s.HeartbeatInterval, err)
+		} else {
+			opts.HeartbeatInterval = d
+		}
+	}
+	return opts
+}
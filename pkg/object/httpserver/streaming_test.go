@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/tracing"
+)
+
+// flushRecorder records the data flushed to the client.
+type flushRecorder struct {
+	header http.Header
+	mutex  sync.Mutex
+	buff   bytes.Buffer
+	flushC chan string
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{header: http.Header{}, flushC: make(chan string, 100)}
+}
+
+func (fr *flushRecorder) Header() http.Header { return fr.header }
+
+func (fr *flushRecorder) WriteHeader(code int) {}
+
+func (fr *flushRecorder) Write(p []byte) (int, error) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	return fr.buff.Write(p)
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	if fr.buff.Len() > 0 {
+		fr.flushC <- fr.buff.String()
+		fr.buff.Reset()
+	}
+}
+
+func (fr *flushRecorder) next(t *testing.T) string {
+	select {
+	case s := <-fr.flushC:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing flushed")
+	}
+	return ""
+}
+
+func newStreamingContext(w http.ResponseWriter, body io.Reader, contentType string, s *Streaming) context.HTTPContext {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/events", nil)
+	ctx := context.New(w, req, tracing.NoopTracing, "")
+	if contentType != "" {
+		ctx.Response().Header().Set("Content-Type", contentType)
+	}
+	if s != nil {
+		ctx.Response().SetStreaming(s.options())
+	}
+	ctx.Response().SetBody(body)
+	return ctx
+}
+
+func TestStreamingValidate(t *testing.T) {
+	if (Streaming{IdleTimeout: "10s", HeartbeatInterval: "10s"}).Validate() == nil {
+		t.Errorf("heartbeatInterval not less than idleTimeout should be invalid")
+	}
+	if err := (Streaming{IdleTimeout: "1m", HeartbeatInterval: "10s"}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	opts := (&Streaming{IdleTimeout: "1m"}).options()
+	if opts.IdleTimeout != time.Minute || opts.HeartbeatInterval != 0 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+}
+
+func TestStreamingFlushPerChunk(t *testing.T) {
+	pr, pw := io.Pipe()
+	fr := newFlushRecorder()
+	ctx := newStreamingContext(fr, pr, "application/x-ndjson", &Streaming{})
+	if !ctx.Response().Streaming() {
+		t.Fatalf("response should be streaming")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ctx.Finish()
+		close(done)
+	}()
+
+	for _, chunk := range []string{"{\"n\":1}\n", "{\"n\":2}\n"} {
+		pw.Write([]byte(chunk))
+		if got := fr.next(t); got != chunk {
+			t.Errorf("want chunk %q, got %q", chunk, got)
+		}
+	}
+
+	pw.Close()
+	<-done
+	if ctx.Response().Size() == 0 {
+		t.Errorf("size should not be zero")
+	}
+}
+
+func TestStreamingEventStream(t *testing.T) {
+	// Server-Sent Events are streamed without configuration.
+	fr := newFlushRecorder()
+	ctx := newStreamingContext(fr, strings.NewReader("data: a\n\n"), "text/event-stream; charset=utf-8", nil)
+	if !ctx.Response().Streaming() {
+		t.Fatalf("event stream should be streaming")
+	}
+	ctx.Finish()
+	if got := fr.next(t); got != "data: a\n\n" {
+		t.Errorf("unexpected data %q", got)
+	}
+
+	ctx = newStreamingContext(newFlushRecorder(), strings.NewReader("{}"), "application/json", nil)
+	if ctx.Response().Streaming() {
+		t.Errorf("json response should not be streaming")
+	}
+}
+
+func TestStreamingHeartbeat(t *testing.T) {
+	pr, pw := io.Pipe()
+	fr := newFlushRecorder()
+	ctx := newStreamingContext(fr, pr, "text/event-stream", &Streaming{HeartbeatInterval: "20ms"})
+
+	done := make(chan struct{})
+	go func() {
+		ctx.Finish()
+		close(done)
+	}()
+
+	if got := fr.next(t); got != ": heartbeat\n\n" {
+		t.Errorf("want heartbeat, got %q", got)
+	}
+
+	// No heartbeat is injected into an incomplete event.
+	pw.Write([]byte("data: a\n"))
+	if got := fr.next(t); got != "data: a\n" {
+		t.Errorf("unexpected data %q", got)
+	}
+	select {
+	case got := <-fr.flushC:
+		t.Errorf("unexpected data %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pw.Write([]byte("\n"))
+	if got := fr.next(t); got != "\n" {
+		t.Errorf("unexpected data %q", got)
+	}
+	if got := fr.next(t); got != ": heartbeat\n\n" {
+		t.Errorf("want heartbeat, got %q", got)
+	}
+
+	pw.Close()
+	<-done
+}
+
+func TestStreamingIdleTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	fr := newFlushRecorder()
+	ctx := newStreamingContext(fr, pr, "text/event-stream", &Streaming{IdleTimeout: "50ms", HeartbeatInterval: "10ms"})
+
+	done := make(chan struct{})
+	go func() {
+		ctx.Finish()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream should be closed after idle timeout")
+	}
+	if _, err := pw.Write([]byte("data: a\n\n")); err == nil {
+		t.Errorf("body should be closed")
+	}
+}
+
+func TestStreamingWriteTimeout(t *testing.T) {
+	const chunks = 6
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pr, pw := io.Pipe()
+		go func() {
+			for i := 0; i < chunks; i++ {
+				time.Sleep(100 * time.Millisecond)
+				pw.Write([]byte("data: a\n\n"))
+			}
+			pw.Close()
+		}()
+
+		ctx := context.New(w, r, tracing.NoopTracing, "")
+		ctx.Response().Header().Set("Content-Type", "text/event-stream")
+		if r.URL.Path == "/configured" {
+			opts := (&Streaming{}).options()
+			opts.WriteTimeout = 200 * time.Millisecond
+			ctx.Response().SetStreaming(opts)
+		}
+		ctx.Response().SetBody(pr)
+		ctx.Finish()
+	}))
+	// The stream lasts longer than the write timeout of the server.
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	for _, path := range []string{"/configured", "/unconfigured"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: stream is cut off: %v", path, err)
+		}
+		if want := strings.Repeat("data: a\n\n", chunks); string(body) != want {
+			t.Errorf("%s: want %q, got %q", path, want, body)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/util/httpheader"
+)
+
+// upgradeResponseWriter wraps the response writer of upgrade requests, the
+// connection could be hijacked by filters, such as WebSocketProxy, and the
+// response is not written after that.
+type upgradeResponseWriter struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+// isUpgradeRequest returns whether the request asks to upgrade the protocol
+// of the connection, only HTTP/1.1 supports it.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.ProtoMajor != 1 || r.Header.Get(httpheader.KeyUpgrade) == "" {
+		return false
+	}
+
+	for _, v := range r.Header.Values(httpheader.KeyConnection) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (w *upgradeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *upgradeResponseWriter) WriteHeader(code int) {
+	if !w.hijacked {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *upgradeResponseWriter) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *upgradeResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && !w.hijacked {
+		flusher.Flush()
+	}
+}
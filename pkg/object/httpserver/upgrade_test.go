@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	cases := []struct {
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, upgrade", "websocket", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "", false},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Connection", c.connection)
+		req.Header.Set("Upgrade", c.upgrade)
+		if got := isUpgradeRequest(req); got != c.want {
+			t.Errorf("%q %q: want %v, got %v", c.connection, c.upgrade, c.want, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.ProtoMajor = 2
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if isUpgradeRequest(req) {
+		t.Errorf("HTTP/2 requests can't be upgraded")
+	}
+}
+
+func TestUpgradeResponseWriter(t *testing.T) {
+	w := &upgradeResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	if _, _, err := w.Hijack(); err == nil {
+		t.Errorf("recorder doesn't support hijacking")
+	}
+
+	w.hijacked = true
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	if _, err := w.Write([]byte("hello")); err != http.ErrHijacked {
+		t.Errorf("want %v, got %v", http.ErrHijacked, err)
+	}
+	if rec := w.ResponseWriter.(*httptest.ResponseRecorder); rec.Body.Len() != 0 || rec.Code != http.StatusOK {
+		t.Errorf("nothing should be written after hijacking")
+	}
+}
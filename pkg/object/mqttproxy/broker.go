@@ -32,7 +32,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/google/uuid"
 	"github.com/megaease/easegress/pkg/api"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
@@ -54,10 +56,19 @@ type (
 		tlsCfg    *tls.Config
 		pipelines map[PacketType]string
 
+		// wsListener and wsServer serve MQTT over WebSocket
+		wsListener net.Listener
+		wsServer   *http.Server
+
 		sessMgr           *SessionManager
 		topicMgr          *TopicManager
+		retainMgr         *RetainManager
+		sharedMgr         *SharedManager
+		routeMgr          *RouteManager
+		downlinkMgr       *DownlinkManager
 		connectionLimiter *Limiter
-		memberURL         func(string, string) ([]string, error)
+		memberURL         func(string, string) (map[string]string, error)
+		stats             RouteStats
 
 		// done is the channel for shutdowning this proxy.
 		done      chan struct{}
@@ -71,6 +82,19 @@ type (
 		Payload     string `json:"payload"`
 		Base64      bool   `json:"base64"`
 		Distributed bool   `json:"distributed"`
+		Retain      bool   `json:"retain"`
+		// Properties is MQTT 5.0 properties of message sent to MQTT 5.0 clients
+		Properties *MessageProperties `json:"properties,omitempty"`
+		// SharedClients is the chosen client of every shared subscription matches the topic,
+		// it's set by the member that receives the message first.
+		SharedClients map[string]string `json:"sharedClients,omitempty"`
+	}
+
+	// HTTPRetainedMessages is json data used for retained message related operations,
+	// like get all retained messages and delete some retained messages
+	HTTPRetainedMessages struct {
+		Messages []*RetainedMessage `json:"messages,omitempty"`
+		Topics   []string           `json:"topics,omitempty"`
 	}
 
 	// HTTPSessions is json data used for session related operations, like get all sessions and delete some sessions
@@ -108,7 +132,7 @@ func getPipelineMap(spec *Spec) (map[PacketType]string, error) {
 	return ans, nil
 }
 
-func newBroker(spec *Spec, store storage, memberURL func(string, string) ([]string, error)) *Broker {
+func newBroker(spec *Spec, store storage, memberURL func(string, string) (map[string]string, error)) *Broker {
 	broker := &Broker{
 		egName:    spec.EGName,
 		name:      spec.Name,
@@ -128,14 +152,31 @@ func newBroker(spec *Spec, store storage, memberURL func(string, string) ([]stri
 		logger.SpanErrorf(nil, "mqtt broker set listener failed: %v", err)
 		return nil
 	}
+	if spec.WebSocket != nil {
+		err = broker.setWebSocketListener()
+		if err != nil {
+			broker.listener.Close()
+			logger.SpanErrorf(nil, "mqtt broker set websocket listener failed: %v", err)
+			return nil
+		}
+	}
 
 	if spec.TopicCacheSize <= 0 {
 		spec.TopicCacheSize = 100000
 	}
 	broker.topicMgr = newTopicManager(spec.TopicCacheSize)
 	broker.sessMgr = newSessionManager(broker, store)
+	broker.retainMgr = newRetainManager(spec.Name, store, spec.Retain)
+	broker.sharedMgr = newSharedManager(spec.EGName, spec.Name, store, spec.SharedSubscription)
+	broker.routeMgr = newRouteManager(spec.EGName, spec.Name, store, spec.TopicCacheSize)
 	broker.connectionLimiter = newLimiter(spec.ConnectionLimit)
+	if spec.Downlink != nil {
+		broker.downlinkMgr = newDownlinkManager(broker, spec.Downlink)
+	}
 	go broker.run()
+	if broker.wsServer != nil {
+		go broker.runWebSocket()
+	}
 	ch, closeFunc, err := broker.sessMgr.store.watchDelete(sessionStoreKey(""))
 	if err != nil {
 		logger.SpanErrorf(nil, "get watcher for session failed, %v", err)
@@ -274,12 +315,11 @@ func (b *Broker) checkConnectPermission(connect *packets.ConnectPacket) bool {
 	return true
 }
 
-func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.Conn) (*Client, *packets.ConnackPacket, bool) {
+func (b *Broker) connectionValidation(connect *packets.ConnectPacket, props, willProps *packets5.Properties, conn net.Conn) (*Client, *packets.ConnackPacket, bool) {
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	connack.SessionPresent = connect.CleanSession
-	connack.ReturnCode = connect.Validate()
+	connack.ReturnCode = validateConnect(connect)
 	if connack.ReturnCode != packets.Accepted {
-		err := connack.Write(conn)
+		err := writeConnack(conn, connect, connack, 0, nil)
 		logger.SpanErrorf(nil, "invalid connection %v, write connack failed: %s", connack.ReturnCode, err)
 		return nil, nil, false
 	}
@@ -287,35 +327,29 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 	if !b.checkConnectPermission(connect) {
 		logger.SpanDebugf(nil, "client %v not get connect permission from rate limiter", connect.ClientIdentifier)
 		connack.ReturnCode = packets.ErrRefusedServerUnavailable
-		err := connack.Write(conn)
+		err := writeConnack(conn, connect, connack, 0, nil)
 		if err != nil {
 			logger.SpanErrorf(nil, "connack back to client %s failed: %s", connect.ClientIdentifier, err)
 		}
 		return nil, nil, false
 	}
 
+	// MQTT 5.0 client without client id is assigned one by broker
+	var assignedClientID string
+	if connect.ProtocolVersion == mqtt5 && connect.ClientIdentifier == "" {
+		assignedClientID = uuid.New().String()
+		connect.ClientIdentifier = assignedClientID
+	}
 	client := newClient(connect, b, conn, b.spec.ClientPublishLimit)
-	// check auth
-	authFail := false
-
-	authPipeline, ok := b.pipelines[Connect]
-	if ok {
-		pipe, err := pipeline.GetPipeline(authPipeline, context.MQTT)
-		if err != nil {
-			logger.SpanErrorf(nil, "get pipeline %v failed, %v", authPipeline, err)
-			authFail = true
-		} else {
-			ctx := context.NewMQTTContext(stdcontext.Background(), client, connect)
-			pipe.HandleMQTT(ctx)
-			if ctx.Disconnect() {
-				logger.SpanErrorf(nil, "client %v not get connect permission from pipeline", connect.ClientIdentifier)
-				authFail = true
-			}
-		}
+	if connect.ProtocolVersion == mqtt5 {
+		client.init5(props, willProps)
+		client.assignedClientID = assignedClientID
 	}
+	// check auth
+	reasonCode, authFail := b.authenticate(client, props)
 	if authFail {
 		connack.ReturnCode = packets.ErrRefusedNotAuthorised
-		err := connack.Write(conn)
+		err := writeConnack(conn, connect, connack, reasonCode, nil)
 		if err != nil {
 			logger.SpanErrorf(nil, "connack back to client %s failed: %s", connect.ClientIdentifier, err)
 		}
@@ -325,21 +359,41 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 	return client, connack, true
 }
 
+// authenticate checks client by using connect pipeline, it returns reason code of
+// MQTT 5.0 and whether the authentication fails. Connect pipeline is run more than
+// once for enhanced authentication of MQTT 5.0 client with authentication method.
+func (b *Broker) authenticate(client *Client, props *packets5.Properties) (byte, bool) {
+	if client.authMethod != "" {
+		return client.enhancedAuth(props)
+	}
+	authPipeline, ok := b.pipelines[Connect]
+	if !ok {
+		return 0, false
+	}
+	pipe, err := pipeline.GetPipeline(authPipeline, context.MQTT)
+	if err != nil {
+		logger.SpanErrorf(nil, "get pipeline %v failed, %v", authPipeline, err)
+		return 0, true
+	}
+	ctx := context.NewMQTT5Context(stdcontext.Background(), client, client.connect, props)
+	pipe.HandleMQTT(ctx)
+	if ctx.Disconnect() {
+		logger.SpanErrorf(nil, "client %v not get connect permission from pipeline", client.info.cid)
+		return ctx.ReasonCode(), true
+	}
+	return 0, false
+}
+
 func (b *Broker) handleConn(conn net.Conn) {
 	defer conn.Close()
-	packet, err := packets.ReadPacket(conn)
+	connect, props, willProps, err := readConnect(conn)
 	if err != nil {
 		logger.SpanErrorf(nil, "read connect packet failed: %s", err)
 		return
 	}
-	connect, ok := packet.(*packets.ConnectPacket)
-	if !ok {
-		logger.SpanErrorf(nil, "first packet received %s that was not Connect", packet.String())
-		return
-	}
 	logger.SpanDebugf(nil, "connection from client %s", connect.ClientIdentifier)
 
-	client, connack, valid := b.connectionValidation(connect, conn)
+	client, connack, valid := b.connectionValidation(connect, props, willProps, conn)
 	if !valid {
 		return
 	}
@@ -348,13 +402,13 @@ func (b *Broker) handleConn(conn net.Conn) {
 	b.Lock()
 	if oldClient, ok := b.clients[cid]; ok {
 		logger.SpanDebugf(nil, "client %v take over by new client with same name", oldClient.info.cid)
-		go oldClient.close()
+		go oldClient.disconnect(packets5.DisconnectSessionTakenOver)
 
 	} else if b.spec.MaxAllowedConnection > 0 {
 		if len(b.clients) >= b.spec.MaxAllowedConnection {
 			logger.SpanDebugf(nil, "client %v not get connect permission from rate limiter", connect.ClientIdentifier)
 			connack.ReturnCode = packets.ErrRefusedServerUnavailable
-			err = connack.Write(conn)
+			err = writeConnack(conn, connect, connack, 0, nil)
 			if err != nil {
 				logger.SpanErrorf(nil, "connack back to client %s failed: %s", connect.ClientIdentifier, err)
 			}
@@ -363,10 +417,10 @@ func (b *Broker) handleConn(conn net.Conn) {
 		}
 	}
 	b.clients[client.info.cid] = client
-	b.setSession(client, connect)
+	connack.SessionPresent = b.setSession(client, connect)
 	b.Unlock()
 
-	err = connack.Write(conn)
+	err = writeConnack(conn, connect, connack, 0, client.connackProperties())
 	if err != nil {
 		logger.SpanErrorf(nil, "send connack to client %s failed: %s", connect.ClientIdentifier, err)
 		return
@@ -379,16 +433,26 @@ func (b *Broker) handleConn(conn net.Conn) {
 		if err != nil {
 			logger.SpanErrorf(nil, "client %v use previous session topics %v to subscribe failed: %v", client.info.cid, topics, err)
 		}
+		err = b.sharedMgr.subscribe(topics, client.info.cid)
+		if err != nil {
+			logger.SpanErrorf(nil, "client %v use previous session topics %v to store shared subscriptions failed: %v", client.info.cid, topics, err)
+		}
+		err = b.routeMgr.subscribe(topics, client.info.cid)
+		if err != nil {
+			logger.SpanErrorf(nil, "client %v use previous session topics %v to store routes failed: %v", client.info.cid, topics, err)
+		}
 	}
 	go client.writeLoop()
 	client.readLoop()
 }
 
-func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket) {
-	// when clean session is false, previous session exist and previous session not clean session,
-	// then we use previous session, otherwise use new session
+// setSession sets session of client, and returns whether previous session is used.
+func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket) bool {
+	// when clean session is false, previous session exist and previous session not clean session
+	// and not expired, then we use previous session, otherwise use new session
 	prevSess := b.sessMgr.get(connect.ClientIdentifier)
-	if !connect.CleanSession && (prevSess != nil) && !prevSess.cleanSession() {
+	sessionPresent := !connect.CleanSession && (prevSess != nil) && !prevSess.cleanSession() && !prevSess.expired()
+	if sessionPresent {
 		client.session = prevSess
 	} else {
 		if prevSess != nil {
@@ -396,6 +460,14 @@ func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket) {
 		}
 		client.session = b.sessMgr.newSessionFromConn(connect)
 	}
+
+	// session of MQTT 5.0 client is cleaned when client disconnects if session expiry interval is 0
+	cleanFlag := connect.CleanSession
+	if client.version == mqtt5 {
+		cleanFlag = client.sessionExpiryInterval == 0
+	}
+	client.session.setCleanFlag(cleanFlag)
+	return sessionPresent
 }
 
 func (b *Broker) requestTransfer(span *model.SpanContext, egName, name string, data HTTPJsonData, header http.Header) {
@@ -410,23 +482,96 @@ func (b *Broker) requestTransfer(span *model.SpanContext, egName, name string, d
 		return
 	}
 	for _, url := range urls {
-		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
-		req.Header = header.Clone()
-		if err != nil {
-			logger.SpanErrorf(span, "make new request failed: %v", err)
+		b.transfer(span, url, jsonData, header)
+	}
+	logger.SpanDebugf(span, "eg %v http transfer data %v to %v", b.egName, data, urls)
+}
+
+// forward forwards data to the members, instead of all members of the cluster.
+func (b *Broker) forward(span *model.SpanContext, members map[string]struct{}, data HTTPJsonData) {
+	urls, err := b.memberURL(b.egName, b.name)
+	if err != nil {
+		logger.SpanErrorf(span, "eg %v find urls for other egs failed:%v", b.egName, err)
+		return
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		logger.SpanErrorf(span, "json data marshal failed: %v", err)
+		return
+	}
+	for member := range members {
+		url, ok := urls[member]
+		if !ok {
+			logger.SpanErrorf(span, "eg %v find url for eg %v failed", b.egName, member)
+			atomic.AddUint64(&b.stats.ForwardFailed, 1)
 			continue
 		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			logger.SpanErrorf(span, "http client send msg failed:%v", err)
-		} else {
-			resp.Body.Close()
+		b.transfer(span, url, jsonData, http.Header{})
+	}
+	logger.SpanDebugf(span, "eg %v forward data %v to %v", b.egName, data, members)
+}
+
+func (b *Broker) transfer(span *model.SpanContext, url string, jsonData []byte, header http.Header) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		logger.SpanErrorf(span, "make new request failed: %v", err)
+		atomic.AddUint64(&b.stats.ForwardFailed, 1)
+		return
+	}
+	req.Header = header.Clone()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.SpanErrorf(span, "http client send msg failed:%v", err)
+		atomic.AddUint64(&b.stats.ForwardFailed, 1)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.SpanErrorf(span, "http client send msg to %v failed, status code %v", url, resp.StatusCode)
+		atomic.AddUint64(&b.stats.ForwardFailed, 1)
+		return
+	}
+	atomic.AddUint64(&b.stats.ForwardedMessages, 1)
+	atomic.AddUint64(&b.stats.ForwardedBytes, uint64(len(jsonData)))
+}
+
+// routeMsg sends message published by client to clients subscribing its topic, the
+// message is forwarded to other members that have clients subscribing it. clientID
+// is the publishing client, which is empty if the message is not from a client.
+func (b *Broker) routeMsg(span *model.SpanContext, clientID, topic string, payload []byte, qos byte, props *MessageProperties) {
+	sharedClients, members, err := b.sharedMgr.choose(topic, clientID)
+	if err != nil {
+		logger.SpanErrorf(span, "choose clients of shared subscriptions for topic %v failed: %v", topic, err)
+	}
+	if members == nil {
+		members = make(map[string]struct{})
+	}
+	routes, err := b.routeMgr.members(topic)
+	if err != nil {
+		logger.SpanErrorf(span, "find routes for topic %v failed: %v", topic, err)
+	}
+	for member := range routes {
+		members[member] = struct{}{}
+	}
+	delete(members, b.egName)
+
+	if len(members) > 0 {
+		data := HTTPJsonData{
+			Topic:         topic,
+			QoS:           int(qos),
+			Payload:       base64.StdEncoding.EncodeToString(payload),
+			Base64:        true,
+			Distributed:   true,
+			Properties:    props,
+			SharedClients: sharedClients,
 		}
+		go b.forward(span, members, data)
 	}
-	logger.SpanDebugf(span, "eg %v http transfer data %v to %v", b.egName, data, urls)
+	b.sendMsgToClient(span, topic, payload, qos, props)
+	b.sendMsgToSharedClients(span, topic, payload, qos, props, sharedClients)
 }
 
-func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload []byte, qos byte) {
+func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload []byte, qos byte, props *MessageProperties) {
 	subscribers, _ := b.topicMgr.findSubscribers(topic)
 	logger.SpanDebugf(span, "eg %v send topic %v to client %v", b.egName, topic, subscribers)
 	if subscribers == nil {
@@ -435,14 +580,47 @@ func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload
 	}
 
 	for clientID, subQoS := range subscribers {
+		// message is delivered with the smaller one of publish qos and subscribe qos
+		msgQoS := qos
 		if subQoS < qos {
-			return
+			msgQoS = subQoS
 		}
 		client := b.getClient(clientID)
 		if client == nil {
 			logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
 		} else {
-			client.session.publish(span, topic, payload, qos)
+			client.session.publish(span, topic, payload, msgQoS, props)
+		}
+	}
+}
+
+// sendMsgToSharedClients sends message to clients of shared subscriptions, sharedClients
+// is the chosen client of every shared subscription, and only clients of this member are sent.
+func (b *Broker) sendMsgToSharedClients(span *model.SpanContext, topic string, payload []byte, qos byte, props *MessageProperties, sharedClients map[string]string) {
+	if len(sharedClients) == 0 {
+		return
+	}
+	shared, err := b.topicMgr.findSharedSubscribers(topic)
+	if err != nil {
+		logger.SpanErrorf(span, "eg %v find shared subscribers for topic %s failed: %v", b.egName, topic, err)
+		return
+	}
+
+	for sharedTopic, clientID := range sharedClients {
+		subQoS, ok := shared[sharedTopic][clientID]
+		if !ok {
+			continue
+		}
+		msgQoS := qos
+		if subQoS < qos {
+			msgQoS = subQoS
+		}
+		client := b.getClient(clientID)
+		if client == nil {
+			logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
+		} else {
+			logger.SpanDebugf(span, "eg %v send topic %v to client %v of shared subscription %v", b.egName, topic, clientID, sharedTopic)
+			client.session.publish(span, topic, payload, msgQoS, props)
 		}
 	}
 }
@@ -494,12 +672,33 @@ func (b *Broker) httpTopicsPublishHandler(w http.ResponseWriter, r *http.Request
 
 	span, _ := b3.ExtractHTTP(r)()
 	logger.SpanDebugf(span, "http endpoint received json data: %v", data)
+	if data.Distributed {
+		atomic.AddUint64(&b.stats.ReceivedMessages, 1)
+		atomic.AddUint64(&b.stats.ReceivedBytes, uint64(r.ContentLength))
+	}
+	// retained messages are stored in cluster storage, so only store it once
+	if data.Retain && !data.Distributed {
+		err = b.retainMgr.retain(data.Topic, payload, byte(data.QoS), data.Properties)
+		if err != nil {
+			api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("retain message failed, %v", err))
+			return
+		}
+	}
 	if !data.Distributed {
+		// clients of shared subscriptions are chosen once, then every member
+		// sends message to the chosen clients connected to it.
+		data.SharedClients, _, err = b.sharedMgr.choose(data.Topic, "")
+		if err != nil {
+			logger.SpanErrorf(span, "choose clients of shared subscriptions for topic %v failed: %v", data.Topic, err)
+		}
 		data.Distributed = true
 		headers := r.Header.Clone()
 		b.requestTransfer(span, b.egName, b.name, data, headers)
 	}
-	go b.sendMsgToClient(span, data.Topic, payload, byte(data.QoS))
+	go func() {
+		b.sendMsgToClient(span, data.Topic, payload, byte(data.QoS), data.Properties)
+		b.sendMsgToSharedClients(span, data.Topic, payload, byte(data.QoS), data.Properties, data.SharedClients)
+	}()
 }
 
 func (b *Broker) mqttAPIPrefix(path string) string {
@@ -623,6 +822,45 @@ func (b *Broker) httpDeleteSessionHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+func (b *Broker) httpGetAllRetainedHandler(w http.ResponseWriter, r *http.Request) {
+	span, _ := b3.ExtractHTTP(r)()
+	logger.SpanDebugf(span, "http endpoint receive request to get all retained messages")
+
+	msgs, err := b.retainMgr.all()
+	if err != nil {
+		logger.SpanErrorf(span, "get all retained messages failed, %v", err)
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("get all retained messages failed, %v", err))
+		return
+	}
+
+	jsonData, err := json.Marshal(&HTTPRetainedMessages{Messages: msgs})
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("all retained messages json marshal failed, %v", err))
+		return
+	}
+	_, err = w.Write(jsonData)
+	if err != nil {
+		logger.SpanErrorf(span, "write json data to http response writer failed, %v", err)
+	}
+}
+
+func (b *Broker) httpDeleteRetainedHandler(w http.ResponseWriter, r *http.Request) {
+	var data HTTPRetainedMessages
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil || len(data.Topics) == 0 {
+		api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid json data from request body"))
+		return
+	}
+
+	span, _ := b3.ExtractHTTP(r)()
+	logger.SpanDebugf(span, "http endpoint received delete retained messages data: %v", data)
+	err = b.retainMgr.clear(data.Topics)
+	if err != nil {
+		logger.SpanErrorf(span, "delete retained messages of %v failed, %v", data.Topics, err)
+		api.HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("delete retained messages failed, %v", err))
+	}
+}
+
 func (b *Broker) currentClients() map[string]struct{} {
 	ans := make(map[string]struct{})
 	b.Lock()
@@ -640,12 +878,24 @@ func (b *Broker) registerAPIs() {
 			{Path: b.mqttAPIPrefix(mqttAPITopicPublishPrefix), Method: http.MethodPost, Handler: b.httpTopicsPublishHandler},
 			{Path: b.mqttAPIPrefix(mqttAPISessionQueryPrefix), Method: http.MethodGet, Handler: b.httpGetAllSessionHandler},
 			{Path: b.mqttAPIPrefix(mqttAPISessionDeletePrefix), Method: http.MethodDelete, Handler: b.httpDeleteSessionHandler},
+			{Path: b.mqttAPIPrefix(mqttAPIRetainedPrefix), Method: http.MethodGet, Handler: b.httpGetAllRetainedHandler},
+			{Path: b.mqttAPIPrefix(mqttAPIRetainedPrefix), Method: http.MethodDelete, Handler: b.httpDeleteRetainedHandler},
 		},
 	}
 
 	api.RegisterAPIs(group)
 }
 
+func (b *Broker) status() *Status {
+	stats := b.stats.Load()
+	stats.Routes = b.routeMgr.count()
+	status := &Status{RouteStats: stats}
+	if b.downlinkMgr != nil {
+		status.Downlink = b.downlinkMgr.status()
+	}
+	return status
+}
+
 func (b *Broker) setClose() {
 	atomic.StoreInt32(&b.closeFlag, 1)
 }
@@ -659,12 +909,25 @@ func (b *Broker) close() {
 	b.setClose()
 	close(b.done)
 	b.listener.Close()
+	if b.wsServer != nil {
+		// hijacked websocket connections are closed with clients below
+		b.wsServer.Close()
+	}
+	if b.downlinkMgr != nil {
+		b.downlinkMgr.close()
+	}
 	b.sessMgr.close()
+	b.retainMgr.close()
+	b.sharedMgr.close()
+	b.routeMgr.close()
 
 	b.Lock()
 	defer b.Unlock()
 	for _, v := range b.clients {
-		go v.closeAndDelSession()
+		go func(c *Client) {
+			c.sendDisconnect(packets5.DisconnectServerShuttingDown)
+			c.closeAndDelSession()
+		}(v)
 	}
 	b.clients = nil
 }
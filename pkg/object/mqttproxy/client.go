@@ -26,6 +26,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	packets5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
@@ -44,17 +45,20 @@ const (
 	QoS1 byte = 1
 	// QoS2 for "Exactly once"
 	QoS2 byte = 2
+
+	// subackFailure is the return code of MQTT 3.1.1 SUBACK for failed subscription
+	subackFailure byte = 0x80
 )
 
-type processFn func(*Client, packets.ControlPacket)
-type processFnWithErr func(*Client, packets.ControlPacket) error
+type processFn func(*Client, packets.ControlPacket, *packets5.Properties)
+type processFnWithErr func(*Client, packets.ControlPacket, *packets5.Properties) error
 
 var processPacketMap = map[string]processFnWithErr{
 	"*packets.ConnectPacket":     errorWrapper("double connect"),
 	"*packets.ConnackPacket":     errorWrapper("client should not send connack"),
-	"*packets.PubrecPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubrelPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubcompPacket":     errorWrapper("qos2 not support now"),
+	"*packets.PubrecPacket":      nilErrWrapper(processPubrec),
+	"*packets.PubrelPacket":      nilErrWrapper(processPubrel),
+	"*packets.PubcompPacket":     nilErrWrapper(processPubcomp),
 	"*packets.SubackPacket":      errorWrapper("broker not subscribe"),
 	"*packets.UnsubackPacket":    errorWrapper("broker not unsubscribe"),
 	"*packets.PingrespPacket":    errorWrapper("broker not ping"),
@@ -62,14 +66,26 @@ var processPacketMap = map[string]processFnWithErr{
 	"*packets.UnsubscribePacket": pipelineWrapper(processUnsubscribe, Unsubscribe),
 	"*packets.PingreqPacket":     nilErrWrapper(processPingreq),
 	"*packets.PubackPacket":      nilErrWrapper(processPuback),
-	"*packets.PublishPacket": func(c *Client, packet packets.ControlPacket) error {
+	"*mqttproxy.packet5":         processAuth,
+	"*packets.PublishPacket": func(c *Client, packet packets.ControlPacket, props *packets5.Properties) error {
 		publish := packet.(*packets.PublishPacket)
 		logger.SpanDebugf(nil, "client %s process publish %v", c.info.cid, publish.TopicName)
 		if !c.checkPublishLimit(publish) {
 			logger.SpanErrorf(nil, "client %v publish limiter drop packet %v", c.info.cid, publish.TopicName)
+			c.nack(publish, packets5.PubackQuotaExceeded)
+			return nil
+		}
+		// QoS2 message received but not released is a duplicate one,
+		// it should be acknowledged but not be delivered again
+		if publish.Qos == QoS2 && c.session.received(publish.MessageID) {
+			logger.SpanDebugf(nil, "client %s publish duplicate qos2 packet %v", c.info.cid, publish.MessageID)
+			processPublish(c, packet, props)
 			return nil
 		}
-		return pipelineWrapper(processPublish, Publish)(c, packet)
+		if publish.Qos == QoS2 && c.exceedReceiveMaximum() {
+			return newReasonError(packets5.DisconnectReceiveMaximumExceeded, "client %v exceeds receive maximum", c.info.cid)
+		}
+		return pipelineWrapper(processPublish, Publish)(c, packet, props)
 	},
 }
 
@@ -91,12 +107,25 @@ type (
 		session      *Session
 		publishLimit *Limiter
 		conn         net.Conn
+		writeMu      sync.Mutex
 
 		info       ClientInfo
 		statusFlag int32
 		writeCh    chan packets.ControlPacket
 		done       chan struct{}
 
+		// connect and fields below are used by MQTT 5.0 client
+		connect               *packets.ConnectPacket
+		version               byte
+		willProperties        *packets5.Properties
+		sessionExpiryInterval uint32
+		receiveMaximum        uint16
+		topicAliases          map[uint16]string
+		assignedClientID      string
+		authMethod            string
+		authData              []byte
+		reauth                bool
+
 		// kv map is used for pipeline to share messages among filters during whole connection
 		kvMap sync.Map
 	}
@@ -150,6 +179,7 @@ func newClient(connect *packets.ConnectPacket, broker *Broker, conn net.Conn, li
 	client := &Client{
 		broker:       broker,
 		conn:         conn,
+		connect:      connect,
 		info:         info,
 		statusFlag:   Connected,
 		writeCh:      make(chan packets.ControlPacket, 50),
@@ -162,7 +192,10 @@ func newClient(connect *packets.ConnectPacket, broker *Broker, conn net.Conn, li
 func (c *Client) readLoop() {
 	defer func() {
 		if c.info.will != nil {
-			c.runPipeline(c.info.will, Publish)
+			if err := c.runPipeline(c.info.will, Publish, c.willProperties); err == nil {
+				c.retain(c.info.will, c.willProperties)
+				c.route(c.info.will, c.willProperties)
+			}
 		}
 		c.closeAndDelSession()
 		c.broker.removeClient(c.info.cid)
@@ -183,30 +216,63 @@ func (c *Client) readLoop() {
 		}
 
 		logger.SpanDebugf(nil, "client %s readLoop read packet", c.info.cid)
-		packet, err := packets.ReadPacket(c.conn)
+		packet, props, err := c.readPacket()
 		if err != nil {
 			logger.SpanErrorf(nil, "client %s read packet failed: %v", c.info.cid, err)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				c.sendDisconnect(packets5.DisconnectKeepAliveTimeout)
+			} else {
+				c.sendDisconnect(reasonCode(err, packets5.DisconnectUnspecifiedError))
+			}
 			return
 		}
 		if _, ok := packet.(*packets.DisconnectPacket); ok {
 			c.info.will = nil
 			return
 		}
-		err = c.processPacket(packet)
+		if p, ok := packet.(*packet5); ok {
+			if disconnect, ok := p.Packet.(*packets5.Disconnect); ok {
+				c.processDisconnect(disconnect)
+				return
+			}
+		}
+		err = c.processPacket(packet, props)
 		if err != nil {
 			logger.SpanErrorf(nil, "client %s process packet failed: %v", c.info.cid, err)
+			c.sendDisconnect(reasonCode(err, packets5.DisconnectUnspecifiedError))
 			return
 		}
 	}
 }
 
-func (c *Client) processPacket(packet packets.ControlPacket) error {
+func (c *Client) processPacket(packet packets.ControlPacket, props *packets5.Properties) error {
 	packetType := reflect.TypeOf(packet).String()
 	fn, ok := processPacketMap[packetType]
 	if !ok {
 		return errors.New("unknown packet")
 	}
-	return fn(c, packet)
+	return fn(c, packet, props)
+}
+
+// processDisconnect processes DISCONNECT of MQTT 5.0 client, will message is sent
+// if reason code asks to, and session expiry interval may be updated.
+func (c *Client) processDisconnect(disconnect *packets5.Disconnect) {
+	if disconnect.ReasonCode != packets5.DisconnectDisconnectWithWillMessage {
+		c.info.will = nil
+	}
+	if interval := disconnect.Properties.SessionExpiryInterval; interval != nil && c.sessionExpiryInterval != 0 {
+		c.sessionExpiryInterval = *interval
+		if *interval == 0 {
+			c.session.setCleanFlag(true)
+		}
+	}
+}
+
+// exceedReceiveMaximum checks whether QoS2 messages received from MQTT 5.0 client
+// but not released exceed receive maximum of broker.
+func (c *Client) exceedReceiveMaximum() bool {
+	max := c.broker.spec.ReceiveMaximum
+	return c.version == mqtt5 && max > 0 && c.session.receivedCount() >= int(max)
 }
 
 func (c *Client) checkPublishLimit(publish *packets.PublishPacket) bool {
@@ -214,9 +280,9 @@ func (c *Client) checkPublishLimit(publish *packets.PublishPacket) bool {
 	return c.publishLimit.acquirePermission(size)
 }
 
-// runPipeline will run MQTT pipeline by using packet.
-// it will return an error if MQTT pipline set MQTTContext to Disconnect or Drop.
-func (c *Client) runPipeline(packet packets.ControlPacket, packetType PacketType) error {
+// runPipeline will run MQTT pipeline by using packet and its MQTT 5.0 properties.
+// it will return an error with reason code if MQTT pipline set MQTTContext to Disconnect or Drop.
+func (c *Client) runPipeline(packet packets.ControlPacket, packetType PacketType, props *packets5.Properties) error {
 	pipelineName, ok := c.broker.pipelines[packetType]
 	if !ok {
 		return nil
@@ -228,18 +294,38 @@ func (c *Client) runPipeline(packet packets.ControlPacket, packetType PacketType
 		return nil
 	}
 
-	ctx := context.NewMQTTContext(stdcontext.Background(), c, packet)
+	ctx := context.NewMQTT5Context(stdcontext.Background(), c, packet, props)
 	pipe.HandleMQTT(ctx)
 	if ctx.Disconnect() {
-		c.close()
-		return errors.New("pipeline set disconnect")
+		err := newReasonError(ctx.ReasonCode(), "pipeline set disconnect")
+		c.disconnect(err.code)
+		return err
 	}
 	if ctx.Drop() {
-		return errors.New("pipeline set drop")
+		return newReasonError(ctx.ReasonCode(), "pipeline set drop")
 	}
 	return nil
 }
 
+// retain stores the publish as retained message of its topic if its retain flag is set.
+func (c *Client) retain(publish *packets.PublishPacket, props *packets5.Properties) {
+	if !publish.Retain {
+		return
+	}
+	err := c.broker.retainMgr.retain(publish.TopicName, publish.Payload, publish.Qos, newMessageProperties(props))
+	if err != nil {
+		logger.SpanErrorf(nil, "client %v retain message of topic %v failed: %v", c.info.cid, publish.TopicName, err)
+	}
+}
+
+// route sends the publish to clients subscribing its topic if device to device messages are enabled.
+func (c *Client) route(publish *packets.PublishPacket, props *packets5.Properties) {
+	if !c.broker.spec.DeviceToDevice {
+		return
+	}
+	c.broker.routeMsg(nil, c.info.cid, publish.TopicName, publish.Payload, publish.Qos, newMessageProperties(props))
+}
+
 func (c *Client) writePacket(packet packets.ControlPacket) {
 	c.writeCh <- packet
 }
@@ -248,7 +334,7 @@ func (c *Client) writeLoop() {
 	for {
 		select {
 		case p := <-c.writeCh:
-			err := p.Write(c.conn)
+			err := c.write(p)
 			if err != nil {
 				logger.SpanErrorf(nil, "write packet %v to client %s failed: %s", p.String(), c.info.cid, err)
 				c.closeAndDelSession()
@@ -293,41 +379,50 @@ func (c *Client) closeAndDelSession() {
 	c.broker.sessMgr.delLocal(c.info.cid)
 	if c.session.cleanSession() {
 		c.broker.sessMgr.delDB(c.info.cid)
+	} else if c.version == mqtt5 {
+		c.session.expireAfter(c.sessionExpiryInterval)
 	}
 
 	topics, _, _ := c.session.allSubscribes()
 	c.broker.topicMgr.unsubscribe(topics, c.info.cid)
+	c.broker.sharedMgr.unsubscribe(topics, c.info.cid)
+	c.broker.routeMgr.unsubscribe(topics, c.info.cid)
 
 	c.close()
 }
 
 func errorWrapper(errMsg string) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
+	return func(c *Client, p packets.ControlPacket, props *packets5.Properties) error {
 		return errors.New(errMsg)
 	}
 }
 
 func nilErrWrapper(fn processFn) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
-		fn(c, p)
+	return func(c *Client, p packets.ControlPacket, props *packets5.Properties) error {
+		fn(c, p, props)
 		return nil
 	}
 }
 
 func pipelineWrapper(fn processFn, packetType PacketType) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
-		err := c.runPipeline(p, packetType)
+	return func(c *Client, p packets.ControlPacket, props *packets5.Properties) error {
+		err := c.runPipeline(p, packetType, props)
 		if err != nil {
 			logger.SpanDebugf(nil, "client process pipeline failed, %v", c.info.cid, err)
+			c.nack(p, reasonCode(err, packets5.DisconnectUnspecifiedError))
 			return nil
 		}
-		fn(c, p)
+		fn(c, p, props)
 		return nil
 	}
 }
 
-func processPublish(c *Client, packet packets.ControlPacket) {
+func processPublish(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
 	publish := packet.(*packets.PublishPacket)
+	c.retain(publish, props)
+	if publish.Qos != QoS2 || !c.session.received(publish.MessageID) {
+		c.route(publish, props)
+	}
 	switch publish.Qos {
 	case QoS0:
 		// do nothing
@@ -336,16 +431,42 @@ func processPublish(c *Client, packet packets.ControlPacket) {
 		puback.MessageID = publish.MessageID
 		c.writePacket(puback)
 	case QoS2:
-		// not support yet
+		c.session.receive(publish.MessageID)
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = publish.MessageID
+		c.writePacket(pubrec)
 	}
 }
 
-func processPuback(c *Client, packet packets.ControlPacket) {
+func processPuback(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
 	puback := packet.(*packets.PubackPacket)
 	c.session.puback(puback)
 }
 
-func processSubscribe(c *Client, p packets.ControlPacket) {
+func processPubrec(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
+	pubrec := packet.(*packets.PubrecPacket)
+	c.session.pubrec(pubrec)
+
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = pubrec.MessageID
+	c.writePacket(pubrel)
+}
+
+func processPubrel(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
+	pubrel := packet.(*packets.PubrelPacket)
+	c.session.release(pubrel.MessageID)
+
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = pubrel.MessageID
+	c.writePacket(pubcomp)
+}
+
+func processPubcomp(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
+	pubcomp := packet.(*packets.PubcompPacket)
+	c.session.pubcomp(pubcomp)
+}
+
+func processSubscribe(c *Client, p packets.ControlPacket, props *packets5.Properties) {
 	packet := p.(*packets.SubscribePacket)
 	logger.SpanDebugf(nil, "client %s subscribe %v with qos %v", c.info.cid, packet.Topics, packet.Qoss)
 
@@ -354,18 +475,35 @@ func processSubscribe(c *Client, p packets.ControlPacket) {
 		logger.SpanErrorf(nil, "client %v subscribe %v failed: %v", c.info.cid, packet.Topics, err)
 		return
 	}
+	err = c.broker.sharedMgr.subscribe(packet.Topics, c.info.cid)
+	if err != nil {
+		logger.SpanErrorf(nil, "client %v store shared subscriptions of %v failed: %v", c.info.cid, packet.Topics, err)
+	}
+	err = c.broker.routeMgr.subscribe(packet.Topics, c.info.cid)
+	if err != nil {
+		logger.SpanErrorf(nil, "client %v store routes of %v failed: %v", c.info.cid, packet.Topics, err)
+	}
 	c.session.subscribe(packet.Topics, packet.Qoss)
 
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 	suback.MessageID = packet.MessageID
 	suback.ReturnCodes = make([]byte, len(packet.Topics))
 	for i := range packet.Topics {
-		suback.ReturnCodes[i] = packet.Qos
+		suback.ReturnCodes[i] = packet.Qoss[i]
 	}
 	c.writePacket(suback)
+
+	msgs, qoss, err := c.broker.retainMgr.match(packet.Topics, packet.Qoss)
+	if err != nil {
+		logger.SpanErrorf(nil, "client %v get retained messages of %v failed: %v", c.info.cid, packet.Topics, err)
+		return
+	}
+	for i, msg := range msgs {
+		c.session.publishRetained(nil, msg, qoss[i])
+	}
 }
 
-func processUnsubscribe(c *Client, p packets.ControlPacket) {
+func processUnsubscribe(c *Client, p packets.ControlPacket, props *packets5.Properties) {
 	packet := p.(*packets.UnsubscribePacket)
 
 	logger.SpanDebugf(nil, "client %s processUnsubscribe %v", c.info.cid, packet.Topics)
@@ -374,14 +512,28 @@ func processUnsubscribe(c *Client, p packets.ControlPacket) {
 	if err != nil {
 		logger.SpanErrorf(nil, "client %v unsubscribe %v failed: %v", c.info.cid, packet.Topics, err)
 	}
+	err = c.broker.sharedMgr.unsubscribe(packet.Topics, c.info.cid)
+	if err != nil {
+		logger.SpanErrorf(nil, "client %v delete shared subscriptions of %v failed: %v", c.info.cid, packet.Topics, err)
+	}
+	err = c.broker.routeMgr.unsubscribe(packet.Topics, c.info.cid)
+	if err != nil {
+		logger.SpanErrorf(nil, "client %v delete routes of %v failed: %v", c.info.cid, packet.Topics, err)
+	}
 	c.session.unsubscribe(packet.Topics)
 
+	if c.version == mqtt5 {
+		// UNSUBACK of MQTT 5.0 has a reason code for every topic filter
+		reasons := make([]byte, len(packet.Topics))
+		c.writePacket(&packet5{&packets5.Unsuback{PacketID: packet.MessageID, Reasons: reasons, Properties: &packets5.Properties{}}})
+		return
+	}
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	unsuback.MessageID = packet.MessageID
 	c.writePacket(unsuback)
 }
 
-func processPingreq(c *Client, packet packets.ControlPacket) {
+func processPingreq(c *Client, packet packets.ControlPacket, props *packets5.Properties) {
 	resp := packets.NewControlPacket(packets.Pingresp).(*packets.PingrespPacket)
 	c.writePacket(resp)
 }
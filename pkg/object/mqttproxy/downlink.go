@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/mqttbackend"
+)
+
+const (
+	// headers of kafka records to set topic, qos and retain flag of MQTT messages
+	headerTopic  = "mqtt-topic"
+	headerQoS    = "mqtt-qos"
+	headerRetain = "mqtt-retain"
+
+	downlinkOldest = "oldest"
+
+	downlinkRetryInterval = 5 * time.Second
+)
+
+type (
+	// DownlinkManager consumes records of Kafka topics in a consumer group and sends them
+	// to MQTT clients. All members of the cluster join the same group, so every record is
+	// consumed by only one member, which routes it to the members having subscribers.
+	DownlinkManager struct {
+		broker *Broker
+		spec   *Downlink
+		topics map[string]*DownlinkTopic
+		config *sarama.Config
+
+		stats  DownlinkStats
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+	}
+
+	// DownlinkStats is the statistics of records consumed from Kafka.
+	DownlinkStats struct {
+		Messages uint64 `yaml:"messages"`
+		Bytes    uint64 `yaml:"bytes"`
+		Failed   uint64 `yaml:"failed"`
+	}
+
+	// downlinkMsg is the MQTT message converted from a Kafka record
+	downlinkMsg struct {
+		topic   string
+		payload []byte
+		qos     byte
+		retain  bool
+		props   *MessageProperties
+	}
+)
+
+var _ sarama.ConsumerGroupHandler = (*DownlinkManager)(nil)
+
+func newDownlinkManager(broker *Broker, spec *Downlink) *DownlinkManager {
+	dm := &DownlinkManager{
+		broker: broker,
+		spec:   spec,
+		topics: make(map[string]*DownlinkTopic),
+	}
+	for _, t := range spec.Topics {
+		dm.topics[t.Topic] = t
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = fmt.Sprintf("%s-%s", broker.name, broker.egName)
+	config.Version = sarama.V1_0_0_0
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	if spec.InitialOffset == downlinkOldest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	dm.config = config
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dm.cancel = cancel
+	dm.wg.Add(1)
+	go dm.run(ctx)
+	return dm
+}
+
+func (dm *DownlinkManager) run(ctx context.Context) {
+	defer dm.wg.Done()
+
+	var group sarama.ConsumerGroup
+	var err error
+	// kafka may be unavailable when the proxy starts, so keep trying
+	for {
+		group, err = sarama.NewConsumerGroup(dm.spec.Backend, dm.spec.Group, dm.config)
+		if err == nil {
+			break
+		}
+		logger.SpanErrorf(nil, "create kafka consumer group %v with address %v failed: %v", dm.spec.Group, dm.spec.Backend, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(downlinkRetryInterval):
+		}
+	}
+	defer func() {
+		// offsets of marked records are committed when the group is closed
+		if err := group.Close(); err != nil {
+			logger.Errorf("close kafka consumer group %v failed: %v", dm.spec.Group, err)
+		}
+	}()
+
+	topics := make([]string, 0, len(dm.topics))
+	for topic := range dm.topics {
+		topics = append(topics, topic)
+	}
+	for {
+		// Consume returns when the group rebalances, so call it in loop
+		err := group.Consume(ctx, topics, dm)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.SpanErrorf(nil, "consume kafka topics %v in group %v failed: %v", topics, dm.spec.Group, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(downlinkRetryInterval):
+			}
+		}
+	}
+}
+
+// Setup is run at the beginning of a new session of the consumer group.
+func (dm *DownlinkManager) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is run at the end of a session of the consumer group.
+func (dm *DownlinkManager) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim sends records of a partition to MQTT clients, and marks them as consumed.
+func (dm *DownlinkManager) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil
+		case record, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			dm.handle(record)
+			session.MarkMessage(record, "")
+		}
+	}
+}
+
+func (dm *DownlinkManager) handle(record *sarama.ConsumerMessage) {
+	atomic.AddUint64(&dm.stats.Messages, 1)
+	atomic.AddUint64(&dm.stats.Bytes, uint64(len(record.Value)))
+
+	msg, err := dm.convert(record)
+	if err != nil {
+		// a malformed record never succeeds, so skip it instead of blocking the partition
+		atomic.AddUint64(&dm.stats.Failed, 1)
+		logger.SpanErrorf(nil, "convert kafka record of topic %v partition %v offset %v failed: %v",
+			record.Topic, record.Partition, record.Offset, err)
+		return
+	}
+	logger.SpanDebugf(nil, "send kafka record of topic %v offset %v to mqtt topic %v", record.Topic, record.Offset, msg.topic)
+
+	if msg.retain {
+		err = dm.broker.retainMgr.retain(msg.topic, msg.payload, msg.qos, msg.props)
+		if err != nil {
+			logger.SpanErrorf(nil, "retain message of topic %v failed: %v", msg.topic, err)
+		}
+	}
+	dm.broker.routeMsg(nil, "", msg.topic, msg.payload, msg.qos, msg.props)
+}
+
+// convert converts a Kafka record to MQTT message. The MQTT topic, qos and retain flag are
+// taken from headers of the record first, then from the spec of the Kafka topic. Headers for
+// MQTT 5.0 properties are converted back, and other headers become user properties.
+func (dm *DownlinkManager) convert(record *sarama.ConsumerMessage) (*downlinkMsg, error) {
+	spec := dm.topics[record.Topic]
+	if spec == nil {
+		return nil, fmt.Errorf("kafka topic %v not configured", record.Topic)
+	}
+	msg := &downlinkMsg{
+		payload: record.Value,
+		qos:     byte(spec.QoS),
+		retain:  spec.Retain,
+	}
+
+	props := &MessageProperties{}
+	for _, h := range record.Headers {
+		if h == nil {
+			continue
+		}
+		key, value := string(h.Key), string(h.Value)
+		switch key {
+		case headerTopic:
+			msg.topic = value
+		case headerQoS:
+			qos, err := strconv.Atoi(value)
+			if err != nil || qos < int(QoS0) || qos > int(QoS2) {
+				return nil, fmt.Errorf("invalid qos %v", value)
+			}
+			msg.qos = byte(qos)
+		case headerRetain:
+			retain, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retain flag %v", value)
+			}
+			msg.retain = retain
+		case mqttbackend.HeaderContentType:
+			props.ContentType = value
+		case mqttbackend.HeaderResponseTopic:
+			props.ResponseTopic = value
+		case mqttbackend.HeaderCorrelationData:
+			props.CorrelationData = h.Value
+		default:
+			props.UserProperties = append(props.UserProperties, UserProperty{Key: key, Value: value})
+		}
+	}
+	if props.ContentType != "" || props.ResponseTopic != "" || props.CorrelationData != nil || props.UserProperties != nil {
+		msg.props = props
+	}
+
+	if msg.topic == "" {
+		msg.topic = record.Topic
+		if spec.MQTTTopic != "" {
+			msg.topic = strings.NewReplacer("{topic}", record.Topic, "{key}", string(record.Key)).Replace(spec.MQTTTopic)
+		}
+	}
+	if msg.topic == "" || strings.ContainsAny(msg.topic, "+#") {
+		return nil, fmt.Errorf("invalid mqtt topic %v", msg.topic)
+	}
+	return msg, nil
+}
+
+func (dm *DownlinkManager) status() *DownlinkStats {
+	return &DownlinkStats{
+		Messages: atomic.LoadUint64(&dm.stats.Messages),
+		Bytes:    atomic.LoadUint64(&dm.stats.Bytes),
+		Failed:   atomic.LoadUint64(&dm.stats.Failed),
+	}
+}
+
+func (dm *DownlinkManager) close() {
+	dm.cancel()
+	dm.wg.Wait()
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSession struct {
+	ctx    context.Context
+	marked chan int64
+}
+
+func (s *mockSession) Claims() map[string][]int32                                        { return nil }
+func (s *mockSession) MemberID() string                                                  { return "member" }
+func (s *mockSession) GenerationID() int32                                               { return 1 }
+func (s *mockSession) MarkOffset(topic string, partition int32, offset int64, m string)  {}
+func (s *mockSession) Commit()                                                           {}
+func (s *mockSession) ResetOffset(topic string, partition int32, offset int64, m string) {}
+func (s *mockSession) Context() context.Context                                          { return s.ctx }
+
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked <- msg.Offset
+}
+
+type mockClaim struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *mockClaim) Topic() string                            { return c.topic }
+func (c *mockClaim) Partition() int32                         { return 0 }
+func (c *mockClaim) InitialOffset() int64                     { return 0 }
+func (c *mockClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *mockClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func header(k, v string) *sarama.RecordHeader {
+	return &sarama.RecordHeader{Key: []byte(k), Value: []byte(v)}
+}
+
+func TestDownlinkConvert(t *testing.T) {
+	assert := assert.New(t)
+
+	dm := &DownlinkManager{topics: map[string]*DownlinkTopic{
+		"device-cmd": {Topic: "device-cmd", MQTTTopic: "device/{key}/cmd", QoS: 1},
+		"broadcast":  {Topic: "broadcast", Retain: true},
+	}}
+
+	msg, err := dm.convert(&sarama.ConsumerMessage{Topic: "device-cmd", Key: []byte("d1"), Value: []byte("on")})
+	assert.Nil(err)
+	assert.Equal(&downlinkMsg{topic: "device/d1/cmd", payload: []byte("on"), qos: QoS1}, msg)
+
+	msg, err = dm.convert(&sarama.ConsumerMessage{Topic: "broadcast", Value: []byte("hi")})
+	assert.Nil(err)
+	assert.Equal(&downlinkMsg{topic: "broadcast", payload: []byte("hi"), retain: true}, msg)
+
+	// headers take precedence
+	record := &sarama.ConsumerMessage{
+		Topic: "device-cmd",
+		Key:   []byte("d1"),
+		Value: []byte("on"),
+		Headers: []*sarama.RecordHeader{
+			header("mqtt-topic", "device/d2/cmd"),
+			header("mqtt-qos", "2"),
+			header("mqtt-retain", "true"),
+			header("mqtt-content-type", "text/plain"),
+			header("mqtt-response-topic", "device/d2/resp"),
+			header("mqtt-correlation-data", "123"),
+			header("k", "v"),
+		},
+	}
+	msg, err = dm.convert(record)
+	assert.Nil(err)
+	want := &downlinkMsg{
+		topic:   "device/d2/cmd",
+		payload: []byte("on"),
+		qos:     QoS2,
+		retain:  true,
+		props: &MessageProperties{
+			ContentType:     "text/plain",
+			ResponseTopic:   "device/d2/resp",
+			CorrelationData: []byte("123"),
+			UserProperties:  []UserProperty{{Key: "k", Value: "v"}},
+		},
+	}
+	assert.True(reflect.DeepEqual(want, msg))
+
+	for _, h := range []*sarama.RecordHeader{header("mqtt-qos", "3"), header("mqtt-retain", "yes"), header("mqtt-topic", "a/+")} {
+		_, err = dm.convert(&sarama.ConsumerMessage{Topic: "device-cmd", Headers: []*sarama.RecordHeader{h}})
+		assert.NotNil(err)
+	}
+	_, err = dm.convert(&sarama.ConsumerMessage{Topic: "unknown"})
+	assert.NotNil(err)
+	_, err = dm.convert(&sarama.ConsumerMessage{Topic: "device-cmd"})
+	assert.Nil(err)
+}
+
+func TestDownlink(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	// kafka is unavailable, the consumer group keeps retrying until the broker closes
+	spec.Downlink = &Downlink{
+		Backend: []string{"127.0.0.1:1"},
+		Group:   "mqtt",
+		Topics:  []*DownlinkTopic{{Topic: "device-cmd", MQTTTopic: "device/{key}/cmd", QoS: 1}},
+	}
+	broker := getBrokerFromSpec(spec)
+	defer broker.close()
+
+	ch := make(chan paho.Message, 10)
+	client := getMQTTClient(t, "d1", "test", "test", true)
+	defer client.Disconnect(200)
+	token := client.Subscribe("device/d1/#", 1, func(c paho.Client, m paho.Message) {
+		ch <- m
+	})
+	token.Wait()
+	require.Nil(t, token.Error())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &mockSession{ctx: ctx, marked: make(chan int64, 10)}
+	claim := &mockClaim{topic: "device-cmd", messages: make(chan *sarama.ConsumerMessage, 10)}
+	done := make(chan struct{})
+	go func() {
+		broker.downlinkMgr.ConsumeClaim(session, claim)
+		close(done)
+	}()
+
+	claim.messages <- &sarama.ConsumerMessage{Topic: "device-cmd", Key: []byte("d1"), Value: []byte("on"), Offset: 1}
+	claim.messages <- &sarama.ConsumerMessage{Topic: "device-cmd", Key: []byte("d1"), Value: []byte("bad"), Offset: 2,
+		Headers: []*sarama.RecordHeader{header("mqtt-qos", "5")}}
+	claim.messages <- &sarama.ConsumerMessage{Topic: "device-cmd", Key: []byte("d2"), Value: []byte("off"), Offset: 3}
+	claim.messages <- &sarama.ConsumerMessage{Topic: "device-cmd", Key: []byte("d1"), Value: []byte("off"), Offset: 4,
+		Headers: []*sarama.RecordHeader{header("mqtt-retain", "true")}}
+
+	// every record is marked, including the malformed one
+	for i := int64(1); i <= 4; i++ {
+		select {
+		case offset := <-session.marked:
+			assert.Equal(i, offset)
+		case <-time.After(time.Second):
+			t.Fatalf("record %d not marked", i)
+		}
+	}
+	for _, want := range []string{"on", "off"} {
+		select {
+		case m := <-ch:
+			assert.Equal("device/d1/cmd", m.Topic())
+			assert.Equal(want, string(m.Payload()))
+			assert.Equal(QoS1, m.Qos())
+		case <-time.After(time.Second):
+			t.Fatalf("message %v not received", want)
+		}
+	}
+	msgs, _ := broker.retainMgr.all()
+	assert.Len(msgs, 1)
+	assert.Equal(&DownlinkStats{Messages: 4, Bytes: 11, Failed: 1}, broker.status().Downlink)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ConsumeClaim not returned after session done")
+	}
+}
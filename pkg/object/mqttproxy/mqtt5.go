@@ -0,0 +1,880 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+)
+
+const (
+	// mqtt5 is the protocol version of MQTT 5.0
+	mqtt5 byte = 5
+
+	// authTimeout is the time to wait for AUTH packet from client during enhanced authentication
+	authTimeout = 10 * time.Second
+	// maxAuthRounds is the max number of AUTH packets exchanged during enhanced authentication
+	maxAuthRounds = 10
+	// sessionNeverExpire is the session expiry interval of session that never expires
+	sessionNeverExpire = math.MaxUint32
+)
+
+// connackReasonCodes maps MQTT 3.1.1 connack return code to MQTT 5.0 reason code,
+// reason code of protocol error is same as the one of DISCONNECT.
+var connackReasonCodes = map[byte]byte{
+	packets.Accepted:                        packets5.ConnackSuccess,
+	packets.ErrRefusedBadProtocolVersion:    packets5.ConnackUnsupportedProtocolVersion,
+	packets.ErrRefusedIDRejected:            packets5.ConnackInvalidClientID,
+	packets.ErrRefusedServerUnavailable:     packets5.ConnackServerUnavailable,
+	packets.ErrRefusedBadUsernameOrPassword: packets5.ConnackBadUsernameOrPassword,
+	packets.ErrRefusedNotAuthorised:         packets5.ConnackNotAuthorized,
+	packets.ErrProtocolViolation:            packets5.DisconnectProtocolError,
+}
+
+type (
+	// MessageProperties is MQTT 5.0 properties of message sent to clients
+	MessageProperties struct {
+		PayloadFormat         byte           `yaml:"payloadFormat,omitempty" json:"payloadFormat,omitempty"`
+		MessageExpiryInterval uint32         `yaml:"messageExpiryInterval,omitempty" json:"messageExpiryInterval,omitempty"`
+		ContentType           string         `yaml:"contentType,omitempty" json:"contentType,omitempty"`
+		ResponseTopic         string         `yaml:"responseTopic,omitempty" json:"responseTopic,omitempty"`
+		CorrelationData       []byte         `yaml:"correlationData,omitempty" json:"correlationData,omitempty"`
+		UserProperties        []UserProperty `yaml:"userProperties,omitempty" json:"userProperties,omitempty"`
+	}
+
+	// UserProperty is MQTT 5.0 user property
+	UserProperty struct {
+		Key   string `yaml:"key" json:"key"`
+		Value string `yaml:"value" json:"value"`
+	}
+
+	// reasonError is an error with MQTT 5.0 reason code, which is sent back
+	// to client in acknowledgement or DISCONNECT packet.
+	reasonError struct {
+		code byte
+		msg  string
+	}
+
+	// packet5 wraps MQTT 5.0 packet which can't be represented by MQTT 3.1.1 packet,
+	// so it can go through the same process as MQTT 3.1.1 packets.
+	packet5 struct {
+		packets5.Packet
+	}
+
+	// publish5 is publish packet with MQTT 5.0 properties of message
+	publish5 struct {
+		*packets.PublishPacket
+		properties *packets5.Properties
+	}
+
+	// decoder reads MQTT data types from buffer, it keeps the first error
+	// and following reads do nothing after error.
+	decoder struct {
+		b   *bytes.Buffer
+		err error
+	}
+)
+
+func newReasonError(code byte, format string, a ...interface{}) *reasonError {
+	// reason code less than 0x80 means success, use unspecified error instead
+	if code < 0x80 {
+		code = packets5.DisconnectUnspecifiedError
+	}
+	return &reasonError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+func (e *reasonError) Error() string {
+	return fmt.Sprintf("%s, reason code 0x%x", e.msg, e.code)
+}
+
+// reasonCode returns reason code of error, or defaultCode if error has no reason code.
+func reasonCode(err error, defaultCode byte) byte {
+	var re *reasonError
+	if errors.As(err, &re) {
+		return re.code
+	}
+	return defaultCode
+}
+
+func newMessageProperties(props *packets5.Properties) *MessageProperties {
+	if props == nil {
+		return nil
+	}
+	mp := &MessageProperties{
+		ContentType:     props.ContentType,
+		ResponseTopic:   props.ResponseTopic,
+		CorrelationData: props.CorrelationData,
+	}
+	if props.PayloadFormat != nil {
+		mp.PayloadFormat = *props.PayloadFormat
+	}
+	if props.MessageExpiry != nil {
+		mp.MessageExpiryInterval = *props.MessageExpiry
+	}
+	for _, u := range props.User {
+		mp.UserProperties = append(mp.UserProperties, UserProperty{Key: u.Key, Value: u.Value})
+	}
+	return mp
+}
+
+// expireAt returns the time when message expires, nil for message never expires.
+func (mp *MessageProperties) expireAt() *time.Time {
+	if mp == nil || mp.MessageExpiryInterval == 0 {
+		return nil
+	}
+	t := time.Now().Add(time.Duration(mp.MessageExpiryInterval) * time.Second)
+	return &t
+}
+
+// remaining returns a copy of properties whose message expiry interval is the
+// time left to expireAt, it is used to send stored messages.
+func (mp *MessageProperties) remaining(expireAt *time.Time) *MessageProperties {
+	if mp == nil || mp.MessageExpiryInterval == 0 || expireAt == nil {
+		return mp
+	}
+	cp := *mp
+	cp.MessageExpiryInterval = expiryInterval(*expireAt)
+	return &cp
+}
+
+func (mp *MessageProperties) properties5(expireAt *time.Time) *packets5.Properties {
+	props := &packets5.Properties{}
+	if mp == nil {
+		return props
+	}
+	if mp.PayloadFormat != 0 {
+		format := mp.PayloadFormat
+		props.PayloadFormat = &format
+	}
+	if expireAt != nil {
+		expiry := expiryInterval(*expireAt)
+		props.MessageExpiry = &expiry
+	}
+	props.ContentType = mp.ContentType
+	props.ResponseTopic = mp.ResponseTopic
+	props.CorrelationData = mp.CorrelationData
+	for _, u := range mp.UserProperties {
+		props.User = append(props.User, packets5.User{Key: u.Key, Value: u.Value})
+	}
+	return props
+}
+
+// expiryInterval returns seconds left to expireAt, at least 1 second.
+func expiryInterval(expireAt time.Time) uint32 {
+	left := math.Ceil(time.Until(expireAt).Seconds())
+	if left < 1 {
+		return 1
+	}
+	if left > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(left)
+}
+
+func (p *packet5) Write(w io.Writer) error {
+	_, err := p.WriteTo(w)
+	return err
+}
+
+func (p *packet5) Unpack(r io.Reader) error {
+	return errors.New("packet5 is decoded by client")
+}
+
+func (p *packet5) String() string {
+	return fmt.Sprint(p.Packet)
+}
+
+func (p *packet5) Details() packets.Details {
+	return packets.Details{}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	var v byte
+	v, d.err = d.b.ReadByte()
+	return v
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if d.b.Len() < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	return d.b.Next(n)
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.bytes(2)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.bytes(4)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) binary() []byte {
+	n := d.uint16()
+	b := d.bytes(int(n))
+	if d.err != nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) properties(packetType byte) *packets5.Properties {
+	props := &packets5.Properties{}
+	if d.err == nil {
+		d.err = props.Unpack(d.b, packetType)
+	}
+	return props
+}
+
+// willProperties decodes will properties of CONNECT packet, which are
+// properties of PUBLISH packet plus will delay interval.
+func (d *decoder) willProperties() *packets5.Properties {
+	props := &packets5.Properties{}
+	size, err := readVBI(d.b)
+	if err != nil {
+		d.err = err
+	}
+	wd := &decoder{b: bytes.NewBuffer(d.bytes(size))}
+	for d.err == nil && wd.err == nil && wd.b.Len() > 0 {
+		switch id := wd.byte(); id {
+		case packets5.PropWillDelayInterval:
+			delay := wd.uint32()
+			props.WillDelayInterval = &delay
+		case packets5.PropPayloadFormat:
+			format := wd.byte()
+			props.PayloadFormat = &format
+		case packets5.PropMessageExpiry:
+			expiry := wd.uint32()
+			props.MessageExpiry = &expiry
+		case packets5.PropContentType:
+			props.ContentType = wd.string()
+		case packets5.PropResponseTopic:
+			props.ResponseTopic = wd.string()
+		case packets5.PropCorrelationData:
+			props.CorrelationData = wd.binary()
+		case packets5.PropUser:
+			key := wd.string()
+			value := wd.string()
+			props.User = append(props.User, packets5.User{Key: key, Value: value})
+		default:
+			wd.err = fmt.Errorf("invalid will property %d", id)
+		}
+	}
+	if d.err == nil {
+		d.err = wd.err
+	}
+	return props
+}
+
+func readVBI(r io.Reader) (int, error) {
+	var value, multiplier int
+	b := make([]byte, 1)
+	for multiplier = 1; multiplier <= 128*128*128; multiplier *= 128 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
+		value += int(b[0]&127) * multiplier
+		if b[0]&128 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("malformed variable byte integer")
+}
+
+// readRawPacket reads the first byte of fixed header and the rest bytes of MQTT packet.
+func readRawPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length, err := readVBI(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// readConnect reads CONNECT packet of MQTT 3.1.1 or MQTT 5.0. For MQTT 5.0, the returned
+// packet has protocol version 5, and properties and will properties are returned too.
+func readConnect(r io.Reader) (*packets.ConnectPacket, *packets5.Properties, *packets5.Properties, error) {
+	header, body, err := readRawPacket(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if header>>4 != packets.Connect {
+		return nil, nil, nil, fmt.Errorf("first packet received with type %d that was not Connect", header>>4)
+	}
+
+	// protocol version is after protocol name
+	if len(body) > 2 {
+		nameLen := int(binary.BigEndian.Uint16(body))
+		if len(body) > 2+nameLen && body[2+nameLen] == mqtt5 {
+			return decodeConnect5(bytes.NewBuffer(body))
+		}
+	}
+
+	raw := bytes.NewBuffer([]byte{header})
+	raw.Write(encodeLength(len(body)))
+	raw.Write(body)
+	packet, err := packets.ReadPacket(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return packet.(*packets.ConnectPacket), nil, nil, nil
+}
+
+func encodeLength(length int) []byte {
+	var b []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+func decodeConnect5(b *bytes.Buffer) (*packets.ConnectPacket, *packets5.Properties, *packets5.Properties, error) {
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.RemainingLength = b.Len()
+
+	d := &decoder{b: b}
+	connect.ProtocolName = d.string()
+	connect.ProtocolVersion = d.byte()
+	flags := d.byte()
+	connect.ReservedBit = flags & 0x01
+	connect.CleanSession = flags&0x02 != 0
+	connect.WillFlag = flags&0x04 != 0
+	connect.WillQos = (flags >> 3) & 0x03
+	connect.WillRetain = flags&0x20 != 0
+	connect.PasswordFlag = flags&0x40 != 0
+	connect.UsernameFlag = flags&0x80 != 0
+	connect.Keepalive = d.uint16()
+	props := d.properties(packets5.CONNECT)
+
+	connect.ClientIdentifier = d.string()
+	var willProps *packets5.Properties
+	if connect.WillFlag {
+		willProps = d.willProperties()
+		connect.WillTopic = d.string()
+		connect.WillMessage = d.binary()
+	}
+	if connect.UsernameFlag {
+		connect.Username = d.string()
+	}
+	if connect.PasswordFlag {
+		connect.Password = d.binary()
+	}
+	if d.err != nil {
+		return nil, nil, nil, fmt.Errorf("decode MQTT 5.0 connect packet failed: %v", d.err)
+	}
+	return connect, props, willProps, nil
+}
+
+// decodeSubscribe5 decodes MQTT 5.0 SUBSCRIBE packet, only maximum qos of
+// subscription options is used, other options are ignored.
+func decodeSubscribe5(b *bytes.Buffer) (*packets.SubscribePacket, *packets5.Properties, error) {
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	d := &decoder{b: b}
+	subscribe.MessageID = d.uint16()
+	props := d.properties(packets5.SUBSCRIBE)
+	for d.err == nil && b.Len() > 0 {
+		topic := d.string()
+		options := d.byte()
+		subscribe.Topics = append(subscribe.Topics, topic)
+		subscribe.Qoss = append(subscribe.Qoss, options&0x03)
+	}
+	if d.err == nil && len(subscribe.Topics) == 0 {
+		d.err = errors.New("no topic filter")
+	}
+	return subscribe, props, d.err
+}
+
+// validateConnect validates CONNECT packet, and returns return code of MQTT 3.1.1 CONNACK.
+func validateConnect(connect *packets.ConnectPacket) byte {
+	if connect.ProtocolVersion != mqtt5 {
+		return connect.Validate()
+	}
+	if connect.ProtocolName != "MQTT" || connect.ReservedBit != 0 || connect.WillQos > QoS2 {
+		return packets.ErrProtocolViolation
+	}
+	return packets.Accepted
+}
+
+// writeConnack writes CONNACK packet to client. For MQTT 5.0 client, the return code
+// of MQTT 3.1.1 CONNACK is converted to reason code if reasonCode is 0.
+func writeConnack(w io.Writer, connect *packets.ConnectPacket, connack *packets.ConnackPacket, reasonCode byte, props *packets5.Properties) error {
+	if connect.ProtocolVersion != mqtt5 {
+		return connack.Write(w)
+	}
+	if reasonCode == 0 {
+		reasonCode = connackReasonCodes[connack.ReturnCode]
+	}
+	if props == nil {
+		props = &packets5.Properties{}
+	}
+	connack5 := &packets5.Connack{
+		SessionPresent: connack.SessionPresent,
+		ReasonCode:     reasonCode,
+		Properties:     props,
+	}
+	_, err := connack5.WriteTo(w)
+	return err
+}
+
+// toPacket5 converts MQTT 3.1.1 packet sent to client to MQTT 5.0 packet.
+func toPacket5(packet packets.ControlPacket) packets5.Packet {
+	switch p := packet.(type) {
+	case *packet5:
+		return p.Packet
+	case *publish5:
+		return &packets5.Publish{
+			PacketID:   p.MessageID,
+			QoS:        p.Qos,
+			Duplicate:  p.Dup,
+			Retain:     p.Retain,
+			Topic:      p.TopicName,
+			Payload:    p.Payload,
+			Properties: p.properties,
+		}
+	case *packets.PublishPacket:
+		return toPacket5(&publish5{PublishPacket: p, properties: &packets5.Properties{}})
+	case *packets.PubackPacket:
+		return &packets5.Puback{PacketID: p.MessageID, Properties: &packets5.Properties{}}
+	case *packets.PubrecPacket:
+		return &packets5.Pubrec{PacketID: p.MessageID, Properties: &packets5.Properties{}}
+	case *packets.PubrelPacket:
+		return &packets5.Pubrel{PacketID: p.MessageID, Properties: &packets5.Properties{}}
+	case *packets.PubcompPacket:
+		return &packets5.Pubcomp{PacketID: p.MessageID, Properties: &packets5.Properties{}}
+	case *packets.SubackPacket:
+		return &packets5.Suback{PacketID: p.MessageID, Reasons: p.ReturnCodes, Properties: &packets5.Properties{}}
+	case *packets.PingrespPacket:
+		return &packets5.Pingresp{}
+	}
+	return nil
+}
+
+// init5 sets MQTT 5.0 related fields of client by using properties of CONNECT packet.
+func (c *Client) init5(props, willProps *packets5.Properties) {
+	c.version = mqtt5
+	if props.SessionExpiryInterval != nil {
+		c.sessionExpiryInterval = *props.SessionExpiryInterval
+	}
+	if props.ReceiveMaximum != nil {
+		c.receiveMaximum = *props.ReceiveMaximum
+	}
+	c.authMethod = props.AuthMethod
+	c.willProperties = willProps
+}
+
+// connackProperties returns properties of CONNACK sent to MQTT 5.0 client.
+func (c *Client) connackProperties() *packets5.Properties {
+	spec := c.broker.spec
+	unavailable, available := byte(0), byte(1)
+	props := &packets5.Properties{
+		AssignedClientID:   c.assignedClientID,
+		AuthMethod:         c.authMethod,
+		AuthData:           c.authData,
+		SubIDAvailable:     &unavailable,
+		SharedSubAvailable: &available,
+	}
+	if spec.ReceiveMaximum > 0 {
+		receiveMaximum := spec.ReceiveMaximum
+		props.ReceiveMaximum = &receiveMaximum
+	}
+	if spec.TopicAliasMaximum > 0 {
+		topicAliasMaximum := spec.TopicAliasMaximum
+		props.TopicAliasMaximum = &topicAliasMaximum
+	}
+	return props
+}
+
+// readPacket reads packet from client. MQTT 5.0 packet is converted to MQTT 3.1.1
+// packet if possible, and its properties are returned.
+func (c *Client) readPacket() (packets.ControlPacket, *packets5.Properties, error) {
+	if c.version != mqtt5 {
+		packet, err := packets.ReadPacket(c.conn)
+		return packet, nil, err
+	}
+	header, body, err := readRawPacket(c.conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	packet, props, err := c.decode5(header, bytes.NewBuffer(body))
+	if err != nil {
+		var re *reasonError
+		if !errors.As(err, &re) {
+			err = newReasonError(packets5.DisconnectMalformedPacket, "decode packet failed: %v", err)
+		}
+		return nil, nil, err
+	}
+	return packet, props, nil
+}
+
+func (c *Client) decode5(header byte, b *bytes.Buffer) (packets.ControlPacket, *packets5.Properties, error) {
+	props := &packets5.Properties{}
+	flags := header & 0x0F
+	switch header >> 4 {
+	case packets5.PUBLISH:
+		p := &packets5.Publish{
+			QoS:        (flags >> 1) & 0x03,
+			Duplicate:  flags&0x08 != 0,
+			Retain:     flags&0x01 != 0,
+			Properties: props,
+		}
+		length := b.Len()
+		if p.QoS > QoS2 {
+			return nil, nil, errors.New("invalid qos of publish packet")
+		}
+		if err := p.Unpack(b); err != nil {
+			return nil, nil, err
+		}
+		topic, err := c.resolveTopicAlias(p.Topic, props.TopicAlias)
+		if err != nil {
+			return nil, nil, err
+		}
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.RemainingLength = length
+		publish.Qos = p.QoS
+		publish.Dup = p.Duplicate
+		publish.Retain = p.Retain
+		publish.TopicName = topic
+		publish.MessageID = p.PacketID
+		publish.Payload = p.Payload
+		return publish, props, nil
+	case packets5.PUBACK:
+		p := &packets5.Puback{Properties: props}
+		if err := p.Unpack(b); err != nil {
+			return nil, nil, err
+		}
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.PacketID
+		return puback, props, nil
+	case packets5.PUBREC:
+		p := &packets5.Pubrec{Properties: props}
+		if err := p.Unpack(b); err != nil {
+			return nil, nil, err
+		}
+		// PUBREC with failure reason code completes the QoS2 flow
+		if p.ReasonCode >= 0x80 {
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.PacketID
+			return pubcomp, props, nil
+		}
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.PacketID
+		return pubrec, props, nil
+	case packets5.PUBREL:
+		p := &packets5.Pubrel{Properties: props}
+		if err := p.Unpack(b); err != nil {
+			return nil, nil, err
+		}
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = p.PacketID
+		return pubrel, props, nil
+	case packets5.PUBCOMP:
+		p := &packets5.Pubcomp{Properties: props}
+		if err := p.Unpack(b); err != nil {
+			return nil, nil, err
+		}
+		pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pubcomp.MessageID = p.PacketID
+		return pubcomp, props, nil
+	case packets5.SUBSCRIBE:
+		return decodeSubscribe5(b)
+	case packets5.UNSUBSCRIBE:
+		p := &packets5.Unsubscribe{Properties: props}
+		if err := p.Unpack(b); err != nil {
+			return nil, nil, err
+		}
+		unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+		unsubscribe.MessageID = p.PacketID
+		unsubscribe.Topics = p.Topics
+		return unsubscribe, props, nil
+	case packets5.PINGREQ:
+		return packets.NewControlPacket(packets.Pingreq), props, nil
+	case packets5.DISCONNECT:
+		// reason code and properties can be omitted
+		p := &packets5.Disconnect{Properties: props}
+		if b.Len() > 0 {
+			p.ReasonCode, _ = b.ReadByte()
+		}
+		if b.Len() > 0 {
+			if err := props.Unpack(b, packets5.DISCONNECT); err != nil {
+				return nil, nil, err
+			}
+		}
+		return &packet5{p}, props, nil
+	case packets5.AUTH:
+		p := &packets5.Auth{Properties: props}
+		if err := p.Unpack(b); err != nil {
+			return nil, nil, err
+		}
+		return &packet5{p}, props, nil
+	}
+	return nil, nil, newReasonError(packets5.DisconnectProtocolError, "unexpected packet type %d", header>>4)
+}
+
+// resolveTopicAlias returns topic name of publish packet, topic alias is set to the topic
+// name if both of them are present, or is replaced by the topic name it was set to.
+func (c *Client) resolveTopicAlias(topic string, alias *uint16) (string, error) {
+	if alias == nil {
+		if topic == "" {
+			return "", newReasonError(packets5.DisconnectProtocolError, "empty topic name without topic alias")
+		}
+		return topic, nil
+	}
+	if *alias == 0 || *alias > c.broker.spec.TopicAliasMaximum {
+		return "", newReasonError(packets5.DisconnectTopicAliasInvalid, "invalid topic alias %d", *alias)
+	}
+	if topic != "" {
+		if c.topicAliases == nil {
+			c.topicAliases = make(map[uint16]string)
+		}
+		c.topicAliases[*alias] = topic
+		return topic, nil
+	}
+	topic, ok := c.topicAliases[*alias]
+	if !ok {
+		return "", newReasonError(packets5.DisconnectProtocolError, "topic alias %d not set", *alias)
+	}
+	return topic, nil
+}
+
+// write writes packet to connection, packets to MQTT 5.0 client are converted to MQTT 5.0 packets.
+func (c *Client) write(packet packets.ControlPacket) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.version == mqtt5 {
+		if p := toPacket5(packet); p != nil {
+			_, err := p.WriteTo(c.conn)
+			return err
+		}
+	}
+	return packet.Write(c.conn)
+}
+
+// publishPacket attaches MQTT 5.0 properties of message to publish packet sent to MQTT 5.0 client.
+func (c *Client) publishPacket(p *packets.PublishPacket, msg *Message) packets.ControlPacket {
+	if c.version != mqtt5 {
+		return p
+	}
+	return &publish5{PublishPacket: p, properties: msg.Properties.properties5(msg.ExpireAt)}
+}
+
+// sendDisconnect sends DISCONNECT with reason code to MQTT 5.0 client, MQTT 3.1.1
+// client is disconnected without DISCONNECT packet.
+func (c *Client) sendDisconnect(code byte) {
+	if c.version != mqtt5 || c.disconnected() {
+		return
+	}
+	disconnect := &packets5.Disconnect{ReasonCode: code, Properties: &packets5.Properties{}}
+	if err := c.write(&packet5{disconnect}); err != nil {
+		logger.SpanDebugf(nil, "client %v send disconnect %v failed: %v", c.info.cid, code, err)
+	}
+}
+
+// disconnect sends DISCONNECT with reason code to MQTT 5.0 client and closes the client.
+func (c *Client) disconnect(code byte) {
+	c.sendDisconnect(code)
+	c.close()
+}
+
+// nack sends acknowledgement with reason code of failure to MQTT 5.0 client for packet not processed.
+// MQTT 3.1.1 client only gets SUBACK with failure return codes for SUBSCRIBE.
+func (c *Client) nack(packet packets.ControlPacket, code byte) {
+	if c.disconnected() {
+		return
+	}
+	if c.version != mqtt5 {
+		if p, ok := packet.(*packets.SubscribePacket); ok {
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = bytes.Repeat([]byte{subackFailure}, len(p.Topics))
+			c.writePacket(suback)
+		}
+		return
+	}
+	props := &packets5.Properties{}
+	switch p := packet.(type) {
+	case *packets.PublishPacket:
+		switch p.Qos {
+		case QoS1:
+			c.writePacket(&packet5{&packets5.Puback{PacketID: p.MessageID, ReasonCode: code, Properties: props}})
+		case QoS2:
+			c.writePacket(&packet5{&packets5.Pubrec{PacketID: p.MessageID, ReasonCode: code, Properties: props}})
+		}
+	case *packets.SubscribePacket:
+		reasons := bytes.Repeat([]byte{code}, len(p.Topics))
+		c.writePacket(&packet5{&packets5.Suback{PacketID: p.MessageID, Reasons: reasons, Properties: props}})
+	case *packets.UnsubscribePacket:
+		reasons := bytes.Repeat([]byte{code}, len(p.Topics))
+		c.writePacket(&packet5{&packets5.Unsuback{PacketID: p.MessageID, Reasons: reasons, Properties: props}})
+	}
+}
+
+// runAuthPipeline runs connect pipeline with properties of CONNECT or AUTH packet
+// for MQTT 5.0 enhanced authentication.
+func (c *Client) runAuthPipeline(props *packets5.Properties) (context.MQTTContext, error) {
+	pipelineName, ok := c.broker.pipelines[Connect]
+	if !ok {
+		return nil, newReasonError(packets5.ConnackBadAuthenticationMethod, "no connect pipeline for authentication method %v", c.authMethod)
+	}
+	pipe, err := pipeline.GetPipeline(pipelineName, context.MQTT)
+	if err != nil {
+		return nil, newReasonError(packets5.ConnackNotAuthorized, "get pipeline %v failed, %v", pipelineName, err)
+	}
+	ctx := context.NewMQTT5Context(stdcontext.Background(), c, c.connect, props)
+	pipe.HandleMQTT(ctx)
+	return ctx, nil
+}
+
+// enhancedAuth does MQTT 5.0 enhanced authentication when client connects. Connect pipeline
+// is run for CONNECT packet and every following AUTH packet, until the pipeline stops
+// continuing the authentication. It returns connack reason code and whether the authentication fails.
+func (c *Client) enhancedAuth(props *packets5.Properties) (byte, bool) {
+	for i := 0; ; i++ {
+		ctx, err := c.runAuthPipeline(props)
+		if err != nil {
+			logger.SpanErrorf(nil, "client %v enhanced authentication failed: %v", c.info.cid, err)
+			return reasonCode(err, packets5.ConnackNotAuthorized), true
+		}
+		if ctx.Disconnect() {
+			return ctx.ReasonCode(), true
+		}
+		c.authData = ctx.AuthData()
+		if !ctx.AuthContinue() {
+			return 0, false
+		}
+		if i >= maxAuthRounds {
+			logger.SpanErrorf(nil, "client %v enhanced authentication exceeds %d rounds", c.info.cid, maxAuthRounds)
+			return packets5.ConnackNotAuthorized, true
+		}
+		props, err = c.continueAuth(ctx.AuthData())
+		if err != nil {
+			logger.SpanErrorf(nil, "client %v continue enhanced authentication failed: %v", c.info.cid, err)
+			return reasonCode(err, packets5.ConnackUnspecifiedError), true
+		}
+	}
+}
+
+// continueAuth sends AUTH packet to continue authentication, and returns properties
+// of the AUTH packet client sends back.
+func (c *Client) continueAuth(data []byte) (*packets5.Properties, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(authTimeout)); err != nil {
+		return nil, err
+	}
+	defer c.conn.SetDeadline(time.Time{})
+
+	auth := &packets5.Auth{
+		ReasonCode: packets5.AuthContinueAuthentication,
+		Properties: &packets5.Properties{AuthMethod: c.authMethod, AuthData: data},
+	}
+	if _, err := auth.WriteTo(c.conn); err != nil {
+		return nil, err
+	}
+	packet, props, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := packet.(*packet5); ok {
+		if a, ok := p.Packet.(*packets5.Auth); ok && a.ReasonCode == packets5.AuthContinueAuthentication && props.AuthMethod == c.authMethod {
+			return props, nil
+		}
+	}
+	return nil, newReasonError(packets5.DisconnectProtocolError, "expect AUTH packet to continue authentication, got %v", packet)
+}
+
+// processAuth processes AUTH packet of MQTT 5.0 re-authentication.
+func processAuth(c *Client, packet packets.ControlPacket, props *packets5.Properties) error {
+	p, ok := packet.(*packet5)
+	if !ok {
+		return errors.New("unexpected packet")
+	}
+	auth, ok := p.Packet.(*packets5.Auth)
+	if !ok || c.authMethod == "" || props.AuthMethod != c.authMethod {
+		return newReasonError(packets5.DisconnectProtocolError, "unexpected packet %v", p)
+	}
+	switch auth.ReasonCode {
+	case packets5.AuthReauthenticate:
+	case packets5.AuthContinueAuthentication:
+		if !c.reauth {
+			return newReasonError(packets5.DisconnectProtocolError, "unexpected continue authentication")
+		}
+	default:
+		return newReasonError(packets5.DisconnectProtocolError, "invalid auth reason code %d", auth.ReasonCode)
+	}
+
+	ctx, err := c.runAuthPipeline(props)
+	if err != nil {
+		return err
+	}
+	if ctx.Disconnect() {
+		return newReasonError(ctx.ReasonCode(), "re-authentication failed")
+	}
+	c.reauth = ctx.AuthContinue()
+	code := byte(packets5.AuthSuccess)
+	if c.reauth {
+		code = packets5.AuthContinueAuthentication
+	}
+	c.writePacket(&packet5{&packets5.Auth{
+		ReasonCode: code,
+		Properties: &packets5.Properties{AuthMethod: c.authMethod, AuthData: ctx.AuthData()},
+	}})
+	return nil
+}
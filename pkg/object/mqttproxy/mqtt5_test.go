@@ -0,0 +1,434 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mqttproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/object/pipeline"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	pipeline.Register(&MockMQTT5Filter{})
+}
+
+// MockMQTT5Filter does enhanced authentication for connect packet with auth method,
+// drops publish packet of topic "drop" and records other publish packets, and drops
+// subscribe packet of topic "drop".
+type MockMQTT5Filter struct {
+	ch chan context.MQTTContext
+}
+
+type MockMQTT5FilterSpec struct{}
+
+var _ pipeline.MQTTFilter = (*MockMQTT5Filter)(nil)
+
+func (f *MockMQTT5Filter) Kind() string                                                      { return "MockMQTT5Filter" }
+func (f *MockMQTT5Filter) DefaultSpec() interface{}                                          { return &MockMQTT5FilterSpec{} }
+func (f *MockMQTT5Filter) Status() interface{}                                               { return nil }
+func (f *MockMQTT5Filter) Description() string                                               { return "mock MQTT 5.0 filter" }
+func (f *MockMQTT5Filter) Inherit(filterSpec *pipeline.FilterSpec, previous pipeline.Filter) {}
+func (f *MockMQTT5Filter) Close()                                                            {}
+func (f *MockMQTT5Filter) Results() []string                                                 { return nil }
+
+func (f *MockMQTT5Filter) Init(filterSpec *pipeline.FilterSpec) {
+	f.ch = make(chan context.MQTTContext, 100)
+}
+
+func (f *MockMQTT5Filter) HandleMQTT(ctx context.MQTTContext) *context.MQTTResult {
+	switch ctx.PacketType() {
+	case context.MQTTConnect:
+		props := ctx.Properties()
+		if props == nil || props.AuthMethod == "" {
+			return &context.MQTTResult{}
+		}
+		switch string(props.AuthData) {
+		case "":
+			ctx.SetAuthData([]byte("challenge"))
+			ctx.SetAuthContinue()
+		case "response":
+			ctx.SetAuthData([]byte("ok"))
+		default:
+			ctx.SetDisconnect()
+			ctx.SetReasonCode(packets5.ConnackBadUsernameOrPassword)
+		}
+	case context.MQTTPublish:
+		if ctx.PublishPacket().TopicName == "drop" {
+			ctx.SetDrop()
+			ctx.SetReasonCode(packets5.PubackNotAuthorized)
+			return &context.MQTTResult{}
+		}
+		f.ch <- ctx
+	case context.MQTTSubscribe:
+		if ctx.SubscribePacket().Topics[0] == "drop" {
+			ctx.SetDrop()
+			ctx.SetReasonCode(packets5.SubackNotauthorized)
+		}
+	}
+	return &context.MQTTResult{}
+}
+
+func getMQTT5Pipeline(t *testing.T, name string) (*pipeline.Pipeline, *MockMQTT5Filter) {
+	yamlStr := `
+name: %s
+kind: Pipeline
+protocol: MQTT
+filters:
+- name: mqtt5
+  kind: MockMQTT5Filter
+`
+	yamlStr = fmt.Sprintf(yamlStr, name)
+
+	super := supervisor.NewDefaultMock()
+	superSpec, err := super.NewSpec(yamlStr)
+	require.Nil(t, err)
+	pipe := &pipeline.Pipeline{}
+	pipe.Init(superSpec)
+
+	filter := pipeline.MockGetFilter(pipe, "mqtt5")
+	require.NotNil(t, filter)
+	return pipe, filter.(*MockMQTT5Filter)
+}
+
+func getMQTT5Broker() *Broker {
+	spec := getDefaultSpec()
+	spec.ReceiveMaximum = 10
+	spec.TopicAliasMaximum = 10
+	return getBrokerFromSpec(spec)
+}
+
+// readPacket5 reads MQTT 5.0 packet, publish packets resent by broker are ignored.
+func readPacket5(t *testing.T, conn net.Conn) *packets5.ControlPacket {
+	for {
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		p, err := packets5.ReadPacket(conn)
+		require.Nil(t, err)
+		if p.Type == packets5.PUBLISH && p.Flags&0x08 != 0 {
+			continue
+		}
+		return p
+	}
+}
+
+func write5(t *testing.T, conn net.Conn, p packets5.Packet) {
+	_, err := p.WriteTo(conn)
+	require.Nil(t, err)
+}
+
+func dial5(t *testing.T, cid string, props *packets5.Properties) net.Conn {
+	conn, err := net.Dial("tcp", "localhost:1883")
+	require.Nil(t, err)
+	if props == nil {
+		props = &packets5.Properties{}
+	}
+	write5(t, conn, &packets5.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 5,
+		ClientID:        cid,
+		KeepAlive:       30,
+		Properties:      props,
+	})
+	return conn
+}
+
+func connect5(t *testing.T, cid string, props *packets5.Properties) (net.Conn, *packets5.Connack) {
+	conn := dial5(t, cid, props)
+	p := readPacket5(t, conn)
+	connack, ok := p.Content.(*packets5.Connack)
+	require.True(t, ok, "expect connack, got %v", p.Content)
+	return conn, connack
+}
+
+func subscribe5(t *testing.T, conn net.Conn, topic string, qos byte) {
+	write5(t, conn, &packets5.Subscribe{
+		PacketID:      1,
+		Subscriptions: map[string]packets5.SubOptions{topic: {QoS: qos}},
+		Properties:    &packets5.Properties{},
+	})
+	suback := readPacket5(t, conn).Content.(*packets5.Suback)
+	require.Equal(t, []byte{qos}, suback.Reasons)
+}
+
+func TestMQTT5Connect(t *testing.T) {
+	assert := assert.New(t)
+	broker := getMQTT5Broker()
+
+	// client id is assigned by broker
+	conn, connack := connect5(t, "", nil)
+	assert.Equal(byte(packets5.ConnackSuccess), connack.ReasonCode)
+	assert.False(connack.SessionPresent)
+	assert.NotEmpty(connack.Properties.AssignedClientID)
+	assert.Equal(uint16(10), *connack.Properties.ReceiveMaximum)
+	assert.Equal(uint16(10), *connack.Properties.TopicAliasMaximum)
+	assert.Equal(byte(1), *connack.Properties.SharedSubAvailable)
+	assert.NotNil(broker.getClient(connack.Properties.AssignedClientID))
+	conn.Close()
+
+	// session is taken over by new connection
+	expiry := uint32(60)
+	conn, connack = connect5(t, "mqtt5", &packets5.Properties{SessionExpiryInterval: &expiry})
+	assert.False(connack.SessionPresent)
+	conn2, connack2 := connect5(t, "mqtt5", &packets5.Properties{SessionExpiryInterval: &expiry})
+	assert.True(connack2.SessionPresent)
+	disconnect := readPacket5(t, conn).Content.(*packets5.Disconnect)
+	assert.Equal(byte(packets5.DisconnectSessionTakenOver), disconnect.ReasonCode)
+	conn.Close()
+
+	// broker sends DISCONNECT when shutting down
+	broker.close()
+	disconnect = readPacket5(t, conn2).Content.(*packets5.Disconnect)
+	assert.Equal(byte(packets5.DisconnectServerShuttingDown), disconnect.ReasonCode)
+	conn2.Close()
+}
+
+func TestMQTT5Properties(t *testing.T) {
+	assert := assert.New(t)
+	broker := getMQTT5Broker()
+	defer broker.close()
+	pipe, filter := getMQTT5Pipeline(t, publishPipeline)
+	defer pipe.Close()
+
+	conn, _ := connect5(t, "mqtt5", nil)
+	defer conn.Close()
+
+	// properties and topic alias
+	alias := uint16(1)
+	write5(t, conn, &packets5.Publish{
+		Topic:   "a/b/c",
+		QoS:     1,
+		Payload: []byte("abc"),
+		Properties: &packets5.Properties{
+			TopicAlias:  &alias,
+			ContentType: "text/plain",
+			User:        []packets5.User{{Key: "k", Value: "v"}},
+		},
+		PacketID: 1,
+	})
+	ctx := <-filter.ch
+	assert.Equal("a/b/c", ctx.PublishPacket().TopicName)
+	assert.Equal("text/plain", ctx.Properties().ContentType)
+	assert.Equal([]packets5.User{{Key: "k", Value: "v"}}, ctx.Properties().User)
+	puback := readPacket5(t, conn).Content.(*packets5.Puback)
+	assert.Equal(uint16(1), puback.PacketID)
+	assert.Equal(byte(packets5.PubackSuccess), puback.ReasonCode)
+
+	write5(t, conn, &packets5.Publish{
+		QoS:        1,
+		Payload:    []byte("abcd"),
+		Properties: &packets5.Properties{TopicAlias: &alias},
+		PacketID:   2,
+	})
+	ctx = <-filter.ch
+	assert.Equal("a/b/c", ctx.PublishPacket().TopicName)
+	readPacket5(t, conn)
+
+	// reason code set by pipeline
+	write5(t, conn, &packets5.Publish{Topic: "drop", QoS: 1, PacketID: 3, Properties: &packets5.Properties{}})
+	puback = readPacket5(t, conn).Content.(*packets5.Puback)
+	assert.Equal(uint16(3), puback.PacketID)
+	assert.Equal(byte(packets5.PubackNotAuthorized), puback.ReasonCode)
+
+	// properties of message sent to client
+	subscribe5(t, conn, "x/y", QoS1)
+	props := &MessageProperties{
+		ContentType:           "application/json",
+		MessageExpiryInterval: 60,
+		CorrelationData:       []byte("123"),
+		UserProperties:        []UserProperty{{Key: "k", Value: "v"}},
+	}
+	broker.sendMsgToClient(nil, "x/y", []byte("xy"), QoS1, props)
+	publish := readPacket5(t, conn).Content.(*packets5.Publish)
+	assert.Equal("x/y", publish.Topic)
+	assert.Equal("application/json", publish.Properties.ContentType)
+	assert.Equal([]byte("123"), publish.Properties.CorrelationData)
+	assert.Equal([]packets5.User{{Key: "k", Value: "v"}}, publish.Properties.User)
+	assert.True(*publish.Properties.MessageExpiry <= 60 && *publish.Properties.MessageExpiry > 50)
+
+	// invalid topic alias
+	invalid := uint16(11)
+	write5(t, conn, &packets5.Publish{Topic: "a", Properties: &packets5.Properties{TopicAlias: &invalid}})
+	disconnect := readPacket5(t, conn).Content.(*packets5.Disconnect)
+	assert.Equal(byte(packets5.DisconnectTopicAliasInvalid), disconnect.ReasonCode)
+}
+
+func TestMQTT5ReceiveMaximum(t *testing.T) {
+	assert := assert.New(t)
+	broker := getMQTT5Broker()
+	defer broker.close()
+
+	receiveMaximum := uint16(1)
+	conn, _ := connect5(t, "mqtt5", &packets5.Properties{ReceiveMaximum: &receiveMaximum})
+	defer conn.Close()
+	subscribe5(t, conn, "a", QoS1)
+
+	for i := 0; i < 3; i++ {
+		broker.sendMsgToClient(nil, "a", []byte(fmt.Sprint(i)), QoS1, nil)
+	}
+	for i := 0; i < 3; i++ {
+		publish := readPacket5(t, conn).Content.(*packets5.Publish)
+		assert.Equal(fmt.Sprint(i), string(publish.Payload))
+
+		// next message is not sent before this one is acknowledged
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(300*time.Millisecond)))
+		for {
+			p, err := packets5.ReadPacket(conn)
+			if err != nil {
+				break
+			}
+			assert.True(p.Flags&0x08 != 0, "only resent message is expected")
+		}
+		write5(t, conn, &packets5.Puback{PacketID: publish.PacketID, Properties: &packets5.Properties{}})
+	}
+}
+
+func TestMQTT5SessionExpiry(t *testing.T) {
+	assert := assert.New(t)
+	broker := getMQTT5Broker()
+	defer broker.close()
+
+	expiry := uint32(1)
+	conn, _ := connect5(t, "mqtt5", &packets5.Properties{SessionExpiryInterval: &expiry})
+	subscribe5(t, conn, "a", QoS1)
+	write5(t, conn, &packets5.Disconnect{Properties: &packets5.Properties{}})
+	conn.Close()
+
+	sess := getStoredSession(t, broker, "mqtt5", func(info *SessionInfo) bool { return info.ExpireAt != nil })
+	sess.close()
+
+	// session is present before it expires
+	conn, connack := connect5(t, "mqtt5", &packets5.Properties{SessionExpiryInterval: &expiry})
+	assert.True(connack.SessionPresent)
+	write5(t, conn, &packets5.Disconnect{Properties: &packets5.Properties{}})
+	conn.Close()
+
+	getStoredSession(t, broker, "mqtt5", func(info *SessionInfo) bool { return info.ExpireAt != nil }).close()
+	time.Sleep(1500 * time.Millisecond)
+	conn, connack = connect5(t, "mqtt5", nil)
+	defer conn.Close()
+	assert.False(connack.SessionPresent)
+}
+
+func TestMQTT5EnhancedAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	// no connect pipeline to do enhanced authentication
+	broker := getMQTT5Broker()
+	conn, connack := connect5(t, "mqtt5", &packets5.Properties{AuthMethod: "test"})
+	assert.Equal(byte(packets5.ConnackBadAuthenticationMethod), connack.ReasonCode)
+	conn.Close()
+	broker.close()
+
+	spec := getDefaultSpec()
+	spec.Rules = append(spec.Rules, &Rule{When: &When{PacketType: Connect}, Pipeline: connectPipeline})
+	broker = getBrokerFromSpec(spec)
+	defer broker.close()
+	pipe, _ := getMQTT5Pipeline(t, connectPipeline)
+	defer pipe.Close()
+
+	for _, tc := range []struct {
+		response string
+		code     byte
+	}{
+		{response: "response", code: packets5.ConnackSuccess},
+		{response: "wrong", code: packets5.ConnackBadUsernameOrPassword},
+	} {
+		conn = dial5(t, "mqtt5", &packets5.Properties{AuthMethod: "test"})
+		auth := readPacket5(t, conn).Content.(*packets5.Auth)
+		assert.Equal(byte(packets5.AuthContinueAuthentication), auth.ReasonCode)
+		assert.Equal("challenge", string(auth.Properties.AuthData))
+
+		write5(t, conn, &packets5.Auth{
+			ReasonCode: packets5.AuthContinueAuthentication,
+			Properties: &packets5.Properties{AuthMethod: "test", AuthData: []byte(tc.response)},
+		})
+		connack = readPacket5(t, conn).Content.(*packets5.Connack)
+		assert.Equal(tc.code, connack.ReasonCode)
+		if tc.code == packets5.ConnackSuccess {
+			assert.Equal("test", connack.Properties.AuthMethod)
+			assert.Equal("ok", string(connack.Properties.AuthData))
+
+			// re-authentication
+			write5(t, conn, &packets5.Auth{
+				ReasonCode: packets5.AuthReauthenticate,
+				Properties: &packets5.Properties{AuthMethod: "test"},
+			})
+			auth = readPacket5(t, conn).Content.(*packets5.Auth)
+			assert.Equal(byte(packets5.AuthContinueAuthentication), auth.ReasonCode)
+			write5(t, conn, &packets5.Auth{
+				ReasonCode: packets5.AuthContinueAuthentication,
+				Properties: &packets5.Properties{AuthMethod: "test", AuthData: []byte("response")},
+			})
+			auth = readPacket5(t, conn).Content.(*packets5.Auth)
+			assert.Equal(byte(packets5.AuthSuccess), auth.ReasonCode)
+		}
+		conn.Close()
+	}
+}
+
+func TestSubackFailure(t *testing.T) {
+	assert := assert.New(t)
+	spec := getDefaultSpec()
+	spec.Rules = append(spec.Rules, &Rule{When: &When{PacketType: Subscribe}, Pipeline: "subscribe-pipeline"})
+	broker := getBrokerFromSpec(spec)
+	defer broker.close()
+	pipe, _ := getMQTT5Pipeline(t, "subscribe-pipeline")
+	defer pipe.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:1883")
+	require.Nil(t, err)
+	defer conn.Close()
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = "mqtt3"
+	connect.Keepalive = 30
+	require.Nil(t, connect.Write(conn))
+	p, err := packets.ReadPacket(conn)
+	require.Nil(t, err)
+	assert.Equal(byte(packets.Accepted), p.(*packets.ConnackPacket).ReturnCode)
+
+	// MQTT 3.1.1 client gets failure return codes for dropped SUBSCRIBE
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.MessageID = 1
+	subscribe.Topics = []string{"drop", "a/b"}
+	subscribe.Qoss = []byte{QoS1, QoS1}
+	require.Nil(t, subscribe.Write(conn))
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	p, err = packets.ReadPacket(conn)
+	require.Nil(t, err)
+	suback := p.(*packets.SubackPacket)
+	assert.Equal(uint16(1), suback.MessageID)
+	assert.Equal([]byte{subackFailure, subackFailure}, suback.ReturnCodes)
+
+	subscribe.MessageID = 2
+	subscribe.Topics = []string{"a/b"}
+	subscribe.Qoss = []byte{QoS1}
+	require.Nil(t, subscribe.Write(conn))
+	p, err = packets.ReadPacket(conn)
+	require.Nil(t, err)
+	assert.Equal([]byte{QoS1}, p.(*packets.SubackPacket).ReturnCodes)
+}
@@ -107,20 +107,21 @@ func getDefaultSpec() *Spec {
 
 func getBrokerFromSpec(spec *Spec) *Broker {
 	store := newStorage(nil)
-	broker := newBroker(spec, store, func(s, ss string) ([]string, error) {
-		m := map[string]string{
-			"test":  "http://localhost:8888/mqtt",
-			"test1": "http://localhost:8889/mqtt",
-		}
-		urls := []string{}
-		for k, v := range m {
-			if k != s {
-				urls = append(urls, v)
-			}
+	return newBroker(spec, store, memberURL)
+}
+
+func memberURL(egName, name string) (map[string]string, error) {
+	m := map[string]string{
+		"test":  "http://localhost:8888/mqtt",
+		"test1": "http://localhost:8889/mqtt",
+	}
+	urls := map[string]string{}
+	for k, v := range m {
+		if k != egName {
+			urls[k] = v
 		}
-		return urls, nil
-	})
-	return broker
+	}
+	return urls, nil
 }
 
 func getDefaultBroker() *Broker {
@@ -578,7 +579,7 @@ func TestSendMsgBack(t *testing.T) {
 			for j := 0; j < msgNum; j++ {
 				topic := r.ClientID()
 				text := fmt.Sprintf("sub %d", j)
-				broker.sendMsgToClient(nil, topic, []byte(text), QoS1)
+				broker.sendMsgToClient(nil, topic, []byte(text), QoS1, nil)
 			}
 		}(clients[i])
 	}
@@ -1197,40 +1198,34 @@ func TestClient(t *testing.T) {
 		t.Error("produce wrong will msg")
 	}
 
-	err := client.processPacket(connect)
+	err := client.processPacket(connect, nil)
 	if err == nil {
 		t.Errorf("double connect should return error")
 	}
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	err = client.processPacket(connack)
+	err = client.processPacket(connack, nil)
 	if err == nil {
 		t.Errorf("client should not send connack")
 	}
 
-	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
-	err = client.processPacket(pubrec)
-	if err == nil {
-		t.Errorf("qos2 not support now")
-	}
-
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
-	err = client.processPacket(suback)
+	err = client.processPacket(suback, nil)
 	if err == nil {
 		t.Errorf("server not subscribe")
 	}
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
-	err = client.processPacket(unsuback)
+	err = client.processPacket(unsuback, nil)
 	if err == nil {
 		t.Errorf("server not subscribe")
 	}
 
 	pingreq := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
-	err = client.processPacket(pingreq)
+	err = client.processPacket(pingreq, nil)
 	if err != nil {
 		t.Errorf("ping should success")
 	}
 	pingresp := packets.NewControlPacket(packets.Pingresp).(*packets.PingrespPacket)
-	err = client.processPacket(pingresp)
+	err = client.processPacket(pingresp, nil)
 	if err == nil {
 		t.Errorf("broker not ping")
 	}
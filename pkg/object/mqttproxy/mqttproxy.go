@@ -66,7 +66,10 @@ func (mp *MQTTProxy) DefaultSpec() interface{} {
 
 // Status returns the Status of MQTTProxy.
 func (mp *MQTTProxy) Status() *supervisor.Status {
-	return &supervisor.Status{}
+	if mp.broker == nil {
+		return &supervisor.Status{}
+	}
+	return &supervisor.Status{ObjectStatus: mp.broker.status()}
 }
 
 func updatePort(urlStr string, hostWithPort string) (string, error) {
@@ -86,23 +89,24 @@ func updatePort(urlStr string, hostWithPort string) (string, error) {
 	return u.String(), nil
 }
 
-func memberURLFunc(superSpec *supervisor.Spec) func(string, string) ([]string, error) {
+// memberURLFunc returns function to get urls of other members, the key of returned map is member name.
+func memberURLFunc(superSpec *supervisor.Spec) func(string, string) (map[string]string, error) {
 	c := superSpec.Super().Cluster()
 
-	f := func(egName, name string) ([]string, error) {
+	f := func(egName, name string) (map[string]string, error) {
 		logger.SpanDebugf(nil, "get member url for %v %v", egName, name)
 		kv, err := c.GetPrefix(c.Layout().StatusMemberPrefix())
 		if err != nil {
 			logger.SpanErrorf(nil, "cluster get member list failed: %v", err)
-			return []string{}, err
+			return map[string]string{}, err
 		}
-		urls := []string{}
+		urls := map[string]string{}
 		for _, v := range kv {
 			memberStatus := cluster.MemberStatus{}
 			err := yaml.Unmarshal([]byte(v), &memberStatus)
 			if err != nil {
 				logger.SpanErrorf(nil, "cluster status unmarshal failed: %v", err)
-				return []string{}, err
+				return map[string]string{}, err
 			}
 			if memberStatus.Options.Name != egName {
 				egURLs := memberStatus.Options.ClusterInitialAdvertisePeerURLs
@@ -120,7 +124,7 @@ func memberURLFunc(superSpec *supervisor.Spec) func(string, string) ([]string, e
 				if err != nil {
 					return nil, fmt.Errorf("get url for %v failed: %v", memberStatus.Options.Name, err)
 				}
-				urls = append(urls, newURL+"/apis/v1"+fmt.Sprintf(mqttAPITopicPublishPrefix, name))
+				urls[memberStatus.Options.Name] = newURL + "/apis/v1" + fmt.Sprintf(mqttAPITopicPublishPrefix, name)
 			}
 		}
 		logger.SpanDebugf(nil, "eg %v %v get urls %v", egName, name, urls)
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQoS2(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := getDefaultBroker()
+	defer broker.close()
+
+	pipe, backend := getPublishPipeline(t)
+	defer pipe.Close()
+
+	ch := make(chan CheckMsg, 10)
+	client := getMQTTClient(t, "test", "test", "test", false)
+	token := client.Subscribe("qos2", 2, getMQTTSubscribeHandler(ch))
+	require.True(t, token.WaitTimeout(time.Second))
+	require.Nil(t, token.Error())
+
+	for i := 0; i < 5; i++ {
+		text := fmt.Sprintf("qos2 msg #%d!", i)
+		token := client.Publish("go-mqtt/sample", 2, false, text)
+		token.Wait()
+		assert.Nil(token.Error())
+		p := backend.get()
+		assert.Equal(text, string(p.Payload))
+	}
+
+	for i := 0; i < 5; i++ {
+		text := fmt.Sprintf("qos2 msg back #%d!", i)
+		broker.sendMsgToClient(nil, "qos2", []byte(text), QoS2, nil)
+		msg := <-ch
+		assert.Equal(CheckMsg{topic: "qos2", payload: text, qos: 2}, msg)
+	}
+
+	// all messages are completed
+	sess := broker.sessMgr.get("test")
+	for i := 0; i < 20; i++ {
+		sess.Lock()
+		done := len(sess.info.InFlight) == 0 && len(sess.info.Received) == 0
+		sess.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	sess.Lock()
+	assert.Empty(sess.info.InFlight)
+	assert.Empty(sess.info.Received)
+	sess.Unlock()
+	client.Disconnect(200)
+}
+
+func readPackets(conn net.Conn) <-chan packets.ControlPacket {
+	ch := make(chan packets.ControlPacket, 100)
+	go func() {
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				close(ch)
+				return
+			}
+			// ignore messages resent in background
+			if publish, ok := p.(*packets.PublishPacket); ok && publish.Dup {
+				continue
+			}
+			ch <- p
+		}
+	}()
+	return ch
+}
+
+func getStoredSession(t *testing.T, broker *Broker, cid string, check func(*SessionInfo) bool) *Session {
+	for i := 0; i < 20; i++ {
+		str, err := broker.sessMgr.store.get(sessionStoreKey(cid))
+		if err == nil {
+			sess := broker.sessMgr.newSessionFromYaml(str)
+			if check(sess.info) {
+				return sess
+			}
+			sess.close()
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("session %v not stored", cid)
+	return nil
+}
+
+func TestQoS2Session(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := getDefaultBroker()
+	defer broker.close()
+
+	pipe, backend := getPublishPipeline(t)
+	defer pipe.Close()
+
+	svcConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ClientIdentifier = "qos2"
+	client := newClient(connect, broker, svcConn, nil)
+	broker.Lock()
+	broker.clients[client.info.cid] = client
+	broker.setSession(client, connect)
+	broker.Unlock()
+	go client.writeLoop()
+	recv := readPackets(clientConn)
+
+	// publish from client is delivered once
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.Qos = QoS2
+	publish.TopicName = "billing"
+	publish.Payload = []byte("1 dollar")
+	publish.MessageID = 10
+	for i := 0; i < 2; i++ {
+		assert.Nil(client.processPacket(publish, nil))
+		pubrec := (<-recv).(*packets.PubrecPacket)
+		assert.Equal(uint16(10), pubrec.MessageID)
+		publish.Dup = true
+	}
+	// the packet id is persisted before pubrec is sent
+	str, err := broker.sessMgr.store.get(sessionStoreKey("qos2"))
+	require.Nil(t, err)
+	stored := broker.sessMgr.newSessionFromYaml(str)
+	assert.True(stored.info.Received[10])
+	stored.close()
+	assert.Equal("1 dollar", string(backend.get().Payload))
+	select {
+	case <-backend.ch:
+		t.Errorf("duplicate qos2 message should not be delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.True(client.session.received(10))
+
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 10
+	assert.Nil(client.processPacket(pubrel, nil))
+	pubcomp := (<-recv).(*packets.PubcompPacket)
+	assert.Equal(uint16(10), pubcomp.MessageID)
+	assert.False(client.session.received(10))
+
+	// publish to client is persisted until completed
+	client.session.publish(nil, "billing", []byte("2 dollars"), QoS2, nil)
+	p := (<-recv).(*packets.PublishPacket)
+	assert.Equal(QoS2, p.Qos)
+	assert.NotEqual(uint16(0), p.MessageID)
+	sess := getStoredSession(t, broker, "qos2", func(info *SessionInfo) bool {
+		return len(info.InFlight) == 1
+	})
+	assert.Equal(p.MessageID, sess.info.InFlight[0].ID)
+	assert.False(sess.info.InFlight[0].Released)
+	sess.close()
+
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = p.MessageID
+	assert.Nil(client.processPacket(pubrec, nil))
+	pubrel = (<-recv).(*packets.PubrelPacket)
+	assert.Equal(p.MessageID, pubrel.MessageID)
+
+	// session restored after reconnect resends pubrel but not publish
+	sess = getStoredSession(t, broker, "qos2", func(info *SessionInfo) bool {
+		return len(info.InFlight) == 1 && info.InFlight[0].Released
+	})
+	sess.doResend()
+	sess.close()
+	pubrel = (<-recv).(*packets.PubrelPacket)
+	assert.Equal(p.MessageID, pubrel.MessageID)
+
+	// restored session does not reuse ids of in-flight messages
+	sess = getStoredSession(t, broker, "qos2", func(info *SessionInfo) bool { return true })
+	next := sess.getPacketFromMsg("billing", nil, QoS2)
+	assert.NotEqual(p.MessageID, next.MessageID)
+	sess.close()
+
+	pubcomp = packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = p.MessageID
+	assert.Nil(client.processPacket(pubcomp, nil))
+	getStoredSession(t, broker, "qos2", func(info *SessionInfo) bool {
+		return len(info.InFlight) == 0
+	}).close()
+	client.close()
+
+	// seq of deleted session is forgotten
+	broker.sessMgr.delDB("qos2")
+	broker.sessMgr.storeMu.Lock()
+	assert.NotContains(broker.sessMgr.latest, "qos2")
+	broker.sessMgr.storeMu.Unlock()
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// RetainedMessage is the retained message of a topic, which is sent to
+	// clients when they subscribe the topic.
+	RetainedMessage struct {
+		Topic      string     `yaml:"topic" json:"topic"`
+		B64Payload string     `yaml:"b64Payload" json:"b64Payload"`
+		QoS        int        `yaml:"qos" json:"qos"`
+		ExpireAt   *time.Time `yaml:"expireAt,omitempty" json:"expireAt,omitempty"`
+		// Properties is MQTT 5.0 properties of the message
+		Properties *MessageProperties `yaml:"properties,omitempty" json:"properties,omitempty"`
+	}
+
+	// RetainManager manages retained messages in storage, retained messages
+	// are shared by all members of the cluster.
+	RetainManager struct {
+		name            string
+		store           storage
+		ttl             time.Duration
+		maxPayloadBytes int
+		maxMessages     int
+
+		// messages is the in-memory index of retained messages, which maps
+		// topic to message. It is synced from storage, and updated by this
+		// member at once so that its own messages are visible immediately.
+		mu        sync.RWMutex
+		messages  map[string]*RetainedMessage
+		closeFunc func()
+	}
+)
+
+func newRetainManager(name string, store storage, spec *Retain) *RetainManager {
+	rm := &RetainManager{
+		name:     name,
+		store:    store,
+		messages: make(map[string]*RetainedMessage),
+	}
+	if spec != nil {
+		if spec.TTL != "" {
+			ttl, err := time.ParseDuration(spec.TTL)
+			if err != nil {
+				logger.Errorf("BUG: parse duration %s failed: %v", spec.TTL, err)
+			}
+			rm.ttl = ttl
+		}
+		rm.maxPayloadBytes = spec.MaxPayloadBytes
+		rm.maxMessages = spec.MaxMessages
+	}
+
+	ch, closeFunc, err := store.syncPrefix(retainStoreKey(name, ""))
+	if err != nil {
+		logger.SpanErrorf(nil, "sync retained messages of %v failed: %v", name, err)
+		return rm
+	}
+	rm.closeFunc = closeFunc
+	go rm.sync(ch)
+	return rm
+}
+
+func (rm *RetainManager) sync(ch <-chan map[string]string) {
+	for kvs := range ch {
+		messages := make(map[string]*RetainedMessage, len(kvs))
+		for k, v := range kvs {
+			msg := &RetainedMessage{}
+			if err := yaml.Unmarshal([]byte(v), msg); err != nil {
+				logger.SpanErrorf(nil, "unmarshal retained message %v failed: %v", k, err)
+				continue
+			}
+			messages[msg.Topic] = msg
+		}
+		rm.mu.Lock()
+		rm.messages = messages
+		rm.mu.Unlock()
+	}
+}
+
+func (rm *RetainManager) close() {
+	if rm.closeFunc != nil {
+		rm.closeFunc()
+	}
+}
+
+func (rm *RetainManager) delete(topic string) error {
+	if err := rm.store.delete(retainStoreKey(rm.name, topic)); err != nil {
+		return err
+	}
+	rm.mu.Lock()
+	delete(rm.messages, topic)
+	rm.mu.Unlock()
+	return nil
+}
+
+func (msg *RetainedMessage) expired(now time.Time) bool {
+	return msg.ExpireAt != nil && now.After(*msg.ExpireAt)
+}
+
+func (msg *RetainedMessage) payload() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(msg.B64Payload)
+}
+
+// retain stores the message as the retained message of the topic, an empty
+// payload clears the retained message of the topic. The message expires after
+// ttl of retain spec or message expiry interval of MQTT 5.0, whichever is shorter.
+func (rm *RetainManager) retain(topic string, payload []byte, qos byte, props *MessageProperties) error {
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("topic %v of retained message contains wildcard", topic)
+	}
+	if len(payload) == 0 {
+		return rm.delete(topic)
+	}
+
+	if rm.maxPayloadBytes > 0 && len(payload) > rm.maxPayloadBytes {
+		return fmt.Errorf("payload of retained message of topic %v exceeds %d bytes", topic, rm.maxPayloadBytes)
+	}
+	if rm.maxMessages > 0 {
+		// NOTE: The check is best-effort, the index may lag behind messages
+		// retained by other members at the same time.
+		rm.mu.RLock()
+		_, exists := rm.messages[topic]
+		count := len(rm.messages)
+		rm.mu.RUnlock()
+		if !exists && count >= rm.maxMessages {
+			return fmt.Errorf("retained messages exceed %d", rm.maxMessages)
+		}
+	}
+
+	msg := &RetainedMessage{
+		Topic:      topic,
+		B64Payload: base64.StdEncoding.EncodeToString(payload),
+		QoS:        int(qos),
+		Properties: props,
+	}
+	if rm.ttl > 0 {
+		expireAt := time.Now().Add(rm.ttl)
+		msg.ExpireAt = &expireAt
+	}
+	if expireAt := props.expireAt(); expireAt != nil {
+		if msg.ExpireAt == nil || expireAt.Before(*msg.ExpireAt) {
+			msg.ExpireAt = expireAt
+		}
+	}
+	b, err := yaml.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := rm.store.put(retainStoreKey(rm.name, topic), string(b)); err != nil {
+		return err
+	}
+	rm.mu.Lock()
+	rm.messages[topic] = msg
+	rm.mu.Unlock()
+	return nil
+}
+
+// all returns all retained messages not expired, sorted by topic.
+func (rm *RetainManager) all() ([]*RetainedMessage, error) {
+	now := time.Now()
+	var expired []string
+
+	rm.mu.RLock()
+	msgs := make([]*RetainedMessage, 0, len(rm.messages))
+	for topic, msg := range rm.messages {
+		if msg.expired(now) {
+			expired = append(expired, topic)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	rm.mu.RUnlock()
+
+	for _, topic := range expired {
+		if err := rm.delete(topic); err != nil {
+			logger.SpanErrorf(nil, "delete expired retained message %v failed: %v", topic, err)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	return msgs, nil
+}
+
+// match returns retained messages whose topics match the topic filters, and the qos
+// used to send every message, which is the smaller one of the message qos and the
+// max qos of matched filters.
+func (rm *RetainManager) match(filters []string, qoss []byte) ([]*RetainedMessage, []byte, error) {
+	msgs, err := rm.all()
+	if err != nil || len(msgs) == 0 {
+		return nil, nil, err
+	}
+
+	// use filter index as client id, so we can find which filters match a topic
+	mgr := newTopicManager(len(filters) + 1)
+	for i, f := range filters {
+		if err := mgr.subscribe([]string{f}, []byte{qoss[i]}, strconv.Itoa(i)); err != nil {
+			logger.SpanErrorf(nil, "invalid topic filter %v: %v", f, err)
+		}
+	}
+
+	var matched []*RetainedMessage
+	var matchedQoS []byte
+	for _, msg := range msgs {
+		subscribers, err := mgr.findSubscribers(msg.Topic)
+		if err != nil || len(subscribers) == 0 {
+			continue
+		}
+		qos := QoS0
+		for _, q := range subscribers {
+			if q > qos {
+				qos = q
+			}
+		}
+		if byte(msg.QoS) < qos {
+			qos = byte(msg.QoS)
+		}
+		matched = append(matched, msg)
+		matchedQoS = append(matchedQoS, qos)
+	}
+	return matched, matchedQoS, nil
+}
+
+// clear deletes retained messages whose topics match the topic filters.
+func (rm *RetainManager) clear(filters []string) error {
+	qoss := make([]byte, len(filters))
+	msgs, _, err := rm.match(filters, qoss)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := rm.delete(msg.Topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetainManager(t *testing.T) {
+	assert := assert.New(t)
+
+	rm := newRetainManager("test", newStorage(nil), &Retain{MaxPayloadBytes: 5, MaxMessages: 2})
+	assert.Nil(rm.retain("a/b/c", []byte("abc"), QoS1, nil))
+	assert.Nil(rm.retain("a/b/c", []byte("abcd"), QoS2, nil))
+	assert.NotNil(rm.retain("a/b/d", []byte("abcdef"), QoS1, nil))
+	assert.NotNil(rm.retain("a/+/d", []byte("abc"), QoS1, nil))
+	assert.Nil(rm.retain("x/y", []byte("xy"), QoS0, nil))
+	assert.NotNil(rm.retain("x/z", []byte("xz"), QoS0, nil))
+
+	msgs, err := rm.all()
+	assert.Nil(err)
+	assert.Len(msgs, 2)
+	assert.Equal("a/b/c", msgs[0].Topic)
+	payload, _ := msgs[0].payload()
+	assert.Equal("abcd", string(payload))
+
+	msgs, qoss, err := rm.match([]string{"a/#", "a/+/c", "x"}, []byte{QoS1, QoS0, QoS2})
+	assert.Nil(err)
+	assert.Len(msgs, 1)
+	assert.Equal("a/b/c", msgs[0].Topic)
+	assert.Equal([]byte{QoS1}, qoss)
+
+	msgs, _, err = rm.match([]string{"#"}, []byte{QoS2})
+	assert.Nil(err)
+	assert.Len(msgs, 2)
+
+	// empty payload clears retained message
+	assert.Nil(rm.retain("x/y", nil, QoS0, nil))
+	msgs, _ = rm.all()
+	assert.Len(msgs, 1)
+
+	assert.Nil(rm.clear([]string{"a/+/c"}))
+	msgs, _ = rm.all()
+	assert.Len(msgs, 0)
+
+	// expired messages are not returned
+	rm.close()
+	rm = newRetainManager("test", newStorage(nil), &Retain{TTL: "50ms"})
+	assert.Nil(rm.retain("a", []byte("a"), QoS0, nil))
+	msgs, _ = rm.all()
+	assert.Len(msgs, 1)
+	time.Sleep(100 * time.Millisecond)
+	msgs, _ = rm.all()
+	assert.Len(msgs, 0)
+	rm.close()
+}
+
+func TestRetainManagerSync(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStorage(nil)
+	rm := newRetainManager("test", store, &Retain{MaxMessages: 1})
+	defer rm.close()
+
+	// messages retained by other members are synced from storage
+	other := newRetainManager("test", store, nil)
+	defer other.close()
+	assert.Nil(other.retain("a/b", []byte("ab"), QoS1, nil))
+	for i := 0; i < 20; i++ {
+		if msgs, _ := rm.all(); len(msgs) == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	msgs, qoss, err := rm.match([]string{"a/+"}, []byte{QoS2})
+	assert.Nil(err)
+	assert.Len(msgs, 1)
+	assert.Equal([]byte{QoS1}, qoss)
+	assert.NotNil(rm.retain("c", []byte("c"), QoS0, nil))
+	assert.Nil(rm.retain("a/b", []byte("new"), QoS0, nil))
+
+	assert.Nil(store.delete(retainStoreKey("test", "a/b")))
+	for i := 0; i < 20; i++ {
+		if msgs, _ := rm.all(); len(msgs) == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	msgs, _ = rm.all()
+	assert.Len(msgs, 0)
+}
+
+func TestRetainedMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := getDefaultBroker()
+	defer broker.close()
+
+	pipe, backend := getPublishPipeline(t)
+	defer pipe.Close()
+
+	pub := getMQTTClient(t, "pub", "test", "test", true)
+	defer pub.Disconnect(200)
+	token := pub.Publish("sensors/1/temp", 1, true, "23")
+	token.Wait()
+	assert.Nil(token.Error())
+	backend.get()
+
+	data := HTTPJsonData{Topic: "sensors/2/temp", QoS: 1, Payload: "25", Retain: true, Distributed: true}
+	b, _ := json.Marshal(data)
+	w := httptest.NewRecorder()
+	broker.httpTopicsPublishHandler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b)))
+	assert.Equal(http.StatusOK, w.Code)
+	// distributed message is stored by the member receiving it first
+	msgs, _ := broker.retainMgr.all()
+	assert.Len(msgs, 1)
+
+	data.Distributed = false
+	b, _ = json.Marshal(data)
+	w = httptest.NewRecorder()
+	broker.httpTopicsPublishHandler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b)))
+	assert.Equal(http.StatusOK, w.Code)
+
+	ch := make(chan paho.Message, 10)
+	sub := getMQTTClient(t, "sub", "test", "test", true)
+	defer sub.Disconnect(200)
+	token = sub.Subscribe("sensors/+/temp", 1, func(c paho.Client, m paho.Message) {
+		ch <- m
+	})
+	token.Wait()
+	require.Nil(t, token.Error())
+
+	for _, want := range []string{"23", "25"} {
+		select {
+		case m := <-ch:
+			assert.True(m.Retained())
+			assert.Equal(want, string(m.Payload()))
+		case <-time.After(time.Second):
+			t.Fatalf("retained message not received")
+		}
+	}
+
+	// get and delete retained messages by http api
+	w = httptest.NewRecorder()
+	broker.httpGetAllRetainedHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	res := HTTPRetainedMessages{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Len(res.Messages, 2)
+
+	b, _ = json.Marshal(HTTPRetainedMessages{Topics: []string{"sensors/1/#"}})
+	w = httptest.NewRecorder()
+	broker.httpDeleteRetainedHandler(w, httptest.NewRequest(http.MethodDelete, "/", bytes.NewReader(b)))
+	assert.Equal(http.StatusOK, w.Code)
+	msgs, _ = broker.retainMgr.all()
+	assert.Len(msgs, 1)
+	assert.Equal("sensors/2/temp", msgs[0].Topic)
+
+	w = httptest.NewRecorder()
+	broker.httpDeleteRetainedHandler(w, httptest.NewRequest(http.MethodDelete, "/", bytes.NewReader([]byte("{}"))))
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
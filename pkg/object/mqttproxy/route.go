@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+// memberDeadTimeout is how long a member is considered dead since its last heartbeat,
+// routes of dead members are dropped, since route keys are not removed when members crash.
+const memberDeadTimeout = 3 * cluster.HeartbeatInterval
+
+type (
+	// RouteManager manages routes from topic filters to members of the cluster. A member
+	// has the route of a topic filter when any client connected to it subscribes the filter,
+	// routes are stored in storage, and every member syncs routes of other members.
+	RouteManager struct {
+		egName string
+		name   string
+		store  storage
+
+		mu sync.Mutex
+		// local is topic filters subscribed by clients of this member
+		local map[string]map[string]struct{}
+
+		// routes is a *TopicManager that uses member name as client id, it is
+		// built from kvs, which is synced routes, and heartbeats of members
+		routes         atomic.Value
+		routeCount     uint64
+		topicCacheSize int
+		closeFuncs     []func()
+
+		syncMu     sync.Mutex
+		kvs        map[string]string
+		heartbeats map[string]time.Time
+	}
+
+	// RouteStats is the statistics of messages forwarded between members.
+	RouteStats struct {
+		Routes            uint64 `yaml:"routes"`
+		ForwardedMessages uint64 `yaml:"forwardedMessages"`
+		ForwardedBytes    uint64 `yaml:"forwardedBytes"`
+		ForwardFailed     uint64 `yaml:"forwardFailed"`
+		ReceivedMessages  uint64 `yaml:"receivedMessages"`
+		ReceivedBytes     uint64 `yaml:"receivedBytes"`
+	}
+)
+
+func newRouteManager(egName, name string, store storage, topicCacheSize int) *RouteManager {
+	rm := &RouteManager{
+		egName:         egName,
+		name:           name,
+		store:          store,
+		local:          make(map[string]map[string]struct{}),
+		topicCacheSize: topicCacheSize,
+	}
+	rm.routes.Store(newTopicManager(topicCacheSize))
+
+	// routes of this member left by previous run are useless, since no client connects now
+	rm.deleteAll()
+
+	ch, closeFunc, err := store.syncPrefix(routeStoreKey(name, "", ""))
+	if err != nil {
+		logger.SpanErrorf(nil, "sync routes of %v failed: %v", name, err)
+		return rm
+	}
+	rm.closeFuncs = append(rm.closeFuncs, closeFunc)
+	go rm.sync(ch)
+
+	statusCh, closeFunc, err := store.syncPrefix(memberStatusPrefix)
+	if err != nil {
+		logger.SpanErrorf(nil, "sync member status failed: %v", err)
+		return rm
+	}
+	rm.closeFuncs = append(rm.closeFuncs, closeFunc)
+	go rm.syncMembers(statusCh)
+	return rm
+}
+
+func (rm *RouteManager) sync(ch <-chan map[string]string) {
+	for kvs := range ch {
+		rm.syncMu.Lock()
+		rm.kvs = kvs
+		rm.build()
+		rm.syncMu.Unlock()
+	}
+}
+
+// syncMembers syncs heartbeats of members, members update their status every
+// heartbeat interval, so routes are rebuilt and routes of dead members are dropped.
+func (rm *RouteManager) syncMembers(ch <-chan map[string]string) {
+	for kvs := range ch {
+		heartbeats := make(map[string]time.Time, len(kvs))
+		for k, v := range kvs {
+			status := cluster.MemberStatus{}
+			if err := yaml.Unmarshal([]byte(v), &status); err != nil {
+				logger.SpanErrorf(nil, "unmarshal member status %v failed: %v", k, err)
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, status.LastHeartbeatTime)
+			if err != nil {
+				logger.SpanErrorf(nil, "parse last heartbeat time %v of member %v failed: %v",
+					status.LastHeartbeatTime, status.Options.Name, err)
+				continue
+			}
+			heartbeats[status.Options.Name] = t
+		}
+		rm.syncMu.Lock()
+		rm.heartbeats = heartbeats
+		rm.build()
+		rm.syncMu.Unlock()
+	}
+}
+
+// alive reports whether the member is alive. Members are considered alive if no
+// member status is synced, it must be called with syncMu held.
+func (rm *RouteManager) alive(member string, now time.Time) bool {
+	if len(rm.heartbeats) == 0 {
+		return true
+	}
+	t, ok := rm.heartbeats[member]
+	return ok && now.Sub(t) < memberDeadTimeout
+}
+
+// build builds routes of other alive members, it must be called with syncMu held.
+func (rm *RouteManager) build() {
+	now := time.Now()
+	routes := newTopicManager(rm.topicCacheSize)
+	count := uint64(0)
+	for k := range rm.kvs {
+		member, topic, err := rm.parseKey(k)
+		if err != nil {
+			logger.SpanErrorf(nil, "invalid route key %v: %v", k, err)
+			continue
+		}
+		if member == rm.egName || !rm.alive(member, now) {
+			continue
+		}
+		if err := routes.subscribe([]string{topic}, []byte{QoS0}, member); err != nil {
+			logger.SpanErrorf(nil, "invalid route %v of member %v: %v", topic, member, err)
+			continue
+		}
+		count++
+	}
+	rm.routes.Store(routes)
+	atomic.StoreUint64(&rm.routeCount, count)
+}
+
+// subscribe adds routes of topics subscribed by the client, shared subscriptions
+// are managed by SharedManager, so they are ignored.
+func (rm *RouteManager) subscribe(topics []string, clientID string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for _, t := range topics {
+		if strings.HasPrefix(t, sharedTopicPrefix) {
+			continue
+		}
+		clients, ok := rm.local[t]
+		if !ok {
+			clients = make(map[string]struct{})
+			rm.local[t] = clients
+		}
+		if len(clients) == 0 {
+			if err := rm.store.put(routeStoreKey(rm.name, rm.egName, t), rm.egName); err != nil {
+				return err
+			}
+		}
+		clients[clientID] = struct{}{}
+	}
+	return nil
+}
+
+// unsubscribe deletes routes of topics that no client of this member subscribes.
+func (rm *RouteManager) unsubscribe(topics []string, clientID string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for _, t := range topics {
+		clients, ok := rm.local[t]
+		if !ok {
+			continue
+		}
+		delete(clients, clientID)
+		if len(clients) > 0 {
+			continue
+		}
+		delete(rm.local, t)
+		if err := rm.store.delete(routeStoreKey(rm.name, rm.egName, t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// members returns other members that have clients subscribing the topic.
+func (rm *RouteManager) members(topic string) (map[string]struct{}, error) {
+	routes := rm.routes.Load().(*TopicManager)
+	subscribers, err := routes.findSubscribers(topic)
+	if err != nil {
+		return nil, err
+	}
+	ans := make(map[string]struct{}, len(subscribers))
+	for member := range subscribers {
+		ans[member] = struct{}{}
+	}
+	return ans, nil
+}
+
+func (rm *RouteManager) count() uint64 {
+	return atomic.LoadUint64(&rm.routeCount)
+}
+
+func (rm *RouteManager) parseKey(key string) (string, string, error) {
+	s := strings.Split(strings.TrimPrefix(key, routeStoreKey(rm.name, "", "")), "/")
+	if len(s) != 2 {
+		return "", "", fmt.Errorf("invalid format")
+	}
+	member, err := url.QueryUnescape(s[0])
+	if err != nil {
+		return "", "", err
+	}
+	topic, err := url.QueryUnescape(s[1])
+	if err != nil {
+		return "", "", err
+	}
+	return member, topic, nil
+}
+
+func (rm *RouteManager) deleteAll() {
+	keys, err := rm.store.getPrefix(routeStoreKey(rm.name, rm.egName, ""), true)
+	if err != nil {
+		logger.SpanErrorf(nil, "get routes of %v failed: %v", rm.egName, err)
+		return
+	}
+	for k := range keys {
+		if err := rm.store.delete(k); err != nil {
+			logger.SpanErrorf(nil, "delete route %v failed: %v", k, err)
+		}
+	}
+}
+
+func (rm *RouteManager) close() {
+	for _, closeFunc := range rm.closeFuncs {
+		closeFunc()
+	}
+	rm.mu.Lock()
+	rm.local = make(map[string]map[string]struct{})
+	rm.mu.Unlock()
+	rm.deleteAll()
+}
+
+// Load returns a snapshot of the stats.
+func (s *RouteStats) Load() RouteStats {
+	return RouteStats{
+		Routes:            atomic.LoadUint64(&s.Routes),
+		ForwardedMessages: atomic.LoadUint64(&s.ForwardedMessages),
+		ForwardedBytes:    atomic.LoadUint64(&s.ForwardedBytes),
+		ForwardFailed:     atomic.LoadUint64(&s.ForwardFailed),
+		ReceivedMessages:  atomic.LoadUint64(&s.ReceivedMessages),
+		ReceivedBytes:     atomic.LoadUint64(&s.ReceivedBytes),
+	}
+}
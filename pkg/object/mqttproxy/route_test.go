@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/cluster"
+)
+
+func TestRouteManager(t *testing.T) {
+	assert := assert.New(t)
+	store := newStorage(nil)
+
+	// stale routes of previous run are deleted
+	store.put(routeStoreKey("test", "eg0", "stale"), "eg0")
+	rm0 := newRouteManager("eg0", "test", store, 100)
+	defer rm0.close()
+	rm1 := newRouteManager("eg1", "test", store, 100)
+	defer rm1.close()
+	_, err := store.get(routeStoreKey("test", "eg0", "stale"))
+	assert.NotNil(err)
+
+	assert.Nil(rm1.subscribe([]string{"a/+", "$share/g/b"}, "c1"))
+	assert.Nil(rm1.subscribe([]string{"a/+"}, "c2"))
+	keys, _ := store.getPrefix(routeStoreKey("test", "", ""), true)
+	assert.Len(keys, 1)
+
+	members := func(topic string) map[string]struct{} {
+		ans, err := rm0.members(topic)
+		assert.Nil(err)
+		return ans
+	}
+	assert.Eventually(func() bool { return len(members("a/b")) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(map[string]struct{}{"eg1": {}}, members("a/b"))
+	assert.Empty(members("b"))
+	assert.Equal(uint64(1), rm0.count())
+	// routes of member itself are not included
+	ans, _ := rm1.members("a/b")
+	assert.Empty(ans)
+
+	// route is kept until no client subscribes the topic
+	assert.Nil(rm1.unsubscribe([]string{"a/+"}, "c1"))
+	keys, _ = store.getPrefix(routeStoreKey("test", "", ""), true)
+	assert.Len(keys, 1)
+	assert.Nil(rm1.unsubscribe([]string{"a/+"}, "c2"))
+	assert.Eventually(func() bool { return len(members("a/b")) == 0 }, time.Second, 10*time.Millisecond)
+
+	assert.Nil(rm1.subscribe([]string{"x/#"}, "c1"))
+	rm1.close()
+	keys, _ = store.getPrefix(routeStoreKey("test", "", ""), true)
+	assert.Empty(keys)
+}
+
+func TestRouteManagerDeadMember(t *testing.T) {
+	assert := assert.New(t)
+	store := newStorage(nil)
+
+	putStatus := func(member string, heartbeat time.Time) {
+		status := cluster.MemberStatus{LastHeartbeatTime: heartbeat.Format(time.RFC3339)}
+		status.Options.Name = member
+		b, _ := yaml.Marshal(status)
+		store.put(memberStatusPrefix+member, string(b))
+	}
+	putStatus("eg0", time.Now())
+	putStatus("eg1", time.Now())
+	putStatus("eg2", time.Now().Add(-time.Hour))
+
+	rm := newRouteManager("eg0", "test", store, 100)
+	defer rm.close()
+	// routes of crashed members are left in storage
+	store.put(routeStoreKey("test", "eg1", "a/+"), "eg1")
+	store.put(routeStoreKey("test", "eg2", "a/+"), "eg2")
+	store.put(routeStoreKey("test", "eg3", "a/+"), "eg3")
+
+	members := func() map[string]struct{} {
+		ans, err := rm.members("a/b")
+		assert.Nil(err)
+		return ans
+	}
+	assert.Eventually(func() bool { return len(members()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(map[string]struct{}{"eg1": {}}, members())
+
+	// routes of member are dropped when its heartbeat stops, and restored when it recovers
+	putStatus("eg1", time.Now().Add(-time.Hour))
+	assert.Eventually(func() bool { return len(members()) == 0 }, time.Second, 10*time.Millisecond)
+	putStatus("eg2", time.Now())
+	assert.Eventually(func() bool { return len(members()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(map[string]struct{}{"eg2": {}}, members())
+}
+
+func TestDeviceToDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStorage(nil)
+	spec0 := getDefaultSpec()
+	spec0.Rules = nil
+	spec0.DeviceToDevice = true
+	broker0 := newBroker(spec0, store, memberURL)
+	spec1 := getDefaultSpec()
+	spec1.Rules = nil
+	spec1.DeviceToDevice = true
+	spec1.EGName = "test1"
+	spec1.Port = 1884
+	broker1 := newBroker(spec1, store, memberURL)
+
+	srv0 := newServer(":8888")
+	srv0.addHandlerFunc("/mqtt", broker0.httpTopicsPublishHandler)
+	srv0.start()
+	srv1 := newServer(":8889")
+	srv1.addHandlerFunc("/mqtt", broker1.httpTopicsPublishHandler)
+	srv1.start()
+
+	var mu sync.Mutex
+	received := map[string][]string{}
+	connect := func(port int, clientID string) paho.Client {
+		opts := paho.NewClientOptions().AddBroker(fmt.Sprintf("tcp://0.0.0.0:%d", port)).SetClientID(clientID).SetUsername("test").SetPassword("test")
+		c := paho.NewClient(opts)
+		token := c.Connect()
+		token.Wait()
+		require.Nil(t, token.Error())
+		return c
+	}
+	subscribe := func(c paho.Client, clientID, topic string) {
+		token := c.Subscribe(topic, 1, func(_ paho.Client, m paho.Message) {
+			mu.Lock()
+			received[clientID] = append(received[clientID], string(m.Payload()))
+			mu.Unlock()
+		})
+		token.Wait()
+		require.Nil(t, token.Error())
+	}
+	local := connect(1883, "local")
+	subscribe(local, "local", "d2d/#")
+	remote := connect(1884, "remote")
+	subscribe(remote, "remote", "d2d/+")
+	shared := connect(1884, "shared")
+	subscribe(shared, "shared", "$share/g/d2d/+")
+	unrelated := connect(1884, "unrelated")
+	subscribe(unrelated, "unrelated", "other")
+
+	assert.Eventually(func() bool {
+		members, _ := broker0.routeMgr.members("d2d/1")
+		return len(members) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	pub := connect(1883, "pub")
+	token := pub.Publish("d2d/1", 1, false, "hello")
+	token.Wait()
+	require.Nil(t, token.Error())
+
+	want := map[string][]string{"local": {"hello"}, "remote": {"hello"}, "shared": {"hello"}}
+	assert.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return reflect.DeepEqual(want, received)
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// message is forwarded once to the member, and not forwarded again
+	stats0 := broker0.status().RouteStats
+	assert.Equal(uint64(1), stats0.ForwardedMessages)
+	assert.Equal(uint64(0), stats0.ForwardFailed)
+	assert.Equal(uint64(2), stats0.Routes)
+	stats1 := broker1.status().RouteStats
+	assert.Equal(uint64(1), stats1.ReceivedMessages)
+	assert.Equal(uint64(0), stats1.ForwardedMessages)
+
+	for _, c := range []paho.Client{local, remote, shared, unrelated, pub} {
+		c.Disconnect(200)
+	}
+	broker0.close()
+	broker1.close()
+	srv0.shutdown()
+	srv1.shutdown()
+}
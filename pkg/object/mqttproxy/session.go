@@ -20,6 +20,7 @@ package mqttproxy
 import (
 	"encoding/base64"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -29,6 +30,10 @@ import (
 	"github.com/openzipkin/zipkin-go/model"
 )
 
+// sessionStoreSeq is increased for every session store, stores of same session
+// are sent to storage concurrently and the stale ones are dropped by it.
+var sessionStoreSeq uint64
+
 type (
 	// SessionInfo is info about session that will be put into etcd for persistency
 	SessionInfo struct {
@@ -38,6 +43,13 @@ type (
 		Topics    map[string]int `yaml:"topics"`
 		ClientID  string         `yaml:"clientID"`
 		CleanFlag bool           `yaml:"cleanFlag"`
+
+		// InFlight is QoS2 messages sent to client but not completed, in the order of sending
+		InFlight []*Message `yaml:"inFlight,omitempty"`
+		// Received is packet IDs of QoS2 messages received from client but not released
+		Received map[uint16]bool `yaml:"received,omitempty"`
+		// ExpireAt is the time when session of disconnected MQTT 5.0 client expires
+		ExpireAt *time.Time `yaml:"expireAt,omitempty"`
 	}
 
 	// Session includes the information about the connect between client and broker,
@@ -45,12 +57,15 @@ type (
 	Session struct {
 		sync.Mutex
 		broker       *Broker
+		sessMgr      *SessionManager
 		storeCh      chan SessionStore
 		info         *SessionInfo
 		done         chan struct{}
 		pending      map[uint16]*Message
 		pendingQueue []uint16
 		nextID       uint16
+		// inflight is the number of messages sent to client but not acknowledged
+		inflight int
 	}
 
 	// Message is the message send from broker to client
@@ -58,6 +73,16 @@ type (
 		Topic      string `yaml:"topic"`
 		B64Payload string `yaml:"b64Payload"`
 		QoS        int    `yaml:"qos"`
+		Retain     bool   `yaml:"retain,omitempty"`
+		// ID and Released are used by QoS2 messages that need to be persisted
+		ID       uint16 `yaml:"id,omitempty"`
+		Released bool   `yaml:"released,omitempty"`
+		// Properties and ExpireAt are used by MQTT 5.0 messages
+		Properties *MessageProperties `yaml:"properties,omitempty"`
+		ExpireAt   *time.Time         `yaml:"expireAt,omitempty"`
+
+		// sent is false when message is queued because of receive maximum of MQTT 5.0 client
+		sent bool
 	}
 )
 
@@ -70,20 +95,56 @@ func newMsg(topic string, payload []byte, qos byte) *Message {
 	return m
 }
 
+func (m *Message) expired() bool {
+	return m.ExpireAt != nil && time.Now().After(*m.ExpireAt)
+}
+
+func (m *Message) packet() (*packets.PublishPacket, error) {
+	payload, err := base64.StdEncoding.DecodeString(m.B64Payload)
+	if err != nil {
+		return nil, err
+	}
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos = byte(m.QoS)
+	p.Retain = m.Retain
+	p.TopicName = m.Topic
+	p.Payload = payload
+	p.MessageID = m.ID
+	return p, nil
+}
+
 func (s *Session) store() {
+	ss, ok := s.storeValue()
+	if !ok {
+		return
+	}
+	go func() {
+		s.storeCh <- ss
+	}()
+}
+
+// storeSync stores session before returning, it is used by QoS2 messages
+// whose state must be persisted before acknowledging or sending them.
+func (s *Session) storeSync() {
+	ss, ok := s.storeValue()
+	if !ok {
+		return
+	}
+	s.sessMgr.put(ss)
+}
+
+func (s *Session) storeValue() (SessionStore, bool) {
 	logger.SpanDebugf(nil, "session %v store", s.info.ClientID)
 	str, err := s.encode()
 	if err != nil {
 		logger.SpanErrorf(nil, "encode session %+v failed: %v", s, err)
-		return
+		return SessionStore{}, false
 	}
-	ss := SessionStore{
+	return SessionStore{
 		key:   s.info.ClientID,
 		value: str,
-	}
-	go func() {
-		s.storeCh <- ss
-	}()
+		seq:   atomic.AddUint64(&sessionStoreSeq, 1),
+	}, true
 }
 
 func (s *Session) encode() (string, error) {
@@ -98,8 +159,19 @@ func (s *Session) decode(str string) error {
 	return yaml.Unmarshal([]byte(str), s.info)
 }
 
+func (s *Session) restoreInFlight() {
+	for _, msg := range s.info.InFlight {
+		msg.sent = true
+		s.pending[msg.ID] = msg
+		s.pendingQueue = append(s.pendingQueue, msg.ID)
+		s.nextID = msg.ID
+		s.inflight++
+	}
+}
+
 func (s *Session) init(sm *SessionManager, b *Broker, connect *packets.ConnectPacket) error {
 	s.broker = b
+	s.sessMgr = sm
 	s.storeCh = sm.storeCh
 	s.done = make(chan struct{})
 	s.pending = make(map[uint16]*Message)
@@ -122,6 +194,33 @@ func (s *Session) updateEGName(egName, name string) {
 	s.Unlock()
 }
 
+// setCleanFlag sets clean flag of session and clears its expire time,
+// it is called when session is taken over by a new connection.
+func (s *Session) setCleanFlag(clean bool) {
+	s.Lock()
+	s.info.CleanFlag = clean
+	s.info.ExpireAt = nil
+	s.Unlock()
+}
+
+// expireAfter sets the session to expire after interval seconds when MQTT 5.0 client disconnects.
+func (s *Session) expireAfter(interval uint32) {
+	if interval == sessionNeverExpire {
+		return
+	}
+	s.Lock()
+	expireAt := time.Now().Add(time.Duration(interval) * time.Second)
+	s.info.ExpireAt = &expireAt
+	s.store()
+	s.Unlock()
+}
+
+func (s *Session) expired() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.info.ExpireAt != nil && time.Now().After(*s.info.ExpireAt)
+}
+
 func (s *Session) subscribe(topics []string, qoss []byte) error {
 	logger.SpanDebugf(nil, "session %s sub %v", s.info.ClientID, topics)
 	s.Lock()
@@ -162,14 +261,34 @@ func (s *Session) getPacketFromMsg(topic string, payload []byte, qos byte) *pack
 	p.Qos = qos
 	p.TopicName = topic
 	p.Payload = payload
-	p.MessageID = s.nextID
 	// the overflow is okay here
-	// the session will give unique id from 0 to 65535 and do this again and again
-	s.nextID++
+	// the session will give unique id from 1 to 65535 and do this again and again,
+	// 0 is not a valid packet id and ids of pending messages are skipped
+	for {
+		s.nextID++
+		if _, ok := s.pending[s.nextID]; !ok && s.nextID != 0 {
+			break
+		}
+	}
+	p.MessageID = s.nextID
 	return p
 }
 
-func (s *Session) publish(span *model.SpanContext, topic string, payload []byte, qos byte) {
+func (s *Session) publish(span *model.SpanContext, topic string, payload []byte, qos byte, props *MessageProperties) {
+	s.doPublish(span, topic, payload, qos, false, props)
+}
+
+// publishRetained sends retained message to client with retain flag set.
+func (s *Session) publishRetained(span *model.SpanContext, msg *RetainedMessage, qos byte) {
+	payload, err := msg.payload()
+	if err != nil {
+		logger.SpanErrorf(span, "base64 decode error for retained message of topic %v: %v", msg.Topic, err)
+		return
+	}
+	s.doPublish(span, msg.Topic, payload, qos, true, msg.Properties.remaining(msg.ExpireAt))
+}
+
+func (s *Session) doPublish(span *model.SpanContext, topic string, payload []byte, qos byte, retain bool, props *MessageProperties) {
 	client := s.broker.getClient(s.info.ClientID)
 	if client == nil {
 		logger.SpanErrorf(span, "client %s is offline in eg %v", s.info.ClientID, s.broker.egName)
@@ -181,27 +300,158 @@ func (s *Session) publish(span *model.SpanContext, topic string, payload []byte,
 
 	logger.SpanDebugf(span, "session %v publish %v", s.info.ClientID, topic)
 	p := s.getPacketFromMsg(topic, payload, qos)
-	if qos == QoS0 {
+	p.Retain = retain
+	msg := newMsg(topic, payload, qos)
+	msg.Retain = retain
+	msg.ID = p.MessageID
+	msg.Properties = props
+	msg.ExpireAt = props.expireAt()
+	switch qos {
+	case QoS0:
 		select {
-		case client.writeCh <- p:
+		case client.writeCh <- client.publishPacket(p, msg):
 		default:
 		}
-	} else if qos == QoS1 {
-		msg := newMsg(topic, payload, qos)
+	case QoS1:
 		s.pending[p.MessageID] = msg
 		s.pendingQueue = append(s.pendingQueue, p.MessageID)
-		client.writePacket(p)
-	} else {
-		logger.SpanErrorf(span, "publish message with qos=2 is not supported currently")
+		s.send(client, p, msg)
+	case QoS2:
+		// persist QoS2 message before sending it, so it can be resent after
+		// client reconnect to this or other broker
+		s.pending[p.MessageID] = msg
+		s.pendingQueue = append(s.pendingQueue, p.MessageID)
+		s.info.InFlight = append(s.info.InFlight, msg)
+		s.storeSync()
+		s.send(client, p, msg)
 	}
 }
 
+// send sends message to client, unless the number of messages sent but not acknowledged
+// reaches receive maximum of MQTT 5.0 client. Queued messages are sent by sendQueued.
+func (s *Session) send(client *Client, p *packets.PublishPacket, msg *Message) {
+	if client.receiveMaximum > 0 && s.inflight >= int(client.receiveMaximum) {
+		return
+	}
+	msg.sent = true
+	s.inflight++
+	client.writePacket(client.publishPacket(p, msg))
+}
+
+// sendQueued sends queued messages in order, expired ones are dropped.
+func (s *Session) sendQueued(client *Client) {
+	if client == nil {
+		return
+	}
+	for _, id := range s.pendingQueue {
+		if client.receiveMaximum > 0 && s.inflight >= int(client.receiveMaximum) {
+			return
+		}
+		msg, ok := s.pending[id]
+		if !ok || msg.sent {
+			continue
+		}
+		if msg.expired() {
+			logger.SpanDebugf(nil, "session %v drop expired message %v", s.info.ClientID, id)
+			s.remove(msg)
+			continue
+		}
+		p, err := msg.packet()
+		if err != nil {
+			logger.SpanErrorf(nil, "base64 decode error for Message B64Payload %s", err)
+			continue
+		}
+		s.send(client, p, msg)
+	}
+}
+
+// remove removes message from pending messages, and stores session if it is an in-flight QoS2 message.
+func (s *Session) remove(msg *Message) {
+	delete(s.pending, msg.ID)
+	if msg.sent {
+		s.inflight--
+	}
+	if msg.QoS != int(QoS2) {
+		return
+	}
+	for i, m := range s.info.InFlight {
+		if m == msg {
+			s.info.InFlight = append(s.info.InFlight[:i], s.info.InFlight[i+1:]...)
+			break
+		}
+	}
+	s.storeSync()
+}
+
 func (s *Session) puback(p *packets.PubackPacket) {
+	client := s.broker.getClient(s.info.ClientID)
 	s.Lock()
-	delete(s.pending, p.MessageID)
+	if msg, ok := s.pending[p.MessageID]; ok && msg.QoS == int(QoS1) {
+		s.remove(msg)
+		s.sendQueued(client)
+	}
 	s.Unlock()
 }
 
+// pubrec marks QoS2 message as released, the message will not be sent again,
+// but pubrel will be resent until client send back pubcomp.
+func (s *Session) pubrec(p *packets.PubrecPacket) {
+	s.Lock()
+	defer s.Unlock()
+	msg, ok := s.pending[p.MessageID]
+	if !ok || msg.QoS != int(QoS2) || msg.Released {
+		return
+	}
+	msg.Released = true
+	s.storeSync()
+}
+
+func (s *Session) pubcomp(p *packets.PubcompPacket) {
+	client := s.broker.getClient(s.info.ClientID)
+	s.Lock()
+	defer s.Unlock()
+	msg, ok := s.pending[p.MessageID]
+	if !ok || msg.QoS != int(QoS2) {
+		return
+	}
+	s.remove(msg)
+	s.sendQueued(client)
+}
+
+// received checks whether QoS2 message with packet id is received from client
+// but not released yet, which means it is a duplicate one.
+func (s *Session) received(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.info.Received[id]
+}
+
+func (s *Session) receive(id uint16) {
+	s.Lock()
+	defer s.Unlock()
+	if s.info.Received == nil {
+		s.info.Received = make(map[uint16]bool)
+	}
+	s.info.Received[id] = true
+	s.storeSync()
+}
+
+func (s *Session) receivedCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.info.Received)
+}
+
+func (s *Session) release(id uint16) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.info.Received[id] {
+		return
+	}
+	delete(s.info.Received, id)
+	s.storeSync()
+}
+
 func (s *Session) cleanSession() bool {
 	return s.info.CleanFlag
 }
@@ -223,18 +473,28 @@ func (s *Session) doResend() {
 		if val, ok := s.pending[idx]; ok {
 			// find first msg need to resend
 			s.pendingQueue = s.pendingQueue[i:]
-			p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-			p.Qos = byte(val.QoS)
-			p.TopicName = val.Topic
-			payload, err := base64.StdEncoding.DecodeString(val.B64Payload)
+			if val.Released {
+				pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+				pubrel.MessageID = idx
+				if client != nil {
+					client.writePacket(pubrel)
+				}
+				return
+			}
+			// message queued by receive maximum is not sent before
+			if !val.sent {
+				s.sendQueued(client)
+				return
+			}
+			p, err := val.packet()
 			if err != nil {
 				logger.SpanErrorf(nil, "base64 decode error for Message B64Payload %s", err)
 				return
 			}
-			p.Payload = payload
+			p.Dup = true
 			p.MessageID = idx
 			if client != nil {
-				client.writePacket(p)
+				client.writePacket(client.publishPacket(p, val))
 			} else {
 				logger.SpanDebugf(nil, "session %v do resend but client is nil", s.info.ClientID)
 			}
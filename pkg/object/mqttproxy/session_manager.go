@@ -32,12 +32,18 @@ type (
 		store      storage
 		storeCh    chan SessionStore
 		done       chan struct{}
+
+		// latest is the seq of latest stored value of sessions, the session stores are
+		// sent by different goroutines, so a stale one may arrive later than new one
+		storeMu sync.Mutex
+		latest  map[string]uint64
 	}
 
 	// SessionStore for session store, key is session clientID, value is session yaml marshal value
 	SessionStore struct {
 		key   string
 		value string
+		seq   uint64
 	}
 )
 
@@ -47,6 +53,7 @@ func newSessionManager(b *Broker, store storage) *SessionManager {
 		store:   store,
 		storeCh: make(chan SessionStore),
 		done:    make(chan struct{}),
+		latest:  make(map[string]uint64),
 	}
 	go sm.doStore()
 	return sm
@@ -62,15 +69,27 @@ func (sm *SessionManager) doStore() {
 		case <-sm.done:
 			return
 		case kv := <-sm.storeCh:
-			logger.SpanDebugf(nil, "session manager store session %v", kv.key)
-			err := sm.store.put(sessionStoreKey(kv.key), kv.value)
-			if err != nil {
-				logger.SpanErrorf(nil, "put session %v into storage failed: %v", kv.key, err)
-			}
+			sm.put(kv)
 		}
 	}
 }
 
+// put puts session into storage, unless a newer value of the session is stored.
+func (sm *SessionManager) put(kv SessionStore) {
+	sm.storeMu.Lock()
+	defer sm.storeMu.Unlock()
+
+	if kv.seq != 0 && kv.seq < sm.latest[kv.key] {
+		return
+	}
+	sm.latest[kv.key] = kv.seq
+	logger.SpanDebugf(nil, "session manager store session %v", kv.key)
+	err := sm.store.put(sessionStoreKey(kv.key), kv.value)
+	if err != nil {
+		logger.SpanErrorf(nil, "put session %v into storage failed: %v", kv.key, err)
+	}
+}
+
 func (sm *SessionManager) newSessionFromConn(connect *packets.ConnectPacket) *Session {
 	s := &Session{}
 	s.init(sm, sm.broker, connect)
@@ -82,6 +101,7 @@ func (sm *SessionManager) newSessionFromConn(connect *packets.ConnectPacket) *Se
 func (sm *SessionManager) newSessionFromYaml(str *string) *Session {
 	sess := &Session{}
 	sess.broker = sm.broker
+	sess.sessMgr = sm
 	sess.storeCh = sm.storeCh
 	sess.done = make(chan struct{})
 	sess.pending = make(map[uint16]*Message)
@@ -92,6 +112,7 @@ func (sm *SessionManager) newSessionFromYaml(str *string) *Session {
 	if err != nil {
 		return nil
 	}
+	sess.restoreInFlight()
 	go sess.backgroundResendPending()
 	return sess
 }
@@ -121,6 +142,10 @@ func (sm *SessionManager) delLocal(clientID string) {
 }
 
 func (sm *SessionManager) delDB(clientID string) {
+	sm.storeMu.Lock()
+	defer sm.storeMu.Unlock()
+
+	delete(sm.latest, clientID)
 	err := sm.store.delete(sessionStoreKey(clientID))
 	if err != nil {
 		logger.SpanErrorf(nil, "delete session %v failed, %v", err)
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const (
+	// sharedRoundRobin delivers messages to clients of a shared subscription in turn
+	sharedRoundRobin = "roundRobin"
+	// sharedHash delivers messages of the same publishing client to the same client of a shared subscription
+	sharedHash = "hash"
+)
+
+type (
+	// SharedManager manages shared subscriptions in storage, so clients of a shared
+	// subscription connected to different members of the cluster are load balanced.
+	SharedManager struct {
+		egName   string
+		name     string
+		store    storage
+		strategy string
+
+		mu   sync.Mutex
+		next map[string]uint64
+
+		// kvs is shared subscriptions synced from storage, and subscriptions is
+		// a *sharedSubscriptions built from it, so choosing clients doesn't read
+		// storage. Subscriptions of this member are applied at once.
+		kvsMu         sync.Mutex
+		kvs           map[string]string
+		subscriptions atomic.Value
+		closeFunc     func()
+	}
+
+	sharedSubscriptions struct {
+		// topics uses client id as subscriber id
+		topics *TopicManager
+		// members maps key of shared subscription to the member the client connects to
+		members map[string]string
+	}
+)
+
+func newSharedManager(egName, name string, store storage, spec *Shared) *SharedManager {
+	sm := &SharedManager{
+		egName:   egName,
+		name:     name,
+		store:    store,
+		strategy: sharedRoundRobin,
+		next:     make(map[string]uint64),
+		kvs:      make(map[string]string),
+	}
+	if spec != nil && spec.Strategy != "" {
+		sm.strategy = spec.Strategy
+	}
+	sm.subscriptions.Store(sm.build())
+
+	ch, closeFunc, err := store.syncPrefix(sharedStoreKey(name, "", ""))
+	if err != nil {
+		logger.SpanErrorf(nil, "sync shared subscriptions of %v failed: %v", name, err)
+		return sm
+	}
+	sm.closeFunc = closeFunc
+	go sm.sync(ch)
+	return sm
+}
+
+func (sm *SharedManager) sync(ch <-chan map[string]string) {
+	for kvs := range ch {
+		sm.kvsMu.Lock()
+		sm.kvs = kvs
+		sm.subscriptions.Store(sm.build())
+		sm.kvsMu.Unlock()
+	}
+}
+
+// update applies change of shared subscription made by this member, a nil value
+// means deletion.
+func (sm *SharedManager) update(key string, value *string) {
+	sm.kvsMu.Lock()
+	defer sm.kvsMu.Unlock()
+	if value == nil {
+		delete(sm.kvs, key)
+	} else {
+		sm.kvs[key] = *value
+	}
+	sm.subscriptions.Store(sm.build())
+}
+
+// build builds shared subscriptions from kvs, it must be called with kvsMu held.
+func (sm *SharedManager) build() *sharedSubscriptions {
+	subs := &sharedSubscriptions{
+		topics:  newTopicManager(len(sm.kvs) + 1),
+		members: make(map[string]string, len(sm.kvs)),
+	}
+	for k, v := range sm.kvs {
+		sharedTopic, clientID, err := sm.parseKey(k)
+		if err != nil {
+			logger.SpanErrorf(nil, "invalid shared subscription key %v: %v", k, err)
+			continue
+		}
+		if err := subs.topics.subscribe([]string{sharedTopic}, []byte{QoS0}, clientID); err != nil {
+			logger.SpanErrorf(nil, "invalid shared subscription %v: %v", sharedTopic, err)
+			continue
+		}
+		subs.members[k] = v
+	}
+	return subs
+}
+
+func (sm *SharedManager) close() {
+	if sm.closeFunc != nil {
+		sm.closeFunc()
+	}
+}
+
+// subscribe stores shared subscriptions in topics of the client, other topics are ignored.
+func (sm *SharedManager) subscribe(topics []string, clientID string) error {
+	for _, t := range topics {
+		_, _, shared, err := parseSharedTopic(t)
+		if err != nil {
+			return err
+		}
+		if !shared {
+			continue
+		}
+		key := sharedStoreKey(sm.name, t, clientID)
+		if err := sm.store.put(key, sm.egName); err != nil {
+			return err
+		}
+		sm.update(key, &sm.egName)
+	}
+	return nil
+}
+
+// unsubscribe deletes shared subscriptions in topics of the client. shared subscriptions
+// stored by other members are kept, since the client may be taken over by them.
+func (sm *SharedManager) unsubscribe(topics []string, clientID string) error {
+	for _, t := range topics {
+		_, _, shared, err := parseSharedTopic(t)
+		if err != nil || !shared {
+			continue
+		}
+		key := sharedStoreKey(sm.name, t, clientID)
+		val, err := sm.store.get(key)
+		if err != nil || val == nil || *val != sm.egName {
+			continue
+		}
+		if err := sm.store.delete(key); err != nil {
+			return err
+		}
+		sm.update(key, nil)
+	}
+	return nil
+}
+
+// choose chooses one client for every shared subscription that matches the topic,
+// publisher is the id of the client publishing the message, which is empty if the
+// message is not published by a client. It returns a map from shared subscription to
+// the chosen client, and members that the chosen clients connect to.
+func (sm *SharedManager) choose(topic, publisher string) (map[string]string, map[string]struct{}, error) {
+	subs := sm.subscriptions.Load().(*sharedSubscriptions)
+	if len(subs.members) == 0 {
+		return nil, nil, nil
+	}
+	shared, err := subs.topics.findSharedSubscribers(topic)
+	if err != nil || len(shared) == 0 {
+		return nil, nil, err
+	}
+
+	ans := make(map[string]string)
+	members := make(map[string]struct{})
+	for sharedTopic, subscribers := range shared {
+		clients := make([]string, 0, len(subscribers))
+		for c := range subscribers {
+			clients = append(clients, c)
+		}
+		sort.Strings(clients)
+		chosen := sm.pick(sharedTopic, topic, publisher, clients)
+		ans[sharedTopic] = chosen
+		members[subs.members[sharedStoreKey(sm.name, sharedTopic, chosen)]] = struct{}{}
+	}
+	return ans, members, nil
+}
+
+func (sm *SharedManager) pick(sharedTopic, topic, publisher string, clients []string) string {
+	if sm.strategy == sharedHash {
+		// hash on the publishing client, messages not published by clients
+		// are hashed on their topics.
+		key := publisher
+		if key == "" {
+			key = topic
+		}
+		// rendezvous hashing, so only messages of the chosen client are moved to
+		// others when clients join or leave the shared subscription.
+		var chosen string
+		var max uint64
+		for _, c := range clients {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte(c))
+			if v := h.Sum64(); chosen == "" || v > max {
+				chosen, max = c, v
+			}
+		}
+		return chosen
+	}
+
+	sm.mu.Lock()
+	i := sm.next[sharedTopic]
+	sm.next[sharedTopic] = i + 1
+	sm.mu.Unlock()
+	return clients[i%uint64(len(clients))]
+}
+
+func (sm *SharedManager) parseKey(key string) (string, string, error) {
+	s := strings.Split(strings.TrimPrefix(key, sharedStoreKey(sm.name, "", "")), "/")
+	if len(s) != 2 {
+		return "", "", fmt.Errorf("invalid format")
+	}
+	sharedTopic, err := url.QueryUnescape(s[0])
+	if err != nil {
+		return "", "", err
+	}
+	clientID, err := url.QueryUnescape(s[1])
+	if err != nil {
+		return "", "", err
+	}
+	return sharedTopic, clientID, nil
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSharedTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		topic  string
+		group  string
+		filter string
+		shared bool
+		valid  bool
+	}{
+		{"a/b/c", "", "", false, true},
+		{"$share/g/a/+", "g", "a/+", true, true},
+		{"$share/g/#", "g", "#", true, true},
+		{"$share/g", "", "", true, false},
+		{"$share//a", "", "", true, false},
+		{"$share/g/", "", "", true, false},
+		{"$share/g+/a", "", "", true, false},
+	}
+	for _, tt := range tests {
+		group, filter, shared, err := parseSharedTopic(tt.topic)
+		assert.Equal(tt.group, group, tt.topic)
+		assert.Equal(tt.filter, filter, tt.topic)
+		assert.Equal(tt.shared, shared, tt.topic)
+		assert.Equal(tt.valid, err == nil, tt.topic)
+	}
+}
+
+func TestTopicManagerShared(t *testing.T) {
+	assert := assert.New(t)
+
+	mgr := newTopicManager(100)
+	assert.Nil(mgr.subscribe([]string{"a/+", "$share/g1/a/+", "$share/g2/a/#"}, []byte{QoS0, QoS1, QoS2}, "c1"))
+	assert.Nil(mgr.subscribe([]string{"$share/g1/a/+"}, []byte{QoS2}, "c2"))
+	assert.NotNil(mgr.subscribe([]string{"$share/g1"}, []byte{QoS0}, "c2"))
+
+	subscribers, err := mgr.findSubscribers("a/b")
+	assert.Nil(err)
+	assert.Equal(map[string]byte{"c1": QoS0}, subscribers)
+
+	shared, err := mgr.findSharedSubscribers("a/b")
+	assert.Nil(err)
+	assert.Equal(map[string]map[string]byte{
+		"$share/g1/a/+": {"c1": QoS1, "c2": QoS2},
+		"$share/g2/a/#": {"c1": QoS2},
+	}, shared)
+
+	shared, err = mgr.findSharedSubscribers("a")
+	assert.Nil(err)
+	assert.Equal(map[string]map[string]byte{"$share/g2/a/#": {"c1": QoS2}}, shared)
+
+	assert.Nil(mgr.unsubscribe([]string{"a/+", "$share/g1/a/+", "$share/g2/a/#"}, "c1"))
+	assert.Nil(mgr.unsubscribe([]string{"$share/g1/a/+"}, "c2"))
+	assert.True(mgr.root.empty())
+}
+
+func TestSharedManager(t *testing.T) {
+	assert := assert.New(t)
+	store := newStorage(nil)
+
+	sm0 := newSharedManager("eg0", "test", store, nil)
+	defer sm0.close()
+	sm1 := newSharedManager("eg1", "test", store, &Shared{Strategy: sharedHash})
+	defer sm1.close()
+	assert.Nil(sm0.subscribe([]string{"a/b", "$share/g/a/+"}, "c0"))
+	assert.Nil(sm1.subscribe([]string{"$share/g/a/+", "$share/h/#"}, "c/1"))
+
+	keys, _ := store.getPrefix(sharedStoreKey("test", "", ""), true)
+	assert.Len(keys, 3)
+
+	// shared subscriptions of other members are synced from storage
+	waitSynced := func(sm *SharedManager, n int) {
+		for i := 0; i < 20; i++ {
+			if len(sm.subscriptions.Load().(*sharedSubscriptions).members) == n {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("shared subscriptions of %v not synced", sm.egName)
+	}
+	waitSynced(sm0, 3)
+	waitSynced(sm1, 3)
+
+	// round robin
+	chosen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		ans, members, err := sm0.choose("a/b", "")
+		assert.Nil(err)
+		assert.Len(ans, 2)
+		if ans["$share/g/a/+"] == "c0" {
+			assert.Equal(map[string]struct{}{"eg0": {}, "eg1": {}}, members)
+		} else {
+			assert.Equal(map[string]struct{}{"eg1": {}}, members)
+		}
+		assert.Equal("c/1", ans["$share/h/#"])
+		chosen[ans["$share/g/a/+"]]++
+	}
+	assert.Equal(map[string]int{"c0": 2, "c/1": 2}, chosen)
+
+	// hash chooses the same client for the same publisher
+	ans, _, err := sm1.choose("a/b", "pub")
+	assert.Nil(err)
+	for i := 0; i < 4; i++ {
+		again, _, _ := sm1.choose("a/c", "pub")
+		assert.Equal(ans, again)
+	}
+	// and for the same topic if messages are not published by clients
+	ans, _, err = sm1.choose("a/b", "")
+	assert.Nil(err)
+	for i := 0; i < 4; i++ {
+		again, _, _ := sm1.choose("a/b", "")
+		assert.Equal(ans, again)
+	}
+
+	ans, _, err = sm0.choose("b", "")
+	assert.Nil(err)
+	assert.Equal(map[string]string{"$share/h/#": "c/1"}, ans)
+
+	// shared subscriptions stored by other members are kept
+	assert.Nil(sm0.unsubscribe([]string{"$share/g/a/+", "$share/h/#"}, "c/1"))
+	keys, _ = store.getPrefix(sharedStoreKey("test", "", ""), true)
+	assert.Len(keys, 3)
+
+	assert.Nil(sm0.unsubscribe([]string{"$share/g/a/+"}, "c0"))
+	assert.Nil(sm1.unsubscribe([]string{"$share/g/a/+", "$share/h/#"}, "c/1"))
+	waitSynced(sm0, 0)
+	ans, _, err = sm0.choose("a/b", "")
+	assert.Nil(err)
+	assert.Empty(ans)
+}
+
+func TestSharedSubscription(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStorage(nil)
+	broker0 := newBroker(getDefaultSpec(), store, memberURL)
+	spec := getDefaultSpec()
+	spec.EGName = "test1"
+	spec.Port = 1884
+	broker1 := newBroker(spec, store, memberURL)
+
+	srv0 := newServer(":8888")
+	srv0.addHandlerFunc("/mqtt", broker0.httpTopicsPublishHandler)
+	srv0.start()
+	srv1 := newServer(":8889")
+	srv1.addHandlerFunc("/mqtt", broker1.httpTopicsPublishHandler)
+	srv1.start()
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	subscribe := func(port int, clientID, topic string) paho.Client {
+		opts := paho.NewClientOptions().AddBroker(fmt.Sprintf("tcp://0.0.0.0:%d", port)).SetClientID(clientID).SetUsername("test").SetPassword("test")
+		c := paho.NewClient(opts)
+		token := c.Connect()
+		token.Wait()
+		require.Nil(t, token.Error())
+		token = c.Subscribe(topic, 1, func(paho.Client, paho.Message) {
+			mu.Lock()
+			received[clientID]++
+			mu.Unlock()
+		})
+		token.Wait()
+		require.Nil(t, token.Error())
+		return c
+	}
+	clients := []paho.Client{
+		subscribe(1883, "normal", "sensors/+"),
+		subscribe(1883, "shared0", "$share/g/sensors/+"),
+		subscribe(1884, "shared1", "$share/g/sensors/+"),
+	}
+
+	for i := 0; i < 4; i++ {
+		code := topicsPublish(t, HTTPJsonData{Topic: "sensors/1", QoS: 1, Payload: fmt.Sprint(i)})
+		assert.Equal(200, code)
+	}
+
+	want := map[string]int{"normal": 4, "shared0": 2, "shared1": 2}
+	assert.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return reflect.DeepEqual(want, received)
+	}, 3*time.Second, 50*time.Millisecond)
+
+	for _, c := range clients {
+		c.Disconnect(200)
+	}
+	broker0.close()
+	broker1.close()
+	srv0.shutdown()
+	srv1.shutdown()
+}
@@ -20,6 +20,7 @@ package mqttproxy
 import (
 	"crypto/tls"
 	"fmt"
+	"net/url"
 )
 
 const (
@@ -28,6 +29,12 @@ const (
 	mqttAPITopicPublishPrefix  = "/mqttproxy/%s/topics/publish"
 	mqttAPISessionQueryPrefix  = "/mqttproxy/%s/session/query"
 	mqttAPISessionDeletePrefix = "/mqttproxy/%s/sessions"
+	mqttAPIRetainedPrefix      = "/mqttproxy/%s/retained"
+	retainPrefix               = "/mqtt/retainMgr/%s/topic/%s"
+	sharedPrefix               = "/mqtt/sharedMgr/%s/topic/%s"
+	routePrefix                = "/mqtt/routeMgr/%s/member/%s"
+	// memberStatusPrefix is the prefix of member status in cluster layout
+	memberStatusPrefix = "/status/members/"
 )
 
 // PacketType is mqtt packet type
@@ -72,6 +79,13 @@ type (
 		ConnectionLimit      *RateLimit    `yaml:"connectionLimit" jsonschema:"omitempty"`
 		ClientPublishLimit   *RateLimit    `yaml:"clientPublishLimit" jsonschema:"omitempty"`
 		Rules                []*Rule       `yaml:"rules" jsonschema:"omitempty"`
+		Retain               *Retain       `yaml:"retain" jsonschema:"omitempty"`
+		ReceiveMaximum       uint16        `yaml:"receiveMaximum" jsonschema:"omitempty"`
+		TopicAliasMaximum    uint16        `yaml:"topicAliasMaximum" jsonschema:"omitempty"`
+		SharedSubscription   *Shared       `yaml:"sharedSubscription" jsonschema:"omitempty"`
+		DeviceToDevice       bool          `yaml:"deviceToDevice" jsonschema:"omitempty"`
+		Downlink             *Downlink     `yaml:"downlink" jsonschema:"omitempty"`
+		WebSocket            *WebSocket    `yaml:"webSocket" jsonschema:"omitempty"`
 	}
 
 	// Rule used to route MQTT packets to different pipelines
@@ -95,6 +109,64 @@ type (
 		TimePeriod  int `yaml:"timePeriod" jsonschema:"omitempty"`
 	}
 
+	// Retain describes the limits of retained messages.
+	// ttl: retained messages expire after ttl, never expire if it is empty
+	// maxPayloadBytes: max allowed payload bytes of a retained message
+	// maxMessages: max allowed number of retained messages
+	Retain struct {
+		TTL             string `yaml:"ttl" jsonschema:"omitempty,format=duration"`
+		MaxPayloadBytes int    `yaml:"maxPayloadBytes" jsonschema:"omitempty,minimum=0"`
+		MaxMessages     int    `yaml:"maxMessages" jsonschema:"omitempty,minimum=0"`
+	}
+
+	// Shared describes how messages are load balanced among clients of a shared subscription.
+	// strategy: roundRobin delivers messages to clients in turn, hash delivers messages
+	// of the same publishing client to the same client by hashing client ids, default roundRobin
+	Shared struct {
+		Strategy string `yaml:"strategy" jsonschema:"omitempty,enum=,enum=roundRobin,enum=hash"`
+	}
+
+	// Downlink describes Kafka topics consumed and sent to MQTT clients.
+	// backend: addresses of Kafka brokers
+	// group: consumer group shared by all members of the cluster, offsets are committed to the group
+	// initialOffset: where to start when the group has no committed offset, newest or oldest, default newest
+	Downlink struct {
+		Backend       []string         `yaml:"backend" jsonschema:"required,uniqueItems=true"`
+		Group         string           `yaml:"group" jsonschema:"required"`
+		InitialOffset string           `yaml:"initialOffset" jsonschema:"omitempty,enum=,enum=newest,enum=oldest"`
+		Topics        []*DownlinkTopic `yaml:"topics" jsonschema:"required"`
+	}
+
+	// DownlinkTopic describes how records of a Kafka topic are mapped to MQTT messages,
+	// headers mqtt-topic, mqtt-qos and mqtt-retain of a record take precedence.
+	// topic: Kafka topic
+	// mqttTopic: MQTT topic, {topic} is replaced by Kafka topic and {key} by key of the record, default Kafka topic
+	// qos: qos of MQTT messages, default 0
+	// retain: whether MQTT messages are retained
+	DownlinkTopic struct {
+		Topic     string `yaml:"topic" jsonschema:"required"`
+		MQTTTopic string `yaml:"mqttTopic" jsonschema:"omitempty"`
+		QoS       int    `yaml:"qos" jsonschema:"omitempty,minimum=0,maximum=2"`
+		Retain    bool   `yaml:"retain" jsonschema:"omitempty"`
+	}
+
+	// WebSocket describes the listener of MQTT over WebSocket, its clients share
+	// sessions, rules and pipelines with clients connected by TCP.
+	// port: port of the WebSocket listener, it must be different from the TCP port
+	// path: path of the WebSocket endpoint, default /mqtt
+	// useTLS: serve wss with the certificates of MQTTProxy
+	WebSocket struct {
+		Port   uint16 `yaml:"port" jsonschema:"required"`
+		Path   string `yaml:"path" jsonschema:"omitempty,pattern=^/"`
+		UseTLS bool   `yaml:"useTLS" jsonschema:"omitempty"`
+	}
+
+	// Status is the status of MQTTProxy.
+	Status struct {
+		RouteStats `yaml:",inline"`
+		Downlink   *DownlinkStats `yaml:"downlink,omitempty"`
+	}
+
 	// Certificate describes TLS certifications.
 	Certificate struct {
 		Name string `yaml:"name" jsonschema:"required"`
@@ -123,3 +195,25 @@ func (spec *Spec) tlsConfig() (*tls.Config, error) {
 func sessionStoreKey(clientID string) string {
 	return fmt.Sprintf(sessionPrefix, clientID)
 }
+
+func retainStoreKey(name, topic string) string {
+	return fmt.Sprintf(retainPrefix, name, topic)
+}
+
+// sharedStoreKey returns key of a client of shared subscription, or the prefix of
+// all shared subscriptions if topic is empty.
+func sharedStoreKey(name, topic, clientID string) string {
+	if topic == "" {
+		return fmt.Sprintf(sharedPrefix, name, "")
+	}
+	return fmt.Sprintf(sharedPrefix, name, url.QueryEscape(topic)+"/"+url.QueryEscape(clientID))
+}
+
+// routeStoreKey returns key of a route from topic filter to member, or the prefix of
+// all routes if egName is empty.
+func routeStoreKey(name, egName, topic string) string {
+	if egName == "" {
+		return fmt.Sprintf(routePrefix, name, "")
+	}
+	return fmt.Sprintf(routePrefix, name, url.QueryEscape(egName)+"/"+url.QueryEscape(topic))
+}
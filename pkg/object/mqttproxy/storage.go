@@ -21,6 +21,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/megaease/easegress/pkg/cluster"
 	etcderror "go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
@@ -33,6 +34,7 @@ type (
 		put(key, value string) error
 		delete(key string) error
 		watchDelete(prefix string) (<-chan map[string]*string, func(), error)
+		syncPrefix(prefix string) (<-chan map[string]string, func(), error)
 	}
 
 	mockStorage struct {
@@ -40,6 +42,16 @@ type (
 		store     map[string]string
 		watchCh   chan map[string]*string
 		watchFlag int32
+		syncers   []*mockSyncer
+	}
+
+	// mockSyncer sends all keys and values of prefix when any of them changes
+	mockSyncer struct {
+		prefix   string
+		notifyCh chan struct{}
+		ch       chan map[string]string
+		done     chan struct{}
+		once     sync.Once
 	}
 
 	clusterStorage struct {
@@ -90,6 +102,7 @@ func (m *mockStorage) getPrefix(prefix string, keysOnly bool) (map[string]string
 func (m *mockStorage) put(key, value string) error {
 	m.mu.Lock()
 	m.store[key] = value
+	m.notify(key)
 	m.mu.Unlock()
 	return nil
 }
@@ -97,6 +110,7 @@ func (m *mockStorage) put(key, value string) error {
 func (m *mockStorage) delete(key string) error {
 	m.mu.Lock()
 	delete(m.store, key)
+	m.notify(key)
 	if m.watched() {
 		go func() {
 			ans := make(map[string]*string)
@@ -118,6 +132,50 @@ func (m *mockStorage) watchDelete(prefix string) (<-chan map[string]*string, fun
 	return m.watchCh, func() {}, nil
 }
 
+func (m *mockStorage) syncPrefix(prefix string) (<-chan map[string]string, func(), error) {
+	s := &mockSyncer{
+		prefix:   prefix,
+		notifyCh: make(chan struct{}, 1),
+		ch:       make(chan map[string]string, 10),
+		done:     make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.syncers = append(m.syncers, s)
+	m.mu.Unlock()
+
+	s.notifyCh <- struct{}{}
+	go func() {
+		defer close(s.ch)
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-s.notifyCh:
+				kvs, _ := m.getPrefix(prefix, false)
+				select {
+				case s.ch <- kvs:
+				case <-s.done:
+					return
+				}
+			}
+		}
+	}()
+	return s.ch, func() { s.once.Do(func() { close(s.done) }) }, nil
+}
+
+// notify notifies syncers that key changes, it must be called with lock.
+func (m *mockStorage) notify(key string) {
+	for _, s := range m.syncers {
+		if !strings.HasPrefix(key, s.prefix) {
+			continue
+		}
+		select {
+		case s.notifyCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (cs *clusterStorage) get(key string) (*string, error) {
 	return cs.cls.Get(key)
 }
@@ -149,3 +207,16 @@ func (cs *clusterStorage) watchDelete(prefix string) (<-chan map[string]*string,
 	}
 	return ch, watcher.Close, nil
 }
+
+func (cs *clusterStorage) syncPrefix(prefix string) (<-chan map[string]string, func(), error) {
+	syncer, err := cs.cls.Syncer(time.Minute)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, err := syncer.SyncPrefix(prefix)
+	if err != nil {
+		syncer.Close()
+		return nil, nil, err
+	}
+	return ch, syncer.Close, nil
+}
@@ -25,6 +25,9 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 )
 
+// sharedTopicPrefix is the prefix of shared subscription "$share/{group}/{filter}"
+const sharedTopicPrefix = "$share/"
+
 // TopicManager to manage topic subscribe and unsubscribe in MQTT
 type TopicManager struct {
 	sync.RWMutex
@@ -82,16 +85,47 @@ func (mgr *TopicManager) unsubscribe(topics []string, clientID string) error {
 // findSubscribers is used to find all clients that subscribe a certain topic directly or use wildcard.
 // for example, topic "loc/device/event" will find clients that subscribe topic "+/+/+" or "loc/+/event" or "loc/device/event"
 // so, clients subscribe topics that contain or not contain wildcard, and this function will find all subscribed topics that match
-// the given topic.
+// the given topic. clients of shared subscriptions are not included, use findSharedSubscribers to find them.
 func (mgr *TopicManager) findSubscribers(topic string) (map[string]byte, error) {
 	mgr.RLock()
 	defer mgr.RUnlock()
 
-	levels, err := mgr.getLevels(topic)
+	nodes, err := mgr.match(topic)
 	if err != nil {
 		return nil, err
 	}
 	ans := make(map[string]byte)
+	for _, n := range nodes {
+		n.addClients(ans)
+	}
+	return ans, nil
+}
+
+// findSharedSubscribers finds shared subscriptions that match the topic, the key of
+// returned map is the shared subscription like "$share/{group}/{filter}", and the value
+// is clients of the shared subscription with their qos.
+func (mgr *TopicManager) findSharedSubscribers(topic string) (map[string]map[string]byte, error) {
+	mgr.RLock()
+	defer mgr.RUnlock()
+
+	nodes, err := mgr.match(topic)
+	if err != nil {
+		return nil, err
+	}
+	ans := make(map[string]map[string]byte)
+	for _, n := range nodes {
+		n.addShared(ans)
+	}
+	return ans, nil
+}
+
+// match returns all nodes whose topic filters match the topic.
+func (mgr *TopicManager) match(topic string) ([]*topicNode, error) {
+	levels, err := mgr.getLevels(topic)
+	if err != nil {
+		return nil, err
+	}
+	ans := []*topicNode{}
 
 	currentLevelNodes := []*topicNode{mgr.root}
 	for _, topicLevel := range levels {
@@ -99,7 +133,7 @@ func (mgr *TopicManager) findSubscribers(topic string) (map[string]byte, error)
 		for _, node := range currentLevelNodes {
 			for nodeLevel, nextNode := range node.nodes {
 				if nodeLevel == "#" {
-					nextNode.addClients(ans)
+					ans = append(ans, nextNode)
 
 				} else if nodeLevel == "+" || nodeLevel == topicLevel {
 					nextLevelNodes = append(nextLevelNodes, nextNode)
@@ -112,18 +146,38 @@ func (mgr *TopicManager) findSubscribers(topic string) (map[string]byte, error)
 		}
 	}
 	for _, n := range currentLevelNodes {
-		n.addClients(ans)
+		ans = append(ans, n)
 		// in MQTT version 3.1.1 section 4.7.1.2, topic "sport/tennis/player1/#" would receive msg from "sport/tennis/player1"
 		// which means when we reach end of topic level, we need check one more level for wildcard #
 		if val, ok := n.nodes["#"]; ok {
-			val.addClients(ans)
+			ans = append(ans, val)
 		}
 	}
 	return ans, nil
 }
 
+// parseSharedTopic parses shared subscription "$share/{group}/{filter}", and returns
+// the group and topic filter of it. ok is false if topic is not a shared subscription.
+func parseSharedTopic(topic string) (group, filter string, ok bool, err error) {
+	if !strings.HasPrefix(topic, sharedTopicPrefix) {
+		return "", "", false, nil
+	}
+	s := strings.SplitN(strings.TrimPrefix(topic, sharedTopicPrefix), "/", 2)
+	if len(s) != 2 || s[0] == "" || s[1] == "" || strings.ContainsAny(s[0], "+#") {
+		return "", "", true, fmt.Errorf("shared subscription %v is invalid", topic)
+	}
+	return s[0], s[1], true, nil
+}
+
 func (mgr *TopicManager) insert(topic string, qos byte, clientID string) error {
-	levels, err := mgr.getLevels(topic)
+	_, filter, shared, err := parseSharedTopic(topic)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		filter = topic
+	}
+	levels, err := mgr.getLevels(filter)
 	if err != nil {
 		return err
 	}
@@ -138,12 +192,28 @@ func (mgr *TopicManager) insert(topic string, qos byte, clientID string) error {
 		}
 		node = nextNode
 	}
-	node.clients[clientID] = qos
+	if !shared {
+		node.clients[clientID] = qos
+		return nil
+	}
+	clients, ok := node.shared[topic]
+	if !ok {
+		clients = make(map[string]byte)
+		node.shared[topic] = clients
+	}
+	clients[clientID] = qos
 	return nil
 }
 
 func (mgr *TopicManager) remove(topic string, clientID string) error {
-	levels, err := mgr.getLevels(topic)
+	_, filter, shared, err := parseSharedTopic(topic)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		filter = topic
+	}
+	levels, err := mgr.getLevels(filter)
 	if err != nil {
 		return err
 	}
@@ -158,12 +228,19 @@ func (mgr *TopicManager) remove(topic string, clientID string) error {
 		prevNodes = append(prevNodes, node)
 		node = nextNode
 	}
-	delete(node.clients, clientID)
+	if !shared {
+		delete(node.clients, clientID)
+	} else if clients, ok := node.shared[topic]; ok {
+		delete(clients, clientID)
+		if len(clients) == 0 {
+			delete(node.shared, topic)
+		}
+	}
 
 	// clear memory
 	for i := len(prevNodes) - 1; i >= 0; i-- {
 		node = prevNodes[i].nodes[levels[i]]
-		if len(node.clients) == 0 && len(node.nodes) == 0 {
+		if node.empty() {
 			delete(prevNodes[i].nodes, levels[i])
 		} else {
 			return nil
@@ -223,18 +300,36 @@ func (t *topicLevelManager) get(topic string) ([]string, error) {
 type topicNode struct {
 	// client with their qos
 	clients map[string]byte
-	nodes   map[string]*topicNode
+	// shared subscriptions with their clients and qos
+	shared map[string]map[string]byte
+	nodes  map[string]*topicNode
 }
 
 func newNode() *topicNode {
 	return &topicNode{
 		clients: make(map[string]byte),
+		shared:  make(map[string]map[string]byte),
 		nodes:   make(map[string]*topicNode),
 	}
 }
 
+func (node *topicNode) empty() bool {
+	return len(node.clients) == 0 && len(node.shared) == 0 && len(node.nodes) == 0
+}
+
 func (node *topicNode) addClients(ans map[string]byte) {
 	for client, qos := range node.clients {
 		ans[client] = qos
 	}
 }
+
+func (node *topicNode) addShared(ans map[string]map[string]byte) {
+	for topic, clients := range node.shared {
+		if _, ok := ans[topic]; !ok {
+			ans[topic] = make(map[string]byte)
+		}
+		for client, qos := range clients {
+			ans[topic][client] = qos
+		}
+	}
+}
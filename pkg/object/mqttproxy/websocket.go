@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const defaultWebSocketPath = "/mqtt"
+
+// webSocketSubprotocols are subprotocols of MQTT over WebSocket, mqttv3.1 is used
+// by some old MQTT 3.1 clients.
+var webSocketSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+// wsConn adapts a WebSocket connection to net.Conn, so MQTT packets can be read and
+// written as a stream. MQTT packets are sent in binary messages, a message may contain
+// part of a packet or multiple packets.
+type wsConn struct {
+	*websocket.Conn
+
+	reader  io.Reader
+	writeMu sync.Mutex
+}
+
+var _ net.Conn = (*wsConn)(nil)
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{Conn: conn}
+}
+
+// Read reads data of binary messages in order, text messages are not allowed by MQTT.
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			msgType, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if msgType != websocket.BinaryMessage {
+				return 0, fmt.Errorf("mqtt over websocket only accepts binary messages, got message type %d", msgType)
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write writes data in a binary message.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetWriteDeadline sets the write deadline, it's not allowed to be called
+// concurrently with writes by websocket.Conn.
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (b *Broker) setWebSocketListener() error {
+	spec := b.spec.WebSocket
+	addr := fmt.Sprintf(":%d", spec.Port)
+	var l net.Listener
+	var err error
+	if spec.UseTLS {
+		var cfg *tls.Config
+		cfg, err = b.spec.tlsConfig()
+		if err != nil {
+			return fmt.Errorf("invalid tls config for mqtt over websocket: %v", err)
+		}
+		l, err = tls.Listen("tcp", addr, cfg)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("gen mqtt websocket listener with addr %v failed: %v", addr, err)
+	}
+
+	path := spec.Path
+	if path == "" {
+		path = defaultWebSocketPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, b.handleWebSocket)
+	b.wsListener = l
+	b.wsServer = &http.Server{Handler: mux}
+	return nil
+}
+
+// runWebSocket serves MQTT over WebSocket, it must be called after the broker
+// is initialized, since connections are handled as soon as it is called.
+func (b *Broker) runWebSocket() {
+	err := b.wsServer.Serve(b.wsListener)
+	if err != nil && err != http.ErrServerClosed {
+		logger.SpanErrorf(nil, "mqtt websocket server with addr %v failed: %v", b.wsListener.Addr(), err)
+	}
+}
+
+func (b *Broker) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !b.checkWebSocketSubprotocol(r) {
+		http.Error(w, "subprotocol mqtt is required", http.StatusBadRequest)
+		return
+	}
+	upgrader := &websocket.Upgrader{
+		Subprotocols: webSocketSubprotocols,
+		// browser clients are usually served from other origins
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.SpanErrorf(nil, "upgrade mqtt websocket connection from %v failed: %v", r.RemoteAddr, err)
+		return
+	}
+	b.handleConn(newWSConn(conn))
+}
+
+func (b *Broker) checkWebSocketSubprotocol(r *http.Request) bool {
+	for _, p := range websocket.Subprotocols(r) {
+		for _, s := range webSocketSubprotocols {
+			if p == s {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.Rules = nil
+	spec.DeviceToDevice = true
+	spec.WebSocket = &WebSocket{Port: 8083}
+	broker := getBrokerFromSpec(spec)
+	require.NotNil(t, broker)
+	defer broker.close()
+
+	// websocket and tcp clients share the same broker
+	opts := paho.NewClientOptions().AddBroker("ws://127.0.0.1:8083/mqtt").SetClientID("ws").SetUsername("test").SetPassword("test")
+	wsClient := paho.NewClient(opts)
+	token := wsClient.Connect()
+	token.Wait()
+	require.Nil(t, token.Error())
+	defer wsClient.Disconnect(200)
+
+	ch := make(chan paho.Message, 10)
+	token = wsClient.Subscribe("ws/#", 1, func(c paho.Client, m paho.Message) {
+		ch <- m
+	})
+	token.Wait()
+	require.Nil(t, token.Error())
+
+	tcpClient := getMQTTClient(t, "tcp", "test", "test", true)
+	defer tcpClient.Disconnect(200)
+	for _, payload := range []string{"hello", string(bytes.Repeat([]byte("a"), 100000))} {
+		token = tcpClient.Publish("ws/1", 1, false, payload)
+		token.Wait()
+		require.Nil(t, token.Error())
+		select {
+		case m := <-ch:
+			assert.Equal("ws/1", m.Topic())
+			assert.Equal(payload, string(m.Payload()))
+		case <-time.After(time.Second):
+			t.Fatalf("message not received by websocket client")
+		}
+	}
+	assert.NotNil(broker.getClient("ws"))
+
+	// subprotocol mqtt is required
+	_, resp, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:8083/mqtt", nil)
+	assert.NotNil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	_, resp, err = websocket.DefaultDialer.Dial("ws://127.0.0.1:8083/other", http.Header{"Sec-WebSocket-Protocol": {"mqtt"}})
+	assert.NotNil(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.WebSocket = &WebSocket{Port: 8083, Path: "/ws"}
+	broker := getBrokerFromSpec(spec)
+	require.NotNil(t, broker)
+	defer broker.close()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	conn, _, err := dialer.Dial("ws://127.0.0.1:8083/ws", nil)
+	require.Nil(t, err)
+	defer conn.Close()
+	assert.Equal("mqtt", conn.Subprotocol())
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = "frames"
+	connect.Keepalive = 30
+	buf := &bytes.Buffer{}
+	require.Nil(t, connect.Write(buf))
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.MessageID = 1
+	subscribe.Topics = []string{"a/b"}
+	subscribe.Qoss = []byte{QoS1}
+	require.Nil(t, subscribe.Write(buf))
+
+	// packets are split into and merged in messages
+	data := buf.Bytes()
+	assert.Nil(conn.WriteMessage(websocket.BinaryMessage, data[:5]))
+	assert.Nil(conn.WriteMessage(websocket.BinaryMessage, data[5:]))
+
+	read := func() packets.ControlPacket {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		msgType, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(websocket.BinaryMessage, msgType)
+		packet, err := packets.ReadPacket(bytes.NewReader(msg))
+		require.Nil(t, err)
+		return packet
+	}
+	connack, ok := read().(*packets.ConnackPacket)
+	require.True(t, ok)
+	assert.Equal(byte(packets.Accepted), connack.ReturnCode)
+	suback, ok := read().(*packets.SubackPacket)
+	require.True(t, ok)
+	assert.Equal([]byte{QoS1}, suback.ReturnCodes)
+
+	// text messages are not allowed
+	assert.Nil(conn.WriteMessage(websocket.TextMessage, []byte("text")))
+	assert.Eventually(func() bool {
+		return broker.getClient("frames") == nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -31,6 +31,7 @@ import (
 
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/wsproxy"
 )
 
 const (
@@ -61,10 +62,6 @@ var (
 
 	// defaultDialer is a dialer with all fields set to the default zero values.
 	defaultDialer = websocket.DefaultDialer
-
-	// defaultInterval is the default interval for polling websocket client and server which is
-	//  200ms right now.
-	defaultInterval = 200 * time.Millisecond
 )
 
 // Proxy is a handler that takes an incoming WebSocket
@@ -84,15 +81,25 @@ type Proxy struct {
 	//  dialer contains options for connecting to the backend WebSocket server.
 	dialer *websocket.Dialer
 
+	// controller controls the messages passed by the proxy.
+	controller *wsproxy.Controller
+	stats      wsproxy.Stats
+
 	// done is the channel for shutdowning this proxy.
 	done chan struct{}
 }
 
 // NewProxy returns a new Websocket proxy.
 func newProxy(superSpec *supervisor.Spec) *Proxy {
+	controller, err := wsproxy.New(superSpec.ObjectSpec().(*Spec).Controls)
+	if err != nil {
+		panic(err)
+	}
+
 	proxy := &Proxy{
-		superSpec: superSpec,
-		done:      make(chan struct{}),
+		superSpec:  superSpec,
+		controller: controller,
+		done:       make(chan struct{}),
 	}
 	go proxy.run()
 	return proxy
@@ -107,42 +114,6 @@ func (p *Proxy) buildRequestURL(r *http.Request) *url.URL {
 	return &u
 }
 
-// passMsg passes websocket message from src to dst.
-func (p *Proxy) passMsg(src, dst *websocket.Conn, errc chan error, stop chan struct{}) {
-	handle := func() bool {
-		msgType, msg, err := src.ReadMessage()
-		if err != nil {
-			m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
-			if e, ok := err.(*websocket.CloseError); ok {
-				if e.Code != websocket.CloseNoStatusReceived {
-					m = websocket.FormatCloseMessage(e.Code, e.Text)
-				}
-			}
-			dst.WriteMessage(websocket.CloseMessage, m)
-			errc <- err
-			return false
-		}
-		err = dst.WriteMessage(msgType, msg)
-		if err != nil {
-			errc <- err
-			return false
-		}
-		return true
-	}
-
-	for {
-		select {
-		// this request handling is stopped due to some error or websocketserver shutdown.
-		case <-stop:
-			return
-		case <-time.After(defaultInterval):
-			if !handle() {
-				return
-			}
-		}
-	}
-}
-
 // run runs the websocket proxy.
 func (p *Proxy) run() {
 	spec := p.superSpec.ObjectSpec().(*Spec)
@@ -154,7 +125,7 @@ func (p *Proxy) run() {
 	}
 
 	p.backendURL = backendURL
-	dialer := defaultDialer
+	dialer := *defaultDialer
 	if strings.HasPrefix(spec.Backend, "wss") {
 		tlsConfig, err := spec.wssTLSConfig()
 		if err != nil {
@@ -164,7 +135,7 @@ func (p *Proxy) run() {
 		}
 		dialer.TLSClientConfig = tlsConfig
 	}
-	p.dialer = dialer
+	p.dialer = &dialer
 	p.upgrader = defaultUpgrader
 
 	mux := http.NewServeMux()
@@ -251,7 +222,15 @@ func (p *Proxy) upgradeRspHeader(resp *http.Response) http.Header {
 
 // handle implements the http.Handler that proxies WebSocket connections.
 func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
-	connBackend, resp, err := p.dialer.Dial(p.buildRequestURL(req).String(), p.copyHeader(req))
+	protocols, err := p.controller.Subprotocols(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dialer := *p.dialer
+	dialer.Subprotocols = protocols
+
+	connBackend, resp, err := dialer.Dial(p.buildRequestURL(req).String(), p.copyHeader(req))
 	if err != nil {
 		logger.Errorf("%s dials %s failed: %v", p.superSpec.Name(), p.backendURL.String(), err)
 		if resp != nil {
@@ -278,34 +257,18 @@ func (p *Proxy) handle(rw http.ResponseWriter, req *http.Request) {
 	}
 	defer connClient.Close()
 
-	errClient := make(chan error, 1)
-	errBackend := make(chan error, 1)
-	stop := make(chan struct{})
-
-	defer close(stop)
-
-	// pass msg from backend to client via WebSocket protocol.
-	go p.passMsg(connBackend, connClient, errBackend, stop)
-	// pass msg from client to backend via WebSocket protocol.
-	go p.passMsg(connClient, connBackend, errClient, stop)
-
-	var errMsg string
-	select {
-	case err = <-errBackend:
-		errMsg = "%s passes msg from backend: %s to client failed: %v"
-	case err = <-errClient:
-		errMsg = "%s passes msg client to backend: %s failed: %v"
-	case <-p.done:
-		logger.Debugf("shutdown websocketserver in request handling")
-		return
-	}
-
+	err = p.controller.Pass(connClient, connBackend, &p.stats, p.done)
 	if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
-		logger.Errorf(errMsg, p.superSpec.Name(), p.backendURL.String(), err)
+		logger.Debugf("%s websocket connection to %s closed: %v", p.superSpec.Name(), p.backendURL.String(), err)
 	}
 	// other error type is expected, not need to log
 }
 
+// status returns the status of the proxy.
+func (p *Proxy) status() *Status {
+	return &Status{Stats: p.stats.Load()}
+}
+
 // Close closes websocket proxy.
 func (p *Proxy) Close() {
 	close(p.done)
@@ -317,6 +280,7 @@ func (p *Proxy) Close() {
 		logger.Warnf("%s shutdowns http server failed: %v",
 			p.superSpec.Name(), err)
 	}
+	p.controller.Close()
 }
 
 func copyResponse(rw http.ResponseWriter, resp *http.Response) error {
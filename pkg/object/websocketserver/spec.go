@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+
+	"github.com/megaease/easegress/pkg/util/wsproxy"
 )
 
 type (
@@ -37,6 +39,15 @@ type (
 
 		WssCertBase64 string `yaml:"wssCertBase64" jsonschema:"omitempty,format=base64"`
 		WssKeyBase64  string `yaml:"wssKeyBase64" jsonschema:"omitempty,format=base64"`
+
+		// Controls controls the messages passed between clients and
+		// the backend.
+		Controls *wsproxy.Spec `yaml:"controls,omitempty" jsonschema:"omitempty"`
+	}
+
+	// Status is the status of WebSocketServer.
+	Status struct {
+		wsproxy.Stats `yaml:",inline"`
 	}
 )
 
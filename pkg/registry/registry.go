@@ -20,28 +20,39 @@ package registry
 import (
 
 	// Filters
+	_ "github.com/megaease/easegress/pkg/filter/amqp"
 	_ "github.com/megaease/easegress/pkg/filter/apiaggregator"
 	_ "github.com/megaease/easegress/pkg/filter/bridge"
 	_ "github.com/megaease/easegress/pkg/filter/circuitbreaker"
 	_ "github.com/megaease/easegress/pkg/filter/connectcontrol"
 	_ "github.com/megaease/easegress/pkg/filter/corsadaptor"
+	_ "github.com/megaease/easegress/pkg/filter/extauth"
 	_ "github.com/megaease/easegress/pkg/filter/fallback"
 	_ "github.com/megaease/easegress/pkg/filter/headerlookup"
 	_ "github.com/megaease/easegress/pkg/filter/headertojson"
+	_ "github.com/megaease/easegress/pkg/filter/httpcache"
+	_ "github.com/megaease/easegress/pkg/filter/jsontransformer"
 	_ "github.com/megaease/easegress/pkg/filter/kafka"
 	_ "github.com/megaease/easegress/pkg/filter/kafkabackend"
 	_ "github.com/megaease/easegress/pkg/filter/meshadaptor"
 	_ "github.com/megaease/easegress/pkg/filter/mock"
+	_ "github.com/megaease/easegress/pkg/filter/mqttacl"
 	_ "github.com/megaease/easegress/pkg/filter/mqttclientauth"
+	_ "github.com/megaease/easegress/pkg/filter/nats"
 	_ "github.com/megaease/easegress/pkg/filter/proxy"
 	_ "github.com/megaease/easegress/pkg/filter/ratelimiter"
 	_ "github.com/megaease/easegress/pkg/filter/remotefilter"
 	_ "github.com/megaease/easegress/pkg/filter/requestadaptor"
 	_ "github.com/megaease/easegress/pkg/filter/responseadaptor"
 	_ "github.com/megaease/easegress/pkg/filter/retryer"
+	_ "github.com/megaease/easegress/pkg/filter/soapadaptor"
 	_ "github.com/megaease/easegress/pkg/filter/timelimiter"
+	_ "github.com/megaease/easegress/pkg/filter/topicmapper"
 	_ "github.com/megaease/easegress/pkg/filter/validator"
+	_ "github.com/megaease/easegress/pkg/filter/waf"
 	_ "github.com/megaease/easegress/pkg/filter/wasmhost"
+	_ "github.com/megaease/easegress/pkg/filter/webhook"
+	_ "github.com/megaease/easegress/pkg/filter/websocketproxy"
 
 	// Objects
 	_ "github.com/megaease/easegress/pkg/object/autocertmanager"
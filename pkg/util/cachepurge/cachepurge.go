@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cachepurge dispatches cache purge records stored in the cluster
+// to the caches of every member.
+package cachepurge
+
+import (
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+// RecordTTL is how long a purge record is kept in the cluster, expired
+// records are removed when a new one is posted.
+const RecordTTL = 10 * time.Minute
+
+type (
+	// Record is a purge request for the caches of all members.
+	Record struct {
+		// Pipeline and Filter select the caches to purge, the record
+		// applies to all pipelines if Pipeline is empty, and to all
+		// cache filters of the pipeline if Filter is empty.
+		Pipeline string `yaml:"pipeline,omitempty" jsonschema:"omitempty"`
+		Filter   string `yaml:"filter,omitempty" jsonschema:"omitempty"`
+		// Key is the cache key, which begins with the host and the path
+		// of requests, the record removes all entries whose keys begin
+		// with it if Prefix is true.
+		Key       string    `yaml:"key" jsonschema:"required"`
+		Prefix    bool      `yaml:"prefix,omitempty" jsonschema:"omitempty"`
+		CreatedAt time.Time `yaml:"createdAt,omitempty" jsonschema:"omitempty"`
+	}
+
+	// PurgeFunc removes the entries of the key, or the ones whose keys
+	// begin with the key if prefix is true, it returns the number of
+	// removed entries.
+	PurgeFunc func(key string, prefix bool) int
+
+	// Watcher watches the purge records in the cluster, and calls the
+	// purge function for the ones matching its pipeline and filter.
+	Watcher struct {
+		cls      cluster.Cluster
+		pipeline string
+		filter   string
+		purge    PurgeFunc
+
+		// startRevision is the latest create revision of the records
+		// when the watcher starts, records not newer than it are ignored.
+		// NOTE: The revisions are used instead of the creation time of
+		// records, because the clocks of members may differ.
+		startRevision int64
+		applied       map[string]bool
+		done          chan struct{}
+	}
+)
+
+// Validate validates Record.
+func (r *Record) Validate() error {
+	if r.Key == "" {
+		return fmt.Errorf("key is empty")
+	}
+	if r.Pipeline == "" && r.Filter != "" {
+		return fmt.Errorf("filter %s is specified without pipeline", r.Filter)
+	}
+	return nil
+}
+
+// Match reports whether the record applies to the filter of the pipeline.
+func (r *Record) Match(pipeline, filter string) bool {
+	if r.Pipeline != "" && r.Pipeline != pipeline {
+		return false
+	}
+	return r.Filter == "" || r.Filter == filter
+}
+
+// Watch creates a Watcher, records created before it are ignored
+// because they were posted before the cache is created.
+func Watch(cls cluster.Cluster, pipeline, filter string, purge PurgeFunc) *Watcher {
+	w := &Watcher{
+		cls:      cls,
+		pipeline: pipeline,
+		filter:   filter,
+		purge:    purge,
+		applied:  map[string]bool{},
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *Watcher) run() {
+	for !w.loadStartRevision() {
+		select {
+		case <-time.After(10 * time.Second):
+		case <-w.done:
+			return
+		}
+	}
+
+	for {
+		w.sync()
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// loadStartRevision loads the latest create revision of the existing
+// records, it returns false if it failed.
+func (w *Watcher) loadStartRevision() bool {
+	kvs, err := w.cls.GetRawPrefix(w.cls.Layout().CachePurgePrefix())
+	if err != nil {
+		logger.Errorf("failed to get cache purge records: %v", err)
+		return false
+	}
+
+	for _, kv := range kvs {
+		if kv.CreateRevision > w.startRevision {
+			w.startRevision = kv.CreateRevision
+		}
+	}
+	return true
+}
+
+// sync watches the records until the watcher is closed or the syncer
+// stops, the caller resyncs in the latter case.
+func (w *Watcher) sync() {
+	syncer, err := w.cls.Syncer(time.Minute)
+	if err != nil {
+		logger.Errorf("failed to watch cache purge records: %v", err)
+		return
+	}
+	defer syncer.Close()
+
+	ch, err := syncer.SyncRawPrefix(w.cls.Layout().CachePurgePrefix())
+	if err != nil {
+		logger.Errorf("failed to watch cache purge records: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				logger.Warnf("watching cache purge records stopped, resync")
+				return
+			}
+			w.apply(data)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Watcher) apply(data map[string]*mvccpb.KeyValue) {
+	for k, kv := range data {
+		if w.applied[k] {
+			continue
+		}
+		w.applied[k] = true
+
+		record := &Record{}
+		if err := yaml.Unmarshal(kv.Value, record); err != nil {
+			logger.Errorf("unmarshal cache purge record %s failed: %v", k, err)
+			continue
+		}
+		if kv.CreateRevision <= w.startRevision || !record.Match(w.pipeline, w.filter) {
+			continue
+		}
+
+		count := w.purge(record.Key, record.Prefix)
+		logger.Infof("cache purge record %s applied to %s/%s: %d entries purged",
+			k, w.pipeline, w.filter, count)
+	}
+
+	for k := range w.applied {
+		if data[k] == nil {
+			delete(w.applied, k)
+		}
+	}
+}
+
+// Close stops watching.
+func (w *Watcher) Close() {
+	close(w.done)
+}
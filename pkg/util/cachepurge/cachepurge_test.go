@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cachepurge
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"gopkg.in/yaml.v2"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func TestRecord(t *testing.T) {
+	if err := (&Record{}).Validate(); err == nil {
+		t.Errorf("record without key should be invalid")
+	}
+	if err := (&Record{Key: "example.com/", Filter: "cache"}).Validate(); err == nil {
+		t.Errorf("record with filter but without pipeline should be invalid")
+	}
+
+	r := &Record{Key: "example.com/"}
+	if !r.Match("pipeline", "cache") {
+		t.Errorf("record without pipeline should match all")
+	}
+	r.Pipeline = "pipeline"
+	if !r.Match("pipeline", "cache") || r.Match("other", "cache") {
+		t.Errorf("record should only match its pipeline")
+	}
+	r.Filter = "cache"
+	if !r.Match("pipeline", "cache") || r.Match("pipeline", "proxy") {
+		t.Errorf("record should only match its filter")
+	}
+}
+
+func kv(t *testing.T, r *Record, revision int64) *mvccpb.KeyValue {
+	buff, err := yaml.Marshal(r)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	return &mvccpb.KeyValue{Value: buff, CreateRevision: revision, ModRevision: revision}
+}
+
+func TestWatcherApply(t *testing.T) {
+	var purged []string
+	w := &Watcher{
+		pipeline:      "pipeline",
+		filter:        "cache",
+		startRevision: 10,
+		applied:       map[string]bool{},
+		purge: func(key string, prefix bool) int {
+			purged = append(purged, key)
+			return 1
+		},
+	}
+
+	// The clock of the member posting records doesn't matter.
+	old := kv(t, &Record{Key: "old", CreatedAt: time.Now().Add(time.Hour)}, 10)
+	newer := kv(t, &Record{Key: "new", CreatedAt: time.Now().Add(-time.Hour)}, 11)
+
+	// The first snapshot may contain records created after watching.
+	w.apply(map[string]*mvccpb.KeyValue{"/1": old, "/2": newer})
+	if len(purged) != 1 || purged[0] != "new" {
+		t.Fatalf("purged %v, want [new]", purged)
+	}
+
+	w.apply(map[string]*mvccpb.KeyValue{
+		"/1": old,
+		"/2": newer,
+		"/3": kv(t, &Record{Key: "other", Pipeline: "other"}, 12),
+		"/4": kv(t, &Record{Key: "newest"}, 13),
+	})
+	if len(purged) != 2 || purged[1] != "newest" {
+		t.Fatalf("purged %v, want [new newest]", purged)
+	}
+
+	// Applied records are not applied again, and removed ones are forgotten.
+	w.apply(map[string]*mvccpb.KeyValue{"/2": newer})
+	if len(purged) != 2 || len(w.applied) != 1 {
+		t.Errorf("purged %v, applied %v", purged, w.applied)
+	}
+}
@@ -26,6 +26,12 @@ const (
 	KeyContentEncoding = "Content-Encoding"
 	// KeyContentLength is the key of Content-Length.
 	KeyContentLength = "Content-Length"
+	// KeyContentType is the key of Content-Type.
+	KeyContentType = "Content-Type"
+	// KeyConnection is the key of Connection.
+	KeyConnection = "Connection"
+	// KeyUpgrade is the key of Upgrade.
+	KeyUpgrade = "Upgrade"
 	// KeyVary is the key of Vary.
 	KeyVary = "Vary"
 
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package iotool provides helpers for readers and writers.
+package iotool
+
+import (
+	"bytes"
+	"io"
+)
+
+// ReadBody reads the body, it returns nil if the body is larger than max,
+// and the returned reader is the body to put back.
+func ReadBody(body io.Reader, max int64) ([]byte, io.Reader, error) {
+	data, truncated, rest, err := PeekBody(body, max)
+	if err != nil {
+		return nil, nil, err
+	}
+	if truncated {
+		return nil, rest, nil
+	}
+	return data, rest, nil
+}
+
+// PeekBody reads at most max bytes of the body, truncated reports whether
+// the body is larger than max. The returned reader is the whole body to
+// put back, it is valid even if an error is returned.
+func PeekBody(body io.Reader, max int64) (data []byte, truncated bool, rest io.Reader, err error) {
+	if body == nil {
+		return []byte{}, false, nil, nil
+	}
+
+	data, err = io.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, false, io.MultiReader(bytes.NewReader(data), body), err
+	}
+	if int64(len(data)) > max {
+		return data[:max], true, io.MultiReader(bytes.NewReader(data), body), nil
+	}
+	return data, false, bytes.NewReader(data), nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package iotool
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadBody(t *testing.T) {
+	data, body, err := ReadBody(nil, 4)
+	if err != nil || len(data) != 0 || body != nil {
+		t.Errorf("nil body should be read as empty")
+	}
+
+	data, body, err = ReadBody(strings.NewReader("abcd"), 4)
+	if err != nil || string(data) != "abcd" {
+		t.Fatalf("want abcd, got %q, %v", data, err)
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "abcd" {
+		t.Errorf("want body abcd, got %q", rest)
+	}
+
+	data, body, err = ReadBody(strings.NewReader("abcdef"), 4)
+	if err != nil || data != nil {
+		t.Fatalf("body larger than max should not be returned")
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "abcdef" {
+		t.Errorf("want body abcdef, got %q", rest)
+	}
+}
+
+func TestPeekBody(t *testing.T) {
+	data, truncated, body, err := PeekBody(strings.NewReader("abcd"), 4)
+	if err != nil || truncated || string(data) != "abcd" {
+		t.Fatalf("want abcd, got %q, %v, %v", data, truncated, err)
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "abcd" {
+		t.Errorf("want body abcd, got %q", rest)
+	}
+
+	data, truncated, body, err = PeekBody(strings.NewReader("abcdef"), 4)
+	if err != nil || !truncated || string(data) != "abcd" {
+		t.Fatalf("want truncated abcd, got %q, %v, %v", data, truncated, err)
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "abcdef" {
+		t.Errorf("want body abcdef, got %q", rest)
+	}
+
+	failed := io.MultiReader(strings.NewReader("ab"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	_, _, body, err = PeekBody(failed, 4)
+	if err == nil {
+		t.Fatalf("error should be returned")
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "ab" {
+		t.Errorf("read data should be put back, got %q", rest)
+	}
+}
@@ -20,6 +20,7 @@ package memorycache
 import (
 	"bytes"
 	"strings"
+	"sync"
 	"time"
 
 	cache "github.com/patrickmn/go-cache"
@@ -33,6 +34,8 @@ import (
 const (
 	cleanupIntervalFactor = 2
 	cleanupIntervalMin    = 1 * time.Minute
+
+	defaultCoalesceTimeout = 10 * time.Second
 )
 
 type (
@@ -41,6 +44,10 @@ type (
 		spec *Spec
 
 		cache *cache.Cache
+
+		coalesceTimeout time.Duration
+		mutex           sync.Mutex
+		inflight        map[string]chan struct{}
 	}
 
 	// Spec describes the MemoryCache.
@@ -49,6 +56,11 @@ type (
 		MaxEntryBytes uint32   `yaml:"maxEntryBytes" jsonschema:"required,minimum=1"`
 		Codes         []int    `yaml:"codes" jsonschema:"required,minItems=1,uniqueItems=true,format=httpcode-array"`
 		Methods       []string `yaml:"methods" jsonschema:"required,minItems=1,uniqueItems=true,format=httpmethod-array"`
+		// Coalesce makes concurrent misses of the same key wait for the
+		// first one to store its response, instead of all of them going
+		// to the backend.
+		Coalesce        bool   `yaml:"coalesce,omitempty" jsonschema:"omitempty"`
+		CoalesceTimeout string `yaml:"coalesceTimeout,omitempty" jsonschema:"omitempty,format=duration"`
 	}
 
 	cacheEntry struct {
@@ -72,21 +84,37 @@ func New(spec *Spec) *MemoryCache {
 	}
 	cache := cache.New(expiration, cleanupInterval)
 
+	coalesceTimeout := defaultCoalesceTimeout
+	if spec.CoalesceTimeout != "" {
+		coalesceTimeout, err = time.ParseDuration(spec.CoalesceTimeout)
+		if err != nil {
+			logger.Errorf("BUG: parse duration %s failed: %v", spec.CoalesceTimeout, err)
+			coalesceTimeout = defaultCoalesceTimeout
+		}
+	}
+
 	return &MemoryCache{
-		spec:  spec,
-		cache: cache,
+		spec:            spec,
+		cache:           cache,
+		coalesceTimeout: coalesceTimeout,
+		inflight:        map[string]chan struct{}{},
 	}
 }
 
+// keySeparator separates the host and path from the rest of the key, it
+// can't appear in paths, while a space could be escaped into one.
+const keySeparator = "\x00"
+
+// key begins with the host and the path, so that entries could be purged
+// by them.
 func (mc *MemoryCache) key(ctx context.HTTPContext) string {
 	r := ctx.Request()
-	return stringtool.Cat(r.Scheme(), r.Host(), r.Path(), r.Method())
+	return stringtool.Cat(strings.ToLower(r.Host()), r.Path(), keySeparator, r.Scheme(), keySeparator, r.Method())
 }
 
-// Load tries to load cache for HTTPContext.
-func (mc *MemoryCache) Load(ctx context.HTTPContext) (loaded bool) {
+func (mc *MemoryCache) cacheable(ctx context.HTTPContext) bool {
 	// Reference: https://tools.ietf.org/html/rfc7234#section-5.2
-	r, w := ctx.Request(), ctx.Response()
+	r := ctx.Request()
 
 	matchMethod := false
 	for _, method := range mc.spec.Methods {
@@ -105,6 +133,16 @@ func (mc *MemoryCache) Load(ctx context.HTTPContext) (loaded bool) {
 		}
 	}
 
+	return true
+}
+
+// Load tries to load cache for HTTPContext.
+func (mc *MemoryCache) Load(ctx context.HTTPContext) (loaded bool) {
+	if !mc.cacheable(ctx) {
+		return false
+	}
+
+	w := ctx.Response()
 	v, ok := mc.cache.Get(mc.key(ctx))
 	if ok {
 		entry := v.(*cacheEntry)
@@ -117,10 +155,79 @@ func (mc *MemoryCache) Load(ctx context.HTTPContext) (loaded bool) {
 	return ok
 }
 
+// Coalesce is called after Load missed, it returns false immediately if
+// the caller is the first one missing the key, which should request the
+// backend, and the others wait until the response of the first one is
+// stored. It returns true if the caller waited, and should try Load again.
+func (mc *MemoryCache) Coalesce(ctx context.HTTPContext) (waited bool) {
+	if !mc.spec.Coalesce || !mc.cacheable(ctx) {
+		return false
+	}
+
+	key := mc.key(ctx)
+
+	mc.mutex.Lock()
+	ch, ok := mc.inflight[key]
+	if !ok {
+		ch = make(chan struct{})
+		mc.inflight[key] = ch
+	}
+	mc.mutex.Unlock()
+
+	if !ok {
+		// The response is stored when it is flushed, which happens before
+		// the finish functions are called.
+		ctx.OnFinish(func() {
+			mc.mutex.Lock()
+			delete(mc.inflight, key)
+			mc.mutex.Unlock()
+			close(ch)
+		})
+		return false
+	}
+
+	timer := time.NewTimer(mc.coalesceTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		ctx.AddTag("cacheCoalesced")
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Purge removes the entry of the key, or all entries whose keys begin with
+// the key if prefix is true. The key consists of the host and the path,
+// it returns the number of removed entries.
+func (mc *MemoryCache) Purge(key string, prefix bool) int {
+	count := 0
+	for k := range mc.cache.Items() {
+		hostPath := k
+		if i := strings.Index(k, keySeparator); i >= 0 {
+			hostPath = k[:i]
+		}
+
+		if hostPath == key || (prefix && strings.HasPrefix(hostPath, key)) {
+			mc.cache.Delete(k)
+			count++
+		}
+	}
+	return count
+}
+
 // Store tries to store cache for HTTPContext.
 func (mc *MemoryCache) Store(ctx context.HTTPContext) {
 	r, w := ctx.Request(), ctx.Response()
 
+	// Streaming responses may never end.
+	if w.Streaming() {
+		return
+	}
+
 	matchMethod := false
 	for _, method := range mc.spec.Methods {
 		if r.Method() == method {
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package memorycache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/tracing"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newContext(url string) context.HTTPContext {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	return context.New(httptest.NewRecorder(), req, tracing.NoopTracing, "")
+}
+
+func newSpec() *Spec {
+	return &Spec{
+		Expiration:    "10s",
+		MaxEntryBytes: 1024,
+		Codes:         []int{http.StatusOK},
+		Methods:       []string{http.MethodGet},
+	}
+}
+
+func respond(ctx context.HTTPContext, mc *MemoryCache, body string) {
+	ctx.Response().SetStatusCode(http.StatusOK)
+	ctx.Response().SetBody(strings.NewReader(body))
+	mc.Store(ctx)
+	ctx.Finish()
+}
+
+func TestCoalesce(t *testing.T) {
+	spec := newSpec()
+	spec.Coalesce = true
+	mc := New(spec)
+
+	leader := newContext("http://example.com/hot")
+	if mc.Load(leader) {
+		t.Fatalf("load should miss")
+	}
+	if mc.Coalesce(leader) {
+		t.Fatalf("the first miss should not wait")
+	}
+
+	done := make(chan bool)
+	go func() {
+		follower := newContext("http://example.com/hot")
+		done <- mc.Coalesce(follower) && mc.Load(follower)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("the follower should wait for the leader")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	respond(leader, mc, "hot content")
+	select {
+	case loaded := <-done:
+		if !loaded {
+			t.Errorf("the follower should load the response of the leader")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the follower is not woken up")
+	}
+
+	// Other keys and disabled coalescing never wait.
+	if mc.Coalesce(newContext("http://example.com/other")) {
+		t.Errorf("the first miss of another key should not wait")
+	}
+	mc = New(newSpec())
+	mc.Coalesce(newContext("http://example.com/hot"))
+	if mc.Coalesce(newContext("http://example.com/hot")) {
+		t.Errorf("coalescing is disabled")
+	}
+}
+
+func TestCoalesceTimeout(t *testing.T) {
+	spec := newSpec()
+	spec.Coalesce = true
+	spec.CoalesceTimeout = "10ms"
+	mc := New(spec)
+
+	mc.Coalesce(newContext("http://example.com/slow"))
+	if mc.Coalesce(newContext("http://example.com/slow")) {
+		t.Errorf("the follower should give up waiting")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	mc := New(newSpec())
+	for _, url := range []string{
+		"http://example.com/static/a.js",
+		"http://example.com/static/b.js",
+		"https://Example.com/static/a.js",
+		"http://example.com/index.html",
+	} {
+		respond(newContext(url), mc, "content")
+	}
+
+	if n := mc.Purge("example.com/static/a.js", false); n != 2 {
+		t.Errorf("purged %d entries, want 2", n)
+	}
+	if mc.Load(newContext("http://example.com/static/a.js")) {
+		t.Errorf("purged entry is loaded")
+	}
+	if n := mc.Purge("example.com/static/", true); n != 1 {
+		t.Errorf("purged %d entries, want 1", n)
+	}
+	if !mc.Load(newContext("http://example.com/index.html")) {
+		t.Errorf("entry out of the prefix should not be purged")
+	}
+
+	// Paths may contain spaces.
+	respond(newContext("http://example.com/my%20file.txt"), mc, "content")
+	if n := mc.Purge("example.com/my file.txt", false); n != 1 {
+		t.Errorf("purged %d entries, want 1", n)
+	}
+}
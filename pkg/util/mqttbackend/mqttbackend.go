@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mqttbackend provides the common parts of the filters that send
+// messages published by MQTT clients to backends, like getting messages
+// from the MQTT context and delivering them with retries.
+package mqttbackend
+
+import (
+	"github.com/megaease/easegress/pkg/context"
+)
+
+const (
+	// HeaderContentType is the header of MQTT 5.0 content type.
+	HeaderContentType = "mqtt-content-type"
+	// HeaderResponseTopic is the header of MQTT 5.0 response topic.
+	HeaderResponseTopic = "mqtt-response-topic"
+	// HeaderCorrelationData is the header of MQTT 5.0 correlation data.
+	HeaderCorrelationData = "mqtt-correlation-data"
+)
+
+type (
+	// KVMap defines the keys to get the topic, headers and payload of
+	// messages from the kv map of MQTT context, which are set by filters
+	// like TopicMapper.
+	KVMap struct {
+		TopicKey   string `yaml:"topicKey" jsonschema:"omitempty"`
+		HeaderKey  string `yaml:"headerKey" jsonschema:"omitempty"`
+		PayloadKey string `yaml:"payloadKey" jsonschema:"omitempty"`
+	}
+
+	// Message is the message sent to backends.
+	Message struct {
+		ClientID string
+		Topic    string
+		Headers  map[string]string
+		Payload  []byte
+	}
+)
+
+// GetMessage gets the message from the kv map of the MQTT context, the
+// topic and payload missing in the kv map are taken from the publish
+// packet, and topic falls back to defaultTopic at last. convert is applied
+// to topics of publish packets if it is not nil. It returns false if the
+// topic or payload is not found.
+//
+// MQTT 5.0 user properties, content type, response topic and correlation
+// data are added to headers, headers from the kv map take precedence.
+func GetMessage(ctx context.MQTTContext, kv *KVMap, defaultTopic string, convert func(string) string) (*Message, bool) {
+	msg := &Message{ClientID: ctx.Client().ClientID()}
+	var headers map[string]string
+	var ok bool
+
+	if kv != nil && kv.TopicKey != "" {
+		msg.Topic, ok = ctx.GetKV(kv.TopicKey).(string)
+		if !ok {
+			return nil, false
+		}
+	}
+	if kv != nil && kv.HeaderKey != "" {
+		headers, ok = ctx.GetKV(kv.HeaderKey).(map[string]string)
+		if !ok {
+			return nil, false
+		}
+	}
+	if kv != nil && kv.PayloadKey != "" {
+		msg.Payload, ok = ctx.GetKV(kv.PayloadKey).([]byte)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	if ctx.PacketType() == context.MQTTPublish {
+		p := ctx.PublishPacket()
+		if msg.Topic == "" {
+			msg.Topic = p.TopicName
+			if convert != nil {
+				msg.Topic = convert(msg.Topic)
+			}
+		}
+		if msg.Payload == nil {
+			msg.Payload = p.Payload
+		}
+	}
+	if msg.Topic == "" {
+		msg.Topic = defaultTopic
+	}
+	if msg.Topic == "" || msg.Payload == nil {
+		return nil, false
+	}
+
+	msg.Headers = make(map[string]string, len(headers))
+	if props := ctx.Properties(); props != nil {
+		for _, u := range props.User {
+			msg.Headers[u.Key] = u.Value
+		}
+		if props.ContentType != "" {
+			msg.Headers[HeaderContentType] = props.ContentType
+		}
+		if props.ResponseTopic != "" {
+			msg.Headers[HeaderResponseTopic] = props.ResponseTopic
+		}
+		if props.CorrelationData != nil {
+			msg.Headers[HeaderCorrelationData] = string(props.CorrelationData)
+		}
+	}
+	for k, v := range headers {
+		msg.Headers[k] = v
+	}
+	return msg, true
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttbackend
+
+import (
+	stdcontext "context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+type mockPublisher struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	msgs     []*Message
+}
+
+func (m *mockPublisher) Publish(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return m.err
+	}
+	m.msgs = append(m.msgs, msg)
+	return nil
+}
+
+func (m *mockPublisher) published() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.msgs)
+}
+
+func newContext(topic string, payload []byte, props *packets5.Properties) context.MQTTContext {
+	client := &context.MockMQTTClient{MockClientID: "client"}
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Payload = payload
+	return context.NewMQTT5Context(stdcontext.Background(), client, packet, props)
+}
+
+func TestGetMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := newContext("a/b", []byte("text"), nil)
+	msg, ok := GetMessage(ctx, nil, "default", nil)
+	assert.True(ok)
+	assert.Equal(&Message{ClientID: "client", Topic: "a/b", Headers: map[string]string{}, Payload: []byte("text")}, msg)
+
+	convert := func(topic string) string { return "converted" }
+	msg, ok = GetMessage(ctx, nil, "", convert)
+	assert.True(ok)
+	assert.Equal("converted", msg.Topic)
+
+	kv := &KVMap{TopicKey: "topic", HeaderKey: "headers", PayloadKey: "payload"}
+	_, ok = GetMessage(ctx, kv, "", nil)
+	assert.False(ok)
+
+	props := &packets5.Properties{
+		ContentType:     "text/plain",
+		ResponseTopic:   "reply",
+		CorrelationData: []byte("123"),
+		User:            []packets5.User{{Key: "k1", Value: "user"}, {Key: "k2", Value: "user"}},
+	}
+	ctx = newContext("a/b", []byte("text"), props)
+	ctx.SetKV("topic", "mapped")
+	ctx.SetKV("headers", map[string]string{"k1": "mapped"})
+	ctx.SetKV("payload", []byte("payload"))
+	msg, ok = GetMessage(ctx, kv, "", convert)
+	assert.True(ok)
+	assert.Equal("mapped", msg.Topic)
+	assert.Equal("payload", string(msg.Payload))
+	assert.Equal(map[string]string{
+		"k1":                  "mapped",
+		"k2":                  "user",
+		HeaderContentType:     "text/plain",
+		HeaderResponseTopic:   "reply",
+		HeaderCorrelationData: "123",
+	}, msg.Headers)
+}
+
+func TestSenderAtLeastOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &mockPublisher{failures: 2, err: fmt.Errorf("unavailable")}
+	s := NewSender(&Delivery{MaxRetries: 2, RetryInterval: "1ms"}, p)
+	defer s.Close()
+	assert.Nil(s.Send(&Message{Topic: "a"}))
+	assert.Equal(1, p.published())
+	assert.Equal(&Stats{Sent: 1, Retried: 2}, s.Status())
+
+	p.failures = 3
+	assert.NotNil(s.Send(&Message{Topic: "a"}))
+	assert.Equal(&Stats{Sent: 1, Failed: 1, Retried: 4}, s.Status())
+
+	// permanent errors are not retried
+	p.failures = 1
+	p.err = Permanent(fmt.Errorf("bad request"))
+	assert.Equal("bad request", s.Send(&Message{Topic: "a"}).Error())
+	assert.Equal(&Stats{Sent: 1, Failed: 2, Retried: 4}, s.Status())
+	assert.Equal(0, p.failures)
+}
+
+func TestSenderAtMostOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &mockPublisher{failures: 1, err: fmt.Errorf("unavailable")}
+	s := NewSender(&Delivery{Guarantee: AtMostOnce, MaxRetries: 1, RetryInterval: "1ms", QueueSize: 10}, p)
+	for i := 0; i < 3; i++ {
+		assert.Nil(s.Send(&Message{Topic: "a"}))
+	}
+	assert.Eventually(func() bool { return p.published() == 3 }, time.Second, time.Millisecond)
+	assert.Equal(&Stats{Sent: 3, Retried: 1}, s.Status())
+	s.Close()
+	assert.NotNil(s.Send(&Message{Topic: "a"}))
+
+	// messages are dropped when the queue is full
+	p = &mockPublisher{}
+	s = &Sender{publisher: p, queue: make(chan *Message, 1), done: make(chan struct{})}
+	assert.Nil(s.Send(&Message{Topic: "a"}))
+	assert.NotNil(s.Send(&Message{Topic: "a"}))
+	assert.Equal(uint64(1), s.Status().Dropped)
+}
+
+func TestDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	var d *Delivery
+	assert.True(d.AtLeastOnce())
+	assert.Equal(defaultTimeout, d.AttemptTimeout())
+
+	d = &Delivery{Guarantee: AtMostOnce, Timeout: "1s"}
+	assert.False(d.AtLeastOnce())
+	assert.Equal(time.Second, d.AttemptTimeout())
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttbackend
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const (
+	// AtMostOnce sends messages in background, the publish is acknowledged
+	// to MQTT clients before the message is accepted by the backend, and the
+	// message is dropped after retries or if the queue is full.
+	AtMostOnce = "atMostOnce"
+	// AtLeastOnce waits for the backend to accept the message, the publish
+	// is dropped and not acknowledged if the message fails after retries,
+	// so MQTT clients send it again.
+	AtLeastOnce = "atLeastOnce"
+
+	defaultRetryInterval = 100 * time.Millisecond
+	maxRetryInterval     = 10 * time.Second
+	defaultTimeout       = 5 * time.Second
+	defaultQueueSize     = 1024
+)
+
+type (
+	// Delivery describes the delivery guarantee and retries of messages.
+	Delivery struct {
+		// Guarantee defaults to atLeastOnce.
+		Guarantee  string `yaml:"guarantee" jsonschema:"omitempty,enum=,enum=atMostOnce,enum=atLeastOnce"`
+		MaxRetries int    `yaml:"maxRetries" jsonschema:"omitempty,minimum=0"`
+		// RetryInterval is doubled after every retry, up to 10s.
+		RetryInterval string `yaml:"retryInterval" jsonschema:"omitempty,format=duration"`
+		// Timeout is the timeout of every attempt to send a message.
+		Timeout string `yaml:"timeout" jsonschema:"omitempty,format=duration"`
+		// QueueSize is the size of the queue of messages sent in background for atMostOnce.
+		QueueSize int `yaml:"queueSize" jsonschema:"omitempty,minimum=1"`
+	}
+
+	// Publisher publishes a message to the backend, it returns nil only if
+	// the message is accepted by the backend.
+	Publisher interface {
+		Publish(msg *Message) error
+	}
+
+	// Sender sends messages to the backend by the Publisher with the
+	// delivery guarantee and retries.
+	Sender struct {
+		publisher     Publisher
+		atLeastOnce   bool
+		maxRetries    int
+		retryInterval time.Duration
+
+		queue chan *Message
+		done  chan struct{}
+		wg    sync.WaitGroup
+		stats Stats
+	}
+
+	// Stats is the statistics of messages, it is updated atomically.
+	Stats struct {
+		Sent    uint64 `yaml:"sent"`
+		Failed  uint64 `yaml:"failed"`
+		Retried uint64 `yaml:"retried"`
+		Dropped uint64 `yaml:"dropped"`
+	}
+
+	permanentError struct {
+		err error
+	}
+)
+
+// Permanent wraps err to tell the Sender not to retry the message.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// AtLeastOnce returns whether the guarantee is atLeastOnce.
+func (d *Delivery) AtLeastOnce() bool {
+	return d == nil || d.Guarantee != AtMostOnce
+}
+
+// AttemptTimeout returns the timeout of every attempt to send a message.
+func (d *Delivery) AttemptTimeout() time.Duration {
+	if d == nil || d.Timeout == "" {
+		return defaultTimeout
+	}
+	timeout, err := time.ParseDuration(d.Timeout)
+	if err != nil || timeout <= 0 {
+		logger.Errorf("BUG: parse duration %s failed: %v", d.Timeout, err)
+		return defaultTimeout
+	}
+	return timeout
+}
+
+// NewSender creates a Sender, spec could be nil to use the default delivery.
+func NewSender(spec *Delivery, publisher Publisher) *Sender {
+	s := &Sender{
+		publisher:     publisher,
+		atLeastOnce:   spec.AtLeastOnce(),
+		retryInterval: defaultRetryInterval,
+		done:          make(chan struct{}),
+	}
+	if spec == nil {
+		return s
+	}
+
+	s.maxRetries = spec.MaxRetries
+	if spec.RetryInterval != "" {
+		interval, err := time.ParseDuration(spec.RetryInterval)
+		if err != nil || interval <= 0 {
+			logger.Errorf("BUG: parse duration %s failed: %v", spec.RetryInterval, err)
+		} else {
+			s.retryInterval = interval
+		}
+	}
+	if !s.atLeastOnce {
+		size := spec.QueueSize
+		if size <= 0 {
+			size = defaultQueueSize
+		}
+		s.queue = make(chan *Message, size)
+		s.wg.Add(1)
+		go s.run()
+	}
+	return s
+}
+
+// Send sends the message. For atLeastOnce, it returns after the message
+// is accepted by the backend or fails after retries. For atMostOnce, it
+// puts the message into the queue and returns immediately, the message is
+// dropped if the queue is full.
+func (s *Sender) Send(msg *Message) error {
+	if s.atLeastOnce {
+		return s.send(msg)
+	}
+
+	select {
+	case <-s.done:
+		return fmt.Errorf("sender closed")
+	default:
+	}
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		atomic.AddUint64(&s.stats.Dropped, 1)
+		return fmt.Errorf("queue is full")
+	}
+}
+
+func (s *Sender) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			atomic.AddUint64(&s.stats.Dropped, uint64(len(s.queue)))
+			return
+		case msg := <-s.queue:
+			if err := s.send(msg); err != nil {
+				logger.Errorf("send message of topic %s failed: %v", msg.Topic, err)
+			}
+		}
+	}
+}
+
+func (s *Sender) send(msg *Message) error {
+	interval := s.retryInterval
+	for i := 0; ; i++ {
+		err := s.publisher.Publish(msg)
+		if err == nil {
+			atomic.AddUint64(&s.stats.Sent, 1)
+			return nil
+		}
+
+		var pe *permanentError
+		if i >= s.maxRetries || errors.As(err, &pe) {
+			atomic.AddUint64(&s.stats.Failed, 1)
+			return err
+		}
+
+		logger.Debugf("send message of topic %s failed, retry after %v: %v", msg.Topic, interval, err)
+		select {
+		case <-s.done:
+			atomic.AddUint64(&s.stats.Failed, 1)
+			return err
+		case <-time.After(interval):
+		}
+		atomic.AddUint64(&s.stats.Retried, 1)
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// Status returns a snapshot of the stats.
+func (s *Sender) Status() *Stats {
+	return &Stats{
+		Sent:    atomic.LoadUint64(&s.stats.Sent),
+		Failed:  atomic.LoadUint64(&s.stats.Failed),
+		Retried: atomic.LoadUint64(&s.stats.Retried),
+		Dropped: atomic.LoadUint64(&s.stats.Dropped),
+	}
+}
+
+// Close closes the Sender, messages in the queue are dropped.
+func (s *Sender) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
@@ -0,0 +1,575 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yamljsontool "github.com/ghodss/yaml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultGroup is the operation group of operations without tags.
+	DefaultGroup = "default"
+
+	kindHTTPServer   = "HTTPServer"
+	kindHTTPPipeline = "HTTPPipeline"
+)
+
+var (
+	methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+	templateRegexp  = regexp.MustCompile(`\{[^{}/]+\}`)
+	invalidNameChar = regexp.MustCompile(`[^a-z0-9\-_\.~]+`)
+)
+
+type (
+	// Options are the options to generate objects from an OpenAPI 3 document.
+	Options struct {
+		// Name is the name of the HTTPServer, and the prefix of the names
+		// of the HTTPPipelines.
+		Name string `yaml:"name"`
+		// Port is the port of the HTTPServer.
+		Port uint16 `yaml:"port"`
+		// BasePath is prepended to the paths of the document, it defaults
+		// to the path of the first server of the document.
+		BasePath string `yaml:"basePath,omitempty"`
+		// Servers are the backend servers, they default to the servers
+		// of the document.
+		Servers []string `yaml:"servers,omitempty"`
+		// Validator adds a Validator filter to validate requests against
+		// the document.
+		Validator bool `yaml:"validator"`
+		// Mock adds a Mock filter to mock responses by the examples of
+		// the document.
+		Mock bool `yaml:"mock"`
+	}
+
+	// Object is a generated object.
+	Object struct {
+		Kind string
+		Name string
+		YAML string
+	}
+
+	// Result is the result of generation, the HTTPPipelines are placed
+	// before the HTTPServer, so they can be created in order.
+	Result struct {
+		Objects []*Object
+	}
+
+	generator struct {
+		opts     *Options
+		document string
+		root     map[string]interface{}
+		basePath string
+		servers  []string
+	}
+
+	operation struct {
+		method   string
+		path     string
+		group    string
+		mockRule yaml.MapSlice
+	}
+)
+
+// Validate validates the options.
+func (opts *Options) Validate() error {
+	if opts.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if invalidNameChar.MatchString(strings.ToLower(opts.Name)) {
+		return fmt.Errorf("invalid name %s", opts.Name)
+	}
+	if opts.Port == 0 {
+		return fmt.Errorf("port is required")
+	}
+	if opts.BasePath != "" && !strings.HasPrefix(opts.BasePath, "/") {
+		return fmt.Errorf("base path %s must begin with /", opts.BasePath)
+	}
+	for _, s := range opts.Servers {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid server %s", s)
+		}
+	}
+	return nil
+}
+
+// Generate generates an HTTPServer and HTTPPipelines from the OpenAPI 3
+// document, operations are grouped by their first tag, and every group
+// has its own HTTPPipeline. The result is always the same for the same
+// document and options, so regenerating is idempotent.
+func Generate(document []byte, opts *Options) (*Result, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	g := &generator{opts: opts, document: string(document)}
+	if err := g.parse(document); err != nil {
+		return nil, err
+	}
+
+	ops, err := g.operations()
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("no operations defined in the document")
+	}
+	if len(g.servers) == 0 && !opts.Mock {
+		return nil, fmt.Errorf("no backend servers, please specify them in options or the document")
+	}
+
+	groups := map[string][]*operation{}
+	for _, op := range ops {
+		name := PipelineName(opts.Name, op.group)
+		groups[name] = append(groups[name], op)
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := &Result{}
+	for _, name := range names {
+		obj, err := g.pipeline(name, groups[name])
+		if err != nil {
+			return nil, err
+		}
+		result.Objects = append(result.Objects, obj)
+	}
+
+	obj, err := g.server(ops)
+	if err != nil {
+		return nil, err
+	}
+	result.Objects = append(result.Objects, obj)
+	return result, nil
+}
+
+// PipelineName returns the name of the HTTPPipeline of an operation group.
+func PipelineName(name, group string) string {
+	group = invalidNameChar.ReplaceAllString(strings.ToLower(group), "-")
+	return name + "-" + strings.Trim(group, "-")
+}
+
+func (g *generator) parse(document []byte) error {
+	data, err := yamljsontool.YAMLToJSON(document)
+	if err != nil {
+		return fmt.Errorf("decode document failed: %v", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err = d.Decode(&g.root); err != nil || g.root == nil {
+		return fmt.Errorf("decode document failed: %v", err)
+	}
+	if version, _ := g.root["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		return fmt.Errorf("only OpenAPI 3 documents are supported")
+	}
+
+	servers := g.documentServers()
+	if len(servers) > 0 {
+		g.basePath = strings.TrimRight(servers[0].Path, "/")
+	}
+	if g.opts.BasePath != "" {
+		g.basePath = strings.TrimRight(g.opts.BasePath, "/")
+	}
+
+	if len(g.opts.Servers) > 0 {
+		g.servers = g.opts.Servers
+		return nil
+	}
+	for _, u := range servers {
+		if u.Scheme == "" || u.Host == "" {
+			continue
+		}
+		g.servers = append(g.servers, u.Scheme+"://"+u.Host)
+	}
+	return nil
+}
+
+// documentServers returns the servers of the document, with variables
+// replaced by their default values.
+func (g *generator) documentServers() []*url.URL {
+	servers, _ := g.root["servers"].([]interface{})
+
+	result := []*url.URL{}
+	for _, s := range servers {
+		server, _ := s.(map[string]interface{})
+		rawURL, _ := server["url"].(string)
+		vars, _ := server["variables"].(map[string]interface{})
+		rawURL = templateRegexp.ReplaceAllStringFunc(rawURL, func(v string) string {
+			variable, _ := vars[v[1:len(v)-1]].(map[string]interface{})
+			def, _ := variable["default"].(string)
+			return def
+		})
+		if u, err := url.Parse(rawURL); err == nil {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// operations returns the operations of the document, operations of
+// literal paths are placed before those of templated paths.
+func (g *generator) operations() ([]*operation, error) {
+	paths, _ := g.root["paths"].(map[string]interface{})
+	keys := make([]string, 0, len(paths))
+	for path := range paths {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+
+	ops := []*operation{}
+	for _, path := range keys {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid path %s", path)
+		}
+		item, err := g.resolve(paths[path])
+		if err != nil {
+			return nil, fmt.Errorf("path %s: %v", path, err)
+		}
+		for _, method := range methods {
+			v, ok := item[method]
+			if !ok {
+				continue
+			}
+			m, err := g.resolve(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", strings.ToUpper(method), path, err)
+			}
+
+			op := &operation{
+				method: strings.ToUpper(method),
+				path:   g.basePath + path,
+				group:  DefaultGroup,
+			}
+			if tags, _ := m["tags"].([]interface{}); len(tags) > 0 {
+				if tag, _ := tags[0].(string); tag != "" {
+					op.group = tag
+				}
+			}
+			if g.opts.Mock {
+				op.mockRule = g.mockRule(op, m)
+			}
+			ops = append(ops, op)
+		}
+	}
+
+	sort.SliceStable(ops, func(i, j int) bool {
+		return !isTemplated(ops[i].path) && isTemplated(ops[j].path)
+	})
+	return ops, nil
+}
+
+func isTemplated(path string) bool {
+	return templateRegexp.MatchString(path)
+}
+
+// pathRegexp converts a templated path to a regular expression.
+func pathRegexp(path string) string {
+	parts := templateRegexp.Split(path, -1)
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return "^" + strings.Join(parts, "[^/]+") + "$"
+}
+
+func (g *generator) server(ops []*operation) (*Object, error) {
+	type route struct {
+		path    string
+		backend string
+		methods []string
+	}
+
+	routes := []*route{}
+	index := map[string]*route{}
+	for _, op := range ops {
+		backend := PipelineName(g.opts.Name, op.group)
+		key := op.path + " " + backend
+		r := index[key]
+		if r == nil {
+			r = &route{path: op.path, backend: backend}
+			index[key] = r
+			routes = append(routes, r)
+		}
+		r.methods = append(r.methods, op.method)
+	}
+
+	paths := []yaml.MapSlice{}
+	for _, r := range routes {
+		p := yaml.MapSlice{}
+		if isTemplated(r.path) {
+			p = append(p, yaml.MapItem{Key: "pathRegexp", Value: pathRegexp(r.path)})
+		} else {
+			p = append(p, yaml.MapItem{Key: "path", Value: r.path})
+		}
+		p = append(p,
+			yaml.MapItem{Key: "methods", Value: r.methods},
+			yaml.MapItem{Key: "backend", Value: r.backend},
+		)
+		paths = append(paths, p)
+	}
+
+	spec := yaml.MapSlice{
+		{Key: "kind", Value: kindHTTPServer},
+		{Key: "name", Value: g.opts.Name},
+		{Key: "port", Value: g.opts.Port},
+		{Key: "keepAlive", Value: true},
+		{Key: "https", Value: false},
+		{Key: "rules", Value: []yaml.MapSlice{{{Key: "paths", Value: paths}}}},
+	}
+	return newObject(kindHTTPServer, g.opts.Name, spec)
+}
+
+func (g *generator) pipeline(name string, ops []*operation) (*Object, error) {
+	filters := []yaml.MapSlice{}
+
+	if g.opts.Validator {
+		openAPI := yaml.MapSlice{{Key: "document", Value: g.document}}
+		if g.basePath != "" {
+			openAPI = append(openAPI, yaml.MapItem{Key: "basePath", Value: g.basePath})
+		}
+		filters = append(filters, yaml.MapSlice{
+			{Key: "kind", Value: "Validator"},
+			{Key: "name", Value: "validator"},
+			{Key: "openAPI", Value: openAPI},
+		})
+	}
+
+	if g.opts.Mock {
+		rules := []yaml.MapSlice{}
+		for _, op := range ops {
+			if op.mockRule != nil {
+				rules = append(rules, op.mockRule)
+			}
+		}
+		if len(rules) > 0 {
+			filters = append(filters, yaml.MapSlice{
+				{Key: "kind", Value: "Mock"},
+				{Key: "name", Value: "mock"},
+				{Key: "rules", Value: rules},
+			})
+		}
+	}
+
+	if len(g.servers) > 0 {
+		servers := make([]yaml.MapSlice, 0, len(g.servers))
+		for _, s := range g.servers {
+			servers = append(servers, yaml.MapSlice{{Key: "url", Value: s}})
+		}
+		filters = append(filters, yaml.MapSlice{
+			{Key: "kind", Value: "Proxy"},
+			{Key: "name", Value: "proxy"},
+			{Key: "mainPool", Value: yaml.MapSlice{
+				{Key: "servers", Value: servers},
+				{Key: "loadBalance", Value: yaml.MapSlice{{Key: "policy", Value: "roundRobin"}}},
+			}},
+		})
+	}
+
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("%s: nothing to mock and no backend servers", name)
+	}
+
+	spec := yaml.MapSlice{
+		{Key: "kind", Value: kindHTTPPipeline},
+		{Key: "name", Value: name},
+		{Key: "filters", Value: filters},
+	}
+	return newObject(kindHTTPPipeline, name, spec)
+}
+
+// mockRule returns the mock rule of the operation built from the example
+// of its first successful response, it returns nil if no example found.
+func (g *generator) mockRule(op *operation, m map[string]interface{}) yaml.MapSlice {
+	responses, _ := m["responses"].(map[string]interface{})
+
+	code, key := 0, ""
+	for k := range responses {
+		if c, err := strconv.Atoi(k); err == nil && c >= 200 && c <= 299 && (code == 0 || c < code) {
+			code, key = c, k
+		}
+	}
+	if code == 0 {
+		for _, k := range []string{"2XX", "2xx", "default"} {
+			if responses[k] != nil {
+				code, key = 200, k
+				break
+			}
+		}
+	}
+	if code == 0 {
+		return nil
+	}
+
+	resp, err := g.resolve(responses[key])
+	if err != nil {
+		return nil
+	}
+
+	var headers map[string]string
+	body := ""
+	content, _ := resp["content"].(map[string]interface{})
+	if len(content) > 0 {
+		mediaType, example, ok := g.example(content)
+		if !ok {
+			return nil
+		}
+		headers = map[string]string{"Content-Type": mediaType}
+		if s, ok := example.(string); ok {
+			body = s
+		} else {
+			data, err := json.Marshal(example)
+			if err != nil {
+				return nil
+			}
+			body = string(data)
+		}
+	}
+
+	match := yaml.MapSlice{}
+	if isTemplated(op.path) {
+		match = append(match, yaml.MapItem{Key: "pathRegexp", Value: pathRegexp(op.path)})
+	} else {
+		match = append(match, yaml.MapItem{Key: "path", Value: op.path})
+	}
+	match = append(match, yaml.MapItem{Key: "methods", Value: []string{op.method}})
+
+	rule := yaml.MapSlice{
+		{Key: "match", Value: match},
+		{Key: "code", Value: code},
+	}
+	if headers != nil {
+		rule = append(rule, yaml.MapItem{Key: "headers", Value: headers})
+	}
+	return append(rule, yaml.MapItem{Key: "body", Value: body})
+}
+
+// example returns the example of the content, JSON media types are preferred.
+func (g *generator) example(content map[string]interface{}) (string, interface{}, bool) {
+	mediaTypes := make([]string, 0, len(content))
+	for mt := range content {
+		mediaTypes = append(mediaTypes, mt)
+	}
+	sort.SliceStable(mediaTypes, func(i, j int) bool {
+		return isJSON(mediaTypes[i]) && !isJSON(mediaTypes[j])
+	})
+	sort.SliceStable(mediaTypes, func(i, j int) bool {
+		return mediaTypes[i] == "application/json" && mediaTypes[j] != "application/json"
+	})
+
+	for _, mt := range mediaTypes {
+		if strings.Contains(mt, "*") {
+			continue
+		}
+		m, err := g.resolve(content[mt])
+		if err != nil {
+			continue
+		}
+		if example, ok := m["example"]; ok {
+			return mt, example, true
+		}
+		if examples, _ := m["examples"].(map[string]interface{}); len(examples) > 0 {
+			names := make([]string, 0, len(examples))
+			for name := range examples {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if e, err := g.resolve(examples[names[0]]); err == nil {
+				if value, ok := e["value"]; ok {
+					return mt, value, true
+				}
+			}
+		}
+		if m["schema"] != nil {
+			if schema, err := g.resolve(m["schema"]); err == nil {
+				if example, ok := schema["example"]; ok {
+					return mt, example, true
+				}
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// resolve follows the local reference of v, and returns the referenced object.
+func (g *generator) resolve(v interface{}) (map[string]interface{}, error) {
+	return Resolve(g.root, v)
+}
+
+// Resolve follows the local reference of v in the document root, and
+// returns the referenced object.
+func Resolve(root map[string]interface{}, v interface{}) (map[string]interface{}, error) {
+	// limit the depth to avoid circular references
+	for i := 0; i < 16; i++ {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("object expected")
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m, nil
+		}
+		if !strings.HasPrefix(ref, "#/") {
+			return nil, fmt.Errorf("reference %s is not supported", ref)
+		}
+
+		v = root
+		for _, token := range strings.Split(ref[2:], "/") {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			m, _ := v.(map[string]interface{})
+			if v = m[token]; v == nil {
+				return nil, fmt.Errorf("reference %s not found", ref)
+			}
+		}
+	}
+	return nil, fmt.Errorf("too deep references")
+}
+
+func newObject(kind, name string, spec yaml.MapSlice) (*Object, error) {
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %s %s failed: %v", kind, name, err)
+	}
+	return &Object{Kind: kind, Name: name, YAML: string(data)}, nil
+}
+
+// YAML returns all objects in a multi-document YAML.
+func (r *Result) YAML() string {
+	docs := make([]string, 0, len(r.Objects))
+	for _, obj := range r.Objects {
+		docs = append(docs, obj.YAML)
+	}
+	return strings.Join(docs, "---\n")
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package openapi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const document = `
+openapi: 3.0.1
+info:
+  title: pets
+  version: 1.0.0
+servers:
+- url: "{scheme}://pets.example.com/api/"
+  variables:
+    scheme:
+      default: https
+paths:
+  /pets:
+    get:
+      tags: [Pets]
+      responses:
+        "200":
+          content:
+            application/json:
+              example: [{"name": "kitty"}]
+    post:
+      tags: [Pets]
+      responses:
+        "201":
+          description: created
+  /pets/{id}:
+    get:
+      tags: [Pets]
+      responses:
+        "404":
+          description: not found
+        "200":
+          $ref: "#/components/responses/Pet"
+  /users/me:
+    get:
+      responses:
+        default:
+          content:
+            text/plain:
+              examples:
+                b:
+                  value: bob
+                a:
+                  $ref: "#/components/examples/Alice"
+components:
+  examples:
+    Alice:
+      value: alice
+  responses:
+    Pet:
+      content:
+        application/xml:
+          example: <pet/>
+        application/json:
+          schema:
+            type: object
+            example: {"name": "kitty", "age": 3}
+`
+
+type testObject struct {
+	Kind    string                   `yaml:"kind"`
+	Name    string                   `yaml:"name"`
+	Port    uint16                   `yaml:"port"`
+	Rules   []map[string]interface{} `yaml:"rules"`
+	Filters []map[string]interface{} `yaml:"filters"`
+}
+
+func decodeObject(t *testing.T, obj *Object) *testObject {
+	o := &testObject{}
+	if err := yaml.Unmarshal([]byte(obj.YAML), o); err != nil {
+		t.Fatalf("invalid yaml: %v", err)
+	}
+	if o.Kind != obj.Kind || o.Name != obj.Name {
+		t.Fatalf("inconsistent object: %s/%s, %s/%s", o.Kind, o.Name, obj.Kind, obj.Name)
+	}
+	return o
+}
+
+func TestGenerate(t *testing.T) {
+	opts := &Options{Name: "petstore", Port: 10080, Validator: true, Mock: true}
+	result, err := Generate([]byte(document), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Objects) != 3 {
+		t.Fatalf("there should be 3 objects, but got %d", len(result.Objects))
+	}
+
+	names := []string{"petstore-default", "petstore-pets", "petstore"}
+	for i, obj := range result.Objects {
+		if obj.Name != names[i] {
+			t.Errorf("object %d should be %s, but got %s", i, names[i], obj.Name)
+		}
+	}
+
+	server := decodeObject(t, result.Objects[2])
+	paths := server.Rules[0]["paths"].([]interface{})
+	expected := []string{
+		"path: /api/pets\nmethods: [GET POST]\nbackend: petstore-pets",
+		"path: /api/users/me\nmethods: [GET]\nbackend: petstore-default",
+		"pathRegexp: ^/api/pets/[^/]+$\nmethods: [GET]\nbackend: petstore-pets",
+	}
+	for i, p := range paths {
+		m := p.(map[interface{}]interface{})
+		key := "path"
+		if m[key] == nil {
+			key = "pathRegexp"
+		}
+		got := fmt.Sprintf("%s: %s\nmethods: %v\nbackend: %s", key, m[key], m["methods"], m["backend"])
+		if got != expected[i] {
+			t.Errorf("path %d should be %q, but got %q", i, expected[i], got)
+		}
+	}
+
+	pets := decodeObject(t, result.Objects[1])
+	if len(pets.Filters) != 3 {
+		t.Fatalf("there should be 3 filters, but got %d", len(pets.Filters))
+	}
+	validator := pets.Filters[0]["openAPI"].(map[interface{}]interface{})
+	if validator["basePath"] != "/api" || validator["document"] != document {
+		t.Errorf("unexpected validator: %v", validator)
+	}
+	rules := pets.Filters[1]["rules"].([]interface{})
+	if len(rules) != 3 {
+		t.Fatalf("there should be 3 mock rules, but got %d", len(rules))
+	}
+	rule := rules[2].(map[interface{}]interface{})
+	if rule["code"] != 200 || rule["body"] != `{"age":3,"name":"kitty"}` {
+		t.Errorf("unexpected mock rule: %v", rule)
+	}
+	rule = rules[1].(map[interface{}]interface{})
+	if rule["code"] != 201 || rule["body"] != "" || rule["headers"] != nil {
+		t.Errorf("unexpected mock rule: %v", rule)
+	}
+	proxy := pets.Filters[2]["mainPool"].(map[interface{}]interface{})
+	servers := proxy["servers"].([]interface{})
+	if servers[0].(map[interface{}]interface{})["url"] != "https://pets.example.com" {
+		t.Errorf("unexpected servers: %v", servers)
+	}
+
+	users := decodeObject(t, result.Objects[0])
+	rule = users.Filters[1]["rules"].([]interface{})[0].(map[interface{}]interface{})
+	if rule["body"] != "alice" {
+		t.Errorf("unexpected mock rule: %v", rule)
+	}
+
+	again, err := Generate([]byte(document), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.YAML() != result.YAML() {
+		t.Errorf("generation should be idempotent")
+	}
+}
+
+func TestGenerateFailures(t *testing.T) {
+	opts := &Options{Name: "petstore", Port: 10080}
+	if _, err := Generate([]byte(document), &Options{Name: "pet store", Port: 10080}); err == nil {
+		t.Errorf("name should be invalid")
+	}
+	if _, err := Generate([]byte(document), &Options{Name: "petstore"}); err == nil {
+		t.Errorf("port should be required")
+	}
+	if _, err := Generate([]byte("swagger: '2.0'"), opts); err == nil {
+		t.Errorf("swagger 2.0 should be rejected")
+	}
+	if _, err := Generate([]byte("openapi: 3.0.0\npaths:\n  /pets:\n    get: {}\n"), opts); err == nil {
+		t.Errorf("backend servers should be required")
+	}
+
+	opts.Servers = []string{"http://127.0.0.1:9095"}
+	opts.BasePath = "/v1"
+	result, err := Generate([]byte("openapi: 3.0.0\npaths:\n  /pets:\n    get: {}\n"), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(result.YAML(), "path: /v1/pets") || !strings.Contains(result.YAML(), "url: http://127.0.0.1:9095") {
+		t.Errorf("unexpected result: %s", result.YAML())
+	}
+}
+
+func TestResolve(t *testing.T) {
+	root := map[string]interface{}{
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"a/b":  map[string]interface{}{"type": "string"},
+				"ref":  map[string]interface{}{"$ref": "#/components/schemas/a~1b"},
+				"loop": map[string]interface{}{"$ref": "#/components/schemas/loop"},
+			},
+		},
+	}
+
+	m, err := Resolve(root, map[string]interface{}{"$ref": "#/components/schemas/ref"})
+	if err != nil || m["type"] != "string" {
+		t.Errorf("unexpected result %v, %v", m, err)
+	}
+	if _, err = Resolve(root, map[string]interface{}{"$ref": "#/components/schemas/loop"}); err == nil {
+		t.Errorf("circular reference should fail")
+	}
+	if _, err = Resolve(root, map[string]interface{}{"$ref": "other.yaml#/a"}); err == nil {
+		t.Errorf("remote reference should fail")
+	}
+	if _, err = Resolve(root, map[string]interface{}{"$ref": "#/components/none"}); err == nil {
+		t.Errorf("missing reference should fail")
+	}
+}
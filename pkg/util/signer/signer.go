@@ -109,6 +109,9 @@ type (
 	Signer struct {
 		literal        *Literal
 		ignoredHeaders map[string]bool
+		// signedHeaders is for signing, all headers which are not ignored
+		// are signed if it is empty
+		signedHeaders  map[string]bool
 		headerHoisting *HeaderHoisting
 		ttl            time.Duration
 		excludeBody    bool
@@ -223,6 +226,22 @@ func (signer *Signer) IgnoreHeader(headers ...string) *Signer {
 	return signer
 }
 
+// SignHeader is an option function for Signer to only sign the specified
+// headers, the host and the literal date & content hash headers are always
+// signed
+func (signer *Signer) SignHeader(headers ...string) *Signer {
+	if len(headers) == 0 {
+		return signer
+	}
+	if signer.signedHeaders == nil {
+		signer.signedHeaders = map[string]bool{}
+	}
+	for _, h := range headers {
+		signer.signedHeaders[textproto.CanonicalMIMEHeaderKey(h)] = true
+	}
+	return signer
+}
+
 // SetHeaderHoisting is an option function for Singer to set header hoisting
 func (signer *Signer) SetHeaderHoisting(hh *HeaderHoisting) *Signer {
 	hh.disallowed = map[string]bool{}
@@ -252,6 +271,20 @@ func (signer *Signer) SetCredential(accessKeyID string, accessKeySecret string)
 	return signer
 }
 
+// AWS4Literal is the literal of Amazon Signature Version 4
+var AWS4Literal = &Literal{
+	ScopeSuffix:      "aws4_request",
+	AlgorithmName:    "X-Amz-Algorithm",
+	AlgorithmValue:   "AWS4-HMAC-SHA256",
+	SignedHeaders:    "X-Amz-SignedHeaders",
+	Signature:        "X-Amz-Signature",
+	Date:             "X-Amz-Date",
+	Expires:          "X-Amz-Expires",
+	Credential:       "X-Amz-Credential",
+	ContentSHA256:    "X-Amz-Content-Sha256",
+	SigningKeyPrefix: "AWS4",
+}
+
 var defaultLiteral = &Literal{
 	ScopeSuffix:      "megaease_request",
 	AlgorithmName:    "X-Me-Algorithm",
@@ -440,6 +473,13 @@ func (ctx *SigningContext) needHoisting(header string) bool {
 	return false
 }
 
+func (ctx *SigningContext) isSignedHeader(header string) bool {
+	if len(ctx.signedHeaders) == 0 || ctx.signedHeaders[header] {
+		return true
+	}
+	return header == ctx.literal.Date || header == ctx.literal.ContentSHA256
+}
+
 func (ctx *SigningContext) buildCanonicalHeaders(req *http.Request) {
 	type pair struct {
 		Name  string
@@ -457,6 +497,10 @@ func (ctx *SigningContext) buildCanonicalHeaders(req *http.Request) {
 			continue
 		}
 
+		if !ctx.isSignedHeader(k) {
+			continue
+		}
+
 		if ctx.needHoisting(k) {
 			ctx.Query[k] = v
 		} else {
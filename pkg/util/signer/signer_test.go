@@ -348,3 +348,39 @@ func BenchmarkVerify(b *testing.B) {
 		signer.Verify(req)
 	}
 }
+
+func TestSignedHeaders(t *testing.T) {
+	spec := &Spec{
+		LiteralPreset:   LiteralPresetAWS4,
+		SignedHeaders:   []string{"x-amz-target", "Content-Type"},
+		AccessKeys:      map[string]string{"AKID": "SECRET"},
+		AccessKeyID:     "AKID",
+		AccessKeySecret: "SECRET",
+	}
+	if e := spec.Validate(); e != nil {
+		t.Errorf("validate should succeed: %v", e)
+	}
+
+	req := buildRequest("dynamodb", "us-east-1", "{}")
+	signer := CreateFromSpec(spec)
+	signer.NewContext(epochTime(), "us-east-1", "dynamodb").Sign(req)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKID/19700101/us-east-1/dynamodb/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-target, "
+	if a := req.Header.Get("Authorization"); !strings.HasPrefix(a, expected) {
+		t.Errorf("\nexpect: %v\nactual: %v\n", expected, a)
+	}
+
+	if e := signer.Verify(req); e != nil {
+		t.Errorf("signature verification failed: %v", e.Error())
+	}
+
+	req.Header.Set("X-Amz-Target", "prefix.Other")
+	if e := signer.Verify(req); e == nil {
+		t.Errorf("signature verification should fail")
+	}
+
+	spec.Literal = awsSpec.Literal
+	if e := spec.Validate(); e == nil {
+		t.Errorf("validate should fail")
+	}
+}
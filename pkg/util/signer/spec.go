@@ -17,11 +17,18 @@
 
 package signer
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
+
+// LiteralPresetAWS4 is the preset of Amazon Signature Version 4 literals
+const LiteralPresetAWS4 = "aws4"
 
 // Spec defines the configuration of a Signer
 type Spec struct {
 	Literal         *Literal          `yaml:"literial,omitempty" json:"literial,omitempty" jsonschema:"omitempty"`
+	LiteralPreset   string            `yaml:"literalPreset,omitempty" json:"literalPreset,omitempty" jsonschema:"omitempty,enum=aws4"`
 	HeaderHoisting  *HeaderHoisting   `yaml:"headerHoisting,omitempty" json:"headerHoisting,omitempty" jsonschema:"omitempty"`
 	IgnoredHeaders  []string          `yaml:"ignoredHeaders" json:"ignoredHeaders" jsonschema:"omitempty,uniqueItems=true"`
 	ExcludeBody     bool              `yaml:"excludeBody" json:"excludeBody" jsonschema:"omitempty"`
@@ -30,6 +37,20 @@ type Spec struct {
 	AccessKeySecret string            `yaml:"accessKeySecret" json:"accessKeySecret" jsonschema:"omitempty"`
 	AccessKeys      map[string]string `yaml:"accessKeys" json:"accessKeys" jsonschema:"omitempty"`
 	// TODO: AccessKeys is used as an internal access key store, but an external store is also needed
+
+	// SignedHeaders and Scopes are only for signing, Scopes are the parts
+	// of the credential scope between the date and the scope suffix, e.g.
+	// the region and service of Amazon Signature Version 4
+	SignedHeaders []string `yaml:"signedHeaders,omitempty" json:"signedHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	Scopes        []string `yaml:"scopes,omitempty" json:"scopes,omitempty" jsonschema:"omitempty"`
+}
+
+// Validate validates the spec
+func (spec Spec) Validate() error {
+	if spec.Literal != nil && spec.LiteralPreset != "" {
+		return fmt.Errorf("literial and literalPreset are mutually exclusive")
+	}
+	return nil
 }
 
 type idSecretMap map[string]string
@@ -47,6 +68,8 @@ func CreateFromSpec(spec *Spec) *Signer {
 
 	if spec.Literal != nil {
 		signer.SetLiteral(spec.Literal)
+	} else if spec.LiteralPreset == LiteralPresetAWS4 {
+		signer.SetLiteral(AWS4Literal)
 	}
 
 	if spec.HeaderHoisting != nil {
@@ -54,6 +77,7 @@ func CreateFromSpec(spec *Spec) *Signer {
 	}
 
 	signer.IgnoreHeader(spec.IgnoredHeaders...)
+	signer.SignHeader(spec.SignedHeaders...)
 	signer.ExcludeBody(spec.ExcludeBody)
 
 	if ttl, e := time.ParseDuration(spec.TTL); e == nil {
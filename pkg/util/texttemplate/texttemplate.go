@@ -19,6 +19,7 @@ package texttemplate
 
 import (
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/tidwall/gjson"
@@ -135,6 +136,7 @@ type TextTemplate struct {
 	metaTemplates []string               // the user raw input candidate templates
 	root          *node                  // The template syntax tree root node generated by use's input raw templates
 	dict          map[string]interface{} // using `interface{}` for fasttemplate's API
+	escaper       func(string) string    // escapes the values when rendering if not nil
 }
 
 // NewDefault returns Template interface implementer with default config and customize meatTemplates
@@ -154,6 +156,25 @@ func NewDefault(metaTemplates []string) (TemplateEngine, error) {
 	return t, nil
 }
 
+// NewDefaultWithEscaper returns Template interface implementer like NewDefault, and the values
+// are escaped by escaper when rendering, e.g. escaping XML special characters for XML documents
+func NewDefaultWithEscaper(metaTemplates []string, escaper func(string) string) (TemplateEngine, error) {
+	t := TextTemplate{
+		beginToken:    DefaultBeginToken,
+		endToken:      DefaultEndToken,
+		separator:     DefaultSeparator,
+		metaTemplates: metaTemplates,
+		dict:          map[string]interface{}{},
+		escaper:       escaper,
+	}
+
+	if err := t.buildTemplateTree(); err != nil {
+		return DummyTemplate{}, err
+	}
+
+	return t, nil
+}
+
 // New returns a new Template interface implementer, return a dummy template if something wrong,
 // and in that case, the dedicated reason will set into error return
 func New(beginToken, endToken, separator string, metaTemplates []string) (TemplateEngine, error) {
@@ -447,5 +468,15 @@ func (t TextTemplate) Render(input string) (string, error) {
 	}
 
 	t.ft = fasttemplate.New(input, t.beginToken, t.endToken)
-	return t.ft.ExecuteString(t.dict), nil
+	if t.escaper == nil {
+		return t.ft.ExecuteString(t.dict), nil
+	}
+
+	return t.ft.ExecuteFuncString(func(w io.Writer, tag string) (int, error) {
+		v, exist := t.dict[tag]
+		if !exist || v == nil {
+			return 0, nil
+		}
+		return w.Write([]byte(t.escaper(fmt.Sprint(v))))
+	}), nil
 }
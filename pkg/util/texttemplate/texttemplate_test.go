@@ -18,6 +18,7 @@
 package texttemplate
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -726,3 +727,31 @@ func TestNewTextTemplateExtractRawTemplateRuleMapEmpty(t *testing.T) {
 		t.Fatalf("extract from input %s no match expect, should extract two target", input)
 	}
 }
+
+func TestNewDefaultWithEscaper(t *testing.T) {
+	tt, err := NewDefaultWithEscaper([]string{
+		"req.body",
+		"req.body.{gjson}",
+		"req.header.{}",
+	}, func(s string) string {
+		return strings.ReplaceAll(s, "<", "&lt;")
+	})
+	if err != nil {
+		t.Fatalf("new engine failed err %v", err)
+	}
+
+	tt.SetDict("req.body", `{"name":"<a>"}`)
+	tt.SetDict("req.header.X-Id", "<1>")
+
+	s, err := tt.Render("<n>[[req.body.name]]</n><id>[[req.header.X-Id]]</id><u>[[req.header.X-Unknown]]</u>")
+	if err != nil {
+		t.Fatalf("render failed err %v", err)
+	}
+	if expect := "<n>&lt;a></n><id>&lt;1></id><u></u>"; s != expect {
+		t.Errorf("rendering fail, result is %s expect %s", s, expect)
+	}
+
+	if _, err = NewDefaultWithEscaper([]string{"filter.xx."}, nil); err == nil {
+		t.Error("new template should not succ")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wsproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const (
+	// HeaderDirection is the header of the direction of the messages sent
+	// to remote hooks.
+	HeaderDirection = "X-WebSocket-Direction"
+
+	defaultHookTimeout        = time.Second
+	defaultHookMaxConcurrency = 10
+)
+
+type (
+	// HookSpec describes the hook inspecting and transforming text
+	// messages, the hook is a remote HTTP service or a wasm module.
+	HookSpec struct {
+		// Directions are the directions of messages handled by the hook,
+		// default is client.
+		Directions []string  `yaml:"directions,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		URL        string    `yaml:"url,omitempty" jsonschema:"omitempty,format=url"`
+		Timeout    string    `yaml:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+		Wasm       *WasmHook `yaml:"wasm,omitempty" jsonschema:"omitempty"`
+		// FailOpen passes the messages as they are if the hook fails,
+		// otherwise the connection is closed.
+		FailOpen bool `yaml:"failOpen,omitempty" jsonschema:"omitempty"`
+	}
+
+	// WasmHook is the wasm module of the hook.
+	WasmHook struct {
+		// Code is the path or the base64 encoded content of the module.
+		Code           string `yaml:"code" jsonschema:"required"`
+		MaxConcurrency int32  `yaml:"maxConcurrency,omitempty" jsonschema:"omitempty,minimum=1"`
+	}
+
+	// HookResult is the result of a hook, the message is dropped if the
+	// result neither has a message nor rejects it.
+	HookResult struct {
+		Message []byte
+		Reject  bool
+		Reason  string
+	}
+
+	// Hook inspects and transforms text messages.
+	Hook interface {
+		Handle(direction string, msg []byte) (*HookResult, error)
+		Close()
+	}
+
+	remoteHook struct {
+		url    string
+		client *http.Client
+	}
+)
+
+// Validate validates HookSpec.
+func (spec HookSpec) Validate() error {
+	if (spec.URL == "") == (spec.Wasm == nil) {
+		return fmt.Errorf("one and only one of url and wasm should be configured")
+	}
+	for _, d := range spec.Directions {
+		if d != DirectionClient && d != DirectionBackend {
+			return fmt.Errorf("invalid direction %s", d)
+		}
+	}
+	if spec.Wasm != nil {
+		return validateWasmHook(spec.Wasm)
+	}
+	return nil
+}
+
+func newHook(spec *HookSpec) (Hook, error) {
+	if spec.Wasm != nil {
+		return newWasmHook(spec.Wasm)
+	}
+
+	return &remoteHook{
+		url: spec.URL,
+		client: &http.Client{
+			Timeout: parseDuration(spec.Timeout, defaultHookTimeout),
+		},
+	}, nil
+}
+
+// Handle posts the message to the remote service. The response body of
+// status 200 is the new message, status 204 drops the message, and status
+// 4xx rejects it and closes the connection with the response body as the
+// reason.
+func (h *remoteHook) Handle(direction string, msg []byte) (*HookResult, error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set(HeaderDirection, direction)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if body == nil {
+			body = []byte{}
+		}
+		return &HookResult{Message: body}, nil
+	case resp.StatusCode == http.StatusNoContent:
+		return &HookResult{}, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &HookResult{Reject: true, Reason: string(body)}, nil
+	}
+
+	logger.Warnf("websocket message hook %s responded status %d", h.url, resp.StatusCode)
+	return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
+
+func (h *remoteHook) Close() {
+	h.client.CloseIdleConnections()
+}
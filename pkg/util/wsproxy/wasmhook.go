@@ -0,0 +1,246 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wsproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/bytecodealliance/wasmtime-go"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+// The wasm module exports memory, 'wasm_alloc(size i32) i32',
+// 'wasm_free(addr i32)' and 'wasm_on_message(direction i32, addr i32) i32'.
+// Data is serialized as 4 bytes little endian length followed by the
+// content, and the direction is 0 for clients and 1 for backends. The
+// result of 'wasm_on_message' is 0 to pass the message as it is, -1 to
+// drop it, -2 to reject it, or the address of the new message, which is
+// freed by the host.
+const (
+	wasmMemory    = "memory"
+	wasmAlloc     = "wasm_alloc"
+	wasmFree      = "wasm_free"
+	wasmOnMessage = "wasm_on_message"
+
+	wasmResultPass   = 0
+	wasmResultDrop   = -1
+	wasmResultReject = -2
+)
+
+type (
+	wasmHook struct {
+		engine *wasmtime.Engine
+		module *wasmtime.Module
+		chInst chan *wasmInstance
+	}
+
+	wasmInstance struct {
+		store     *wasmtime.Store
+		inst      *wasmtime.Instance
+		fnAlloc   *wasmtime.Func
+		fnFree    *wasmtime.Func
+		fnMessage *wasmtime.Func
+	}
+)
+
+func readWasmCode(code string) ([]byte, error) {
+	if _, err := os.Stat(code); err == nil {
+		return os.ReadFile(code)
+	}
+	return base64.StdEncoding.DecodeString(code)
+}
+
+// validateWasmHook compiles and instantiates the module, so that invalid
+// modules are rejected before the hook is created.
+func validateWasmHook(spec *WasmHook) error {
+	h, err := newWasmHook(spec)
+	if err != nil {
+		return err
+	}
+	h.Close()
+	return nil
+}
+
+func newWasmHook(spec *WasmHook) (Hook, error) {
+	code, err := readWasmCode(spec.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	engine := wasmtime.NewEngine()
+	module, err := wasmtime.NewModule(engine, code)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := spec.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultHookMaxConcurrency
+	}
+
+	h := &wasmHook{
+		engine: engine,
+		module: module,
+		chInst: make(chan *wasmInstance, concurrency),
+	}
+
+	// Instantiate one to check the module, the others are created on
+	// demand.
+	inst, err := h.newInstance()
+	if err != nil {
+		return nil, err
+	}
+	h.chInst <- inst
+	for i := int32(1); i < concurrency; i++ {
+		h.chInst <- nil
+	}
+
+	return h, nil
+}
+
+func (h *wasmHook) newInstance() (*wasmInstance, error) {
+	store := wasmtime.NewStore(h.engine)
+	linker := wasmtime.NewLinker(h.engine)
+	if err := linker.DefineWasi(); err != nil {
+		return nil, err
+	}
+
+	inst, err := linker.Instantiate(store, h.module)
+	if err != nil {
+		return nil, err
+	}
+
+	wi := &wasmInstance{store: store, inst: inst}
+	if inst.GetExport(store, wasmMemory) == nil || inst.GetExport(store, wasmMemory).Memory() == nil {
+		return nil, fmt.Errorf("wasm code hasn't export memory")
+	}
+	for name, fn := range map[string]**wasmtime.Func{
+		wasmAlloc:     &wi.fnAlloc,
+		wasmFree:      &wi.fnFree,
+		wasmOnMessage: &wi.fnMessage,
+	} {
+		extern := inst.GetExport(store, name)
+		if extern == nil || extern.Func() == nil {
+			return nil, fmt.Errorf("wasm code hasn't export function '%s'", name)
+		}
+		*fn = extern.Func()
+	}
+
+	return wi, nil
+}
+
+func (wi *wasmInstance) memory() []byte {
+	return wi.inst.GetExport(wi.store, wasmMemory).Memory().UnsafeData(wi.store)
+}
+
+func (wi *wasmInstance) write(data []byte) (int32, error) {
+	v, err := wi.fnAlloc.Call(wi.store, int32(len(data)+4))
+	if err != nil {
+		return 0, err
+	}
+	addr := v.(int32)
+
+	mem := wi.memory()
+	if int(addr)+len(data)+4 > len(mem) || addr < 0 {
+		return 0, fmt.Errorf("invalid address %d allocated by wasm code", addr)
+	}
+	binary.LittleEndian.PutUint32(mem[addr:], uint32(len(data)))
+	copy(mem[addr+4:], data)
+	return addr, nil
+}
+
+func (wi *wasmInstance) read(addr int32) ([]byte, error) {
+	mem := wi.memory()
+	if addr < 0 || int(addr)+4 > len(mem) {
+		return nil, fmt.Errorf("invalid address %d returned by wasm code", addr)
+	}
+	size := int(binary.LittleEndian.Uint32(mem[addr:]))
+	if int(addr)+4+size > len(mem) {
+		return nil, fmt.Errorf("invalid size %d returned by wasm code", size)
+	}
+	data := make([]byte, size)
+	copy(data, mem[addr+4:])
+	return data, nil
+}
+
+func (wi *wasmInstance) handle(direction string, msg []byte) (*HookResult, error) {
+	addr, err := wi.write(msg)
+	if err != nil {
+		return nil, err
+	}
+	defer wi.fnFree.Call(wi.store, addr)
+
+	d := int32(0)
+	if direction == DirectionBackend {
+		d = 1
+	}
+	v, err := wi.fnMessage.Call(wi.store, d, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r := v.(int32); r {
+	case wasmResultPass:
+		return &HookResult{Message: msg}, nil
+	case wasmResultDrop:
+		return &HookResult{}, nil
+	case wasmResultReject:
+		return &HookResult{Reject: true, Reason: "rejected by wasm hook"}, nil
+	default:
+		defer wi.fnFree.Call(wi.store, r)
+		data, err := wi.read(r)
+		if err != nil {
+			return nil, err
+		}
+		return &HookResult{Message: data}, nil
+	}
+}
+
+// Handle calls the wasm code to handle the message.
+func (h *wasmHook) Handle(direction string, msg []byte) (result *HookResult, err error) {
+	wi := <-h.chInst
+	if wi == nil {
+		wi, err = h.newInstance()
+		if err != nil {
+			h.chInst <- nil
+			return nil, err
+		}
+	}
+
+	defer func() {
+		// NOTE: The instance is dropped on errors, as its state is
+		// unknown, a new one is created for the next message.
+		if err != nil {
+			logger.Warnf("wasm message hook failed: %v", err)
+			wi = nil
+		}
+		h.chInst <- wi
+	}()
+
+	return wi.handle(direction, msg)
+}
+
+func (h *wasmHook) Close() {
+}
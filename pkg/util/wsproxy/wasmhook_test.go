@@ -0,0 +1,119 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wsproxy
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+const testWasmHook = `
+(module
+  (memory (export "memory") 1)
+  (global $next (mut i32) (i32.const 1024))
+  (func (export "wasm_alloc") (param $size i32) (result i32)
+    (local $addr i32)
+    (local.set $addr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (local.get $addr))
+  (func (export "wasm_free") (param i32))
+  (func (export "wasm_on_message") (param $dir i32) (param $addr i32) (result i32)
+    (local $c i32)
+    (local.set $c (i32.load8_u (i32.add (local.get $addr) (i32.const 4))))
+    (if (i32.eq (local.get $c) (i32.const 120)) (then (return (i32.const -1))))
+    (if (i32.eq (local.get $c) (i32.const 114)) (then (return (i32.const -2))))
+    (if (i32.eq (local.get $c) (i32.const 117)) (then (return (i32.const 0))))
+    (i32.store8 (i32.add (local.get $addr) (i32.const 4)) (i32.const 42))
+    (local.get $addr))
+)
+`
+
+func TestWasmHook(t *testing.T) {
+	code, err := wasmtime.Wat2Wasm(testWasmHook)
+	if err != nil {
+		t.Fatalf("compile wat failed: %v", err)
+	}
+
+	spec := &WasmHook{Code: base64.StdEncoding.EncodeToString(code), MaxConcurrency: 2}
+	if err = validateWasmHook(spec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h, err := newWasmHook(spec)
+	if err != nil {
+		t.Fatalf("create wasm hook failed: %v", err)
+	}
+	defer h.Close()
+
+	cases := []struct {
+		msg    string
+		want   string
+		drop   bool
+		reject bool
+	}{
+		{msg: "hello", want: "*ello"},
+		{msg: "unchanged", want: "unchanged"},
+		{msg: "xdrop", drop: true},
+		{msg: "reject", reject: true},
+	}
+
+	for _, c := range cases {
+		result, err := h.Handle(DirectionClient, []byte(c.msg))
+		if err != nil {
+			t.Fatalf("handle %s failed: %v", c.msg, err)
+		}
+		switch {
+		case c.reject:
+			if !result.Reject {
+				t.Errorf("%s should be rejected", c.msg)
+			}
+		case c.drop:
+			if result.Message != nil || result.Reject {
+				t.Errorf("%s should be dropped", c.msg)
+			}
+		default:
+			if string(result.Message) != c.want {
+				t.Errorf("want %q, got %q", c.want, result.Message)
+			}
+		}
+	}
+}
+
+func TestWasmHookValidate(t *testing.T) {
+	code, err := wasmtime.Wat2Wasm(`(module (memory (export "memory") 1))`)
+	if err != nil {
+		t.Fatalf("compile wat failed: %v", err)
+	}
+
+	spec := &WasmHook{Code: base64.StdEncoding.EncodeToString(code)}
+	if validateWasmHook(spec) == nil {
+		t.Errorf("module without the exported functions should be invalid")
+	}
+
+	spec.Code = base64.StdEncoding.EncodeToString([]byte("not wasm"))
+	if validateWasmHook(spec) == nil {
+		t.Errorf("invalid module should be invalid")
+	}
+	if _, err := New(&Spec{Hook: &HookSpec{Wasm: spec}}); err == nil {
+		t.Errorf("controller with invalid hook should not be created")
+	}
+}
@@ -0,0 +1,442 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package wsproxy passes messages between the websocket connections of
+// clients and backends, with controls of the messages.
+package wsproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+const (
+	// DirectionClient is the direction of messages from clients to backends.
+	DirectionClient = "client"
+	// DirectionBackend is the direction of messages from backends to clients.
+	DirectionBackend = "backend"
+
+	// ActionClose closes the connection when the rate limit is exceeded.
+	ActionClose = "close"
+	// ActionDrop drops the messages exceeding the rate limit.
+	ActionDrop = "drop"
+
+	defaultPongTimeout = 10 * time.Second
+	writeWait          = time.Second
+
+	// maxCloseReason is the max length of the reason of close messages.
+	maxCloseReason = 123
+)
+
+type (
+	// Spec describes the controls of websocket messages.
+	Spec struct {
+		// MaxMessageBytes limits the size of messages in both directions,
+		// the connection is closed with 1009 if a message is too large.
+		MaxMessageBytes int64      `yaml:"maxMessageBytes,omitempty" jsonschema:"omitempty,minimum=1"`
+		RateLimit       *RateLimit `yaml:"rateLimit,omitempty" jsonschema:"omitempty"`
+		// IdleTimeout closes the connection if no message is passed in
+		// either direction for the duration, pings and pongs are not
+		// counted.
+		IdleTimeout string `yaml:"idleTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		// PingInterval is the interval of pings to clients, a client not
+		// responding a pong in PongTimeout is closed.
+		PingInterval string `yaml:"pingInterval,omitempty" jsonschema:"omitempty,format=duration"`
+		PongTimeout  string `yaml:"pongTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		// Subprotocols are the subprotocols allowed to be negotiated with
+		// backends, all subprotocols are allowed if it is empty.
+		Subprotocols       []string  `yaml:"subprotocols,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		RequireSubprotocol bool      `yaml:"requireSubprotocol,omitempty" jsonschema:"omitempty"`
+		Hook               *HookSpec `yaml:"hook,omitempty" jsonschema:"omitempty"`
+	}
+
+	// RateLimit limits the rate of messages from a client on a connection.
+	RateLimit struct {
+		MessagesPerSecond uint32 `yaml:"messagesPerSecond" jsonschema:"required,minimum=1"`
+		// Burst defaults to MessagesPerSecond.
+		Burst  uint32 `yaml:"burst,omitempty" jsonschema:"omitempty,minimum=1"`
+		Action string `yaml:"action,omitempty" jsonschema:"omitempty,enum=,enum=close,enum=drop"`
+	}
+
+	// Stats is the statistics of messages, it is updated atomically.
+	Stats struct {
+		ClientMessages  uint64 `yaml:"clientMessages"`
+		ClientBytes     uint64 `yaml:"clientBytes"`
+		BackendMessages uint64 `yaml:"backendMessages"`
+		BackendBytes    uint64 `yaml:"backendBytes"`
+		RateLimited     uint64 `yaml:"rateLimited"`
+		HookDropped     uint64 `yaml:"hookDropped"`
+		HookRejected    uint64 `yaml:"hookRejected"`
+		HookFailed      uint64 `yaml:"hookFailed"`
+		IdleTimeouts    uint64 `yaml:"idleTimeouts"`
+		PongTimeouts    uint64 `yaml:"pongTimeouts"`
+	}
+
+	// Controller controls the messages passed between clients and
+	// backends, it is shared by all connections of a proxy.
+	Controller struct {
+		spec *Spec
+
+		idleTimeout  time.Duration
+		pingInterval time.Duration
+		pongTimeout  time.Duration
+		hook         Hook
+	}
+
+	// CloseError is the error of connections closed by the controls.
+	CloseError struct {
+		Code   int
+		Reason string
+	}
+
+	limiter struct {
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+)
+
+// Validate validates Spec.
+func (spec Spec) Validate() error {
+	if spec.PongTimeout != "" && spec.PingInterval == "" {
+		return fmt.Errorf("pongTimeout is configured without pingInterval")
+	}
+	if spec.RequireSubprotocol && len(spec.Subprotocols) == 0 {
+		return fmt.Errorf("requireSubprotocol is configured without subprotocols")
+	}
+	return nil
+}
+
+// Validate validates RateLimit.
+func (rl RateLimit) Validate() error {
+	if rl.Burst > 0 && rl.Burst < rl.MessagesPerSecond {
+		return fmt.Errorf("burst must not be less than messagesPerSecond")
+	}
+	return nil
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("closed by proxy: %d %s", e.Code, e.Reason)
+}
+
+func parseDuration(s string, d time.Duration) time.Duration {
+	if s == "" {
+		return d
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		logger.Errorf("BUG: parse duration %s failed: %v", s, err)
+		return d
+	}
+	return v
+}
+
+// New creates a Controller, a nil spec means no control.
+func New(spec *Spec) (*Controller, error) {
+	if spec == nil {
+		spec = &Spec{}
+	}
+
+	c := &Controller{
+		spec:         spec,
+		idleTimeout:  parseDuration(spec.IdleTimeout, 0),
+		pingInterval: parseDuration(spec.PingInterval, 0),
+		pongTimeout:  parseDuration(spec.PongTimeout, defaultPongTimeout),
+	}
+
+	if spec.Hook != nil {
+		hook, err := newHook(spec.Hook)
+		if err != nil {
+			return nil, fmt.Errorf("create websocket message hook failed: %v", err)
+		}
+		c.hook = hook
+	}
+
+	return c, nil
+}
+
+// Close closes the Controller.
+func (c *Controller) Close() {
+	if c.hook != nil {
+		c.hook.Close()
+	}
+}
+
+// Subprotocols returns the subprotocols requested by the client which are
+// allowed to be negotiated with the backend.
+func (c *Controller) Subprotocols(r *http.Request) ([]string, error) {
+	requested := websocket.Subprotocols(r)
+	if len(c.spec.Subprotocols) == 0 {
+		return requested, nil
+	}
+
+	var protocols []string
+	for _, p := range requested {
+		if stringtool.StrInSlice(p, c.spec.Subprotocols) {
+			protocols = append(protocols, p)
+		}
+	}
+
+	if len(protocols) == 0 && c.spec.RequireSubprotocol {
+		return nil, fmt.Errorf("none of subprotocols %v is allowed", requested)
+	}
+	return protocols, nil
+}
+
+// Load returns a snapshot of the stats.
+func (s *Stats) Load() Stats {
+	return Stats{
+		ClientMessages:  atomic.LoadUint64(&s.ClientMessages),
+		ClientBytes:     atomic.LoadUint64(&s.ClientBytes),
+		BackendMessages: atomic.LoadUint64(&s.BackendMessages),
+		BackendBytes:    atomic.LoadUint64(&s.BackendBytes),
+		RateLimited:     atomic.LoadUint64(&s.RateLimited),
+		HookDropped:     atomic.LoadUint64(&s.HookDropped),
+		HookRejected:    atomic.LoadUint64(&s.HookRejected),
+		HookFailed:      atomic.LoadUint64(&s.HookFailed),
+		IdleTimeouts:    atomic.LoadUint64(&s.IdleTimeouts),
+		PongTimeouts:    atomic.LoadUint64(&s.PongTimeouts),
+	}
+}
+
+// Pass passes messages between the client and the backend, until one of
+// them closes the connection, the connection is closed by the controls, or
+// done is closed. It returns the reason of the end, the connections are
+// not closed by it.
+func (c *Controller) Pass(client, backend *websocket.Conn, stats *Stats, done <-chan struct{}) error {
+	if c.spec.MaxMessageBytes > 0 {
+		client.SetReadLimit(c.spec.MaxMessageBytes)
+		backend.SetReadLimit(c.spec.MaxMessageBytes)
+	}
+
+	if c.pingInterval > 0 {
+		c.extendReadDeadline(client)
+		client.SetPongHandler(func(string) error {
+			c.extendReadDeadline(client)
+			return nil
+		})
+	}
+
+	errc := make(chan error, 2)
+	activity := make(chan struct{}, 1)
+	go c.pass(client, backend, DirectionClient, stats, errc, activity)
+	go c.pass(backend, client, DirectionBackend, stats, errc, activity)
+
+	var idleTimer *time.Timer
+	var idleC, pingC <-chan time.Time
+	if c.idleTimeout > 0 {
+		idleTimer = time.NewTimer(c.idleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+
+	for {
+		select {
+		case err := <-errc:
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() && c.pingInterval > 0 {
+				atomic.AddUint64(&stats.PongTimeouts, 1)
+				closeErr := &CloseError{Code: websocket.CloseGoingAway, Reason: "pong timeout"}
+				closeConns(closeErr, client, backend)
+				return closeErr
+			}
+			return err
+		case <-activity:
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+				idleTimer.Reset(c.idleTimeout)
+			}
+		case <-pingC:
+			err := client.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			if err != nil {
+				return err
+			}
+		case <-idleC:
+			atomic.AddUint64(&stats.IdleTimeouts, 1)
+			closeErr := &CloseError{Code: websocket.CloseGoingAway, Reason: "idle timeout"}
+			closeConns(closeErr, client, backend)
+			return closeErr
+		case <-done:
+			closeErr := &CloseError{Code: websocket.CloseGoingAway}
+			closeConns(closeErr, client, backend)
+			return closeErr
+		}
+	}
+}
+
+// extendReadDeadline extends the read deadline of the client, so it is
+// cut off if neither a message nor a pong arrives in time.
+func (c *Controller) extendReadDeadline(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(c.pingInterval + c.pongTimeout))
+}
+
+func (c *Controller) newLimiter() *limiter {
+	rl := c.spec.RateLimit
+	if rl == nil {
+		return nil
+	}
+
+	burst := rl.Burst
+	if burst == 0 {
+		burst = rl.MessagesPerSecond
+	}
+	return &limiter{
+		rate:   float64(rl.MessagesPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *limiter) allow(now time.Time) bool {
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (c *Controller) hookDirection(direction string) bool {
+	if c.hook == nil {
+		return false
+	}
+	directions := c.spec.Hook.Directions
+	if len(directions) == 0 {
+		return direction == DirectionClient
+	}
+	return stringtool.StrInSlice(direction, directions)
+}
+
+// pass passes messages from src to dst, and the closure of src to dst.
+func (c *Controller) pass(src, dst *websocket.Conn, direction string, stats *Stats,
+	errc chan<- error, activity chan<- struct{}) {
+
+	messages, size := &stats.ClientMessages, &stats.ClientBytes
+	var lim *limiter
+	if direction == DirectionClient {
+		lim = c.newLimiter()
+	} else {
+		messages, size = &stats.BackendMessages, &stats.BackendBytes
+	}
+	hook := c.hookDirection(direction)
+
+	for {
+		msgType, msg, err := src.ReadMessage()
+		if err != nil {
+			if err == websocket.ErrReadLimit {
+				closeErr := &CloseError{Code: websocket.CloseMessageTooBig, Reason: "message too large"}
+				closeConns(closeErr, src, dst)
+				errc <- closeErr
+				return
+			}
+
+			m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			if e, ok := err.(*websocket.CloseError); ok && e.Code != websocket.CloseNoStatusReceived {
+				m = websocket.FormatCloseMessage(e.Code, e.Text)
+			}
+			dst.WriteControl(websocket.CloseMessage, m, time.Now().Add(writeWait))
+			errc <- err
+			return
+		}
+
+		atomic.AddUint64(messages, 1)
+		atomic.AddUint64(size, uint64(len(msg)))
+
+		if c.pingInterval > 0 && direction == DirectionClient {
+			c.extendReadDeadline(src)
+		}
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+
+		if lim != nil && !lim.allow(time.Now()) {
+			atomic.AddUint64(&stats.RateLimited, 1)
+			if c.spec.RateLimit.Action == ActionDrop {
+				continue
+			}
+			closeErr := &CloseError{Code: websocket.ClosePolicyViolation, Reason: "message rate limit exceeded"}
+			closeConns(closeErr, src, dst)
+			errc <- closeErr
+			return
+		}
+
+		if hook && msgType == websocket.TextMessage {
+			result, err := c.hook.Handle(direction, msg)
+			switch {
+			case err != nil:
+				atomic.AddUint64(&stats.HookFailed, 1)
+				if !c.spec.Hook.FailOpen {
+					closeErr := &CloseError{Code: websocket.CloseInternalServerErr, Reason: "message hook failed"}
+					closeConns(closeErr, src, dst)
+					errc <- fmt.Errorf("message hook failed: %v", err)
+					return
+				}
+			case result.Reject:
+				atomic.AddUint64(&stats.HookRejected, 1)
+				closeErr := &CloseError{Code: websocket.ClosePolicyViolation, Reason: result.Reason}
+				closeConns(closeErr, src, dst)
+				errc <- closeErr
+				return
+			case result.Message == nil:
+				atomic.AddUint64(&stats.HookDropped, 1)
+				continue
+			default:
+				msg = result.Message
+			}
+		}
+
+		if err = dst.WriteMessage(msgType, msg); err != nil {
+			errc <- err
+			return
+		}
+	}
+}
+
+// closeConns sends the close message to the connections, the connections
+// are closed by the callers.
+func closeConns(e *CloseError, conns ...*websocket.Conn) {
+	reason := e.Reason
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	m := websocket.FormatCloseMessage(e.Code, reason)
+	deadline := time.Now().Add(writeWait)
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, m, deadline)
+	}
+}
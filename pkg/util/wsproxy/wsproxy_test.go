@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wsproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+type testProxy struct {
+	url     string
+	stats   *Stats
+	backend *httptest.Server
+	front   *httptest.Server
+	done    chan struct{}
+}
+
+func (tp *testProxy) close() {
+	close(tp.done)
+	tp.front.Close()
+	tp.backend.Close()
+}
+
+func (tp *testProxy) dial(t *testing.T, protocols ...string) *websocket.Conn {
+	dialer := &websocket.Dialer{Subprotocols: protocols}
+	conn, _, err := dialer.Dial(tp.url, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	return conn
+}
+
+func newTestProxy(spec *Spec) *testProxy {
+	c, _ := New(spec)
+	tp := &testProxy{stats: &Stats{}, done: make(chan struct{})}
+
+	tp.backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := &websocket.Upgrader{Subprotocols: []string{"v1", "v2"}}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(msg) == "protocol" {
+				msg = []byte(conn.Subprotocol())
+			}
+			conn.WriteMessage(msgType, msg)
+		}
+	}))
+
+	tp.front = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocols, err := c.Subprotocols(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dialer := &websocket.Dialer{Subprotocols: protocols}
+		backend, resp, err := dialer.Dial("ws"+strings.TrimPrefix(tp.backend.URL, "http"), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+
+		header := http.Header{}
+		if p := resp.Header.Get("Sec-Websocket-Protocol"); p != "" {
+			header.Set("Sec-Websocket-Protocol", p)
+		}
+		client, err := (&websocket.Upgrader{}).Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		c.Pass(client, backend, tp.stats, tp.done)
+	}))
+
+	tp.url = "ws" + strings.TrimPrefix(tp.front.URL, "http")
+	return tp
+}
+
+func expectMessage(t *testing.T, conn *websocket.Conn, want string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read message failed: %v", err)
+	}
+	if string(msg) != want {
+		t.Errorf("want message %q, got %q", want, msg)
+	}
+}
+
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if e, ok := err.(*websocket.CloseError); !ok || e.Code != code {
+			t.Errorf("want close code %d, got %v", code, err)
+		}
+		return
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	if (Spec{PongTimeout: "1s"}).Validate() == nil {
+		t.Errorf("pongTimeout without pingInterval should be invalid")
+	}
+	if (Spec{RequireSubprotocol: true}).Validate() == nil {
+		t.Errorf("requireSubprotocol without subprotocols should be invalid")
+	}
+	if (RateLimit{MessagesPerSecond: 10, Burst: 5}).Validate() == nil {
+		t.Errorf("burst less than messagesPerSecond should be invalid")
+	}
+	if (HookSpec{}).Validate() == nil {
+		t.Errorf("hook without url and wasm should be invalid")
+	}
+	if (HookSpec{URL: "http://127.0.0.1", Directions: []string{"both"}}).Validate() == nil {
+		t.Errorf("invalid direction should be invalid")
+	}
+}
+
+func TestPass(t *testing.T) {
+	tp := newTestProxy(nil)
+	defer tp.close()
+
+	conn := tp.dial(t)
+	defer conn.Close()
+
+	for _, m := range []string{"hello", "world"} {
+		conn.WriteMessage(websocket.TextMessage, []byte(m))
+		expectMessage(t, conn, m)
+	}
+
+	stats := tp.stats.Load()
+	if stats.ClientMessages != 2 || stats.BackendMessages != 2 || stats.ClientBytes != 10 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	expectClose(t, conn, websocket.CloseNormalClosure)
+}
+
+func TestSubprotocols(t *testing.T) {
+	c, _ := New(&Spec{Subprotocols: []string{"v2", "v3"}, RequireSubprotocol: true})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Sec-Websocket-Protocol", "v1, v2")
+	protocols, err := c.Subprotocols(req)
+	if err != nil || len(protocols) != 1 || protocols[0] != "v2" {
+		t.Errorf("unexpected subprotocols %v, %v", protocols, err)
+	}
+
+	req.Header.Set("Sec-Websocket-Protocol", "v1")
+	if _, err = c.Subprotocols(req); err == nil {
+		t.Errorf("request without allowed subprotocols should be rejected")
+	}
+
+	tp := newTestProxy(&Spec{Subprotocols: []string{"v2"}})
+	defer tp.close()
+
+	conn := tp.dial(t, "v1", "v2")
+	defer conn.Close()
+	if conn.Subprotocol() != "v2" {
+		t.Errorf("want subprotocol v2, got %q", conn.Subprotocol())
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("protocol"))
+	expectMessage(t, conn, "v2")
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	tp := newTestProxy(&Spec{MaxMessageBytes: 8})
+	defer tp.close()
+
+	conn := tp.dial(t)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("small"))
+	expectMessage(t, conn, "small")
+
+	conn.WriteMessage(websocket.TextMessage, []byte("too large message"))
+	expectClose(t, conn, websocket.CloseMessageTooBig)
+}
+
+func TestRateLimit(t *testing.T) {
+	tp := newTestProxy(&Spec{RateLimit: &RateLimit{MessagesPerSecond: 1, Burst: 2}})
+	defer tp.close()
+
+	conn := tp.dial(t)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	}
+	expectClose(t, conn, websocket.ClosePolicyViolation)
+	if stats := tp.stats.Load(); stats.RateLimited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	tp = newTestProxy(&Spec{RateLimit: &RateLimit{MessagesPerSecond: 1, Burst: 1, Action: ActionDrop}})
+	defer tp.close()
+
+	conn = tp.dial(t)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("first"))
+	conn.WriteMessage(websocket.TextMessage, []byte("dropped"))
+	expectMessage(t, conn, "first")
+	time.Sleep(time.Second)
+	conn.WriteMessage(websocket.TextMessage, []byte("third"))
+	expectMessage(t, conn, "third")
+	if stats := tp.stats.Load(); stats.RateLimited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tp := newTestProxy(&Spec{IdleTimeout: "100ms"})
+	defer tp.close()
+
+	conn := tp.dial(t)
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		expectMessage(t, conn, "hello")
+	}
+	expectClose(t, conn, websocket.CloseGoingAway)
+	if stats := tp.stats.Load(); stats.IdleTimeouts != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	tp := newTestProxy(&Spec{PingInterval: "20ms", PongTimeout: "50ms"})
+	defer tp.close()
+
+	// The client responds pongs while reading.
+	conn := tp.dial(t)
+	pings := 0
+	conn.SetPingHandler(func(data string) error {
+		pings++
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err := conn.ReadMessage()
+	if e, ok := err.(interface{ Timeout() bool }); !ok || !e.Timeout() {
+		t.Errorf("want timeout, got %v", err)
+	}
+	if pings == 0 {
+		t.Errorf("client should receive pings")
+	}
+	conn.Close()
+
+	// The client doesn't read, so pongs are not responded.
+	conn = tp.dial(t)
+	defer conn.Close()
+	time.Sleep(300 * time.Millisecond)
+	if stats := tp.stats.Load(); stats.PongTimeouts != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRemoteHook(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch string(body) {
+		case "drop":
+			w.WriteHeader(http.StatusNoContent)
+		case "bad":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("bad word"))
+		case "fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(r.Header.Get(HeaderDirection) + ":" + strings.ToUpper(string(body))))
+		}
+	}))
+	defer hook.Close()
+
+	tp := newTestProxy(&Spec{Hook: &HookSpec{URL: hook.URL, FailOpen: true}})
+	defer tp.close()
+
+	conn := tp.dial(t)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	expectMessage(t, conn, "client:HELLO")
+
+	// Binary messages are not handled by hooks.
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hello"))
+	expectMessage(t, conn, "hello")
+
+	conn.WriteMessage(websocket.TextMessage, []byte("drop"))
+	conn.WriteMessage(websocket.TextMessage, []byte("fail"))
+	expectMessage(t, conn, "fail")
+
+	conn.WriteMessage(websocket.TextMessage, []byte("bad"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if e, ok := err.(*websocket.CloseError); !ok || e.Code != websocket.ClosePolicyViolation || e.Text != "bad word" {
+		t.Errorf("want policy violation, got %v", err)
+	}
+
+	stats := tp.stats.Load()
+	if stats.HookDropped != 1 || stats.HookFailed != 1 || stats.HookRejected != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}